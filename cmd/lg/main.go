@@ -18,6 +18,9 @@ var (
 	server      = flag.String("server", "http://localhost:8910", "The livegrep server to connect to")
 	unixSocket  = flag.String("unix_socket", "", "unix socket path to connect() to as a proxy")
 	showVersion = flag.Bool("show_version", false, "Show versions of matched packages")
+	token       = flag.String("token", "", "API token to authenticate with; best set in your lgrc")
+	pages       = flag.Int("pages", 1, "Fetch up to this many pages of results, each starting after the last")
+	cursor      = flag.String("cursor", "", "Start after this cursor, as printed when there are more results")
 )
 
 func main() {
@@ -48,8 +51,7 @@ func main() {
 		uri = &url.URL{Scheme: "http", Host: *server}
 	}
 
-	uri.Path = "/api/v1/search/"
-	uri.RawQuery = url.Values{"q": []string{strings.Join(flag.Args(), " ")}}.Encode()
+	query := url.Values{"q": []string{strings.Join(flag.Args(), " ")}}
 
 	var transport http.RoundTripper
 	if *unixSocket == "" {
@@ -64,14 +66,65 @@ func main() {
 			DisableKeepAlives: true,
 		}
 	}
-	client := http.Client{Transport: transport}
+	client := &http.Client{Transport: transport}
 
-	resp, err := client.Get(uri.String())
+	if *pages == 1 && *cursor == "" {
+		uri.Path = "/api/v1/search/"
+		uri.RawQuery = query.Encode()
+		var reply api.ReplySearch
+		get(client, uri, &reply)
+		printResults(reply.Results)
+		return
+	}
+
+	// Only the v2 API pages results with a cursor.
+	uri.Path = "/api/v2/search/"
+	next := *cursor
+	for page := 0; page < *pages; page++ {
+		// Even the first page needs a cursor, empty, to be paged.
+		query.Set("cursor", next)
+		uri.RawQuery = query.Encode()
+		var reply api.ReplySearchV2
+		get(client, uri, &reply)
+		for _, r := range reply.Results {
+			var results []*api.Result
+			for _, l := range r.Lines {
+				// The other lines are context.
+				if len(l.Bounds) > 0 {
+					results = append(results, &api.Result{
+						Tree: r.Tree, Version: r.Version, Path: r.Path,
+						LineNumber: l.LineNumber, Line: l.Line,
+					})
+				}
+			}
+			printResults(results)
+		}
+		if next = reply.NextCursor; next == "" {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "There are more results; continue with -cursor=%s\n", next)
+}
 
+// get requests uri, exiting if it fails, and decodes the reply into
+// reply.
+func get(client *http.Client, uri *url.URL, reply interface{}) {
+	req, err := http.NewRequest("GET", uri.String(), nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Requesting %s: %s\n", uri.String(), err.Error())
 		os.Exit(1)
 	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Requesting %s: %s\n", uri.String(), err.Error())
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		var reply api.ReplyError
@@ -84,15 +137,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	var reply api.ReplySearch
-
-	if e := json.NewDecoder(resp.Body).Decode(&reply); e != nil {
+	if e := json.NewDecoder(resp.Body).Decode(reply); e != nil {
 		fmt.Fprintf(os.Stderr,
 			"Error reading reply (status=%d): %s\n", resp.StatusCode, e.Error())
 		os.Exit(1)
 	}
+}
 
-	for _, r := range reply.Results {
+func printResults(results []*api.Result) {
+	for _, r := range results {
 		if r.Tree != "" {
 			fmt.Printf("%s:", r.Tree)
 		}
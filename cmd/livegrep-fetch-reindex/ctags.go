@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/livegrep/livegrep/src/proto/config"
+	"golang.org/x/sync/errgroup"
+)
+
+// buildTagsIndex runs ctags over the indexed revision of each repository
+// and indexes the resulting tags files, one per repository at its root,
+// into the index the codesearch backend loads with --load_tags.
+func buildTagsIndex(cfg *config.IndexSpec) error {
+	dir, err := ioutil.TempDir("", "livegrep-ctags")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	spec := config.IndexSpec{Name: cfg.Name}
+	var g errgroup.Group
+	sem := make(chan struct{}, *flagNumWorkers)
+	for i, r := range cfg.Repositories {
+		tagsDir := path.Join(dir, fmt.Sprintf("%d", i))
+		// The tags file must be indexed under the repository's name,
+		// so the backend can find the files it points at.
+		spec.Paths = append(spec.Paths, &config.PathSpec{Path: tagsDir, Name: r.Name})
+
+		r := r
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			return generateTags(r, tagsDir)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&spec)
+	if err != nil {
+		return err
+	}
+	specPath := path.Join(dir, "tags.json")
+	if err := ioutil.WriteFile(specPath, data, 0644); err != nil {
+		return err
+	}
+
+	tmp := *flagTagsIndexPath + ".tmp"
+	// Gone after the rename unless indexing failed.
+	defer os.Remove(tmp)
+	cmd := exec.Command(findCodesearch(*flagCodesearch),
+		"--debug=ui",
+		"--dump_index",
+		tmp,
+		"--index_only",
+		specPath,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *flagTagsIndexPath)
+}
+
+// generateTags writes the ctags file for the first revision of r that's
+// indexed, or HEAD, to tagsDir/tags. It checks the revision out into a
+// temporary directory, since the repositories are bare mirrors.
+func generateTags(r *config.RepoSpec, tagsDir string) error {
+	log.Println("Generating tags for", r.Name)
+
+	revision := "HEAD"
+	if len(r.Revisions) > 0 {
+		revision = r.Revisions[0]
+	}
+
+	checkout := tagsDir + ".checkout"
+	if err := os.MkdirAll(checkout, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(checkout)
+	if err := os.MkdirAll(tagsDir, 0755); err != nil {
+		return err
+	}
+
+	archive := exec.Command("git", "--git-dir", r.Path, "archive", "--format=tar", revision)
+	untar := exec.Command("tar", "-x", "-C", checkout)
+	pipe, err := archive.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	untar.Stdin = pipe
+	archive.Stderr = os.Stderr
+	untar.Stderr = os.Stderr
+	if err := untar.Start(); err != nil {
+		return err
+	}
+	if err := archive.Run(); err != nil {
+		untar.Wait()
+		return fmt.Errorf("%s: git archive %s: %s", r.Name, revision, err)
+	}
+	if err := untar.Wait(); err != nil {
+		return fmt.Errorf("%s: tar: %s", r.Name, err)
+	}
+
+	out, err := os.Create(path.Join(tagsDir, "tags"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Run from the checkout, writing to stdout, so the paths in the
+	// tags file are relative to the repository's root.
+	ctags := exec.Command(*flagCtagsBinary, "--format=2", "-n", "--fields=+K", "-R", "-f", "-")
+	ctags.Dir = checkout
+	ctags.Stdout = out
+	ctags.Stderr = os.Stderr
+	if err := ctags.Run(); err != nil {
+		return fmt.Errorf("%s: ctags: %s", r.Name, err)
+	}
+	return out.Close()
+}
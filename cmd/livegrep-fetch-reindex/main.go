@@ -33,6 +33,9 @@ var (
 	flagStatsdOn      = flag.Bool("send-metrics-to-statsd", false, "Send indexing metrics to StatsD")
 	flagStatsdAddr    = flag.String("statsd-address", "", "address URI of statsd listener for metrics export")
 	flagStatsdPrefix  = flag.String("statsd-prefix", "", "optional prefix to apply to all metrics")
+	flagCtags         = flag.Bool("ctags", false, "Also run ctags over each repository and index the tags, for symbol search")
+	flagCtagsBinary   = flag.String("ctags-binary", "ctags", "Path to the `ctags` binary, with -ctags")
+	flagTagsIndexPath = flag.String("tags-out", "livegrep.tags.idx", "Path to write the tags index, with -ctags; load it with the backend's --load_tags")
 )
 
 // Used to extract the refname from a line like the following:
@@ -93,6 +96,14 @@ func main() {
 		log.Fatalln("rename:", err.Error())
 	}
 
+	if *flagCtags {
+		// The code index is what matters; a backend with stale
+		// definitions, or none, should still get the new code.
+		if err := buildTagsIndex(&cfg); err != nil {
+			log.Printf("ctags: %s; skipping the tags index and keeping the last one, if any", err.Error())
+		}
+	}
+
 	if *flagReloadBackend != "" {
 		if err := reloadBackend(*flagReloadBackend); err != nil {
 			log.Fatalln("reload:", err.Error())
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"regexp"
@@ -20,11 +21,23 @@ const (
 	envStatsdPrefix = "LIVEGREP_METRICS_STATSD_PREFIX"
 )
 
+const (
+	outputStatsd      = "statsd"
+	outputOpenMetrics = "openmetrics"
+	outputPushgateway = "pushgateway"
+	outputJSON        = "json"
+)
+
 var (
+	flagOutput       = flag.String("output", outputStatsd, "where to export metrics: statsd, openmetrics, pushgateway or json")
 	flagStatsdAddr   = flag.String("statsd-address", os.Getenv(envStatsdAddr), "address URI of statsd listener for metrics export")
 	flagStatsdPrefix = flag.String("statsd-prefix", os.Getenv(envStatsdPrefix), "optional prefix to apply to all metrics")
 	flagMetricsPath  = flag.String("metrics-out", "", "path to the file containing indexing metrics")
 	flagStatsdTags   = newStringMapFlag()
+	flagOutPath      = flag.String("out", "-", "file to write openmetrics or json output to, or - for stdout")
+	flagPushURL      = flag.String("pushgateway-url", "", "base URL of the Pushgateway to push metrics to")
+	flagPushJob      = flag.String("pushgateway-job", "livegrep_index", "job name to push metrics under")
+	flagLabels       = newStringMapFlag()
 
 	indexTimeToCompletePattern = regexp.MustCompile("repository[\\s]*indexed[\\s]*in[\\s]*(.*)")
 	metricPattern              = regexp.MustCompile(strings.Join([]string{
@@ -37,60 +50,61 @@ var (
 
 func init() {
 	flag.Var(flagStatsdTags, "statsd-tag", "statsd tags to include on all emitted metrics")
+	flag.Var(flagLabels, "label", "labels to include on all openmetrics and pushgateway metrics, as key=value")
+}
 
+// parseFlags parses and checks the flags. It's called from main rather
+// than init, so that tests can run without them.
+func parseFlags() {
 	flag.Parse()
 
 	if *flagMetricsPath == "" {
 		log.Fatalf("--metrics-out is required. It is the path to the file containing metrics from the indexing run\n")
 	}
 
-	if *flagStatsdAddr == "" {
-		log.Fatalf("--statsd-address is required. It is the host:port of the StatsD server.\n")
-	} else {
-		log.Printf("using statsd server: address=%s", *flagStatsdAddr)
-	}
+	switch *flagOutput {
+	case outputStatsd:
+		if *flagStatsdAddr == "" {
+			log.Fatalf("--statsd-address is required. It is the host:port of the StatsD server.\n")
+		} else {
+			log.Printf("using statsd server: address=%s", *flagStatsdAddr)
+		}
 
-	if *flagStatsdPrefix != "" {
-		log.Printf("using prefix for all metrics: prefix=%s", *flagStatsdPrefix)
+		if *flagStatsdPrefix != "" {
+			log.Printf("using prefix for all metrics: prefix=%s", *flagStatsdPrefix)
+		}
+	case outputPushgateway:
+		if *flagPushURL == "" {
+			log.Fatalf("--pushgateway-url is required with --output=pushgateway.\n")
+		}
+	case outputOpenMetrics, outputJSON:
+	default:
+		log.Fatalf("unknown --output %q. Must be one of statsd, openmetrics, pushgateway or json.\n", *flagOutput)
 	}
 }
 
-func main() {
-	log.Println("starting livegrep statsd metrics exporter")
-
-	// Stopwatch to track the end-to-end duration required to export metrics
-	start := time.Now()
-
-	// Create a statsd client
-	statsd, err := statsd.New(statsd.Address(*flagStatsdAddr), statsd.Prefix(*flagStatsdPrefix))
-	if err != nil {
-		panic(err)
-	}
-	defer statsd.Close()
-
-	metricsFile, err := os.ReadFile(*flagMetricsPath)
-	if err != nil {
-		panic(err)
-	}
-
-	metricsFileStr := string(metricsFile)
+// indexMetrics are the metrics reported by an indexing run.
+type indexMetrics struct {
+	TimeToIndex time.Duration
+	Gauges      map[string]int
+}
 
+func parseMetrics(metricsFileStr string) (*indexMetrics, error) {
 	iTimeToCompleteLine := indexTimeToCompletePattern.FindStringSubmatch(metricsFileStr)
 	if iTimeToCompleteLine == nil {
-		log.Fatal("failed to read time to index line from stdin")
+		return nil, fmt.Errorf("failed to read time to index line from stdin")
 	}
 
 	timeToIndex, err := time.ParseDuration(string(iTimeToCompleteLine[1]))
 
 	if err != nil {
-		log.Fatalf("failed to parse indexing time %v", err)
+		return nil, fmt.Errorf("failed to parse indexing time %v", err)
 	}
-	statsd.Timing("index.timeToIndex", timeToIndex.Milliseconds())
 
 	// Regex-match the metrics dump block
 	dump := metricsDumpPattern.FindStringSubmatch(metricsFileStr)
 	if len(dump) < 2 {
-		log.Fatalf("failed to parse metrics dump from indexer output")
+		return nil, fmt.Errorf("failed to parse metrics dump from indexer output")
 	}
 
 	// Regex-match the metric name and value from each line
@@ -98,25 +112,75 @@ func main() {
 	for _, metricLine := range strings.Split(dump[1], "\n") {
 		metric := metricPattern.FindStringSubmatch(metricLine)
 		if len(metric) < 3 {
-			log.Fatalf("failed to parse metric name and value: line=%s", metricLine)
+			return nil, fmt.Errorf("failed to parse metric name and value: line=%s", metricLine)
 		}
 
 		value, err := strconv.Atoi(metric[2])
 		if err != nil {
-			log.Fatalf("failed to parse metric value: name=%s value=%s", metric[1], metric[2])
+			return nil, fmt.Errorf("failed to parse metric value: name=%s value=%s", metric[1], metric[2])
 		}
 
 		metrics[metric[1]] = value
 	}
 
+	return &indexMetrics{TimeToIndex: timeToIndex, Gauges: metrics}, nil
+}
+
+func exportStatsd(metrics *indexMetrics, start time.Time) {
+	// Create a statsd client
+	statsd, err := statsd.New(statsd.Address(*flagStatsdAddr), statsd.Prefix(*flagStatsdPrefix))
+	if err != nil {
+		panic(err)
+	}
+	defer statsd.Close()
+
+	statsd.Timing("index.timeToIndex", metrics.TimeToIndex.Milliseconds())
+
 	// Report all parsed gauge metrics to statsd
-	for metric, value := range metrics {
+	for metric, value := range metrics.Gauges {
 		log.Printf("reporting gauge metric: metric=%s value=%d", metric, value)
 		statsd.Gauge(metric, float64(value))
 	}
 
 	// Report metrics export duration to statsd
-	duration := time.Since(start)
-	log.Printf("completed metrics export: duration=%v", duration)
-	statsd.Timing("export.duration", duration.Milliseconds())
+	statsd.Timing("export.duration", time.Since(start).Milliseconds())
+}
+
+func main() {
+	parseFlags()
+
+	log.Printf("starting livegrep metrics exporter: output=%s", *flagOutput)
+
+	// Stopwatch to track the end-to-end duration required to export metrics
+	start := time.Now()
+
+	metricsFile, err := os.ReadFile(*flagMetricsPath)
+	if err != nil {
+		panic(err)
+	}
+
+	metrics, err := parseMetrics(string(metricsFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *flagOutput {
+	case outputStatsd:
+		exportStatsd(metrics, start)
+	case outputOpenMetrics:
+		err = writeOutput(*flagOutPath, func(f *os.File) error {
+			return writeOpenMetrics(f, metrics, flagLabels.Values(), true)
+		})
+	case outputPushgateway:
+		err = pushMetrics(*flagPushURL, *flagPushJob, metrics, flagLabels.Values())
+	case outputJSON:
+		err = writeOutput(*flagOutPath, func(f *os.File) error {
+			return writeJSON(f, metrics)
+		})
+	}
+	if err != nil {
+		log.Fatalf("failed to export metrics: output=%s err=%v", *flagOutput, err)
+	}
+
+	log.Printf("completed metrics export: duration=%v", time.Since(start))
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metricNamespace = "livegrep_"
+
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// now is when metrics are exported; tests replace it.
+var now = time.Now
+
+// promName turns an indexer metric name like index.bytes.dedup into
+// livegrep_index_bytes_dedup.
+func promName(name string) string {
+	return metricNamespace + invalidMetricChars.ReplaceAllString(name, "_")
+}
+
+func formatLabels(labels map[string]interface{}) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for key, value := range labels {
+		escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(fmt.Sprint(value))
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, invalidMetricChars.ReplaceAllString(key, "_"), escaped))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// writeOpenMetrics writes every metric as a gauge in the text exposition
+// format. The OpenMetrics format additionally requires the trailing
+// "# EOF", which the Pushgateway doesn't expect.
+func writeOpenMetrics(w io.Writer, metrics *indexMetrics, labels map[string]interface{}, eof bool) error {
+	lbls := formatLabels(labels)
+	var buf bytes.Buffer
+
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(&buf, "%s%s %s\n", name, lbls, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	gauge(promName("index.time_to_index_seconds"), "Time taken to build the index.",
+		metrics.TimeToIndex.Seconds())
+	gauge(promName("index.exported_timestamp_seconds"), "When these metrics were exported.",
+		float64(now().Unix()))
+
+	names := make([]string, 0, len(metrics.Gauges))
+	for name := range metrics.Gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gauge(promName(name), fmt.Sprintf("The indexer's %s metric.", name), float64(metrics.Gauges[name]))
+	}
+
+	if eof {
+		buf.WriteString("# EOF\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeJSON(w io.Writer, metrics *indexMetrics) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		TimeToIndexMs int64          `json:"time_to_index_ms"`
+		Metrics       map[string]int `json:"metrics"`
+	}{
+		TimeToIndexMs: metrics.TimeToIndex.Milliseconds(),
+		Metrics:       metrics.Gauges,
+	})
+}
+
+// writeOutput calls write with the file at path, or stdout if path is
+// "-". Files are written in place atomically, since node_exporter's
+// textfile collector may read them at any time.
+func writeOutput(path string, write func(*os.File) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file 0600, which node_exporter may not be
+	// able to read.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushMetrics replaces the metrics of job on the Pushgateway at baseURL.
+func pushMetrics(baseURL, job string, metrics *indexMetrics, labels map[string]interface{}) error {
+	var body bytes.Buffer
+	if err := writeOpenMetrics(&body, metrics, labels, false); err != nil {
+		return err
+	}
+
+	pushURL := strings.TrimSuffix(baseURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest("PUT", pushURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pushgateway returned %s: %s", resp.Status, msg)
+	}
+	log.Printf("pushed metrics: url=%s", pushURL)
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPromName(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"index.bytes", "livegrep_index_bytes"},
+		{"index.bytes.dedup", "livegrep_index_bytes_dedup"},
+		{"git-walk time", "livegrep_git_walk_time"},
+		{"already_valid", "livegrep_already_valid"},
+	}
+	for _, tc := range cases {
+		if got := promName(tc.in); got != tc.want {
+			t.Errorf("promName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	cases := []struct {
+		name   string
+		labels map[string]interface{}
+		want   string
+	}{
+		{"none", nil, ""},
+		{"empty", map[string]interface{}{}, ""},
+		{"one", map[string]interface{}{"repo": "livegrep"}, `{repo="livegrep"}`},
+		{
+			"sorted",
+			map[string]interface{}{"zone": "b", "env": "prod", "attempt": 2},
+			`{attempt="2",env="prod",zone="b"}`,
+		},
+		{"invalid name", map[string]interface{}{"index.name": "x"}, `{index_name="x"}`},
+		{
+			"escaped value",
+			map[string]interface{}{"path": `C:\idx "main"` + "\nnext"},
+			`{path="C:\\idx \"main\"\nnext"}`,
+		},
+	}
+	for _, tc := range cases {
+		if got := formatLabels(tc.labels); got != tc.want {
+			t.Errorf("%s: formatLabels = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	header := "# HELP livegrep_index_time_to_index_seconds Time taken to build the index.\n" +
+		"# TYPE livegrep_index_time_to_index_seconds gauge\n"
+	exported := "# HELP livegrep_index_exported_timestamp_seconds When these metrics were exported.\n" +
+		"# TYPE livegrep_index_exported_timestamp_seconds gauge\n"
+
+	cases := []struct {
+		name    string
+		metrics *indexMetrics
+		labels  map[string]interface{}
+		eof     bool
+		want    string
+	}{
+		{
+			name:    "no gauges",
+			metrics: &indexMetrics{TimeToIndex: 90 * time.Second},
+			want: header + "livegrep_index_time_to_index_seconds 90\n" +
+				exported + "livegrep_index_exported_timestamp_seconds 1700000000\n",
+		},
+		{
+			name:    "fractional seconds with eof",
+			metrics: &indexMetrics{TimeToIndex: 1500 * time.Millisecond},
+			eof:     true,
+			want: header + "livegrep_index_time_to_index_seconds 1.5\n" +
+				exported + "livegrep_index_exported_timestamp_seconds 1700000000\n" +
+				"# EOF\n",
+		},
+		{
+			name: "gauges sorted and labelled",
+			metrics: &indexMetrics{
+				TimeToIndex: time.Second,
+				Gauges:      map[string]int{"index.files": 12, "index.bytes.dedup": 3456},
+			},
+			labels: map[string]interface{}{"repo": "livegrep"},
+			want: header + `livegrep_index_time_to_index_seconds{repo="livegrep"} 1` + "\n" +
+				exported + `livegrep_index_exported_timestamp_seconds{repo="livegrep"} 1700000000` + "\n" +
+				"# HELP livegrep_index_bytes_dedup The indexer's index.bytes.dedup metric.\n" +
+				"# TYPE livegrep_index_bytes_dedup gauge\n" +
+				`livegrep_index_bytes_dedup{repo="livegrep"} 3456` + "\n" +
+				"# HELP livegrep_index_files The indexer's index.files metric.\n" +
+				"# TYPE livegrep_index_files gauge\n" +
+				`livegrep_index_files{repo="livegrep"} 12` + "\n",
+		},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		if err := writeOpenMetrics(&buf, tc.metrics, tc.labels, tc.eof); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	cases := []struct {
+		name    string
+		metrics *indexMetrics
+		want    string
+	}{
+		{
+			name:    "no gauges",
+			metrics: &indexMetrics{TimeToIndex: 2 * time.Second},
+			want:    "{\n  \"time_to_index_ms\": 2000,\n  \"metrics\": null\n}\n",
+		},
+		{
+			name: "gauges",
+			metrics: &indexMetrics{
+				TimeToIndex: 1500 * time.Millisecond,
+				Gauges:      map[string]int{"index.files": 12, "index.bytes": 3456},
+			},
+			want: "{\n  \"time_to_index_ms\": 1500,\n  \"metrics\": {\n" +
+				"    \"index.bytes\": 3456,\n    \"index.files\": 12\n  }\n}\n",
+		},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, tc.metrics); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "livegrep.prom")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := writeOutput(path, func(f *os.File) error {
+		_, err := f.WriteString("new\n")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new\n" {
+		t.Errorf("got %q, want %q", got, "new\n")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0644 {
+		t.Errorf("got mode %o, want 644", mode)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("left %d files behind, want only the output", len(entries))
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	var method, path, contentType string
+	var body bytes.Buffer
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, contentType = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type")
+		body.ReadFrom(r.Body)
+	}))
+	defer gateway.Close()
+
+	metrics := &indexMetrics{TimeToIndex: time.Second}
+	if err := pushMetrics(gateway.URL+"/", "live grep", metrics, nil); err != nil {
+		t.Fatal(err)
+	}
+	if method != "PUT" || path != "/metrics/job/live%20grep" {
+		t.Errorf("got %s %s, want PUT /metrics/job/live%%20grep", method, path)
+	}
+	if contentType != "text/plain; version=0.0.4" {
+		t.Errorf("got content type %q", contentType)
+	}
+	var want bytes.Buffer
+	writeOpenMetrics(&want, metrics, nil, false)
+	if body.String() != want.String() {
+		t.Errorf("pushed\n%s\nwant\n%s", body.String(), want.String())
+	}
+}
@@ -26,6 +26,8 @@ var (
 	indexConfig       = flag.String("index-config", "", "Codesearch index config file; provide to enable repo browsing")
 	reload            = flag.Bool("reload", false, "Reload template files on every request")
 	_                 = flag.Bool("logtostderr", false, "[DEPRECATED] compatibility with glog")
+	logFormat         = flag.String("log-format", "text", "Log format: text or json")
+	logLevel          = flag.String("log-level", "info", "The least severe level to log: debug, info, warn or error")
 	zoektRepoCache    = flag.String("zoekt-repo-cache", "", "The on disk location of zoekt git repos. Used to provide filevieer functionality for a zoekt deployment")
 )
 
@@ -69,6 +71,10 @@ func main() {
 			Tags:       strings.Split(os.Getenv("STATSD_TAGS"), ","),
 			TagsFormat: os.Getenv("STATSD_TAGS_FORMAT"),
 		},
+		Log: config.Log{
+			Format: *logFormat,
+			Level:  *logLevel,
+		},
 		ZoektRepoCache: *zoektRepoCache,
 		FileviewerOnly: *fileviewerOnly,
 	}
@@ -100,10 +106,24 @@ func main() {
 		panic(err.Error())
 	}
 
+	if middleware.ShouldEnableRateLimit(cfg.RateLimit) {
+		handler = middleware.WrapWithRateLimit(handler, cfg.RateLimit)
+		log.Printf("Enabled rate limiting: %g requests/s per client", cfg.RateLimit.RequestsPerSecond)
+	}
+
 	if cfg.ReverseProxy {
 		handler = middleware.UnwrapProxyHeaders(handler)
 	}
 
+	// Auth sees the address requests really came from, which
+	// trusted_proxies relies on, rather than X-Forwarded-For.
+	if middleware.ShouldEnableAuth(cfg.Auth) {
+		if handler, err = middleware.WrapWithAuth(handler, cfg.Auth); err != nil {
+			log.Fatalf("Enabling auth: %s", err.Error())
+		}
+		log.Printf("Enabled AuthMiddleware")
+	}
+
 	if middleware.ShouldEnableGoogleIAP(cfg.GoogleIAPConfig) {
 		handler = middleware.WrapWithIAP(handler, cfg.GoogleIAPConfig)
 		log.Printf("Enabled GoogleIAPAuthMiddleware")
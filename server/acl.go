@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/identity"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// aclLabelPrefix marks index metadata labels that restrict a tree to a
+// group, e.g. "acl:security".
+const aclLabelPrefix = "acl:"
+
+func aclGroups(labels []string) []string {
+	var groups []string
+	for _, l := range labels {
+		if strings.HasPrefix(l, aclLabelPrefix) {
+			groups = append(groups, strings.TrimPrefix(l, aclLabelPrefix))
+		}
+	}
+	return groups
+}
+
+// repoGroups returns the groups allowed to see repo, from both the
+// server's index config and the index metadata of bk, or of every
+// backend if bk is nil. A repo with no groups is public.
+func (s *server) repoGroups(bk *Backend, repo string) []string {
+	var groups []string
+	if r, ok := s.repos[repo]; ok {
+		groups = append(groups, r.AllowedGroups...)
+	}
+
+	backends := []*Backend{bk}
+	if bk == nil {
+		backends = nil
+		for _, id := range s.bkOrder {
+			backends = append(backends, s.bk[id])
+		}
+	}
+	for _, bk := range backends {
+		bk.I.Lock()
+		for _, tree := range bk.I.Trees {
+			if tree.Name == repo {
+				groups = append(groups, tree.AllowedGroups...)
+			}
+		}
+		bk.I.Unlock()
+	}
+	return groups
+}
+
+// canSeeRepo reports whether whoever sent the request ctx belongs to
+// may see repo.
+func (s *server) canSeeRepo(ctx context.Context, bk *Backend, repo string) bool {
+	groups := s.repoGroups(bk, repo)
+	if len(groups) == 0 {
+		return true
+	}
+	id, ok := identity.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	if id.HasScope(identity.ScopeAdmin) {
+		return true
+	}
+	for _, g := range groups {
+		if id.InGroup(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterResults drops the results in trees the requester may not see.
+// Results may be cached and shared between requests, so rather than
+// modifying result, it returns a filtered copy if anything was dropped.
+// The copy counts only the matches left in it, so the count doesn't
+// give away how much the requester can't see.
+func (s *server) filterResults(ctx context.Context, bk *Backend, result *pb.CodeSearchResult) *pb.CodeSearchResult {
+	visible := make(map[string]bool)
+	canSee := func(tree string) bool {
+		ok, seen := visible[tree]
+		if !seen {
+			ok = s.canSeeRepo(ctx, bk, tree)
+			visible[tree] = ok
+		}
+		return ok
+	}
+
+	var results []*pb.SearchResult
+	for _, r := range result.Results {
+		if canSee(r.Tree) {
+			results = append(results, r)
+		}
+	}
+	var fileResults []*pb.FileResult
+	for _, r := range result.FileResults {
+		if canSee(r.Tree) {
+			fileResults = append(fileResults, r)
+		}
+	}
+	var treeResults []*pb.TreeResult
+	for _, r := range result.TreeResults {
+		if canSee(r.Name) {
+			treeResults = append(treeResults, r)
+		}
+	}
+
+	if len(results) == len(result.Results) &&
+		len(fileResults) == len(result.FileResults) &&
+		len(treeResults) == len(result.TreeResults) {
+		return result
+	}
+	filtered := *result
+	filtered.Results = results
+	filtered.FileResults = fileResults
+	filtered.TreeResults = treeResults
+	recountMatches(&filtered)
+	return &filtered
+}
+
+// canSeeRequestedRepo checks the repo fileviewer routes name with their
+// :parent and :repo parameters. Requests for other routes are allowed.
+func (s *server) canSeeRequestedRepo(ctx context.Context, r *http.Request) bool {
+	params := r.URL.Query()
+	parent, repo := params.Get(":parent"), params.Get(":repo")
+	if parent == "" || repo == "" {
+		return true
+	}
+	return s.canSeeRepo(ctx, nil, parent+"/"+repo)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func aclServer() (*server, *Backend) {
+	bk := &Backend{Id: "main"}
+	bk.I = &I{Trees: []Tree{
+		{Name: "org/public"},
+		{Name: "org/labeled", AllowedGroups: aclGroups([]string{"team", "acl:security"})},
+	}}
+	s := &server{
+		repos: map[string]config.RepoConfig{
+			"org/public":     {Name: "org/public"},
+			"org/configured": {Name: "org/configured", AllowedGroups: []string{"eng", "user:alice"}},
+		},
+		bk:      map[string]*Backend{"main": bk},
+		bkOrder: []string{"main"},
+	}
+	return s, bk
+}
+
+func TestCanSeeRepo(t *testing.T) {
+	s, bk := aclServer()
+	ctxFor := func(id *identity.Identity) context.Context {
+		if id == nil {
+			return context.Background()
+		}
+		return identity.NewContext(context.Background(), id)
+	}
+
+	cases := []struct {
+		id   *identity.Identity
+		repo string
+		want bool
+	}{
+		{nil, "org/public", true},
+		{nil, "org/unknown", true},
+		{nil, "org/configured", false},
+		{nil, "org/labeled", false},
+		{&identity.Identity{Name: "bob", Groups: []string{"eng"}}, "org/configured", true},
+		{&identity.Identity{Name: "bob", Groups: []string{"eng"}}, "org/labeled", false},
+		{&identity.Identity{Name: "alice"}, "org/configured", true},
+		{&identity.Identity{Name: "carol", Groups: []string{"security"}}, "org/labeled", true},
+		{&identity.Identity{Name: "carol", Groups: []string{"team"}}, "org/labeled", false},
+		{&identity.Identity{Name: "root", Scopes: []string{identity.ScopeAdmin}}, "org/labeled", true},
+	}
+	for _, tc := range cases {
+		name := "anonymous"
+		if tc.id != nil {
+			name = tc.id.Name
+		}
+		if got := s.canSeeRepo(ctxFor(tc.id), bk, tc.repo); got != tc.want {
+			t.Errorf("canSeeRepo(%s, %s) = %v, want %v", name, tc.repo, got, tc.want)
+		}
+		if got := s.canSeeRepo(ctxFor(tc.id), nil, tc.repo); got != tc.want {
+			t.Errorf("canSeeRepo(%s, %s) on all backends = %v, want %v", name, tc.repo, got, tc.want)
+		}
+	}
+}
+
+func TestFilterResults(t *testing.T) {
+	s, bk := aclServer()
+	result := &pb.CodeSearchResult{
+		Stats: &pb.SearchStats{NumMatches: 9},
+		Results: []*pb.SearchResult{
+			{Tree: "org/public", Path: "a", NumMatches: 2},
+			{Tree: "org/configured", Path: "b", NumMatches: 4},
+		},
+		FileResults: []*pb.FileResult{
+			{Tree: "org/labeled", Path: "c"},
+		},
+		TreeResults: []*pb.TreeResult{
+			{Name: "org/public"},
+			{Name: "org/configured"},
+		},
+	}
+
+	filtered := s.filterResults(context.Background(), bk, result)
+	if got, want := resultPaths(filtered), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("results: got %v, want %v", got, want)
+	}
+	if len(filtered.FileResults) != 0 {
+		t.Errorf("file results: got %d, want none", len(filtered.FileResults))
+	}
+	if len(filtered.TreeResults) != 1 || filtered.TreeResults[0].Name != "org/public" {
+		t.Errorf("tree results: got %v, want only org/public", filtered.TreeResults)
+	}
+	if got := filtered.Stats.NumMatches; got != 3 {
+		t.Errorf("filtered NumMatches = %d, want the 3 left", got)
+	}
+	if len(result.Results) != 2 || len(result.FileResults) != 1 || len(result.TreeResults) != 2 ||
+		result.Stats.NumMatches != 9 {
+		t.Error("filterResults modified its argument")
+	}
+
+	ctx := identity.NewContext(context.Background(),
+		&identity.Identity{Name: "alice", Groups: []string{"security"}})
+	if got := s.filterResults(ctx, bk, result); got != result {
+		t.Error("filterResults copied results it didn't need to filter")
+	}
+}
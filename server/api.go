@@ -9,7 +9,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -20,6 +23,7 @@ import (
 
 	"github.com/livegrep/livegrep/server/api"
 	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/metrics"
 	"github.com/livegrep/livegrep/server/reqid"
 
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
@@ -29,14 +33,18 @@ func replyJSON(ctx context.Context, w http.ResponseWriter, status int, obj inter
 	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(obj); err != nil {
-		log.Printf(ctx, "writing http response, data=%s err=%q",
+		log.Errorf(ctx, "writing http response, data=%s err=%q",
 			asJSON{obj},
 			err.Error())
 	}
 }
 
 func writeError(ctx context.Context, w http.ResponseWriter, status int, code, message string) {
-	log.Printf(ctx, "error status=%d code=%s message=%q",
+	level := log.LevelInfo
+	if status >= 500 {
+		level = log.LevelError
+	}
+	log.Logf(ctx, level, nil, "error status=%d code=%s message=%q",
 		status, code, message)
 	replyJSON(ctx, w, status, &api.ReplyError{Err: api.InnerError{Code: code, Message: message}})
 }
@@ -53,15 +61,35 @@ func writeQueryError(ctx context.Context, w http.ResponseWriter, err error) {
 func getQueryError(err error) (errCode int, errorMsg string, errorMsgLong string) {
 	if code := grpc.Code(err); code == codes.InvalidArgument {
 		return 400, "query", grpc.ErrorDesc(err)
+	} else if code == codes.FailedPrecondition {
+		// The backend has no tags file to search with sym:, def: or tags:.
+		return 400, "no_tags", fmt.Sprintf("%s Searching symbols needs an index built with ctags.", grpc.ErrorDesc(err))
 	} else {
 		return 500, "internal_error",
 			fmt.Sprintf("Talking to backend: %s", err.Error())
 	}
 }
 
-func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error) {
+// limitQuery caps how many matches, and lines of context, a search may
+// ask for, so a single request can't tie up a backend.
+func (s *server) limitQuery(q *pb.Query, expr *QueryExpr) {
+	if limit := s.config.MaxMatchesLimit; limit > 0 && q.MaxMatches > limit {
+		q.MaxMatches = limit
+		expr.setMaxMatches(limit)
+	}
+	if limit := s.config.ContextLinesLimit; limit > 0 && q.ContextLines > limit {
+		q.ContextLines = limit
+		expr.setContextLines(limit)
+	}
+}
+
+// extractQuery parses the search query out of the request. If the query
+// combines several terms with AND/OR/NOT, the parsed expression is also
+// returned, and only MaxMatches is meaningful in the returned pb.Query.
+func extractQuery(ctx context.Context, r *http.Request) (pb.Query, *QueryExpr, bool, error) {
 	params := r.URL.Query()
 	var query pb.Query
+	var expr *QueryExpr
 	var err error
 
 	regex := true
@@ -70,8 +98,17 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 	}
 
 	if q, ok := params["q"]; ok {
-		query, err = ParseQuery(q[0], regex)
-		log.Printf(ctx, "parsing query q=%q out=%s", q[0], asJSON{query})
+		expr, err = ParseQueryExpr(q[0], regex)
+		if expr != nil {
+			query.MaxMatches = expr.Leaves()[0].Query.MaxMatches
+			log.Printf(ctx, "parsing boolean query q=%q leaves=%d", q[0], len(expr.Leaves()))
+		} else if err == nil {
+			query, err = ParseQuery(q[0], regex)
+			log.Printf(ctx, "parsing query q=%q out=%s", q[0], asJSON{query})
+		}
+		if err == nil {
+			_, err = queryGeneration(q[0], regex)
+		}
 	}
 
 	// Support old-style query arguments
@@ -94,6 +131,16 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 		}
 	}
 
+	if cl, ok := params["context_lines"]; ok && err == nil {
+		var n int
+		if n, err = strconv.Atoi(cl[0]); err != nil || n < 0 {
+			err = fmt.Errorf("invalid context_lines: %q", cl[0])
+		} else {
+			query.ContextLines = int32(n)
+			expr.setContextLines(query.ContextLines)
+		}
+	}
+
 	if fc, ok := params["fold_case"]; ok {
 		if fc[0] == "false" {
 			query.FoldCase = false
@@ -102,9 +149,14 @@ func extractQuery(ctx context.Context, r *http.Request) (pb.Query, bool, error)
 		} else {
 			query.FoldCase = strings.IndexAny(query.Line, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1
 		}
+		if expr != nil && (fc[0] == "false" || fc[0] == "true") {
+			for _, l := range expr.Leaves() {
+				l.Query.FoldCase = fc[0] == "true"
+			}
+		}
 	}
 
-	return query, regex, err
+	return query, expr, regex, err
 }
 
 var (
@@ -135,7 +187,30 @@ func convertBounds(bounds []*pb.Bounds) [][2]int {
 	return convertedBounds
 }
 
-func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*api.ReplySearch, error) {
+// searchOptions are the parts of a search the server handles itself,
+// rather than passing them on to the backend.
+type searchOptions struct {
+	// Whether the client is paging through the results, and the cursor
+	// the page starts after; nil for the first.
+	paging bool
+	after  *searchCursor
+	// How results are ordered; one of the sort* orders, or empty for
+	// the server's default.
+	order string
+	// Whether the query's terms are regexes, rather than literal strings.
+	regex bool
+}
+
+// extractSearchOptions parses the options the server handles itself out
+// of the request.
+func extractSearchOptions(r *http.Request, globalRegex bool) (searchOptions, error) {
+	opts := searchOptions{regex: globalRegex}
+	var err error
+	opts.order, err = querySortOrder(r.URL.Query().Get("q"), globalRegex)
+	return opts, err
+}
+
+func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query, expr *QueryExpr, opts searchOptions) (*api.ReplySearch, error) {
 	var search *pb.CodeSearchResult
 	var err error
 
@@ -148,14 +223,23 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 		ctx = metadata.AppendToOutgoingContext(ctx, "Request-Id", string(id))
 	}
 
-	search, err = backend.Codesearch.Search(
-		ctx, q,
-		grpc.FailFast(false),
-	)
+	searchOne := s.cachedSearch(backend, func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+		return backend.Codesearch.Search(
+			ctx, q,
+			grpc.FailFast(false),
+		)
+	})
+
+	if expr != nil {
+		search, err = searchExpr(ctx, expr, searchOne)
+	} else {
+		search, err = searchOne(ctx, q)
+	}
 	if err != nil {
-		log.Printf(ctx, "error talking to backend err=%s", err)
+		log.Errorf(ctx, "error talking to backend err=%s", err)
 		return nil, err
 	}
+	search = s.filterResults(ctx, backend, search)
 
 	reply := &api.ReplySearch{
 		Results:     make([]*api.Result, 0),
@@ -180,17 +264,11 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 			ContextAfter:  stringSlice(r.ContextAfter),
 			Bounds:        convertBounds(r.Bounds),
 			Line:          r.Line,
+			Symbol:        parseTag(r.Tag),
 		})
 	}
 
-	// sort based on the repo name first, then file path
-	sort.Slice(reply.Results, func(i, j int) bool {
-		if reply.Results[i].Tree != reply.Results[j].Tree {
-			return reply.Results[i].Tree < reply.Results[j].Tree
-		}
-
-		return reply.Results[i].Path < reply.Results[j].Path
-	})
+	rankResults(s.ranker(opts.order), reply.Results, rankPattern(q, expr))
 
 	for _, r := range search.FileResults {
 		reply.FileResults = append(reply.FileResults, &api.FileResult{
@@ -227,12 +305,35 @@ func (s *server) doSearch(ctx context.Context, backend *Backend, q *pb.Query) (*
 	return reply, nil
 }
 
-func (s *server) doSearchV2(ctx context.Context, backend *Backend, q *pb.Query) (*api.ReplySearchV2, error) {
+// doSearchV2 runs a search and returns the page of results after
+// opts.after, or the first page if it's nil. Pages hold up to
+// q.MaxMatches results, ranked among themselves.
+func (s *server) doSearchV2(ctx context.Context, backend *Backend, q *pb.Query, expr *QueryExpr, opts searchOptions) (*api.ReplySearchV2, error) {
 	var search *pb.CodeSearchResult
 	var err error
 
 	start := time.Now()
 
+	pageSize := q.MaxMatches
+	after := opts.after
+	// A client paging through the results gets the first page in cursor
+	// order too, so that the cursor at its end leaves nothing out. That
+	// has the backend look at every match rather than stop at the limit,
+	// so other searches just get the first results found. Boolean
+	// queries search their leaves without one, since the first results
+	// of each leaf needn't be the first of their combination.
+	ordered := opts.paging && expr == nil
+	// Set the cursor on a copy: callers may share q, as a federated
+	// search's backends do.
+	query := *q
+	q = &query
+	if ordered {
+		q.ResumeAfter = &pb.Cursor{}
+		if after != nil {
+			q.ResumeAfter = after.proto()
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -243,26 +344,41 @@ func (s *server) doSearchV2(ctx context.Context, backend *Backend, q *pb.Query)
 	// initial attempts at checking whether the backend is available before querying it
 	// did not work very well. So instead we just send the request, if it fails, go to
 	// the backup
-	backendIdxUsed := false
-	search, err = backend.Codesearch.Search(
-		ctx, q,
-		grpc.FailFast(true),
-	)
-
-	if err != nil && grpc.Code(err) == 14 && backend.BackupBackend != nil {
-		backendIdxUsed = true
-		log.Printf(ctx, "SEARCH ERROR: Primary backend unavailable. state=%s. Trying backup=%s",
-			backend.GrpcClient.GetState(), backend.BackupBackend.Id)
-		search, err = backend.BackupBackend.Codesearch.Search(
+	var backupUsed int32
+	searchOne := s.cachedSearch(backend, func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+		search, err := backend.Codesearch.Search(
 			ctx, q,
 			grpc.FailFast(true),
 		)
+
+		if err != nil && grpc.Code(err) == 14 && backend.BackupBackend != nil {
+			atomic.StoreInt32(&backupUsed, 1)
+			log.Warnf(ctx, "SEARCH ERROR: Primary backend unavailable. state=%s. Trying backup=%s",
+				backend.GrpcClient.GetState(), backend.BackupBackend.Id)
+			search, err = backend.BackupBackend.Codesearch.Search(
+				ctx, q,
+				grpc.FailFast(true),
+			)
+		}
+		return search, err
+	})
+
+	if expr != nil {
+		search, err = searchExpr(ctx, expr, searchOne)
+	} else {
+		search, err = searchOne(ctx, q)
 	}
+	backendIdxUsed := atomic.LoadInt32(&backupUsed) == 1
 
 	if err != nil {
-		log.Printf(ctx, "error talking to backend(s) err=%s", err)
+		log.Errorf(ctx, "error talking to backend(s) err=%s", err)
 		return nil, err
 	}
+	// Page the backend's results before dropping those the requester
+	// may not see, so that where the page ends, and whether there's
+	// another, depends only on what the backend found.
+	search, next := pageResults(search, after, pageSize, ordered)
+	search = s.filterResults(ctx, backend, search)
 
 	reply := &api.ReplySearchV2{
 		Results:        make([]*api.ResultV2, 0),
@@ -272,8 +388,10 @@ func (s *server) doSearchV2(ctx context.Context, backend *Backend, q *pb.Query)
 		IndexAge:       time.Since(time.Unix(search.IndexTime, 0)).Round(time.Minute).String(),
 		LastIndexed:    time.Unix(search.IndexTime, 0).In(newYorkTime).Format("2006-01-02 3:04PM ET"),
 		BackupIdxUsed:  backendIdxUsed,
-		NextMaxMatches: int(q.MaxMatches) * 3,
-		CurrMaxMatches: int(q.MaxMatches),
+		CurrMaxMatches: int(pageSize),
+	}
+	if next != nil {
+		reply.NextCursor = next.String()
 	}
 
 	if q.FilenameOnly {
@@ -287,92 +405,60 @@ func (s *server) doSearchV2(ctx context.Context, backend *Backend, q *pb.Query)
 	dedupedResults := make(map[string]*api.ResultV2)
 	for _, r := range search.Results {
 		key := fmt.Sprintf("%s-%s", r.Tree, r.Path)
-		lineNumber := int(r.LineNumber)
 
 		existingResult, present := dedupedResults[key]
 		if !present {
-			existingResult = &api.ResultV2{
-				Tree:         r.Tree,
-				Version:      r.Version,
-				Path:         r.Path,
-				ContextLines: make(map[int]*api.ResultLine),
-				NumMatches:   0,
-			}
-		}
-		existingResult.NumMatches += int(r.NumMatches)
-
-		var contextLinesInit []string
-		contextLinesInit = append(contextLinesInit, reverse(r.ContextBefore)...)
-		contextLinesInit = append(contextLinesInit, r.Line)
-		contextLinesInit = append(contextLinesInit, r.ContextAfter...)
-
-		for idx, line := range contextLinesInit {
-			contexLno := idx + lineNumber - len(r.ContextBefore)
-
-			var bounds [][2]int
-			if contexLno == lineNumber {
-				bounds = convertBounds(r.Bounds)
-			}
-
-			// defer to the existing bounds information
-			if present {
-				if existingContextLine, exist := existingResult.ContextLines[contexLno]; exist {
-					if len(existingContextLine.Bounds) > len(bounds) {
-						bounds = existingContextLine.Bounds
-					}
-				}
-			}
-
-			existingResult.ContextLines[contexLno] = &api.ResultLine{
-				LineNumber: contexLno,
-				Bounds:     bounds,
-				Line:       line,
-			}
-		}
-
-		if !present {
+			existingResult = newResultV2(r)
 			dedupedResults[key] = existingResult
 		}
+		addContextLines(existingResult, r)
+	}
 
+	for _, dededupedResult := range dedupedResults {
+		sortResultLines(dededupedResult)
+		reply.Results = append(reply.Results, dededupedResult)
 	}
 
-	extensionCounts := make(map[string]int, len(dedupedResults))
-	for treeAndPath, dededupedResult := range dedupedResults {
-		ext := filepath.Ext(treeAndPath)
-		extensionCounts[ext] += 1
+	rankResultsV2(s.ranker(opts.order), reply.Results, rankPattern(q, expr))
+	reply.PopExts = popularExtensions(reply.Results)
+	reply.Facets = searchFacets(search.Results, opts.regex)
 
-		// Change the lines over to an array then sort by LineNumber
-		dededupedResult.Lines = make([]*api.ResultLine, 0)
-		for _, line := range dededupedResult.ContextLines {
-			dededupedResult.Lines = append(dededupedResult.Lines, line)
-		}
-		// It's faster to sort after the fact than trying to maintain sort
-		// order I believe
-		sort.Slice(dededupedResult.Lines, func(i, j int) bool {
-			lines := dededupedResult.Lines
-			return lines[i].LineNumber < lines[j].LineNumber
-		})
+	for _, r := range search.FileResults {
+		reply.FileResults = append(reply.FileResults, convertFileResult(r))
+	}
 
-		reply.Results = append(reply.Results, dededupedResult)
+	for _, r := range search.TreeResults {
+		reply.TreeResults = append(reply.TreeResults, convertTreeResult(r))
 	}
 
-	// sort based on the repo name first, then file path
-	sort.Slice(reply.Results, func(i, j int) bool {
-		if reply.Results[i].Tree != reply.Results[j].Tree {
-			return reply.Results[i].Tree < reply.Results[j].Tree
+	reply.Info = convertStats(search.Stats, start)
+	return reply, nil
+}
+
+// sortResults sorts results by repo name first, then file path
+func sortResults(results []*api.ResultV2) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Tree != results[j].Tree {
+			return results[i].Tree < results[j].Tree
 		}
 
-		return reply.Results[i].Path < reply.Results[j].Path
+		return results[i].Path < results[j].Path
 	})
+}
+
+// popularExtensions returns the most common file extensions in results
+func popularExtensions(results []*api.ResultV2) []*api.FileExtension {
+	extensionCounts := make(map[string]int, len(results))
+	for _, r := range results {
+		extensionCounts[filepath.Ext(r.Path)] += 1
+	}
 
 	extensionArray := make([]*api.FileExtension, 0, len(extensionCounts))
-	idx := 0
 	for ext, count := range extensionCounts {
 		if ext == "" {
 			continue
 		}
 		extensionArray = append(extensionArray, &api.FileExtension{Ext: ext, Count: count})
-		idx += 1
 	}
 
 	sort.Slice(extensionArray, func(i, j int) bool {
@@ -386,99 +472,509 @@ func (s *server) doSearchV2(ctx context.Context, backend *Backend, q *pb.Query)
 	if c < 2 {
 		c = 0
 	}
-	reply.PopExts = extensionArray[:c]
+	return extensionArray[:c]
+}
+
+func newResultV2(r *pb.SearchResult) *api.ResultV2 {
+	return &api.ResultV2{
+		Tree:         r.Tree,
+		Version:      r.Version,
+		Path:         r.Path,
+		ContextLines: make(map[int]*api.ResultLine),
+		NumMatches:   0,
+	}
+}
+
+// addContextLines adds the matched line of r, and its context, to
+// result.ContextLines. When lines overlap with an earlier match in the
+// same file, we keep whichever has more bounds information.
+func addContextLines(result *api.ResultV2, r *pb.SearchResult) {
+	lineNumber := int(r.LineNumber)
+	result.NumMatches += int(r.NumMatches)
+	symbol := parseTag(r.Tag)
+	if symbol != nil {
+		result.NumDefinitions++
+	}
 
+	var contextLinesInit []string
+	contextLinesInit = append(contextLinesInit, reverse(r.ContextBefore)...)
+	contextLinesInit = append(contextLinesInit, r.Line)
+	contextLinesInit = append(contextLinesInit, r.ContextAfter...)
+
+	for idx, line := range contextLinesInit {
+		contexLno := idx + lineNumber - len(r.ContextBefore)
+
+		var bounds [][2]int
+		var lineSymbol *api.Symbol
+		if contexLno == lineNumber {
+			bounds = convertBounds(r.Bounds)
+			lineSymbol = symbol
+		}
+
+		// defer to the existing bounds information
+		if existingContextLine, exist := result.ContextLines[contexLno]; exist {
+			if len(existingContextLine.Bounds) > len(bounds) {
+				bounds = existingContextLine.Bounds
+			}
+			if lineSymbol == nil {
+				lineSymbol = existingContextLine.Symbol
+			}
+		}
+
+		result.ContextLines[contexLno] = &api.ResultLine{
+			LineNumber: contexLno,
+			Bounds:     bounds,
+			Line:       line,
+			Symbol:     lineSymbol,
+		}
+	}
+}
+
+// sortResultLines changes result.ContextLines over to an array sorted
+// by LineNumber.
+func sortResultLines(result *api.ResultV2) {
+	result.Lines = make([]*api.ResultLine, 0, len(result.ContextLines))
+	for _, line := range result.ContextLines {
+		result.Lines = append(result.Lines, line)
+	}
+	// It's faster to sort after the fact than trying to maintain sort
+	// order I believe
+	sort.Slice(result.Lines, func(i, j int) bool {
+		return result.Lines[i].LineNumber < result.Lines[j].LineNumber
+	})
+}
+
+func convertFileResult(r *pb.FileResult) *api.FileResult {
+	return &api.FileResult{
+		Tree:    r.Tree,
+		Version: r.Version,
+		Path:    r.Path,
+		Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
+	}
+}
+
+func convertTreeResult(r *pb.TreeResult) *api.TreeResult {
+	return &api.TreeResult{
+		Name:    r.Name,
+		Version: r.Version,
+		Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
+		// Only GitHub links are enabled atm.
+		Metadata: &api.Metadata{
+			Labels:      r.Metadata.Labels,
+			ExternalUrl: r.Metadata.Github + "/tree/" + r.Version,
+		},
+	}
+}
+
+func convertStats(stats *pb.SearchStats, start time.Time) *api.Stats {
+	return &api.Stats{
+		RE2Time:     stats.Re2Time,
+		GitTime:     stats.GitTime,
+		SortTime:    stats.SortTime,
+		IndexTime:   stats.IndexTime,
+		AnalyzeTime: stats.AnalyzeTime,
+		TotalTime:   int64(time.Since(start) / time.Millisecond),
+		ExitReason:  stats.ExitReason.String(),
+		NumMatches:  int(stats.NumMatches),
+	}
+}
+
+type fileKey struct {
+	tree, path string
+}
+
+type fileSet map[fileKey]bool
+
+func leafFiles(search *pb.CodeSearchResult) fileSet {
+	files := make(fileSet)
+	for _, r := range search.Results {
+		files[fileKey{r.Tree, r.Path}] = true
+	}
 	for _, r := range search.FileResults {
-		reply.FileResults = append(reply.FileResults, &api.FileResult{
-			Tree:    r.Tree,
-			Version: r.Version,
-			Path:    r.Path,
-			Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
-		})
+		files[fileKey{r.Tree, r.Path}] = true
+	}
+	return files
+}
+
+// matchingFiles evaluates e over the files matched by each leaf. If
+// negated is true, e matches every file *except* the returned ones.
+// ParseQueryExpr rejects expressions that can't be evaluated this way.
+func (e *QueryExpr) matchingFiles(results map[*QueryExpr]*pb.CodeSearchResult) (files fileSet, negated bool) {
+	switch e.Op {
+	case ExprLeaf:
+		return leafFiles(results[e]), false
+	case ExprNot:
+		files, negated := e.Children[0].matchingFiles(results)
+		return files, !negated
+	}
+
+	var positive, negative []fileSet
+	for _, c := range e.Children {
+		files, negated := c.matchingFiles(results)
+		if negated {
+			negative = append(negative, files)
+		} else {
+			positive = append(positive, files)
+		}
+	}
+
+	union := func(sets []fileSet) fileSet {
+		out := make(fileSet)
+		for _, set := range sets {
+			for k := range set {
+				out[k] = true
+			}
+		}
+		return out
+	}
+	intersect := func(sets []fileSet) fileSet {
+		out := make(fileSet)
+		for k := range sets[0] {
+			in := true
+			for _, set := range sets[1:] {
+				in = in && set[k]
+			}
+			if in {
+				out[k] = true
+			}
+		}
+		return out
+	}
+
+	if e.Op == ExprOr {
+		if len(negative) > 0 {
+			// NOT a OR NOT b == NOT (a AND b)
+			return intersect(negative), true
+		}
+		return union(positive), false
+	}
+
+	if len(positive) == 0 {
+		// NOT a AND NOT b == NOT (a OR b)
+		return union(negative), true
 	}
+	files = intersect(positive)
+	for k := range union(negative) {
+		delete(files, k)
+	}
+	return files, false
+}
+
+func matchesAll(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if !re.MatchString(s) {
+			return false
+		}
+	}
+	return true
+}
 
+// filterSearch returns the results of search that pass the filters f
+// holds, counting their matches again. Results may be cached and shared
+// between requests, so search itself is left alone.
+func (f *QueryFilters) filterSearch(search *pb.CodeSearchResult) *pb.CodeSearchResult {
+	if f == nil {
+		return search
+	}
+	filtered := *search
+	filtered.Results = nil
+	filtered.FileResults = nil
+	filtered.TreeResults = nil
+	for _, r := range search.Results {
+		// Results only carry the tag that defines them when the
+		// backend searched its tags.
+		if matchesAll(f.Repo, r.Tree) && matchesAll(f.File, r.Path) && matchesAll(f.Tags, r.Tag) {
+			filtered.Results = append(filtered.Results, r)
+		}
+	}
+	for _, r := range search.FileResults {
+		if matchesAll(f.Repo, r.Tree) && matchesAll(f.File, r.Path) {
+			filtered.FileResults = append(filtered.FileResults, r)
+		}
+	}
 	for _, r := range search.TreeResults {
-		reply.TreeResults = append(reply.TreeResults, &api.TreeResult{
-			Name:    r.Name,
-			Version: r.Version,
-			Bounds:  [2]int{int(r.Bounds.Left), int(r.Bounds.Right)},
-			// Only GitHub links are enabled atm.
-			Metadata: &api.Metadata{
-				Labels:      r.Metadata.Labels,
-				ExternalUrl: r.Metadata.Github + "/tree/" + r.Version,
-			},
-		})
+		if matchesAll(f.Repo, r.Name) {
+			filtered.TreeResults = append(filtered.TreeResults, r)
+		}
 	}
+	recountMatches(&filtered)
+	return &filtered
+}
 
-	reply.Info = &api.Stats{
-		RE2Time:     search.Stats.Re2Time,
-		GitTime:     search.Stats.GitTime,
-		SortTime:    search.Stats.SortTime,
-		IndexTime:   search.Stats.IndexTime,
-		AnalyzeTime: search.Stats.AnalyzeTime,
-		TotalTime:   int64(time.Since(start) / time.Millisecond),
-		ExitReason:  search.Stats.ExitReason.String(),
-		NumMatches:  int(search.Stats.NumMatches),
+// recountMatches sets search's NumMatches to the matches in the results
+// it has, after some were filtered out. search's Stats may be shared, so
+// they're copied.
+func recountMatches(search *pb.CodeSearchResult) {
+	if search.Stats == nil {
+		return
 	}
-	return reply, nil
+	stats := *search.Stats
+	stats.NumMatches = countMatches(search)
+	search.Stats = &stats
+}
+
+// countMatches counts the matches in search's results.
+func countMatches(search *pb.CodeSearchResult) int64 {
+	var numMatches int64
+	for _, r := range search.Results {
+		numMatches += r.NumMatches
+	}
+	return numMatches + int64(len(search.FileResults)+len(search.TreeResults))
+}
+
+// combineExprResults keeps the matches of the positive leaves of expr
+// that fall in files matching the whole expression, merging lines
+// matched by more than one leaf.
+func combineExprResults(expr *QueryExpr, results map[*QueryExpr]*pb.CodeSearchResult) *pb.CodeSearchResult {
+	files, _ := expr.matchingFiles(results)
+
+	type lineKey struct {
+		fileKey
+		line int64
+	}
+	// index into combined.Results
+	seenLines := make(map[lineKey]int)
+	seenFiles := make(map[fileKey]bool)
+
+	combined := &pb.CodeSearchResult{Stats: &pb.SearchStats{}}
+	for i, leaf := range expr.Leaves() {
+		search := results[leaf]
+		if i == 0 {
+			combined.IndexName = search.IndexName
+			combined.IndexTime = search.IndexTime
+		}
+
+		// The leaves were searched concurrently, so the slowest one
+		// is the closest thing we have to the time spent.
+		stats := search.Stats
+		if stats.Re2Time > combined.Stats.Re2Time {
+			combined.Stats.Re2Time = stats.Re2Time
+		}
+		if stats.GitTime > combined.Stats.GitTime {
+			combined.Stats.GitTime = stats.GitTime
+		}
+		if stats.SortTime > combined.Stats.SortTime {
+			combined.Stats.SortTime = stats.SortTime
+		}
+		if stats.IndexTime > combined.Stats.IndexTime {
+			combined.Stats.IndexTime = stats.IndexTime
+		}
+		if stats.AnalyzeTime > combined.Stats.AnalyzeTime {
+			combined.Stats.AnalyzeTime = stats.AnalyzeTime
+		}
+		if stats.TotalTime > combined.Stats.TotalTime {
+			combined.Stats.TotalTime = stats.TotalTime
+		}
+		// If any leaf was cut short, the combination may be incomplete.
+		// A leaf hitting its match limit is reported over the others'
+		// reasons, since a bigger max_matches: can do something about
+		// it.
+		if stats.ExitReason == pb.SearchStats_MATCH_LIMIT || combined.Stats.ExitReason == pb.SearchStats_NONE {
+			combined.Stats.ExitReason = stats.ExitReason
+		}
+	}
+
+	for _, leaf := range expr.PositiveLeaves() {
+		search := results[leaf]
+		for _, r := range search.Results {
+			fk := fileKey{r.Tree, r.Path}
+			if !files[fk] {
+				continue
+			}
+			lk := lineKey{fk, r.LineNumber}
+			if idx, ok := seenLines[lk]; ok {
+				// Build a new result rather than appending to the
+				// existing one, which may be shared with the cache.
+				existing := combined.Results[idx]
+				bounds := make([]*pb.Bounds, 0, len(existing.Bounds)+len(r.Bounds))
+				bounds = append(bounds, existing.Bounds...)
+				bounds = append(bounds, r.Bounds...)
+				sort.Slice(bounds, func(i, j int) bool {
+					return bounds[i].Left < bounds[j].Left
+				})
+				combined.Results[idx] = &pb.SearchResult{
+					Tree:          existing.Tree,
+					Version:       existing.Version,
+					Path:          existing.Path,
+					LineNumber:    existing.LineNumber,
+					ContextBefore: existing.ContextBefore,
+					ContextAfter:  existing.ContextAfter,
+					Bounds:        bounds,
+					Line:          existing.Line,
+					NumMatches:    existing.NumMatches,
+				}
+				continue
+			}
+			seenLines[lk] = len(combined.Results)
+			combined.Results = append(combined.Results, r)
+			combined.Stats.NumMatches += r.NumMatches
+		}
+		for _, r := range search.FileResults {
+			fk := fileKey{r.Tree, r.Path}
+			if !files[fk] || seenFiles[fk] {
+				continue
+			}
+			seenFiles[fk] = true
+			combined.FileResults = append(combined.FileResults, r)
+			combined.Stats.NumMatches++
+		}
+	}
+
+	return combined
 }
 
-// TODO:(xvandish) Rename this to indicate that if not in query, pick first
-func getBackendFromQuery(s *server, r *http.Request) (string, *Backend) {
+// searchExpr runs every leaf of expr concurrently using search, checks
+// their results against the filters they repeat, then combines them per
+// (tree, path) according to the expression.
+func searchExpr(ctx context.Context, expr *QueryExpr,
+	search func(context.Context, *pb.Query) (*pb.CodeSearchResult, error)) (*pb.CodeSearchResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	leaves := expr.Leaves()
+	results := make(map[*QueryExpr]*pb.CodeSearchResult, len(leaves))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	for _, leaf := range leaves {
+		wg.Add(1)
+		go func(leaf *QueryExpr) {
+			defer wg.Done()
+			result, err := searchFiltered(ctx, leaf, search)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			results[leaf] = result
+		}(leaf)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if expr.Op == ExprLeaf {
+		// A query that only repeats filters has nothing to combine.
+		return results[expr], nil
+	}
+	return combineExprResults(expr, results), nil
+}
+
+// filteredMaxMatches is how many matches a leaf that repeats filters
+// may ask the backend for, searching again while its filters leave it
+// short of the matches it wants.
+const filteredMaxMatches = 10000
+
+// searchFiltered runs leaf using search and checks its results against
+// the filters it repeats. The backend only applies the first of them,
+// so it may stop at MaxMatches with most of what it found filtered out;
+// the leaf is then searched again for three times as many matches, up
+// to filteredMaxMatches, until its filters leave enough.
+func searchFiltered(ctx context.Context, leaf *QueryExpr,
+	search func(context.Context, *pb.Query) (*pb.CodeSearchResult, error)) (*pb.CodeSearchResult, error) {
+	// leaf.Query may be shared with other searches of the same
+	// expression, so raise the limit on a copy.
+	q := leaf.Query
+	for {
+		result, err := search(ctx, &q)
+		if err != nil {
+			return nil, err
+		}
+		filtered := leaf.Filters.filterSearch(result)
+		if leaf.Filters == nil || result.Stats == nil ||
+			result.Stats.ExitReason != pb.SearchStats_MATCH_LIMIT ||
+			countMatches(filtered) >= int64(leaf.Query.MaxMatches) ||
+			q.MaxMatches >= filteredMaxMatches {
+			return filtered, nil
+		}
+		q.MaxMatches *= 3
+		if q.MaxMatches > filteredMaxMatches {
+			q.MaxMatches = filteredMaxMatches
+		}
+	}
+}
+
+// getBackendFromQuery returns the backend named in the URL, or nil if
+// there's no such backend. If none is named, the query is routed to one
+// by its repo: filter. If the query has at:, it's the generation of the
+// backend's index that names.
+func getBackendFromQuery(s *server, r *http.Request, q *pb.Query, expr *QueryExpr) (string, *Backend) {
 	backendName := r.URL.Query().Get(":backend")
 	var backend *Backend
 	if backendName != "" {
 		backend = s.bk[backendName]
 	} else {
-		for _, backend = range s.bk {
-			break
-		}
+		backend = s.routeQuery(q, expr)
 	}
 
+	if at := requestGeneration(r); at != "" && backend != nil {
+		return backend.Id + "@" + at, backend.generation(at)
+	}
 	return backendName, backend
 }
 
-// we provide users a "show more" link that just multiples the current
-// max_matches value by 3. Being careful not to modify max_matches if
-// it is wrapped in () to escape it
-func getNextPageUrl(searchQ url.Values, q *pb.Query, exitReason string) string {
-	if exitReason == "NONE" {
+// pagedSearchURL returns the query string that runs the search in
+// params again, paged, to get the results after its first page. It's
+// empty if the search was paged already, or found everything.
+func pagedSearchURL(params url.Values, paged bool, exitReason string) string {
+	if paged || exitReason == "NONE" {
 		return ""
 	}
+	params.Set("cursor", "")
+	return "?" + params.Encode()
+}
 
-	currQuery := searchQ.Get("q")
-	newQuery := ""
-	nextMaxMatches := int(q.MaxMatches) * 3
-
-	// if the ` max_matches:` string already exists, replace its value
-	if strings.Contains(currQuery, " max_matches:") {
-		newQuery = strings.Replace(currQuery, fmt.Sprintf(" max_matches:%d", q.MaxMatches), fmt.Sprintf(" max_matches:%d", nextMaxMatches), 1)
-
-	} else {
-		newQuery = fmt.Sprintf("%s max_matches:%d", currQuery, nextMaxMatches)
-	}
-
-	searchQ.Set("q", newQuery)
+// withSearchFields attaches the backend and query a search runs with to
+// every line it logs.
+func withSearchFields(ctx context.Context, r *http.Request, backend string) context.Context {
+	return log.WithFields(ctx, log.Fields{
+		"backend": backend,
+		"query":   r.URL.Query().Get("q"),
+	})
+}
 
-	return "?" + searchQ.Encode()
+func logSearch(ctx context.Context, results int, info *api.Stats) {
+	log.Logf(ctx, log.LevelInfo, log.Fields{
+		"exit_reason": info.ExitReason,
+		"latency_ms":  info.TotalTime,
+	}, "responding success results=%d stats=%s", results, asJSON{info})
 }
 
 // This function is internal to the app and not exposed.
 // It is used to perform a search, and those results are then rendered to HTML
 func (s *server) ServerSideAPISearchV2(ctx context.Context, w http.ResponseWriter, r *http.Request) (reply *api.ReplySearchV2, errCode int, errorMsg string, errorMsgLong string) {
-	backendName, backend := getBackendFromQuery(s, r)
+	q, expr, is_regex, err := extractQuery(ctx, r)
 
-	if backend == nil {
-		return nil, 400, "bad_backend", fmt.Sprintf("Unknown backend: %s", backendName)
+	if err != nil {
+		return nil, 400, "bad_query", err.Error()
 	}
 
-	q, is_regex, err := extractQuery(ctx, r)
+	federated := r.URL.Query().Get(":backend") == AllBackends
 
-	if err != nil {
-		return nil, 400, "bad_query", err.Error()
+	var backend *Backend
+	if !federated {
+		var backendName string
+		backendName, backend = getBackendFromQuery(s, r, &q, expr)
+
+		if backend == nil {
+			return nil, 400, "bad_backend", fmt.Sprintf("Unknown backend: %s", backendName)
+		}
+		ctx = withSearchFields(ctx, r, backend.Id)
+	} else {
+		if requestGeneration(r) != "" {
+			return nil, 400, "bad_query", "at: can't be used when searching every backend"
+		}
+		ctx = withSearchFields(ctx, r, AllBackends)
 	}
 
-	if q.Line == "" {
+	if expr == nil && q.Line == "" {
 		kind := "string"
 		if is_regex {
 			kind = "regex"
@@ -489,17 +985,43 @@ func (s *server) ServerSideAPISearchV2(ctx context.Context, w http.ResponseWrite
 
 	if q.MaxMatches == 0 {
 		q.MaxMatches = s.config.DefaultMaxMatches
+		expr.setMaxMatches(q.MaxMatches)
+	}
+	s.limitQuery(&q, expr)
+
+	opts, err := extractSearchOptions(r, is_regex)
+	if err != nil {
+		return nil, 400, "bad_query", err.Error()
+	}
+	_, opts.paging = r.URL.Query()["cursor"]
+	if opts.after, err = parseCursor(r.URL.Query().Get("cursor")); err != nil {
+		return nil, 400, "bad_cursor", err.Error()
+	}
+	if opts.paging && federated {
+		return nil, 400, "bad_cursor", "Searches of all backends can't be paged with a cursor"
 	}
 
-	reply, err = s.doSearchV2(ctx, backend, &q)
+	if federated {
+		reply, err = s.doFederatedSearchV2(ctx, &q, expr, opts)
+	} else {
+		reply, err = s.doSearchV2(ctx, backend, &q, expr, opts)
+	}
 
 	if err != nil {
-		log.Printf(ctx, "error in search err=%s", err)
+		log.Errorf(ctx, "error in search err=%s", err)
 		errCode, errorMsg, errorMsgLong = getQueryError(err)
 		return nil, errCode, errorMsg, errorMsgLong
 	}
 
-	reply.NextUrl = getNextPageUrl(r.URL.Query(), &q, reply.Info.ExitReason)
+	if !federated {
+		reply.NextUrl = pagedSearchURL(r.URL.Query(), opts.paging, reply.Info.ExitReason)
+	}
+
+	if federated {
+		metrics.ObserveSearch(AllBackends, reply.Info.ExitReason)
+	} else {
+		metrics.ObserveSearch(backend.Id, reply.Info.ExitReason)
+	}
 
 	if s.statsd != nil {
 		s.statsd.Increment("api.search.v2.invocations")
@@ -512,39 +1034,41 @@ func (s *server) ServerSideAPISearchV2(ctx context.Context, w http.ResponseWrite
 		s.statsd.Timing("api.search.v2.total_time", reply.Info.TotalTime)
 	}
 
-	log.Printf(ctx,
-		"responding success results=%d why=%s stats=%s",
-		reply.Info.NumMatches,
-		reply.Info.ExitReason,
-		asJSON{reply.Info})
+	logSearch(ctx, reply.Info.NumMatches, reply.Info)
 
 	return reply, 200, "", ""
 }
 
-func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	backendName := r.URL.Query().Get(":backend")
-	var backend *Backend
-	if backendName != "" {
-		backend = s.bk[backendName]
-		if backend == nil {
-			writeError(ctx, w, 400, "bad_backend",
-				fmt.Sprintf("Unknown backend: %s", backendName))
-			return
-		}
-	} else {
-		for _, backend = range s.bk {
-			break
-		}
+// ServeAPISearchV2 serves the same search as ServeRenderedSearchResults, as
+// JSON. Pass AllBackends as the backend to search every backend at once.
+func (s *server) ServeAPISearchV2(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	reply, statusCode, errorMsg, errorMsgLong := s.ServerSideAPISearchV2(ctx, w, r)
+
+	if statusCode > 200 {
+		writeError(ctx, w, statusCode, errorMsg, errorMsgLong)
+		return
 	}
 
-	q, is_regex, err := extractQuery(ctx, r)
+	replyJSON(ctx, w, 200, reply)
+}
+
+func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	q, expr, is_regex, err := extractQuery(ctx, r)
 
 	if err != nil {
 		writeError(ctx, w, 400, "bad_query", err.Error())
 		return
 	}
 
-	if q.Line == "" {
+	backendName, backend := getBackendFromQuery(s, r, &q, expr)
+	if backend == nil {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Unknown backend: %s", backendName))
+		return
+	}
+	ctx = withSearchFields(ctx, r, backend.Id)
+
+	if expr == nil && q.Line == "" {
 		kind := "string"
 		if is_regex {
 			kind = "regex"
@@ -556,16 +1080,26 @@ func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *h
 
 	if q.MaxMatches == 0 {
 		q.MaxMatches = s.config.DefaultMaxMatches
+		expr.setMaxMatches(q.MaxMatches)
 	}
+	s.limitQuery(&q, expr)
 
-	reply, err := s.doSearch(ctx, backend, &q)
+	opts, err := extractSearchOptions(r, is_regex)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	reply, err := s.doSearch(ctx, backend, &q, expr, opts)
 
 	if err != nil {
-		log.Printf(ctx, "error in search err=%s", err)
+		log.Errorf(ctx, "error in search err=%s", err)
 		writeQueryError(ctx, w, err)
 		return
 	}
 
+	metrics.ObserveSearch(backend.Id, reply.Info.ExitReason)
+
 	if s.statsd != nil {
 		s.statsd.Increment("api.search.v1.invocations")
 		s.statsd.Increment("api.search.v1.exit_reason." + reply.Info.ExitReason)
@@ -577,11 +1111,178 @@ func (s *server) ServeAPISearch(ctx context.Context, w http.ResponseWriter, r *h
 		s.statsd.Timing("api.search.v1.total_time", reply.Info.TotalTime)
 	}
 
-	log.Printf(ctx,
-		"responding success results=%d why=%s stats=%s",
-		len(reply.Results),
-		reply.Info.ExitReason,
-		asJSON{reply.Info})
+	logSearch(ctx, len(reply.Results), reply.Info)
 
 	replyJSON(ctx, w, 200, reply)
 }
+
+// writeEvent sends obj, JSON-encoded, as a single Server-Sent Event.
+func writeEvent(w http.ResponseWriter, event string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// ServeAPISearchStream sends search results as Server-Sent Events as soon
+// as the backend finds them, instead of waiting for the whole search like
+// /api/v2/getRenderedSearchResults does. The events are described in
+// server/api/types.go.
+func (s *server) ServeAPISearchStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	q, expr, is_regex, err := extractQuery(ctx, r)
+
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	backendName, backend := getBackendFromQuery(s, r, &q, expr)
+	if backend == nil {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Unknown backend: %s", backendName))
+		return
+	}
+	ctx = withSearchFields(ctx, r, backend.Id)
+
+	if expr == nil && q.Line == "" {
+		kind := "string"
+		if is_regex {
+			kind = "regex"
+		}
+		msg := fmt.Sprintf("You must specify a %s to match", kind)
+		writeError(ctx, w, 400, "bad_query", msg)
+		return
+	}
+
+	if q.MaxMatches == 0 {
+		q.MaxMatches = s.config.DefaultMaxMatches
+		expr.setMaxMatches(q.MaxMatches)
+	}
+	s.limitQuery(&q, expr)
+
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(ctx, w, 500, "internal_error", "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx and friends from buffering the whole response
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	// The ctx handlers are given lives on after the client goes away,
+	// and searches streamed to no one shouldn't keep the backend busy.
+	go func() {
+		select {
+		case <-r.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if id, ok := reqid.FromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, "Request-Id", string(id))
+	}
+
+	var stats *pb.SearchStats
+	numResults := 0
+	// The matches sent, which the stats report rather than the
+	// backend's count, as that includes any the requester may not see.
+	var numMatches int64
+	// The backend sends a line at a time, so hold on to a file's lines
+	// until a line from another file arrives, and send them as one
+	// result, as doSearchV2 does.
+	var pending *api.ResultV2
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		sortResultLines(pending)
+		result := pending
+		pending = nil
+		numResults++
+		return writeEvent(w, "result", result)
+	}
+	send := func(chunk *pb.CodeSearchResult) error {
+		chunk = s.filterResults(ctx, backend, chunk)
+		numMatches += countMatches(chunk)
+		for _, r := range chunk.Results {
+			if pending != nil && (pending.Tree != r.Tree || pending.Path != r.Path) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if pending == nil {
+				pending = newResultV2(r)
+			}
+			addContextLines(pending, r)
+		}
+		for _, r := range chunk.FileResults {
+			if err := writeEvent(w, "file_result", convertFileResult(r)); err != nil {
+				return err
+			}
+		}
+		for _, r := range chunk.TreeResults {
+			if err := writeEvent(w, "tree_result", convertTreeResult(r)); err != nil {
+				return err
+			}
+		}
+		if chunk.Stats != nil {
+			stats = chunk.Stats
+		}
+		return nil
+	}
+
+	if expr != nil {
+		// We can't know which files match a boolean query until every
+		// term has finished, so those results all arrive at once.
+		var search *pb.CodeSearchResult
+		search, err = searchExpr(ctx, expr, func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+			return backend.Codesearch.Search(ctx, q, grpc.FailFast(true))
+		})
+		if err == nil {
+			sortSearchResults(search.Results)
+			err = send(search)
+		}
+	} else {
+		err = backend.StreamSearch(ctx, &q, send)
+	}
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		log.Errorf(ctx, "error in streaming search err=%s", err)
+		_, code, message := getQueryError(err)
+		writeEvent(w, "error", &api.ReplyError{Err: api.InnerError{Code: code, Message: message}})
+		return
+	}
+
+	if stats == nil {
+		stats = &pb.SearchStats{}
+	}
+	info := convertStats(stats, start)
+	info.NumMatches = int(numMatches)
+
+	metrics.ObserveSearch(backend.Id, info.ExitReason)
+
+	if s.statsd != nil {
+		s.statsd.Increment("api.search.v2.stream.invocations")
+		s.statsd.Increment("api.search.v2.stream.exit_reason." + info.ExitReason)
+		s.statsd.Timing("api.search.v2.stream.total_time", info.TotalTime)
+	}
+
+	logSearch(ctx, numResults, info)
+
+	writeEvent(w, "stats", info)
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"io/fs"
+	"time"
 )
 
 type InnerError struct {
@@ -31,19 +32,74 @@ type ReplySearchV2 struct {
 	TreeResults    []*TreeResult    `json:"tree_results"`
 	SearchType     string           `json:"search_type"`
 	PopExts        []*FileExtension `json:"popular_extensions"` // at most 5 common extensions in search
+	Facets         *Facets          `json:"facets"`
 	IndexAge       string           `json:"index_age"`
 	LastIndexed    string           `json:"last_indexed"`
 	BackupIdxUsed  bool             `json:"backup_idx_used"`
 	CurrMaxMatches int              `json:"curr_max_matches"`
-	NextMaxMatches int              `json:"next_max_matches"`
-	NextUrl        string           `json:"next_url"`
+	// The query string that runs a search that stopped at the match
+	// limit again, paged, so that NextCursor gets the rest.
+	NextUrl string `json:"next_url"`
+	// Pass as the cursor parameter to get the next page of results,
+	// without those already returned. Empty if there are no more. Only
+	// searches with a cursor parameter, empty for the first page, are
+	// paged: finding the first results in cursor order means looking
+	// at every match, so other searches return the first found.
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Only set when searching every backend at once
+	Backends []*BackendInfo `json:"backends,omitempty"`
 }
 
+// BackendInfo describes how one backend did in a search across all
+// backends. If it failed, Error is set and none of the results came from it.
+type BackendInfo struct {
+	Id            string      `json:"id"`
+	Name          string      `json:"name"`
+	Info          *Stats      `json:"info,omitempty"`
+	IndexAge      string      `json:"index_age,omitempty"`
+	LastIndexed   string      `json:"last_indexed,omitempty"`
+	BackupIdxUsed bool        `json:"backup_idx_used"`
+	Error         *InnerError `json:"error,omitempty"`
+}
+
+// api/v2/search/stream/:backend replies with Server-Sent Events rather
+// than a ReplySearchV2, sending results as soon as the backend finds them:
+//
+//	event: result       data: a ResultV2 holding a file's matches and their context
+//	event: file_result  data: a FileResult
+//	event: tree_result  data: a TreeResult
+//
+// The stream ends with either a `stats` event holding the search's Stats,
+// or an `error` event holding a ReplyError. A file's matches are sent as
+// one result event when the backend finds them one after another, as it
+// mostly does; if another file's come in between, the file is sent as
+// more than one, and clients merge them by tree and path. Boolean
+// queries are supported, but since which files match isn't known until
+// every term has been searched, their results all arrive at once.
+
 type FileExtension struct {
 	Ext   string
 	Count int
 }
 
+// Facets count the matches on a reply's page of results by the tree,
+// top-level directory and language of the files they're in. The backend
+// stops at the match limit, so they describe the page, not every match
+// of the search. Each lists at most 20 values, most matches first.
+type Facets struct {
+	Repos     []*Facet `json:"repos"`
+	Dirs      []*Facet `json:"dirs"`
+	Languages []*Facet `json:"languages"`
+}
+
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+	// Adding Filter to the query narrows it to this facet's value,
+	// e.g. "repo:^livegrep$" or "dir:server".
+	Filter string `json:"filter"`
+}
+
 type Stats struct {
 	RE2Time     int64  `json:"re2_time"`
 	GitTime     int64  `json:"git_time"`
@@ -69,16 +125,32 @@ type Result struct {
 	ContextAfter  []string `json:"context_after"`
 	Bounds        [][2]int `json:"bounds"`
 	Line          string   `json:"line"`
+	// Set when the line is a definition found in the backend's tags.
+	Symbol *Symbol `json:"symbol,omitempty"`
+}
+
+// Symbol describes the definition ctags found on a line.
+type Symbol struct {
+	Name string `json:"name"`
+	// What ctags calls the definition, like "function" or "class".
+	Kind string `json:"kind"`
+	// What the symbol is defined in, like "Server", and what kind of
+	// thing that is, like "struct". Empty at the top level.
+	Scope     string `json:"scope,omitempty"`
+	ScopeKind string `json:"scope_kind,omitempty"`
 }
 
 type ResultV2 struct {
 	Tree    string        `json:"tree"`
 	Version string        `json:"version"`
 	Path    string        `json:"path"`
+	Backend string        `json:"backend,omitempty"`
 	Lines   []*ResultLine `json:"lines"`
 	// Will never be sent over wire, used to deduplicate
 	ContextLines map[int]*ResultLine `json:"-"`
 	NumMatches   int                 `json:"num_matches"`
+	// How many of the matched lines are definitions.
+	NumDefinitions int `json:"num_definitions,omitempty"`
 }
 
 type Bounds struct {
@@ -97,12 +169,15 @@ type ResultLine struct {
 	// then this line is a match. Otherwise it's contex
 	Bounds [][2]int `json:"bounds"`
 	Line   string   `json:"line"`
+	// Set when the line is a definition found in the backend's tags.
+	Symbol *Symbol `json:"symbol,omitempty"`
 }
 
 type FileResult struct {
 	Tree    string `json:"tree"`
 	Version string `json:"version"`
 	Path    string `json:"path"`
+	Backend string `json:"backend,omitempty"`
 	Bounds  [2]int `json:"bounds"`
 }
 
@@ -110,9 +185,88 @@ type TreeResult struct {
 	Name     string    `json:"name"`
 	Version  string    `json:"version"`
 	Metadata *Metadata `json:"metadata"`
+	Backend  string    `json:"backend,omitempty"`
 	Bounds   [2]int    `json:"bounds"`
 }
 
+// api/v2/search/replace/:backend
+type ReplyReplace struct {
+	Info    *Stats       `json:"info"`
+	Patches []*RepoPatch `json:"patches"`
+	// Files with matches that couldn't be read, as "tree:path: error".
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// RepoPatch holds the changes a search-and-replace makes to one repo.
+type RepoPatch struct {
+	Tree    string `json:"tree"`
+	Version string `json:"version"`
+	// How many files and lines the replacement changes.
+	NumFiles int `json:"num_files"`
+	NumLines int `json:"num_lines"`
+	// A unified diff of the changes, to apply with `git apply` at the
+	// root of the repo, checked out at Version.
+	Diff string `json:"diff"`
+}
+
+// SearchGeneration is the generation of a backend's index a search ran
+// against.
+type SearchGeneration struct {
+	// The generation's name, or "" for the current index.
+	Name       string    `json:"name"`
+	IndexTime  time.Time `json:"index_time"`
+	ExitReason string    `json:"exit_reason"`
+}
+
+// api/v2/search/diff/:backend
+type ReplySearchDiff struct {
+	From *SearchGeneration `json:"from"`
+	To   *SearchGeneration `json:"to"`
+	// The matches only To has, and those only From has. Matches are
+	// compared by tree, path and the text of their line, so moving a
+	// line within a file doesn't change it.
+	Added   []*Result `json:"added"`
+	Removed []*Result `json:"removed"`
+}
+
+// WatchNotification is what a watch sends when a backend's new index
+// has matches that the watch didn't find in the previous one.
+type WatchNotification struct {
+	Watch     string    `json:"watch"`
+	Backend   string    `json:"backend"`
+	IndexTime time.Time `json:"index_time"`
+	Query     string    `json:"q"`
+	// Whether this run or the last stopped before finding every match,
+	// in which case some of NewMatches may have been missed last time
+	// rather than being new.
+	Incomplete bool      `json:"incomplete,omitempty"`
+	NewMatches []*Result `json:"new_matches"`
+}
+
+// SavedSearch is a search someone saved to rerun later. It's created by
+// POSTing one, without Id, Owner or Created, as JSON to
+// api/v2/saved-searches, and deleted with DELETE to
+// api/v2/saved-searches/:id.
+type SavedSearch struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Who saved the search; only they may see or delete it.
+	Owner string `json:"owner"`
+	// The backend to search, or empty to pick one the way searches
+	// without a backend do.
+	Backend string `json:"backend,omitempty"`
+	// The search's q, regex and fold_case parameters.
+	Query    string    `json:"q"`
+	Regex    bool      `json:"regex"`
+	FoldCase string    `json:"fold_case,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// api/v2/saved-searches
+type ReplySavedSearches struct {
+	SavedSearches []*SavedSearch `json:"saved_searches"`
+}
+
 // TODO:(xvandish) Find a way to colocate this type closer to the fileview.
 // The server has access to fileview structs, but template.go does not. If we
 // decide to JS render instead of server render that fixes our problems...
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func searchResult(paths ...string) *pb.CodeSearchResult {
+	res := &pb.CodeSearchResult{Stats: &pb.SearchStats{}}
+	for _, p := range paths {
+		res.Results = append(res.Results, &pb.SearchResult{
+			Tree:       "repo",
+			Path:       p,
+			LineNumber: 1,
+			NumMatches: 1,
+		})
+	}
+	return res
+}
+
+func resultPaths(res *pb.CodeSearchResult) []string {
+	var paths []string
+	for _, r := range res.Results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func TestCombineExprResults(t *testing.T) {
+	cases := []struct {
+		query string
+		leafs []*pb.CodeSearchResult
+		paths []string
+	}{
+		{
+			"a AND b",
+			[]*pb.CodeSearchResult{searchResult("x", "y"), searchResult("y", "z")},
+			[]string{"y"},
+		},
+		{
+			"a OR b",
+			[]*pb.CodeSearchResult{searchResult("x"), searchResult("y")},
+			[]string{"x", "y"},
+		},
+		{
+			"a NOT b",
+			[]*pb.CodeSearchResult{searchResult("x", "y"), searchResult("y")},
+			[]string{"x"},
+		},
+		{
+			"a AND NOT (b OR c)",
+			[]*pb.CodeSearchResult{searchResult("x", "y", "z"), searchResult("y"), searchResult("z")},
+			[]string{"x"},
+		},
+	}
+
+	for _, tc := range cases {
+		expr, err := ParseQueryExpr(tc.query, true)
+		if err != nil {
+			t.Fatalf("ParseQueryExpr(%q): %v", tc.query, err)
+		}
+		results := make(map[*QueryExpr]*pb.CodeSearchResult)
+		for i, l := range expr.Leaves() {
+			results[l] = tc.leafs[i]
+		}
+		combined := combineExprResults(expr, results)
+		if got := resultPaths(combined); !reflect.DeepEqual(got, tc.paths) {
+			t.Errorf("%q: got paths %v, want %v", tc.query, got, tc.paths)
+		}
+		if combined.Stats.NumMatches != int64(len(tc.paths)) {
+			t.Errorf("%q: got %d matches, want %d", tc.query, combined.Stats.NumMatches, len(tc.paths))
+		}
+	}
+}
+
+func TestCombineExprResultsExitReason(t *testing.T) {
+	withReason := func(reason pb.SearchStats_ExitReason) *pb.CodeSearchResult {
+		res := searchResult("x")
+		res.Stats.ExitReason = reason
+		return res
+	}
+	cases := []struct {
+		leafs []pb.SearchStats_ExitReason
+		want  pb.SearchStats_ExitReason
+	}{
+		{[]pb.SearchStats_ExitReason{pb.SearchStats_NONE, pb.SearchStats_NONE, pb.SearchStats_NONE}, pb.SearchStats_NONE},
+		{[]pb.SearchStats_ExitReason{pb.SearchStats_NONE, pb.SearchStats_TIMEOUT, pb.SearchStats_NONE}, pb.SearchStats_TIMEOUT},
+		{[]pb.SearchStats_ExitReason{pb.SearchStats_TIMEOUT, pb.SearchStats_NONE, pb.SearchStats_MATCH_LIMIT}, pb.SearchStats_MATCH_LIMIT},
+		{[]pb.SearchStats_ExitReason{pb.SearchStats_MATCH_LIMIT, pb.SearchStats_TIMEOUT, pb.SearchStats_NONE}, pb.SearchStats_MATCH_LIMIT},
+	}
+	for _, tc := range cases {
+		expr, err := ParseQueryExpr("a OR b OR c", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make(map[*QueryExpr]*pb.CodeSearchResult)
+		for i, l := range expr.Leaves() {
+			results[l] = withReason(tc.leafs[i])
+		}
+		if got := combineExprResults(expr, results).Stats.ExitReason; got != tc.want {
+			t.Errorf("leaves exiting with %v: got %v, want %v", tc.leafs, got, tc.want)
+		}
+	}
+}
+
+func TestCombineExprResultsMergesLines(t *testing.T) {
+	expr, err := ParseQueryExpr("a OR b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := expr.Leaves()
+	a, b := searchResult("x"), searchResult("x")
+	a.Results[0].Bounds = []*pb.Bounds{{Left: 5, Right: 6}}
+	b.Results[0].Bounds = []*pb.Bounds{{Left: 1, Right: 2}}
+
+	combined := combineExprResults(expr, map[*QueryExpr]*pb.CodeSearchResult{
+		leaves[0]: a,
+		leaves[1]: b,
+	})
+	if len(combined.Results) != 1 {
+		t.Fatalf("expected the line matched by both terms once, got %d results", len(combined.Results))
+	}
+	bounds := combined.Results[0].Bounds
+	if len(bounds) != 2 || bounds[0].Left != 1 || bounds[1].Left != 5 {
+		t.Errorf("expected merged, sorted bounds, got %v", bounds)
+	}
+}
+
+func TestLimitQuery(t *testing.T) {
+	s := &server{config: &config.Config{MaxMatchesLimit: 500, ContextLinesLimit: 5}}
+
+	expr, err := ParseQueryExpr("a OR b max_matches:100000", true)
+	if err != nil {
+		t.Fatalf("ParseQueryExpr: %v", err)
+	}
+	q := pb.Query{MaxMatches: 100000, ContextLines: 20}
+	expr.setContextLines(20)
+	s.limitQuery(&q, expr)
+	if q.MaxMatches != 500 || q.ContextLines != 5 {
+		t.Errorf("limitQuery = max_matches %d, context %d", q.MaxMatches, q.ContextLines)
+	}
+	for _, l := range expr.Leaves() {
+		if l.Query.MaxMatches != 500 || l.Query.ContextLines != 5 {
+			t.Errorf("leaf %q not limited: %+v", l.Query.Line, l.Query)
+		}
+	}
+
+	q = pb.Query{MaxMatches: 50}
+	s.limitQuery(&q, nil)
+	if q.MaxMatches != 50 || q.ContextLines != 0 {
+		t.Errorf("queries under the limits should be left alone, got %+v", q)
+	}
+}
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+func parseEvents(t *testing.T, body string) []sseEvent {
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		lines := strings.SplitN(block, "\n", 2)
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "event: ") || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("bad event %q", block)
+		}
+		events = append(events, sseEvent{strings.TrimPrefix(lines[0], "event: "), strings.TrimPrefix(lines[1], "data: ")})
+	}
+	return events
+}
+
+func TestSearchStream(t *testing.T) {
+	line := func(path string, lno int64) *pb.SearchResult {
+		return &pb.SearchResult{
+			Tree: "repo", Version: "v", Path: path, LineNumber: lno,
+			Line: "foo bar", Bounds: []*pb.Bounds{{Left: 0, Right: 3}}, NumMatches: 1,
+		}
+	}
+	cs := &fakeCodesearch{lines: []*pb.SearchResult{
+		line("a.go", 3), line("a.go", 1), line("b.go", 1), line("c.go", 2),
+	}}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": {Id: "main", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"main"},
+	}
+
+	stream := func(q string) []sseEvent {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v2/search/stream/main?:backend=main&q="+q, nil)
+		s.ServeAPISearchStream(context.Background(), w, r)
+		if w.Code != 200 {
+			t.Fatalf("%s: status %d: %s", q, w.Code, w.Body)
+		}
+		return parseEvents(t, w.Body.String())
+	}
+	files := func(events []sseEvent) map[string][]int {
+		lines := make(map[string][]int)
+		for _, e := range events {
+			if e.event != "result" {
+				continue
+			}
+			var result api.ResultV2
+			if err := json.Unmarshal([]byte(e.data), &result); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := lines[result.Path]; ok {
+				t.Errorf("%s was sent twice", result.Path)
+			}
+			for _, l := range result.Lines {
+				if l.Bounds != nil {
+					lines[result.Path] = append(lines[result.Path], l.LineNumber)
+				}
+			}
+		}
+		return lines
+	}
+
+	events := stream("foo")
+	want := map[string][]int{"a.go": {1, 3}, "b.go": {1}, "c.go": {2}}
+	if got := files(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("matched lines = %v, want %v", got, want)
+	}
+	if last := events[len(events)-1]; last.event != "stats" {
+		t.Errorf("last event = %+v, want stats", last)
+	}
+
+	events = stream("foo+OR+bar")
+	if got := files(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("boolean query: matched lines = %v, want %v", got, want)
+	}
+	if last := events[len(events)-1]; last.event != "stats" {
+		t.Errorf("boolean query: last event = %+v, want stats", last)
+	}
+}
+
+func TestSearchStreamCountsVisibleMatches(t *testing.T) {
+	s, bk := aclServer()
+	s.config = &config.Config{}
+	bk.Codesearch = &fakeCodesearch{lines: []*pb.SearchResult{
+		{Tree: "org/public", Version: "v", Path: "a.go", LineNumber: 1, Line: "foo", NumMatches: 1},
+		{Tree: "org/configured", Version: "v", Path: "b.go", LineNumber: 1, Line: "foo foo", NumMatches: 2},
+	}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v2/search/stream/main?:backend=main&q=foo", nil)
+	s.ServeAPISearchStream(context.Background(), w, r)
+	events := parseEvents(t, w.Body.String())
+	last := events[len(events)-1]
+	if last.event != "stats" {
+		t.Fatalf("last event = %+v, want stats", last)
+	}
+	var stats api.Stats
+	if err := json.Unmarshal([]byte(last.data), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumMatches != 1 {
+		t.Errorf("stats count %d matches, want only the 1 streamed", stats.NumMatches)
+	}
+}
+
+func TestSearchStreamStopsWhenClientLeaves(t *testing.T) {
+	cs := &fakeCodesearch{
+		lines: []*pb.SearchResult{fakeLine("repo", "a.go", 1, "foo")},
+		hang:  make(chan struct{}),
+	}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": {Id: "main", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"main"},
+	}
+
+	reqCtx, leave := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/api/v2/search/stream/main?:backend=main&q=foo", nil).WithContext(reqCtx)
+	go func() {
+		<-cs.hang
+		leave()
+	}()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.ServeAPISearchStream(context.Background(), w, r)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the search went on for %s after the client left", elapsed)
+	}
+	events := parseEvents(t, w.Body.String())
+	if last := events[len(events)-1]; last.event != "error" {
+		t.Errorf("last event = %+v, want an error", last)
+	}
+}
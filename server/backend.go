@@ -2,8 +2,7 @@ package server
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"io"
 	"net/url"
 	"os"
 	"sync"
@@ -16,12 +15,16 @@ import (
 	"google.golang.org/grpc/connectivity"
 
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
 )
 
 type Tree struct {
 	Name    string
 	Version string
 	Url     string
+	// AllowedGroups restricts the tree to these groups, taken from
+	// "acl:<group>" labels in its index metadata.
+	AllowedGroups []string
 }
 
 type I struct {
@@ -29,6 +32,8 @@ type I struct {
 	Trees []Tree
 	sync.Mutex
 	IndexTime time.Time
+	// Whether the backend has a tags file, so can search symbols.
+	HasTags bool
 }
 
 type Availability struct {
@@ -47,6 +52,14 @@ type Backend struct {
 	Up            *Availability
 	BackupBackend *Backend
 	IsBackup      bool
+	// For an older generation of a backend's index, the generation's
+	// name; "" for the current index.
+	Generation  string
+	Generations []*Backend
+	cache       *searchCache
+	// Called, with I locked, when the backend's index changes. It
+	// mustn't block.
+	onNewIndex func(bk *Backend)
 }
 
 // NewBackend can now be recursively called since BackupBackend can be nested...
@@ -77,6 +90,22 @@ func NewBackend(be config.Backend) (*Backend, error) {
 		return nil, err
 	}
 
+	var codesearch pb.CodeSearchClient = pb.NewCodeSearchClient(client)
+	if len(be.Replicas) > 0 {
+		replicas := []*replica{{addr: be.Addr, client: codesearch, conn: client}}
+		for _, addr := range be.Replicas {
+			conn, err := grpc.Dial(addr, opts...)
+			if err != nil {
+				return nil, err
+			}
+			replicas = append(replicas, &replica{addr: addr, client: pb.NewCodeSearchClient(conn), conn: conn})
+		}
+		codesearch, err = newReplicaSet(replicas, be)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var backupBk *Backend
 	if be.BackupBackend != nil && be.BackupBackend.Addr != "" {
 		backupBk, err = NewBackend(*be.BackupBackend)
@@ -87,14 +116,29 @@ func NewBackend(be config.Backend) (*Backend, error) {
 		// start the backup polling!
 		backupBk.Start()
 	}
+	var generations []*Backend
+	for _, g := range be.Generations {
+		gen, err := NewBackend(config.Backend{
+			Id:             be.Id + "@" + g.Name,
+			Addr:           g.Addr,
+			MaxMessageSize: be.MaxMessageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		gen.Generation = g.Name
+		gen.Start()
+		generations = append(generations, gen)
+	}
 	bk := &Backend{
 		Id:            be.Id,
 		Addr:          be.Addr,
 		I:             &I{Name: be.Id},
-		Codesearch:    pb.NewCodeSearchClient(client),
+		Codesearch:    codesearch,
 		GrpcClient:    client,
 		Up:            &Availability{},
 		BackupBackend: backupBk,
+		Generations:   generations,
 	}
 	return bk, nil
 }
@@ -115,6 +159,7 @@ type BackendStatus struct {
 	BuIndexAge   string             `json:"bu_index_age"`
 	BuIndexName  string             `json:"bu_index_name"`
 	BuUp         *Availability      `json:"bu_up"`
+	Replicas     []*ReplicaStatus   `json:"replicas,omitempty"`
 }
 
 func (bk *Backend) getStatus() *BackendStatus {
@@ -131,6 +176,9 @@ func (bk *Backend) getStatus() *BackendStatus {
 		IndexName:  bk.I.Name,
 		Up:         bk.Up,
 	}
+	if rs, ok := bk.Codesearch.(*replicaSet); ok {
+		bkStatus.Replicas = rs.status()
+	}
 	// now get backup info
 	if bk.BackupBackend == nil {
 		return bkStatus
@@ -160,6 +208,7 @@ func (bk *Backend) grpcReadyOrIdle() bool {
 //  1. the indexTime we have is different than what quickInfo returns
 // This occurs on startup and on codesearch backend reloads
 func (bk *Backend) poll() {
+	ctx := log.WithFields(context.Background(), log.Fields{"backend": bk.Id})
 	for {
 		quickInfo, e := bk.Codesearch.QuickInfo(context.Background(), &pb.Empty{}, grpc.WaitForReady(false))
 		bk.Up.Lock()
@@ -167,7 +216,7 @@ func (bk *Backend) poll() {
 		if e == nil {
 			newTime := time.Unix(quickInfo.IndexTime, 0)
 			if !bk.Up.IsUp || bk.I.IndexTime.Before(newTime) {
-				fmt.Printf("quickPoll for be=%s -- fetching getInfo(). was_up=%t new_index_available=%t\n", bk.Id, bk.Up.IsUp, bk.I.IndexTime.Before(newTime))
+				log.Printf(ctx, "quickPoll -- fetching getInfo(). was_up=%t new_index_available=%t", bk.Up.IsUp, bk.I.IndexTime.Before(newTime))
 				bk.getInfo()
 			}
 			bk.Up.IsUp = true
@@ -175,7 +224,7 @@ func (bk *Backend) poll() {
 			bk.Up.DownCode = 0
 		} else {
 			if os.Getenv("LOG_BK_QUICKPOLL_FAIL") == "true" {
-				fmt.Printf("quickPoll for be=%s -- ERROR: %s\n", bk.Id, grpc.Code(e))
+				log.Warnf(ctx, "quickPoll -- ERROR: %s", grpc.Code(e))
 			}
 			if bk.Up.IsUp || bk.Up.DownSince.IsZero() {
 				bk.Up.IsUp = false
@@ -194,7 +243,7 @@ func (bk *Backend) getInfo() {
 	if e == nil {
 		bk.refresh(info)
 	} else {
-		log.Printf("getInfo %s: %v", bk.Id, e)
+		log.Errorf(context.Background(), "getInfo %s: %v", bk.Id, e)
 	}
 }
 
@@ -207,7 +256,16 @@ func (bk *Backend) refresh(info *pb.ServerInfo) {
 	}
 
 	newIndexTime := time.Unix(info.IndexTime, 0)
+	if !newIndexTime.Equal(bk.I.IndexTime) {
+		// Cached results are keyed by index time, so they'd never be
+		// served again; free them now.
+		bk.cache.Purge()
+		if bk.onNewIndex != nil {
+			bk.onNewIndex(bk)
+		}
+	}
 	bk.I.IndexTime = newIndexTime
+	bk.I.HasTags = info.HasTags
 
 	if len(info.Trees) > 0 {
 		bk.I.Trees = nil
@@ -225,7 +283,46 @@ func (bk *Backend) refresh(info *pb.ServerInfo) {
 				pattern = base + "/blob/{version}/{path}#L{lno}"
 			}
 			bk.I.Trees = append(bk.I.Trees,
-				Tree{r.Name, r.Version, pattern})
+				Tree{
+					Name:          r.Name,
+					Version:       r.Version,
+					Url:           pattern,
+					AllowedGroups: aclGroups(r.Metadata.Labels),
+				})
+		}
+	}
+}
+
+// StreamSearch runs q against the backend, calling fn with each partial
+// CodeSearchResult as the backend produces it. The last message carries
+// only the search stats. As with regular searches, we fall back to the
+// backup backend if the primary is unavailable, but only if it did not
+// send us anything first.
+func (bk *Backend) StreamSearch(ctx context.Context, q *pb.Query, fn func(*pb.CodeSearchResult) error) error {
+	received, err := bk.streamSearch(ctx, q, fn)
+	if err != nil && !received && grpc.Code(err) == codes.Unavailable && bk.BackupBackend != nil {
+		log.Warnf(ctx, "StreamSearch: primary backend %s unavailable, trying backup=%s", bk.Id, bk.BackupBackend.Id)
+		_, err = bk.BackupBackend.streamSearch(ctx, q, fn)
+	}
+	return err
+}
+
+func (bk *Backend) streamSearch(ctx context.Context, q *pb.Query, fn func(*pb.CodeSearchResult) error) (received bool, err error) {
+	stream, err := bk.Codesearch.StreamSearch(ctx, q, grpc.FailFast(true))
+	if err != nil {
+		return false, err
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := fn(chunk); err != nil {
+			return received, err
 		}
 	}
 }
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// searchCache is an LRU cache of a backend's search results. Results
+// must be treated as read-only, since they are shared between requests.
+// A nil *searchCache is valid, and caches nothing.
+type searchCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	result  *pb.CodeSearchResult
+	expires time.Time
+}
+
+func newSearchCache(cfg config.SearchCache) *searchCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+	return &searchCache{
+		size:    cfg.Size,
+		ttl:     time.Duration(cfg.TTLSeconds) * time.Second,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey identifies q run against the index built at indexTime.
+func cacheKey(q *pb.Query, indexTime time.Time) string {
+	resumeAfter := ""
+	if c := q.ResumeAfter; c != nil {
+		resumeAfter = fmt.Sprintf("%q|%q|%d", c.Tree, c.Path, c.LineNumber)
+	}
+	return fmt.Sprintf("%d|%q|%q|%q|%q|%t|%q|%q|%q|%d|%t|%t|%d|%s",
+		indexTime.Unix(),
+		q.Line, q.File, q.Repo, q.Tags, q.FoldCase,
+		q.NotFile, q.NotRepo, q.NotTags,
+		q.MaxMatches, q.FilenameOnly, q.TreenameOnly, q.ContextLines,
+		resumeAfter)
+}
+
+func (c *searchCache) Get(key string) (*pb.CodeSearchResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.result, true
+}
+
+func (c *searchCache) Add(key string, result *pb.CodeSearchResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, result: result}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Purge drops every cached result.
+func (c *searchCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// cachedSearch wraps search, which runs a query against bk, so that
+// queries already answered by bk's current index are served from its
+// cache.
+func (s *server) cachedSearch(bk *Backend,
+	search func(context.Context, *pb.Query) (*pb.CodeSearchResult, error)) func(context.Context, *pb.Query) (*pb.CodeSearchResult, error) {
+	if bk.cache == nil {
+		return search
+	}
+
+	return func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+		bk.I.Lock()
+		indexTime := bk.I.IndexTime
+		bk.I.Unlock()
+
+		key := cacheKey(q, indexTime)
+		if result, ok := bk.cache.Get(key); ok {
+			if s.statsd != nil {
+				s.statsd.Increment("api.search.cache.hit")
+			}
+			return result, nil
+		}
+		if s.statsd != nil {
+			s.statsd.Increment("api.search.cache.miss")
+		}
+
+		result, err := search(ctx, q)
+		// Results from a backup, or from an index we haven't polled
+		// yet, would be cached under the wrong index time. Timed out
+		// searches might do better next time.
+		if err == nil && result.IndexTime == indexTime.Unix() &&
+			result.Stats.ExitReason != pb.SearchStats_TIMEOUT {
+			bk.cache.Add(key, result)
+		}
+		return result, err
+	}
+}
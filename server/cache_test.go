@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestSearchCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newSearchCache(config.SearchCache{Size: 2})
+	a, b, d := &pb.CodeSearchResult{}, &pb.CodeSearchResult{}, &pb.CodeSearchResult{}
+
+	c.Add("a", a)
+	c.Add("b", b)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+	c.Add("d", d)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	if got, ok := c.Get("a"); !ok || got != a {
+		t.Error("a should still be cached")
+	}
+	if got, ok := c.Get("d"); !ok || got != d {
+		t.Error("d should be cached")
+	}
+
+	c.Purge()
+	if _, ok := c.Get("a"); ok {
+		t.Error("Purge should drop everything")
+	}
+}
+
+func TestSearchCacheTTL(t *testing.T) {
+	c := newSearchCache(config.SearchCache{Size: 2, TTLSeconds: 1})
+	c.Add("a", &pb.CodeSearchResult{})
+	c.entries["a"].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expired entries should not be served")
+	}
+}
+
+func TestSearchCacheDisabled(t *testing.T) {
+	if c := newSearchCache(config.SearchCache{}); c != nil {
+		t.Fatal("a zero size should disable the cache")
+	}
+	var c *searchCache
+	c.Add("a", &pb.CodeSearchResult{})
+	if _, ok := c.Get("a"); ok {
+		t.Error("a nil cache should cache nothing")
+	}
+}
+
+func TestCachedSearch(t *testing.T) {
+	indexTime := time.Unix(1000, 0)
+	bk := &Backend{
+		Id:    "bk",
+		I:     &I{IndexTime: indexTime},
+		cache: newSearchCache(config.SearchCache{Size: 10}),
+	}
+	s := &server{}
+
+	calls := 0
+	resultIndexTime := indexTime.Unix()
+	search := s.cachedSearch(bk, func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+		calls++
+		return &pb.CodeSearchResult{IndexTime: resultIndexTime, Stats: &pb.SearchStats{}}, nil
+	})
+
+	q := &pb.Query{Line: "hello"}
+	search(context.Background(), q)
+	search(context.Background(), q)
+	if calls != 1 {
+		t.Errorf("backend searched %d times, want 1", calls)
+	}
+
+	search(context.Background(), &pb.Query{Line: "hello", FoldCase: true})
+	if calls != 2 {
+		t.Errorf("a different query should miss the cache")
+	}
+
+	// A new index means the old results no longer apply.
+	bk.refresh(&pb.ServerInfo{IndexTime: 2000})
+	resultIndexTime = 2000
+	search(context.Background(), q)
+	if calls != 3 {
+		t.Errorf("a new index should miss the cache")
+	}
+
+	// Results from some other index (e.g. a backup) are never cached.
+	resultIndexTime = 1
+	q = &pb.Query{Line: "backup"}
+	search(context.Background(), q)
+	search(context.Background(), q)
+	if calls != 5 {
+		t.Errorf("backend searched %d times, want 5", calls)
+	}
+}
@@ -9,6 +9,35 @@ type Backend struct {
 	Addr           string   `json:"addr"`
 	MaxMessageSize int      `json:"maxMessageSize"`
 	BackupBackend  *Backend `json:"backup_addr"`
+
+	// Addresses of identical copies of the index at Addr. When set,
+	// searches are spread across Addr and every replica that is up.
+	Replicas []string `json:"replicas"`
+	// How to pick a replica for each search: "round_robin" (the
+	// default) or "least_loaded", which picks the replica with the
+	// fewest searches in flight.
+	Balancing string `json:"balancing"`
+	// How big a share of searches each address, Addr or one of
+	// Replicas, gets relative to the others, e.g. 2 for a replica on
+	// a machine twice the size. Addresses not listed weigh 1. With
+	// least_loaded balancing, searches in flight are divided by weight.
+	Weights map[string]int `json:"weights"`
+	// If set, a search that hasn't been answered within this percentile
+	// (e.g. 95) of recent search latencies is also sent to a second
+	// replica, and whichever answers first is used.
+	HedgePercentile float64 `json:"hedge_percentile"`
+
+	// Older indexes of the same repos, which queries can search with
+	// at:<name>, or with at:<YYYY-MM-DD> for the newest index, current
+	// or not, built by the end of that day.
+	Generations []Generation `json:"generations"`
+}
+
+type Generation struct {
+	Name string `json:"name"`
+	// The address of a codesearch serving the generation's index, e.g.
+	// one started with -load_index on an older index file.
+	Addr string `json:"addr"`
 }
 
 // For more options - https://pkg.go.dev/gopkg.in/alexcesaro/statsd.v2#pkg-index
@@ -25,6 +54,138 @@ type StatsD struct {
 	TagsFormat string `json:"tags_format"`
 }
 
+type SearchCache struct {
+	// The number of search results kept per backend. The cache is
+	// disabled when this is 0.
+	Size int `json:"size"`
+	// How long, in seconds, a cached result may be served for. When 0,
+	// results are served until the backend's index changes.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+type Ranking struct {
+	// How search results are ordered if the query doesn't say with
+	// sort:. One of "relevance" (the default), "path", "repo" or
+	// "definitions".
+	DefaultSort string `json:"default_sort"`
+	// Added to the relevance of results in repos whose name matches
+	// each regex. Negative boosts push a repo's results down.
+	RepoBoosts map[string]float64 `json:"repo_boosts"`
+}
+
+type SavedSearches struct {
+	// The JSON file saved searches are kept in, which is created when
+	// the first one is saved. Saving searches is disabled when this is
+	// empty.
+	Path string `json:"path"`
+}
+
+type Watch struct {
+	// Identifies the watch in the notifications it sends, and in the
+	// matches kept from its last run.
+	Name string `json:"name"`
+	// The backend to search, or every backend if empty.
+	Backend  string `json:"backend"`
+	Query    string `json:"q"`
+	Regex    bool   `json:"regex"`
+	FoldCase string `json:"fold_case"`
+	// The groups the watch searches as, deciding which repos with ACLs
+	// it sees.
+	Groups []string `json:"groups"`
+	// New matches are POSTed as JSON to this URL, and/or appended as a
+	// line of JSON to this file.
+	WebhookURL string `json:"webhook_url"`
+	File       string `json:"file"`
+}
+
+type Watches struct {
+	// Queries rerun whenever a backend's index changes, reporting the
+	// matches that are new since their last run.
+	Queries []Watch `json:"queries"`
+	// The JSON file the matches each watch last found are kept in. If
+	// empty, they're only kept in memory, so the first run after a
+	// restart reports nothing.
+	StatePath string `json:"state_path"`
+}
+
+type Auth struct {
+	// A JSON file listing the API tokens clients may send, as
+	// "Authorization: Bearer <token>". Each entry has a "name", either
+	// the "token" itself or its "sha256" in hex, the "scopes" it
+	// grants: "search", "fileviewer" or "admin" (everything), and the
+	// "groups" it belongs to.
+	TokensFile string `json:"tokens_file"`
+	// Whether requests without credentials are let through anyway,
+	// e.g. so the web UI keeps working while scripts use tokens.
+	AllowAnonymous bool `json:"allow_anonymous"`
+
+	// If configured, users may authenticate with a JWT from an OIDC
+	// identity provider.
+	OIDC OIDC `json:"oidc"`
+
+	// If set, an authenticating proxy in front of livegrep names the
+	// user in this header, e.g. "X-Forwarded-Email".
+	ProxyHeader string `json:"proxy_header"`
+	// If set, the proxy lists the user's groups in this header,
+	// separated by commas.
+	ProxyGroupsHeader string `json:"proxy_groups_header"`
+	// The addresses, as CIDRs, that ProxyHeader is trusted from.
+	// Required with ProxyHeader.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// The scopes granted to users authenticated with OIDC,
+	// ProxyHeader or Google IAP. Defaults to "search" and "fileviewer".
+	UserScopes []string `json:"user_scopes"`
+	// Users who are granted every scope.
+	Admins []string `json:"admins"`
+}
+
+type OIDC struct {
+	// The issuer's URL, which must match the "iss" claim.
+	Issuer string `json:"issuer"`
+	// Must match (one of) the "aud" claim.
+	Audience string `json:"audience"`
+	// Where the issuer's signing keys are published, as a JWKS file
+	// or URL. Defaults to the jwks_uri in the issuer's discovery
+	// document.
+	JWKSFile string `json:"jwks_file"`
+	JWKSURL  string `json:"jwks_url"`
+	// The claim naming the user. Defaults to "email".
+	UserClaim string `json:"user_claim"`
+	// The claim listing the user's groups. Defaults to "groups".
+	GroupsClaim string `json:"groups_claim"`
+	// The header the JWT is sent in. Defaults to the Authorization
+	// header, as a bearer token.
+	Header string `json:"header"`
+}
+
+type RateLimit struct {
+	// How many requests per second each client may make, on average.
+	// Rate limiting is disabled when this is 0.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// How many requests a client may make in a burst before being
+	// limited. Defaults to RequestsPerSecond, rounded up.
+	Burst int `json:"burst"`
+	// What identifies a client: "ip" (the default), "iap" (the user
+	// Google IAP authenticated), "token" (the API token the auth
+	// middleware verified) or "user" (whoever the auth middleware or
+	// IAP established sent the request). Requests without that
+	// verified identity are limited by IP.
+	Key string `json:"key"`
+	// Only requests whose path starts with one of these prefixes are
+	// limited. Defaults to the routes that search the backends.
+	Paths []string `json:"paths"`
+}
+
+type Log struct {
+	// "text" (the default) or "json", which writes every log line as
+	// a single JSON object.
+	Format string `json:"format"`
+	// The least severe level logged: "debug", "info" (the default),
+	// "warn" or "error".
+	Level string `json:"level"`
+}
+
 type GoogleIAPConfig struct {
 	ProjectNumber string `json:"project_number"`
 
@@ -59,6 +220,15 @@ type Config struct {
 	// the "id" and "addr" fields.
 	Backends []Backend `json:"backends"`
 
+	// The id of the backend searched when a request doesn't name one
+	// and no route matches. Defaults to the first entry in Backends.
+	DefaultBackend string `json:"default_backend"`
+
+	// Routes queries that don't name a backend to one based on their
+	// repo: filter. Routes are tried in order before falling back to the
+	// trees each backend reports that it indexes.
+	BackendRoutes []BackendRoute `json:"backend_routes"`
+
 	// The address to listen on, as HOST:PORT.
 	Listen string `json:"listen"`
 
@@ -77,11 +247,46 @@ type Config struct {
 	// Whether to re-load templates on every request
 	Reload bool `json:"reload"`
 
+	// How the server logs requests and errors.
+	Log Log `json:"log"`
+
 	// If included, search api metrics will be sent to StatsD
 	StatsD StatsD `json:"statsd"`
 
 	DefaultMaxMatches int32 `json:"default_max_matches"`
 
+	// If set, searches asking for more matches, or more lines of
+	// context around each match, are capped to these. Searches that
+	// don't ask for context get the backend's -context_lines.
+	MaxMatchesLimit   int32 `json:"max_matches_limit"`
+	ContextLinesLimit int32 `json:"context_lines_limit"`
+
+	// How many matches /api/v2/search/export/ may page up to while
+	// fetching every result of a search. Defaults to 10000.
+	ExportMaxMatches int32 `json:"export_max_matches"`
+
+	// If configured, requests must carry credentials, such as an API
+	// token, allowing them to access what they ask for.
+	Auth Auth `json:"auth"`
+
+	// If configured, clients making too many requests are turned away
+	// with a 429 until they slow down.
+	RateLimit RateLimit `json:"rate_limit"`
+
+	// If configured, identical searches against the same index are
+	// answered from memory rather than by the backend.
+	SearchCache SearchCache `json:"search_cache"`
+
+	// How search results are ranked.
+	Ranking Ranking `json:"ranking"`
+
+	// Where searches users save to rerun later are kept.
+	SavedSearches SavedSearches `json:"saved_searches"`
+
+	// Searches that notify someone when new matches for them are
+	// indexed.
+	Watches Watches `json:"watches"`
+
 	// Same json config structure that the backend uses when building indexes;
 	// used here for repository browsing.
 	IndexConfig IndexConfig `json:"index_config"`
@@ -101,6 +306,14 @@ type Config struct {
 	FileviewerOnly bool
 }
 
+type BackendRoute struct {
+	// Queries whose repo: regex starts with this prefix, e.g. "infra/",
+	// are sent to Backend.
+	RepoPrefix string `json:"repo_prefix"`
+	// The id of the backend to send them to.
+	Backend string `json:"backend"`
+}
+
 type IndexConfig struct {
 	Name         string       `json:"name"`
 	Repositories []RepoConfig `json:"repositories"`
@@ -112,6 +325,12 @@ type RepoConfig struct {
 	Revisions      []string          `json:"revisions"`
 	Metadata       map[string]string `json:"metadata"`
 	WalkSubmodules bool              `json:"walk_submodules"`
+
+	// If set, only users in one of these groups may see the repo in
+	// search results or the fileviewer. "user:<name>" allows a single
+	// user. Backends can also restrict trees with "acl:<group>" labels
+	// in their index metadata.
+	AllowedGroups []string `json:"allowed_groups"`
 }
 
 type LinkConfig struct {
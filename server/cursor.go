@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// A searchCursor marks where a page of search results ended, so that
+// the next page can start after it. Clients get it as an opaque
+// string, in next_cursor, to pass back as the cursor parameter.
+//
+// Results are ordered by tree, then path, then line number. A search
+// with Query.ResumeAfter set returns the first max_matches results
+// after it in that order, so every result up to the last one it
+// returned is on a page, even when it stops at the match limit.
+type searchCursor struct {
+	Tree string `json:"t"`
+	Path string `json:"p"`
+	Line int64  `json:"l"`
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+func (c *searchCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseCursor parses a cursor from a previous search's next_cursor. It
+// returns nil if s is empty.
+func parseCursor(s string) (*searchCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c searchCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+func (c *searchCursor) proto() *pb.Cursor {
+	return &pb.Cursor{Tree: c.Tree, Path: c.Path, LineNumber: c.Line}
+}
+
+type resultKey struct {
+	tree, path string
+	line       int64
+}
+
+func (k resultKey) less(o resultKey) bool {
+	if k.tree != o.tree {
+		return k.tree < o.tree
+	}
+	if k.path != o.path {
+		return k.path < o.path
+	}
+	return k.line < o.line
+}
+
+// sortSearchResults puts results in cursor order.
+func sortSearchResults(results []*pb.SearchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		return resultKey{results[i].Tree, results[i].Path, results[i].LineNumber}.less(
+			resultKey{results[j].Tree, results[j].Path, results[j].LineNumber})
+	})
+}
+
+// pageResults returns the page of search that follows after, which is
+// nil for the first page, holding at most size results, and a cursor
+// for the next page if there may be one. Backends that honor
+// Query.ResumeAfter will already have dropped the results up to after;
+// we drop them again for those that don't, and for boolean queries,
+// which run without it.
+//
+// If ordered is set, search holds the first results that follow after,
+// as the backend returns them for a query with ResumeAfter. Otherwise its
+// results are the first the backend happened to find, and we can only
+// page through them if it found them all.
+//
+// Pages are made of results, or of file or tree results if that's what
+// the search looks for. Otherwise file and tree results come with the
+// first page only.
+func pageResults(search *pb.CodeSearchResult, after *searchCursor, size int32, ordered bool) (*pb.CodeSearchResult, *searchCursor) {
+	var start resultKey
+	if after != nil {
+		start = resultKey{after.Tree, after.Path, after.Line}
+	}
+	isNext := func(k resultKey) bool { return after == nil || start.less(k) }
+
+	page := *search
+	page.Results = nil
+	page.FileResults = nil
+	page.TreeResults = nil
+
+	var keys []resultKey
+	for _, r := range search.Results {
+		if k := (resultKey{r.Tree, r.Path, r.LineNumber}); isNext(k) {
+			page.Results = append(page.Results, r)
+			keys = append(keys, k)
+		}
+	}
+	filesPaged := len(search.Results) == 0
+	for _, r := range search.FileResults {
+		if k := (resultKey{r.Tree, r.Path, 0}); isNext(k) && (filesPaged || after == nil) {
+			page.FileResults = append(page.FileResults, r)
+			if filesPaged {
+				keys = append(keys, k)
+			}
+		}
+	}
+	treesPaged := filesPaged && len(search.FileResults) == 0
+	for _, r := range search.TreeResults {
+		if k := (resultKey{r.Name, "", 0}); isNext(k) && (treesPaged || after == nil) {
+			page.TreeResults = append(page.TreeResults, r)
+			if treesPaged {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	exitReason := pb.SearchStats_NONE
+	if search.Stats != nil {
+		exitReason = search.Stats.ExitReason
+	}
+	// Whether every result up to the last one in keys is in keys. An
+	// ordered search that timed out may have missed some, and one that
+	// isn't ordered may have missed some wherever it stopped.
+	upToLast := exitReason == pb.SearchStats_NONE ||
+		ordered && exitReason == pb.SearchStats_MATCH_LIMIT
+	// An ordered search that stopped at the limit with fewer than a
+	// page of these results stopped for results of another kind.
+	more := exitReason != pb.SearchStats_NONE && (size <= 0 || int32(len(keys)) >= size)
+
+	if size > 0 && int32(len(keys)) > size {
+		// The backend found more than a page; leave the rest for the
+		// next one.
+		keys = keys[:size]
+		end := keys[size-1]
+		inPage := func(k resultKey) bool { return !end.less(k) }
+		page.Results = filterSearchResults(page.Results, inPage)
+		if filesPaged {
+			page.FileResults = filterFileResults(page.FileResults, inPage)
+		}
+		if treesPaged {
+			page.TreeResults = filterTreeResults(page.TreeResults, inPage)
+		}
+		more = true
+	}
+	if !more || !upToLast || len(keys) == 0 {
+		return &page, nil
+	}
+
+	end := keys[len(keys)-1]
+	return &page, &searchCursor{Tree: end.tree, Path: end.path, Line: end.line}
+}
+
+func filterSearchResults(results []*pb.SearchResult, keep func(resultKey) bool) []*pb.SearchResult {
+	var kept []*pb.SearchResult
+	for _, r := range results {
+		if keep(resultKey{r.Tree, r.Path, r.LineNumber}) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func filterFileResults(results []*pb.FileResult, keep func(resultKey) bool) []*pb.FileResult {
+	var kept []*pb.FileResult
+	for _, r := range results {
+		if keep(resultKey{r.Tree, r.Path, 0}) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func filterTreeResults(results []*pb.TreeResult, keep func(resultKey) bool) []*pb.TreeResult {
+	var kept []*pb.TreeResult
+	for _, r := range results {
+		if keep(resultKey{r.Name, "", 0}) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
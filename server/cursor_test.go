@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func pagedSearch(reason pb.SearchStats_ExitReason, keys ...resultKey) *pb.CodeSearchResult {
+	res := &pb.CodeSearchResult{Stats: &pb.SearchStats{ExitReason: reason}}
+	for _, k := range keys {
+		res.Results = append(res.Results, &pb.SearchResult{Tree: k.tree, Path: k.path, LineNumber: k.line})
+	}
+	return res
+}
+
+func pageKeys(res *pb.CodeSearchResult) []resultKey {
+	var keys []resultKey
+	for _, r := range res.Results {
+		keys = append(keys, resultKey{r.Tree, r.Path, r.LineNumber})
+	}
+	return keys
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := &searchCursor{Tree: "org/repo", Path: "dir/a b.go", Line: 42}
+	got, err := parseCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("got %+v, want %+v", got, c)
+	}
+
+	if got, err := parseCursor(""); got != nil || err != nil {
+		t.Errorf("empty cursor: got %v, %v", got, err)
+	}
+	for _, bad := range []string{"!!!", "bm90IGpzb24"} {
+		if _, err := parseCursor(bad); err == nil {
+			t.Errorf("parseCursor(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPageResults(t *testing.T) {
+	a1 := resultKey{"a", "x.go", 1}
+	a2 := resultKey{"a", "x.go", 2}
+	a3 := resultKey{"a", "y.go", 1}
+	b1 := resultKey{"b", "x.go", 1}
+
+	cases := []struct {
+		name     string
+		search   *pb.CodeSearchResult
+		after    *searchCursor
+		size     int32
+		ordered  bool
+		want     []resultKey
+		wantNext *searchCursor
+	}{
+		{
+			name:   "complete",
+			search: pagedSearch(pb.SearchStats_NONE, b1, a1),
+			size:   5,
+			want:   []resultKey{b1, a1},
+		},
+		{
+			name:     "more to find",
+			search:   pagedSearch(pb.SearchStats_MATCH_LIMIT, b1, a1),
+			size:     2,
+			ordered:  true,
+			want:     []resultKey{b1, a1},
+			wantNext: &searchCursor{Tree: "b", Path: "x.go", Line: 1},
+		},
+		{
+			name:   "more to find in no particular order",
+			search: pagedSearch(pb.SearchStats_MATCH_LIMIT, b1, a1),
+			size:   2,
+			want:   []resultKey{b1, a1},
+		},
+		{
+			name:    "timed out",
+			search:  pagedSearch(pb.SearchStats_TIMEOUT, b1, a1),
+			size:    2,
+			ordered: true,
+			want:    []resultKey{b1, a1},
+		},
+		{
+			name:     "more than a page",
+			search:   pagedSearch(pb.SearchStats_NONE, b1, a3, a1, a2),
+			size:     2,
+			want:     []resultKey{a1, a2},
+			wantNext: &searchCursor{Tree: "a", Path: "x.go", Line: 2},
+		},
+		{
+			name:   "skips results up to the cursor",
+			search: pagedSearch(pb.SearchStats_NONE, a1, a2, a3, b1),
+			after:  &searchCursor{Tree: "a", Path: "x.go", Line: 2},
+			size:   2,
+			want:   []resultKey{a3, b1},
+		},
+		{
+			name:    "limited by results of another kind",
+			search:  pagedSearch(pb.SearchStats_MATCH_LIMIT, a3),
+			after:   &searchCursor{Tree: "a", Path: "x.go", Line: 2},
+			size:    2,
+			ordered: true,
+			want:    []resultKey{a3},
+		},
+	}
+	for _, tc := range cases {
+		page, next := pageResults(tc.search, tc.after, tc.size, tc.ordered)
+		got := pageKeys(page)
+		for _, k := range tc.want {
+			found := false
+			for _, g := range got {
+				found = found || g == k
+			}
+			if !found {
+				t.Errorf("%s: page %v is missing %v", tc.name, got, k)
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: page %v, want %v", tc.name, got, tc.want)
+		}
+		if !reflect.DeepEqual(next, tc.wantNext) {
+			t.Errorf("%s: next cursor %+v, want %+v", tc.name, next, tc.wantNext)
+		}
+	}
+}
+
+func TestPageResultsFileResults(t *testing.T) {
+	search := &pb.CodeSearchResult{
+		Stats: &pb.SearchStats{ExitReason: pb.SearchStats_MATCH_LIMIT},
+		Results: []*pb.SearchResult{
+			{Tree: "a", Path: "x.go", LineNumber: 1},
+		},
+		FileResults: []*pb.FileResult{
+			{Tree: "a", Path: "x.go"},
+		},
+	}
+	page, _ := pageResults(search, nil, 10, true)
+	if len(page.FileResults) != 1 {
+		t.Errorf("first page: got %d file results, want 1", len(page.FileResults))
+	}
+	page, _ = pageResults(search, &searchCursor{Tree: "0"}, 10, true)
+	if len(page.FileResults) != 0 {
+		t.Errorf("later page: got %d file results, want none", len(page.FileResults))
+	}
+
+	files := &pb.CodeSearchResult{
+		Stats: &pb.SearchStats{ExitReason: pb.SearchStats_MATCH_LIMIT},
+		FileResults: []*pb.FileResult{
+			{Tree: "a", Path: "x.go"},
+			{Tree: "a", Path: "y.go"},
+			{Tree: "a", Path: "z.go"},
+		},
+	}
+	page, next := pageResults(files, &searchCursor{Tree: "a", Path: "x.go"}, 1, true)
+	if len(page.FileResults) != 1 || page.FileResults[0].Path != "y.go" {
+		t.Errorf("filename search: got %v, want only y.go", page.FileResults)
+	}
+	if want := (&searchCursor{Tree: "a", Path: "y.go"}); !reflect.DeepEqual(next, want) {
+		t.Errorf("filename search: next cursor %+v, want %+v", next, want)
+	}
+}
+
+func TestPagingLosesNothing(t *testing.T) {
+	newYorkTime = time.UTC
+
+	cs := &fakeCodesearch{}
+	want := map[resultKey]bool{}
+	// Out of order, as the backend's threads would find them.
+	for _, i := range rand.New(rand.NewSource(1)).Perm(23) {
+		path := fmt.Sprintf("f%d.go", i/4)
+		line := int64(i%4 + 1)
+		cs.lines = append(cs.lines, &pb.SearchResult{
+			Tree: "org/repo", Version: "v", Path: path, LineNumber: line,
+			Line: "match", Bounds: []*pb.Bounds{{Left: 0, Right: 5}}, NumMatches: 1,
+		})
+		want[resultKey{"org/repo", path, line}] = true
+	}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": {Id: "main", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"main"},
+	}
+
+	got := map[resultKey]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("too many pages")
+		}
+		params := url.Values{"q": {"match max_matches:5"}, "cursor": {cursor}}
+		r := httptest.NewRequest("GET", "/api/v2/search/?"+params.Encode(), nil)
+		reply, _, _, msg := s.ServerSideAPISearchV2(context.Background(), nil, r)
+		if reply == nil {
+			t.Fatal(msg)
+		}
+		if pages < 4 && reply.Info.ExitReason != "MATCH_LIMIT" {
+			t.Errorf("page %d: exit reason %s, want MATCH_LIMIT", pages, reply.Info.ExitReason)
+		}
+		for _, res := range reply.Results {
+			for _, l := range res.Lines {
+				if l.Bounds == nil {
+					continue
+				}
+				k := resultKey{res.Tree, res.Path, int64(l.LineNumber)}
+				if got[k] {
+					t.Errorf("page %d repeats %v", pages, k)
+				}
+				got[k] = true
+			}
+		}
+		if reply.NextCursor == "" {
+			break
+		}
+		cursor = reply.NextCursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged through %d results, want %d", len(got), len(want))
+	}
+}
+
+func TestOnlyPagedSearchesAreOrdered(t *testing.T) {
+	newYorkTime = time.UTC
+
+	cs := &fakeCodesearch{}
+	for i := 0; i < 10; i++ {
+		cs.lines = append(cs.lines, fakeLine("org/repo", fmt.Sprintf("f%d.go", 9-i), 1, "match"))
+	}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": {Id: "main", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"main"},
+	}
+
+	cases := []struct {
+		params  string
+		ordered bool
+	}{
+		{"q=match+max_matches:5", false},
+		{"q=match+max_matches:5&cursor=", true},
+	}
+	for _, tc := range cases {
+		cs.queries = nil
+		r := httptest.NewRequest("GET", "/api/v2/search/?"+tc.params, nil)
+		reply, _, _, msg := s.ServerSideAPISearchV2(context.Background(), nil, r)
+		if reply == nil {
+			t.Fatal(msg)
+		}
+		if got := cs.queries[0].ResumeAfter != nil; got != tc.ordered {
+			t.Errorf("%s: searched in cursor order = %v, want %v", tc.params, got, tc.ordered)
+		}
+		if got := reply.NextCursor != ""; got != tc.ordered {
+			t.Errorf("%s: next cursor %q, want one only if paged", tc.params, reply.NextCursor)
+		}
+		if got := reply.NextUrl != ""; got == tc.ordered {
+			t.Errorf("%s: next URL %q, want one only if not paged", tc.params, reply.NextUrl)
+		} else if got && !strings.Contains(reply.NextUrl, "cursor=&") && !strings.HasSuffix(reply.NextUrl, "cursor=") {
+			t.Errorf("%s: next URL %q doesn't page the search", tc.params, reply.NextUrl)
+		}
+		if reply.Info.ExitReason != "MATCH_LIMIT" {
+			t.Errorf("%s: exit reason %s, want MATCH_LIMIT", tc.params, reply.Info.ExitReason)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/v2/search/_all?:backend=_all&q=match&cursor=", nil)
+	if _, code, _, _ := s.ServerSideAPISearchV2(context.Background(), nil, r); code != 400 {
+		t.Errorf("paging a search of every backend: status %d, want 400", code)
+	}
+}
+
+func TestPagingPastHiddenResults(t *testing.T) {
+	newYorkTime = time.UTC
+
+	s, bk := aclServer()
+	s.config = &config.Config{}
+	cs := &fakeCodesearch{lines: []*pb.SearchResult{fakeLine("org/configured", "secret.go", 1, "match")}}
+	want := map[string]bool{}
+	for i := 0; i < 11; i++ {
+		path := fmt.Sprintf("f%02d.go", i)
+		cs.lines = append(cs.lines, fakeLine("org/public", path, 1, "match"))
+		want[path] = true
+	}
+	bk.Codesearch = cs
+
+	got := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+		params := url.Values{"q": {"match max_matches:5"}, "cursor": {cursor}}
+		r := httptest.NewRequest("GET", "/api/v2/search/?"+params.Encode(), nil)
+		reply, _, _, msg := s.ServerSideAPISearchV2(context.Background(), nil, r)
+		if reply == nil {
+			t.Fatal(msg)
+		}
+		for _, res := range reply.Results {
+			if res.Tree != "org/public" {
+				t.Errorf("page %d shows %s/%s", pages, res.Tree, res.Path)
+			}
+			got[res.Path] = true
+		}
+		if reply.NextCursor == "" {
+			break
+		}
+		cursor = reply.NextCursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged through %d visible files, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/metrics"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// defaultExportMaxMatches is how many matches an export pages up to if
+// the config doesn't say.
+const defaultExportMaxMatches = 10000
+
+// exportMaxMatches returns how many matches an export may page up to.
+func (s *server) exportMaxMatches() int32 {
+	if s.config.ExportMaxMatches > 0 {
+		return s.config.ExportMaxMatches
+	}
+	return defaultExportMaxMatches
+}
+
+type exportFormat struct {
+	contentType string
+	ext         string
+	write       func(w io.Writer, reply *api.ReplySearch) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"jsonl": {"application/x-ndjson", "jsonl", writeExportJSONL},
+	"csv":   {"text/csv; charset=utf-8", "csv", writeExportCSV},
+	"grep":  {"text/plain; charset=utf-8", "txt", writeExportGrep},
+}
+
+// exportSearch runs q with search, and while the search stops short of
+// finding every match, runs it again asking for three times as many, up
+// to limit matches.
+func exportSearch(q *pb.Query, expr *QueryExpr, limit int32,
+	search func(q *pb.Query, expr *QueryExpr) (*api.ReplySearch, error)) (*api.ReplySearch, error) {
+	if q.MaxMatches <= 0 || q.MaxMatches > limit {
+		q.MaxMatches = limit
+		expr.setMaxMatches(limit)
+	}
+	for {
+		reply, err := search(q, expr)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Info.ExitReason == "NONE" || q.MaxMatches >= limit {
+			return reply, nil
+		}
+		next := q.MaxMatches * 3
+		if next > limit {
+			next = limit
+		}
+		q.MaxMatches = next
+		expr.setMaxMatches(next)
+	}
+}
+
+func writeExportJSONL(w io.Writer, reply *api.ReplySearch) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, r := range reply.Results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range reply.FileResults {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportCSV(w io.Writer, reply *api.ReplySearch) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"tree", "version", "path", "lno", "line"})
+	for _, r := range reply.Results {
+		cw.Write([]string{r.Tree, r.Version, r.Path, strconv.Itoa(r.LineNumber), r.Line})
+	}
+	for _, r := range reply.FileResults {
+		cw.Write([]string{r.Tree, r.Version, r.Path, "", ""})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeExportGrep writes results the way `lg` prints them, prefixing
+// paths with their tree, if any.
+func writeExportGrep(w io.Writer, reply *api.ReplySearch) error {
+	prefix := func(tree string) string {
+		if tree == "" {
+			return ""
+		}
+		return tree + ":"
+	}
+	for _, r := range reply.Results {
+		if _, err := fmt.Fprintf(w, "%s%s:%d:%s\n", prefix(r.Tree), r.Path, r.LineNumber, r.Line); err != nil {
+			return err
+		}
+	}
+	for _, r := range reply.FileResults {
+		if _, err := fmt.Fprintf(w, "%s%s\n", prefix(r.Tree), r.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeAPISearchExport serves every result of a search as a file to
+// download, in the format named by the format parameter: jsonl (the
+// default), csv or grep. Rather than stopping at max_matches, it keeps
+// searching for more until it has them all or reaches the configured
+// export_max_matches, and says which in the X-Livegrep-Exit-Reason
+// header.
+func (s *server) ServeAPISearchExport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "jsonl"
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		writeError(ctx, w, 400, "bad_format",
+			fmt.Sprintf("Unknown format: %s. Use jsonl, csv or grep", formatName))
+		return
+	}
+
+	q, expr, is_regex, err := extractQuery(ctx, r)
+
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	backendName, backend := getBackendFromQuery(s, r, &q, expr)
+	if backend == nil {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Unknown backend: %s", backendName))
+		return
+	}
+	ctx = withSearchFields(ctx, r, backend.Id)
+
+	if expr == nil && q.Line == "" {
+		kind := "string"
+		if is_regex {
+			kind = "regex"
+		}
+		msg := fmt.Sprintf("You must specify a %s to match", kind)
+		writeError(ctx, w, 400, "bad_query", msg)
+		return
+	}
+
+	if q.MaxMatches == 0 {
+		q.MaxMatches = s.config.DefaultMaxMatches
+		expr.setMaxMatches(q.MaxMatches)
+	}
+	s.limitQuery(&q, expr)
+
+	opts, err := extractSearchOptions(r, is_regex)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	reply, err := exportSearch(&q, expr, s.exportMaxMatches(), func(q *pb.Query, expr *QueryExpr) (*api.ReplySearch, error) {
+		return s.doSearch(ctx, backend, q, expr, opts)
+	})
+
+	if err != nil {
+		log.Errorf(ctx, "error in search export err=%s", err)
+		writeQueryError(ctx, w, err)
+		return
+	}
+
+	metrics.ObserveSearch(backend.Id, reply.Info.ExitReason)
+
+	if s.statsd != nil {
+		s.statsd.Increment("api.search.export.invocations")
+		s.statsd.Increment("api.search.export.exit_reason." + reply.Info.ExitReason)
+		s.statsd.Timing("api.search.export.total_time", reply.Info.TotalTime)
+	}
+
+	logSearch(ctx, len(reply.Results)+len(reply.FileResults), reply.Info)
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"livegrep-results.%s\"", format.ext))
+	w.Header().Set("X-Livegrep-Exit-Reason", reply.Info.ExitReason)
+	w.WriteHeader(200)
+	if err := format.write(w, reply); err != nil {
+		log.Warnf(ctx, "writing search export err=%s", err)
+	}
+}
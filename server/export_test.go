@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestExportSearch(t *testing.T) {
+	cases := []struct {
+		name       string
+		maxMatches int32
+		found      int32
+		want       []int32
+	}{
+		{"all found at once", 50, 20, []int32{50}},
+		{"pages until done", 50, 1000, []int32{50, 150, 450, 1350}},
+		{"stops at the limit", 50, 1e6, []int32{50, 150, 450, 1350, 4050, 5000}},
+		{"starts at the limit", 1e6, 20, []int32{5000}},
+	}
+	for _, tc := range cases {
+		var asked []int32
+		q := &pb.Query{Line: "x", MaxMatches: tc.maxMatches}
+		reply, err := exportSearch(q, nil, 5000, func(q *pb.Query, expr *QueryExpr) (*api.ReplySearch, error) {
+			asked = append(asked, q.MaxMatches)
+			reason := "NONE"
+			if tc.found > q.MaxMatches {
+				reason = "MATCH_LIMIT"
+			}
+			return &api.ReplySearch{Info: &api.Stats{ExitReason: reason}}, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(asked, tc.want) {
+			t.Errorf("%s: searched with max_matches %v, want %v", tc.name, asked, tc.want)
+		}
+		wantReason := "NONE"
+		if tc.found > 5000 {
+			wantReason = "MATCH_LIMIT"
+		}
+		if reply.Info.ExitReason != wantReason {
+			t.Errorf("%s: exit reason %s, want %s", tc.name, reply.Info.ExitReason, wantReason)
+		}
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	reply := &api.ReplySearch{
+		Results: []*api.Result{
+			{Tree: "org/repo", Version: "abc", Path: "a.go", LineNumber: 3, Line: `x := "a, b"`},
+			{Path: "b.go", LineNumber: 10, Line: "<x>"},
+		},
+		FileResults: []*api.FileResult{
+			{Tree: "org/repo", Version: "abc", Path: "c.go"},
+		},
+	}
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{"grep", "org/repo:a.go:3:x := \"a, b\"\nb.go:10:<x>\norg/repo:c.go\n"},
+		{"csv", "tree,version,path,lno,line\n" +
+			"org/repo,abc,a.go,3,\"x := \"\"a, b\"\"\"\n" +
+			",,b.go,10,<x>\n" +
+			"org/repo,abc,c.go,,\n"},
+		{"jsonl", `{"tree":"org/repo","version":"abc","path":"a.go","lno":3,"context_before":null,"context_after":null,"bounds":null,"line":"x := \"a, b\""}` + "\n" +
+			`{"tree":"","version":"","path":"b.go","lno":10,"context_before":null,"context_after":null,"bounds":null,"line":"<x>"}` + "\n" +
+			`{"tree":"org/repo","version":"abc","path":"c.go","bounds":[0,0]}` + "\n"},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		if err := exportFormats[tc.format].write(&buf, reply); err != nil {
+			t.Fatalf("%s: %s", tc.format, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.format, got, tc.want)
+		}
+	}
+}
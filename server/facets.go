@@ -0,0 +1,112 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/fileviewer"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// maxFacetValues is how many values of each facet a reply lists.
+const maxFacetValues = 20
+
+// facetTally holds the matches counted per tree, per top-level
+// directory and per language.
+type facetTally struct {
+	repos, dirs, langs map[string]int
+}
+
+func newFacetTally() *facetTally {
+	return &facetTally{
+		repos: make(map[string]int),
+		dirs:  make(map[string]int),
+		langs: make(map[string]int),
+	}
+}
+
+// searchFacets counts the matches in results per tree, per top-level
+// directory and per language, along with the filter that narrows a
+// query to each. regex says whether the query's filters are regexes.
+// results are a page of a search's results; counting more would take
+// searching past the match limit.
+func searchFacets(results []*pb.SearchResult, regex bool) *api.Facets {
+	counts := newFacetTally()
+	for _, r := range results {
+		n := int(r.NumMatches)
+		counts.repos[r.Tree] += n
+		if i := strings.Index(r.Path, "/"); i > 0 {
+			counts.dirs[r.Path[:i]] += n
+		}
+		if lang := fileviewer.LanguageForPath(r.Path); lang != "" {
+			counts.langs[lang] += n
+		}
+	}
+	return counts.facets(regex)
+}
+
+// mergeFacets adds up the facets of a federated search's replies, so
+// that they count the merged page. Each reply lists only its top values,
+// so a value can count for less than it should if some backends left it
+// out.
+func mergeFacets(replies []*api.Facets, regex bool) *api.Facets {
+	counts := newFacetTally()
+	add := func(into map[string]int, facets []*api.Facet) {
+		for _, f := range facets {
+			into[f.Value] += f.Count
+		}
+	}
+	for _, r := range replies {
+		if r == nil {
+			continue
+		}
+		add(counts.repos, r.Repos)
+		add(counts.dirs, r.Dirs)
+		add(counts.langs, r.Languages)
+	}
+	return counts.facets(regex)
+}
+
+func (c *facetTally) facets(regex bool) *api.Facets {
+	return &api.Facets{
+		Repos: facetValues(c.repos, func(tree string) string {
+			if regex {
+				return "repo:^" + regexp.QuoteMeta(tree) + "$"
+			}
+			return "repo:" + tree
+		}),
+		// dir: is never a regex, and always anchored at the root of
+		// the repo, unlike file:.
+		Dirs: facetValues(c.dirs, func(dir string) string {
+			return "dir:" + dir
+		}),
+		Languages: facetValues(c.langs, func(lang string) string {
+			return "lang:" + lang
+		}),
+	}
+}
+
+// facetValues lists the values counted in counts, most matches first,
+// with the filter for each.
+func facetValues(counts map[string]int, filter func(value string) string) []*api.Facet {
+	facets := make([]*api.Facet, 0, len(counts))
+	for v, n := range counts {
+		facets = append(facets, &api.Facet{Value: v, Count: n})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+	if len(facets) > maxFacetValues {
+		facets = facets[:maxFacetValues]
+	}
+	for _, f := range facets {
+		f.Filter = filter(f.Value)
+	}
+	return facets
+}
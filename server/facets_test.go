@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func facetCounts(facets []*api.Facet) map[string]int {
+	counts := make(map[string]int)
+	for _, f := range facets {
+		counts[f.Value] = f.Count
+	}
+	return counts
+}
+
+func TestSearchFacets(t *testing.T) {
+	results := []*pb.SearchResult{
+		{Tree: "livegrep", Path: "server/api.go", NumMatches: 3},
+		{Tree: "livegrep", Path: "server/query.go", NumMatches: 2},
+		{Tree: "livegrep", Path: "src/tools/main.cpp", NumMatches: 1},
+		{Tree: "other", Path: "server/BUILD", NumMatches: 4},
+		{Tree: "other", Path: "README", NumMatches: 1},
+	}
+	facets := searchFacets(results, true)
+
+	if got, want := facetCounts(facets.Repos), map[string]int{"livegrep": 6, "other": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("repos: got %v, want %v", got, want)
+	}
+	if got, want := facetCounts(facets.Dirs), map[string]int{"server": 9, "src": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dirs: got %v, want %v", got, want)
+	}
+	if got, want := facetCounts(facets.Languages), map[string]int{"go": 5, "python": 4, "cpp": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("languages: got %v, want %v", got, want)
+	}
+	if facets.Repos[0].Value != "livegrep" || facets.Dirs[0].Value != "server" || facets.Languages[0].Value != "go" {
+		t.Errorf("facets not ordered by count: %+v %+v %+v", facets.Repos[0], facets.Dirs[0], facets.Languages[0])
+	}
+
+	if got, want := facets.Repos[0].Filter, "repo:^livegrep$"; got != want {
+		t.Errorf("repo filter: got %q, want %q", got, want)
+	}
+	if got, want := facets.Dirs[0].Filter, "dir:server"; got != want {
+		t.Errorf("dir filter: got %q, want %q", got, want)
+	}
+	if got, want := facets.Languages[0].Filter, "lang:go"; got != want {
+		t.Errorf("language filter: got %q, want %q", got, want)
+	}
+}
+
+func TestSearchFacetsLiteral(t *testing.T) {
+	results := []*pb.SearchResult{
+		{Tree: "live.grep", Path: "server/api.go", NumMatches: 3},
+		{Tree: "live.grep", Path: "tools/BUILD", NumMatches: 2},
+		{Tree: "live.grep", Path: "tools/BUILD", NumMatches: 2},
+	}
+	facets := searchFacets(results, false)
+	var filters []string
+	for _, f := range append(append(facets.Repos, facets.Dirs...), facets.Languages...) {
+		filters = append(filters, f.Filter)
+	}
+	want := []string{"repo:live.grep", "dir:tools", "dir:server", "lang:python", "lang:go"}
+	if !reflect.DeepEqual(filters, want) {
+		t.Errorf("got filters %q, want %q", filters, want)
+	}
+}
+
+func TestSearchFacetsLimit(t *testing.T) {
+	var results []*pb.SearchResult
+	for i := 0; i < maxFacetValues+5; i++ {
+		results = append(results, &pb.SearchResult{Tree: string(rune('a' + i)), Path: "x.go", NumMatches: 1})
+	}
+	if got := len(searchFacets(results, true).Repos); got != maxFacetValues {
+		t.Errorf("got %d repo facets, want %d", got, maxFacetValues)
+	}
+}
+
+func TestMergeFacets(t *testing.T) {
+	replies := []*api.Facets{
+		{
+			Repos: []*api.Facet{{Value: "a", Count: 2}},
+			Dirs:  []*api.Facet{{Value: "server", Count: 2}},
+		},
+		nil,
+		{
+			Repos:     []*api.Facet{{Value: "a", Count: 1}, {Value: "b", Count: 4}},
+			Languages: []*api.Facet{{Value: "go", Count: 5}},
+		},
+	}
+	facets := mergeFacets(replies, true)
+	if got, want := facetCounts(facets.Repos), map[string]int{"a": 3, "b": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("repos: got %v, want %v", got, want)
+	}
+	if facets.Repos[0].Value != "b" || facets.Repos[0].Filter != "repo:^b$" {
+		t.Errorf("got first repo %+v, want b", facets.Repos[0])
+	}
+	if got, want := facets.Dirs[0].Filter, "dir:server"; got != want {
+		t.Errorf("dir filter: got %q, want %q", got, want)
+	}
+	if got, want := facetCounts(facets.Languages), map[string]int{"go": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("languages: got %v, want %v", got, want)
+	}
+}
+
+func TestSearchFacetsCountPage(t *testing.T) {
+	newYorkTime = time.UTC
+
+	cs := &fakeCodesearch{}
+	for i := 0; i < 20; i++ {
+		cs.lines = append(cs.lines, &pb.SearchResult{
+			Tree: "repo", Version: "v", Path: fmt.Sprintf("d%d/f%d.go", i%4, i), LineNumber: 1,
+			Line: "foo", Bounds: []*pb.Bounds{{Left: 0, Right: 3}}, NumMatches: 1,
+		})
+	}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": {Id: "main", I: &I{}, Codesearch: cs}},
+		bkOrder: []string{"main"},
+	}
+
+	cursor := ""
+	for page := 0; page < 2; page++ {
+		params := url.Values{"q": {"foo max_matches:5"}, "cursor": {cursor}}
+		r := httptest.NewRequest("GET", "/api/v2/search/?"+params.Encode(), nil)
+		reply, _, _, msg := s.ServerSideAPISearchV2(context.Background(), nil, r)
+		if reply == nil {
+			t.Fatal(msg)
+		}
+		want := map[string]int{}
+		for _, res := range reply.Results {
+			want[res.Path[:strings.Index(res.Path, "/")]] += res.NumMatches
+		}
+		if got := facetCounts(reply.Facets.Dirs); !reflect.DeepEqual(got, want) {
+			t.Errorf("page %d: dirs %v, want the page's %v", page, got, want)
+		}
+		if got := facetCounts(reply.Facets.Repos); got["repo"] != 5 {
+			t.Errorf("page %d: repos %v, want the page's 5 matches", page, got)
+		}
+		cursor = reply.NextCursor
+	}
+}
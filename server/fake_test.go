@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeCodesearch is a backend for tests, searching the lines it holds
+// the way the real one searches an index. A query matches the lines
+// whose text, path and tree match its Line, File and Repo, and not its
+// NotFile or NotRepo; a query with Tags searches tags instead, matching
+// Line against their names. Like the real backend, it returns the first
+// MaxMatches lines in the order it holds them and stops with
+// MATCH_LIMIT, or, for a query with ResumeAfter, the first MaxMatches
+// after the cursor in (tree, path, line) order. StreamSearch sends them
+// one per chunk, then the stats.
+type fakeCodesearch struct {
+	pb.CodeSearchClient
+
+	lines []*pb.SearchResult
+	// The lines tags searches match, with Tag set.
+	tags []*pb.SearchResult
+
+	// The IndexName of its results, and the IndexTime QuickInfo reports.
+	name      string
+	indexTime int64
+	// How long searches take.
+	delay time.Duration
+	// Whether QuickInfo fails.
+	down bool
+	// What every search fails with, if set.
+	err error
+	// What streams fail with once opened, before sending anything, if
+	// set.
+	streamErr error
+	// If set, StreamSearch closes it once every line is sent, and
+	// waits for the search to be cancelled before sending the stats.
+	hang chan struct{}
+
+	// How many searches and streams were started
+	searches int32
+
+	mu                  sync.Mutex
+	queries             []*pb.Query
+	running, mostAtOnce int
+}
+
+func (f *fakeCodesearch) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	atomic.AddInt32(&f.searches, 1)
+	f.mu.Lock()
+	copied := *in
+	f.queries = append(f.queries, &copied)
+	f.running++
+	if f.running > f.mostAtOnce {
+		f.mostAtOnce = f.running
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.running--
+		f.mu.Unlock()
+	}()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return f.search(in)
+}
+
+func (f *fakeCodesearch) QuickInfo(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.QuickServerInfo, error) {
+	if f.down {
+		return nil, errors.New("down")
+	}
+	return &pb.QuickServerInfo{IndexTime: f.indexTime}, nil
+}
+
+func (f *fakeCodesearch) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	return &pb.ServerInfo{Name: f.name, IndexTime: f.indexTime}, nil
+}
+
+func (f *fakeCodesearch) StreamSearch(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (pb.CodeSearch_StreamSearchClient, error) {
+	atomic.AddInt32(&f.searches, 1)
+	if f.err != nil {
+		return nil, f.err
+	}
+	result, err := f.search(in)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeStream{ctx: ctx, f: f, result: result}, nil
+}
+
+// search returns the lines in matches, as the backend would.
+func (f *fakeCodesearch) search(in *pb.Query) (*pb.CodeSearchResult, error) {
+	match, err := f.matcher(in)
+	if err != nil {
+		return nil, err
+	}
+	lines := f.lines
+	if in.Tags != "" {
+		lines = f.tags
+	}
+
+	var found []*pb.SearchResult
+	for _, l := range lines {
+		if match(l) {
+			found = append(found, l)
+		}
+	}
+	if in.ResumeAfter != nil {
+		after := resultKey{in.ResumeAfter.Tree, in.ResumeAfter.Path, in.ResumeAfter.LineNumber}
+		found = filterSearchResults(found, after.less)
+		sortSearchResults(found)
+	}
+
+	result := &pb.CodeSearchResult{
+		IndexName: f.name,
+		Stats:     &pb.SearchStats{ExitReason: pb.SearchStats_NONE},
+	}
+	if in.MaxMatches > 0 && len(found) > int(in.MaxMatches) {
+		found = found[:in.MaxMatches]
+		result.Stats.ExitReason = pb.SearchStats_MATCH_LIMIT
+	}
+	result.Results = found
+	result.Stats.NumMatches = countMatches(result)
+	return result, nil
+}
+
+// matcher returns whether a line matches in.
+func (f *fakeCodesearch) matcher(in *pb.Query) (func(*pb.SearchResult) bool, error) {
+	compile := func(re string, foldCase bool) (*regexp.Regexp, error) {
+		if re == "" {
+			return nil, nil
+		}
+		if foldCase {
+			re = "(?i)" + re
+		}
+		compiled, err := regexp.Compile(re)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
+		}
+		return compiled, nil
+	}
+	var res [5]*regexp.Regexp
+	for i, re := range []string{in.Line, in.File, in.Repo, in.NotFile, in.NotRepo} {
+		var err error
+		if res[i], err = compile(re, i == 0 && in.FoldCase); err != nil {
+			return nil, err
+		}
+	}
+	line, file, repo, notFile, notRepo := res[0], res[1], res[2], res[3], res[4]
+
+	return func(l *pb.SearchResult) bool {
+		text := l.Line
+		if in.Tags != "" {
+			text = strings.SplitN(l.Tag, "\t", 2)[0]
+		}
+		return (line == nil || line.MatchString(text)) &&
+			(file == nil || file.MatchString(l.Path)) &&
+			(repo == nil || repo.MatchString(l.Tree)) &&
+			(notFile == nil || !notFile.MatchString(l.Path)) &&
+			(notRepo == nil || !notRepo.MatchString(l.Tree))
+	}, nil
+}
+
+type fakeStream struct {
+	grpc.ClientStream
+	ctx    context.Context
+	f      *fakeCodesearch
+	result *pb.CodeSearchResult
+	i      int
+}
+
+func (s *fakeStream) Recv() (*pb.CodeSearchResult, error) {
+	if s.f.streamErr != nil {
+		return nil, s.f.streamErr
+	}
+	results := s.result.Results
+	if s.i < len(results) {
+		s.i++
+		return &pb.CodeSearchResult{Results: []*pb.SearchResult{results[s.i-1]}}, nil
+	}
+	if s.i > len(results) {
+		return nil, io.EOF
+	}
+	s.i++
+	if s.f.hang != nil {
+		close(s.f.hang)
+		select {
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return &pb.CodeSearchResult{Stats: s.result.Stats}, nil
+}
+
+// fakeLine returns a line of path in repo matching text.
+func fakeLine(tree, path string, lno int64, text string) *pb.SearchResult {
+	return &pb.SearchResult{
+		Tree: tree, Version: "v", Path: path, LineNumber: lno,
+		Line: text, Bounds: []*pb.Bounds{{Left: 0, Right: int32(len(text))}}, NumMatches: 1,
+	}
+}
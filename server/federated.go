@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/log"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// AllBackends is the backend name that searches every configured
+// backend at once, e.g. /api/v2/search/_all?q=hello
+const AllBackends = "_all"
+
+// federatedBackendTimeout bounds how long a search across all backends
+// waits for any one of them, so a slow or down backend only costs us
+// its own results rather than the whole reply.
+const federatedBackendTimeout = 10 * time.Second
+
+type backendSearch struct {
+	backend *Backend
+	reply   *api.ReplySearchV2
+	err     error
+}
+
+// doFederatedSearchV2 runs the same search against every backend
+// concurrently, and merges the replies into one. It only fails if every
+// backend does; otherwise failures are reported in reply.Backends.
+func (s *server) doFederatedSearchV2(ctx context.Context, q *pb.Query, expr *QueryExpr, opts searchOptions) (*api.ReplySearchV2, error) {
+	if len(s.bkOrder) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+
+	start := time.Now()
+
+	searches := make([]*backendSearch, 0, len(s.bkOrder))
+	var wg sync.WaitGroup
+	for _, id := range s.bkOrder {
+		bs := &backendSearch{backend: s.bk[id]}
+		searches = append(searches, bs)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, federatedBackendTimeout)
+			defer cancel()
+
+			// Each backend gets its own copy of the query.
+			q := *q
+			bs.reply, bs.err = s.doSearchV2(ctx, bs.backend, &q, expr, opts)
+			if bs.err != nil {
+				log.Warnf(ctx, "federated search failed for backend=%q err=%s", bs.backend.Id, bs.err)
+				if s.statsd != nil {
+					s.statsd.Increment("api.search.v2.federated.backend_errors")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	reply, err := mergeBackendReplies(searches, start)
+	if err != nil {
+		return nil, err
+	}
+	rankResultsV2(s.ranker(opts.order), reply.Results, rankPattern(q, expr))
+	var facets []*api.Facets
+	for _, bs := range searches {
+		if bs.err == nil {
+			facets = append(facets, bs.reply.Facets)
+		}
+	}
+	reply.Facets = mergeFacets(facets, opts.regex)
+	return reply, nil
+}
+
+func backendName(bk *Backend) string {
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	if bk.I.Name != "" {
+		return bk.I.Name
+	}
+	return bk.Id
+}
+
+func backendIndexTime(bk *Backend) time.Time {
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	return bk.I.IndexTime
+}
+
+// mergeBackendReplies combines the replies of a federated search, tagging
+// every result with the backend it came from. The reply's index age is that
+// of the oldest index searched.
+func mergeBackendReplies(searches []*backendSearch, start time.Time) (*api.ReplySearchV2, error) {
+	reply := &api.ReplySearchV2{
+		Results:     make([]*api.ResultV2, 0),
+		FileResults: make([]*api.FileResult, 0),
+		TreeResults: make([]*api.TreeResult, 0),
+		Info:        &api.Stats{ExitReason: pb.SearchStats_NONE.String()},
+		Backends:    make([]*api.BackendInfo, 0, len(searches)),
+	}
+
+	var firstErr error
+	var oldestIndex time.Time
+	succeeded := 0
+	for _, bs := range searches {
+		info := &api.BackendInfo{
+			Id:   bs.backend.Id,
+			Name: backendName(bs.backend),
+		}
+		reply.Backends = append(reply.Backends, info)
+
+		if bs.err != nil {
+			if firstErr == nil {
+				firstErr = bs.err
+			}
+			_, code, message := getQueryError(bs.err)
+			info.Error = &api.InnerError{Code: code, Message: message}
+			continue
+		}
+
+		r := bs.reply
+		info.Info = r.Info
+		info.IndexAge = r.IndexAge
+		info.LastIndexed = r.LastIndexed
+		info.BackupIdxUsed = r.BackupIdxUsed
+
+		for _, res := range r.Results {
+			res.Backend = bs.backend.Id
+			reply.Results = append(reply.Results, res)
+		}
+		for _, res := range r.FileResults {
+			res.Backend = bs.backend.Id
+			reply.FileResults = append(reply.FileResults, res)
+		}
+		for _, res := range r.TreeResults {
+			res.Backend = bs.backend.Id
+			reply.TreeResults = append(reply.TreeResults, res)
+		}
+
+		if indexTime := backendIndexTime(bs.backend); succeeded == 0 || indexTime.Before(oldestIndex) {
+			oldestIndex = indexTime
+			reply.IndexAge = r.IndexAge
+			reply.LastIndexed = r.LastIndexed
+		}
+
+		reply.SearchType = r.SearchType
+		reply.CurrMaxMatches = r.CurrMaxMatches
+		reply.BackupIdxUsed = reply.BackupIdxUsed || r.BackupIdxUsed
+		mergeStats(reply.Info, r.Info)
+		succeeded++
+	}
+
+	if succeeded == 0 {
+		return nil, firstErr
+	}
+
+	sortResults(reply.Results)
+	reply.PopExts = popularExtensions(reply.Results)
+	reply.Info.TotalTime = int64(time.Since(start) / time.Millisecond)
+	return reply, nil
+}
+
+// mergeStats adds the stats of one backend's search into into. The
+// backends are searched in parallel, so we report the slowest of each
+// timing rather than their sum.
+func mergeStats(into, stats *api.Stats) {
+	max := func(a, b int64) int64 {
+		if a > b {
+			return a
+		}
+		return b
+	}
+	into.RE2Time = max(into.RE2Time, stats.RE2Time)
+	into.GitTime = max(into.GitTime, stats.GitTime)
+	into.SortTime = max(into.SortTime, stats.SortTime)
+	into.IndexTime = max(into.IndexTime, stats.IndexTime)
+	into.AnalyzeTime = max(into.AnalyzeTime, stats.AnalyzeTime)
+	into.NumMatches += stats.NumMatches
+	if into.ExitReason == pb.SearchStats_NONE.String() {
+		into.ExitReason = stats.ExitReason
+	}
+}
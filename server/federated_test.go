@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func testBackend(id string, indexTime time.Time) *Backend {
+	return &Backend{Id: id, I: &I{Name: id, IndexTime: indexTime}}
+}
+
+func backendReply(lastIndexed, exitReason string, paths ...string) *api.ReplySearchV2 {
+	reply := &api.ReplySearchV2{
+		SearchType:  "normal",
+		LastIndexed: lastIndexed,
+		Info:        &api.Stats{ExitReason: exitReason, NumMatches: len(paths), RE2Time: int64(len(paths))},
+	}
+	for _, p := range paths {
+		reply.Results = append(reply.Results, &api.ResultV2{Tree: "repo", Path: p})
+	}
+	return reply
+}
+
+func TestMergeBackendReplies(t *testing.T) {
+	now := time.Now()
+	searches := []*backendSearch{
+		{
+			backend: testBackend("deps", now),
+			reply:   backendReply("new", "NONE", "b.go", "c.go"),
+		},
+		{
+			backend: testBackend("down", now),
+			err:     errors.New("connection refused"),
+		},
+		{
+			backend: testBackend("infra", now.Add(-time.Hour)),
+			reply:   backendReply("old", "MATCH_LIMIT", "a.go"),
+		},
+	}
+
+	reply, err := mergeBackendReplies(searches, now)
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+
+	var got []string
+	for _, r := range reply.Results {
+		got = append(got, r.Backend+":"+r.Path)
+	}
+	want := []string{"infra:a.go", "deps:b.go", "deps:c.go"}
+	if len(got) != len(want) {
+		t.Fatalf("results = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("results = %v, want %v", got, want)
+		}
+	}
+
+	if reply.Info.NumMatches != 3 || reply.Info.RE2Time != 2 || reply.Info.ExitReason != "MATCH_LIMIT" {
+		t.Errorf("merged stats = %+v", reply.Info)
+	}
+	if reply.LastIndexed != "old" {
+		t.Errorf("LastIndexed = %q, want the oldest index", reply.LastIndexed)
+	}
+	if len(reply.Backends) != 3 {
+		t.Fatalf("got %d backends, want 3", len(reply.Backends))
+	}
+	if reply.Backends[1].Error == nil || reply.Backends[0].Error != nil {
+		t.Errorf("backend errors = %+v, %+v", reply.Backends[0].Error, reply.Backends[1].Error)
+	}
+}
+
+func TestMergeBackendRepliesAllFailed(t *testing.T) {
+	searches := []*backendSearch{
+		{backend: testBackend("a", time.Now()), err: errors.New("a is down")},
+		{backend: testBackend("b", time.Now()), err: errors.New("b is down")},
+	}
+	if _, err := mergeBackendReplies(searches, time.Now()); err == nil {
+		t.Error("expected an error when every backend fails")
+	}
+}
+
+func TestFederatedSearch(t *testing.T) {
+	newYorkTime = time.UTC
+
+	s := &server{
+		config: &config.Config{},
+		bk: map[string]*Backend{
+			"deps":  {Id: "deps", I: &I{}, Codesearch: &fakeCodesearch{lines: []*pb.SearchResult{fakeLine("dep", "a.go", 1, "foo")}}},
+			"infra": {Id: "infra", I: &I{}, Codesearch: &fakeCodesearch{lines: []*pb.SearchResult{fakeLine("infra", "b.go", 1, "foo")}}},
+		},
+		bkOrder: []string{"deps", "infra"},
+	}
+	r := httptest.NewRequest("GET", "/api/v2/search/_all?:backend=_all&q=foo", nil)
+	reply, _, _, msg := s.ServerSideAPISearchV2(context.Background(), nil, r)
+	if reply == nil {
+		t.Fatal(msg)
+	}
+	var got []string
+	for _, r := range reply.Results {
+		got = append(got, r.Backend+":"+r.Path)
+	}
+	sort.Strings(got)
+	if want := []string{"deps:a.go", "infra:b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got results %v, want %v", got, want)
+	}
+}
+
+func TestSearchLeavesQueryAlone(t *testing.T) {
+	newYorkTime = time.UTC
+
+	cs := &fakeCodesearch{lines: []*pb.SearchResult{fakeLine("repo", "a.go", 1, "foo")}}
+	s := &server{config: &config.Config{}}
+	q := &pb.Query{Line: "foo", MaxMatches: 10}
+	bk := &Backend{Id: "main", I: &I{}, Codesearch: cs}
+	if _, err := s.doSearchV2(context.Background(), bk, q, nil, searchOptions{paging: true}); err != nil {
+		t.Fatal(err)
+	}
+	if cs.queries[0].ResumeAfter == nil {
+		t.Error("a paged search wasn't sent a cursor")
+	}
+	if q.ResumeAfter != nil {
+		t.Errorf("doSearchV2 set the caller's cursor to %+v", q.ResumeAfter)
+	}
+}
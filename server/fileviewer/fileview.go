@@ -17,8 +17,12 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/livegrep/livegrep/server/api"
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/metrics"
 )
 
 // Mapping from known file extensions to filetype hinting.
@@ -76,6 +80,96 @@ var extToLangMap map[string]string = map[string]string{
 	".yml":         "yaml",
 }
 
+// languageAliases maps other names for languages, in lower case, to the
+// names extToLangMap and filenameToLangMap use.
+var languageAliases = map[string]string{
+	"c++":         "cpp",
+	"cc":          "cpp",
+	"coffee":      "coffeescript",
+	"golang":      "go",
+	"hs":          "haskell",
+	"js":          "javascript",
+	"md":          "markdown",
+	"objc":        "objectivec",
+	"objective-c": "objectivec",
+	"pl":          "perl",
+	"py":          "python",
+	"rb":          "ruby",
+	"rs":          "rust",
+	"sh":          "bash",
+	"shell":       "bash",
+	"ts":          "typescript",
+	"yml":         "yaml",
+}
+
+// LookupLanguage returns the name the file viewer knows the language
+// called name by, ignoring case and allowing aliases like "golang".
+func LookupLanguage(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if lang, ok := languageAliases[name]; ok {
+		return lang, true
+	}
+	for _, langs := range []map[string]string{extToLangMap, filenameToLangMap} {
+		for _, lang := range langs {
+			if strings.ToLower(lang) == name {
+				return lang, true
+			}
+		}
+	}
+	return "", false
+}
+
+// LanguageForPath returns the language of the file at path, as the file
+// viewer highlights it, or "" if it doesn't know the file's type.
+func LanguageForPath(path string) string {
+	if lang, ok := filenameToLangMap[filepath.Base(path)]; ok {
+		return lang
+	}
+	return extToLangMap[filepath.Ext(path)]
+}
+
+// LanguageFiles returns the extensions and file names of the files
+// LanguageForPath says are in lang, in sorted order.
+func LanguageFiles(lang string) (exts []string, names []string) {
+	for ext, l := range extToLangMap {
+		if l == lang {
+			exts = append(exts, ext)
+		}
+	}
+	for name, l := range filenameToLangMap {
+		if l == lang {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(exts)
+	sort.Strings(names)
+	return exts, names
+}
+
+// LanguageFileRegex returns a regex matching the paths of the files
+// LanguageForPath says are in lang.
+func LanguageFileRegex(lang string) string {
+	exts, names := LanguageFiles(lang)
+	quote := func(ss []string, trim string) string {
+		quoted := make([]string, len(ss))
+		for i, s := range ss {
+			quoted[i] = regexp.QuoteMeta(strings.TrimPrefix(s, trim))
+		}
+		return strings.Join(quoted, "|")
+	}
+	var alts []string
+	if len(exts) > 0 {
+		alts = append(alts, `\.(`+quote(exts, ".")+`)`)
+	}
+	if len(names) > 0 {
+		alts = append(alts, `(^|/)(`+quote(names, "")+`)`)
+	}
+	if len(alts) == 1 {
+		return alts[0] + "$"
+	}
+	return "(" + strings.Join(alts, "|") + ")$"
+}
+
 // Grabbed from the extensions GitHub supports here - https://github.com/github/markup
 var supportedReadmeExtensions = []string{
 	"markdown", "mdown", "mkdn", "md", "textile", "rdoc", "org", "creole", "mediawiki", "wiki",
@@ -147,8 +241,14 @@ type directoryContent struct {
 
 type DirListingSort []directoryListEntry
 
+// logCtx is what the fileviewer logs with, until its functions are passed
+// the request's context.
+var logCtx = context.Background()
+
 func timeTrack(start time.Time, name string) {
-	fmt.Printf("%s took %s\n", name, time.Since(start))
+	log.Logf(logCtx, log.LevelDebug, log.Fields{
+		"latency_ms": time.Since(start).Milliseconds(),
+	}, "%s took %s", name, time.Since(start))
 }
 
 func (s DirListingSort) Len() int {
@@ -167,6 +267,7 @@ func (s DirListingSort) Less(i, j int) bool {
 }
 
 func gitCommitHash(ref string, repoPath string) (string, error) {
+	defer metrics.ObserveGitCommand("rev-parse", time.Now())
 	out, err := exec.Command(
 		"git", "-C", repoPath, "rev-parse", ref,
 	).Output()
@@ -177,8 +278,9 @@ func gitCommitHash(ref string, repoPath string) (string, error) {
 }
 
 func gitObjectType(obj string, repoPath string) (string, error) {
+	defer metrics.ObserveGitCommand("cat-file", time.Now())
 	cmd := exec.Command("git", "-C", repoPath, "cat-file", "-t", obj)
-	fmt.Printf("cmd=%s\n", cmd.String())
+	log.Debugf(logCtx, "cmd=%s", cmd.String())
 	out, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -187,6 +289,7 @@ func gitObjectType(obj string, repoPath string) (string, error) {
 }
 
 func gitCatBlob(obj string, repoPath string) (string, error) {
+	defer metrics.ObserveGitCommand("cat-file", time.Now())
 	out, err := exec.Command("git", "-C", repoPath, "cat-file", "blob", obj).Output()
 	if err != nil {
 		return "", err
@@ -194,8 +297,15 @@ func gitCatBlob(obj string, repoPath string) (string, error) {
 	return string(out), nil
 }
 
+// ReadBlob returns the content of the file at relativePath in repo, as of
+// commit.
+func ReadBlob(relativePath string, repo config.RepoConfig, commit string) (string, error) {
+	return gitCatBlob(commit+":"+path.Clean(relativePath), repo.Path)
+}
+
 // used to get the "real" name of "HEAD"
 func GitRevParseAbbrev(rev string, repoPath string) (string, error) {
+	defer metrics.ObserveGitCommand("rev-parse", time.Now())
 	out, err := exec.Command("git", "-C", repoPath, "rev-parse", "--abbrev-ref", rev).Output()
 	if err != nil {
 		return "", err
@@ -204,6 +314,7 @@ func GitRevParseAbbrev(rev string, repoPath string) (string, error) {
 }
 
 func GitGetLastRevToTouchPath(relativePath, repoPath, repoRev string) (string, error) {
+	defer metrics.ObserveGitCommand("rev-list", time.Now())
 	// clean
 	cleanPath := path.Clean(relativePath)
 	if cleanPath == "." {
@@ -235,6 +346,7 @@ func gitParseTreeEntry(line string) gitTreeEntry {
 }
 
 func gitListDir(obj string, repoPath string) ([]gitTreeEntry, error) {
+	defer metrics.ObserveGitCommand("cat-file", time.Now())
 	out, err := exec.Command("git", "-C", repoPath, "cat-file", "-p", obj).Output()
 	if err != nil {
 		return nil, err
@@ -597,6 +709,7 @@ func (opts CommitOptions) genLogArgs(initialArgs []string) (args []string, err e
 }
 
 func BuildGitLog(logArgs CommitOptions, repoPath string) (*GitLog, error) {
+	defer metrics.ObserveGitCommand("log", time.Now())
 	args, err := logArgs.genLogArgs([]string{"-C", repoPath, "log", logFormatWithoutRefs})
 	if err != nil {
 		return nil, err
@@ -604,12 +717,12 @@ func BuildGitLog(logArgs CommitOptions, repoPath string) (*GitLog, error) {
 
 	start := time.Now()
 	cmd := exec.Command("git", args...)
-	fmt.Printf("Commits cmd=%s\n", cmd.String())
+	log.Debugf(logCtx, "Commits cmd=%s", cmd.String())
 
 	out, err := cmd.Output()
-	fmt.Printf("took %s to get git log\n", time.Since(start))
+	log.Debugf(logCtx, "took %s to get git log", time.Since(start))
 	if err != nil {
-		fmt.Printf("err=%s\n", err.Error())
+		log.Errorf(logCtx, "err=%s", err.Error())
 		return nil, err
 	}
 
@@ -627,15 +740,16 @@ func BuildGitLog(logArgs CommitOptions, repoPath string) (*GitLog, error) {
 
 // We should add a bound for this - make it max at 3 seconds (use project-vi as reference)
 func BuildSimpleGitLogData(relativePath string, firstParent string, repo config.RepoConfig) (*SimpleGitLog, error) {
+	defer metrics.ObserveGitCommand("log", time.Now())
 	cleanPath := path.Clean(relativePath)
 	start := time.Now()
 	cmd := exec.Command("git", "-C", repo.Path, "log", "-n", "1000", "-z", "--no-abbrev", "--pretty="+customGitLogFormat, firstParent, "--", cleanPath)
-	fmt.Printf("BuildSimpleGitLogData cmd=%s", cmd.String())
+	log.Debugf(logCtx, "BuildSimpleGitLogData cmd=%s", cmd.String())
 
 	out, err := cmd.Output()
-	fmt.Printf("took %s to get git log\n", time.Since(start))
+	log.Debugf(logCtx, "took %s to get git log", time.Since(start))
 	if err != nil {
-		fmt.Printf("err=%s\n", err.Error())
+		log.Errorf(logCtx, "err=%s", err.Error())
 		return nil, err
 	}
 
@@ -657,7 +771,7 @@ func BuildSimpleGitLogData(relativePath string, firstParent string, repo config.
 
 	for i, match := range matches {
 		if len(match) != 8 {
-			fmt.Printf("GIT_LOG_ERROR: match len < 8: %+v\n", match)
+			log.Errorf(logCtx, "GIT_LOG_ERROR: match len < 8: %+v", match)
 			continue
 		}
 		simpleGitLog.Commits[i] = &Commit{
@@ -769,6 +883,7 @@ func ScanGitShowEntry(data []byte, atEOF bool) (advance int, token []byte, err e
 
 // Given a specific commitHash, get detailed info (--numstat or --shortstat)
 func GitShowCommit(repo config.RepoConfig, commit string) (*GitShow, error) {
+	defer metrics.ObserveGitCommand("show", time.Now())
 	defer timeTrack(time.Now(), "gitShowCommit")
 
 	// git show 74846d35b24b6efd61bb88a0a750b6bb257e6e78 --patch-with-stat -z > out.txt
@@ -1135,6 +1250,7 @@ func processNextChunk(scanner *bufio.Scanner, commitHashToChunkMap map[string]*B
 }
 
 func GitBlameBlob(relativePath string, repo config.RepoConfig, commit string) (*BlameResult, error) {
+	defer metrics.ObserveGitCommand("blame", time.Now())
 	defer timeTrack(time.Now(), "gitBlameBlob")
 
 	// technically commiId isn't required, but we always blame with a commit
@@ -1144,7 +1260,7 @@ func GitBlameBlob(relativePath string, repo config.RepoConfig, commit string) (*
 	cmd := exec.Command("git", "-C", repo.Path, "blame", cleanPath, commit, "--porcelain")
 
 	stdout, err := cmd.StdoutPipe()
-	fmt.Printf("took %s to do command\n", time.Since(start))
+	log.Debugf(logCtx, "took %s to do command", time.Since(start))
 
 	if err != nil {
 		return nil, err
@@ -1181,8 +1297,8 @@ func GitBlameBlob(relativePath string, repo config.RepoConfig, commit string) (*
 	// sort.Slice(blameChunks, func(i, j int) bool {
 	// 	return blameChunks[i].StartLine < blameChunks[j].StartLine
 	// })
-	fmt.Printf("there are %d commits in map, and len of chunks is %d\n", len(commitHashToChunkMap), len(blameChunks))
-	fmt.Printf("blameRes: %+v\n", blameRes)
+	log.Debugf(logCtx, "there are %d commits in map, and len of chunks is %d", len(commitHashToChunkMap), len(blameChunks))
+	log.Debugf(logCtx, "blameRes: %+v", blameRes)
 	blameRes.LinesToBlameChunk = lnoToChunkMap
 	blameRes.BlameChunks = blameChunks
 
@@ -1214,14 +1330,14 @@ func BuildFileDataForZoektFilePreview(relativePath, repoPath, repoName, commit s
 	objectType, err := gitObjectType(obj, repoPath)
 
 	if err != nil {
-		fmt.Printf("error getting object type: %v\n", err)
+		log.Errorf(logCtx, "error getting object type: %v", err)
 		return nil, err
 	}
 	if objectType == "tree" {
-		fmt.Printf("objectType is tree\n")
+		log.Debugf(logCtx, "objectType is tree")
 		treeEntries, err := gitListDir(obj, repoPath)
 		if err != nil {
-			fmt.Printf("err=%v\n", err)
+			log.Errorf(logCtx, "err=%v", err)
 			return nil, err
 		}
 
@@ -1266,16 +1382,13 @@ func BuildFileDataForZoektFilePreview(relativePath, repoPath, repoName, commit s
 			ReadmeContent: readmeContent,
 		}
 	} else if objectType == "blob" {
-		fmt.Printf("objectType is blob\n")
+		log.Debugf(logCtx, "objectType is blob")
 		content, err := gitCatBlob(obj, repoPath)
 		if err != nil {
 			return nil, err
 		}
 		filename := filepath.Base(cleanPath)
-		language := filenameToLangMap[filename]
-		if language == "" {
-			language = extToLangMap[filepath.Ext(cleanPath)]
-		}
+		language := LanguageForPath(cleanPath)
 		fileContent = &SourceFileContent{
 			Content: content,
 			// LineCount: strings.Count(string(content), "\n"),
@@ -1314,12 +1427,12 @@ func BuildFileData(relativePath string, repo config.RepoConfig, commit string) (
 	// we still want the fileviewer to load, and we want to display a message like
 	// "The file does not exist at the commit"
 	if err != nil {
-		fmt.Printf("error getting object type: %v\n", err)
+		log.Errorf(logCtx, "error getting object type: %v", err)
 		return nil, err
 	}
 
 	if objectType == "tree" {
-		fmt.Printf("objectType is tree\n")
+		log.Debugf(logCtx, "objectType is tree")
 		treeEntries, err := gitListDir(obj, repo.Path)
 		if err != nil {
 			return nil, err
@@ -1354,7 +1467,7 @@ func BuildFileData(relativePath string, repo config.RepoConfig, commit string) (
 
 		var readmeContent *SourceFileContent
 		if readmePath != "" {
-			fmt.Printf("readmePath != empty\n")
+			log.Debugf(logCtx, "readmePath != empty")
 			if content, err := gitCatBlob(readmePath, repo.Path); err == nil {
 				readmeContent = &SourceFileContent{
 					Content:   content,
@@ -1372,16 +1485,13 @@ func BuildFileData(relativePath string, repo config.RepoConfig, commit string) (
 			ReadmeContent: readmeContent,
 		}
 	} else if objectType == "blob" {
-		fmt.Printf("objectType is blob\n")
+		log.Debugf(logCtx, "objectType is blob")
 		content, err := gitCatBlob(obj, repo.Path)
 		if err != nil {
 			return nil, err
 		}
 		filename := filepath.Base(cleanPath)
-		language := filenameToLangMap[filename]
-		if language == "" {
-			language = extToLangMap[filepath.Ext(cleanPath)]
-		}
+		language := LanguageForPath(cleanPath)
 		fileContent = &SourceFileContent{
 			Content: content,
 			// LineCount: strings.Count(string(content), "\n"),
@@ -1617,6 +1727,7 @@ func buildDirectoryTree(out []byte) (*api.TreeNode, error) {
 }
 
 func GetLsTreeOutput(relativePath string, repo, commit string) ([]byte, error) {
+	defer metrics.ObserveGitCommand("ls-tree", time.Now())
 	defer timeTrack(time.Now(), "getLSTree")
 	cmd := exec.Command("git", "-C", repo, "ls-tree",
 		"--long", // show size
@@ -1626,7 +1737,7 @@ func GetLsTreeOutput(relativePath string, repo, commit string) ([]byte, error) {
 		"-t",
 		commit,
 	)
-	fmt.Printf("cmd=%s\n", cmd.String())
+	log.Debugf(logCtx, "cmd=%s", cmd.String())
 
 	out, err := cmd.CombinedOutput()
 
@@ -1668,6 +1779,7 @@ func ReverseSlice(s interface{}) {
 }
 
 func ListAllBranches(repoPath string) ([]GitBranch, error) {
+	defer metrics.ObserveGitCommand("for-each-ref", time.Now())
 	// git for-each-ref --format='%(HEAD) %(refname:short)' refs/heads
 	cmd := exec.Command("git", "-C", repoPath, "for-each-ref", "--format="+refFormat, "--sort="+sortFormat, "refs/heads")
 
@@ -1733,6 +1845,7 @@ func parseGitListTagsOutput(input *bufio.Scanner) []GitTag {
 }
 
 func ListAllTags(repoPath string) ([]GitTag, error) {
+	defer metrics.ObserveGitCommand("for-each-ref", time.Now())
 	// git for-each-ref --format='%(HEAD) %(refname:short)' refs/tags
 	cmd := exec.Command("git", "-C", repoPath, "for-each-ref", "--format="+refFormat, "--sort="+sortFormat, "refs/tags")
 
@@ -1969,14 +2082,14 @@ func parseGitDiffHunkHeader(headerLine []byte) (*GitDiffHunkHeader, error) {
 		return nil, errors.New(fmt.Sprintf("Invalid patch string: %s\n", string(headerLine)))
 	}
 
-	fmt.Printf("h[1]=%s h[2]=%s h[3]=%s h[4]=%s \n", string(h[1]), string(h[2]), string(h[3]), string(h[4]))
+	log.Debugf(logCtx, "h[1]=%s h[2]=%s h[3]=%s h[4]=%s", string(h[1]), string(h[2]), string(h[3]), string(h[4]))
 	// If endLines are missing default to 1, see diffHeaderRe docs
 	oldStartLine := numberFromGroup(h[1], 0)
 	oldLineCount := numberFromGroup(h[2], 1)
 	newStartLine := numberFromGroup(h[3], 0)
 	newLineCount := numberFromGroup(h[4], 1)
 
-	fmt.Printf("oldStartLine=%d oldLineCount=%d newStartLine=%d newLineCount=%d\n", oldStartLine, oldLineCount, newStartLine, newLineCount)
+	log.Debugf(logCtx, "oldStartLine=%d oldLineCount=%d newStartLine=%d newLineCount=%d", oldStartLine, oldLineCount, newStartLine, newLineCount)
 
 	return &GitDiffHunkHeader{
 		OldStartLine: oldStartLine,
@@ -2062,23 +2175,23 @@ type HunkScanner struct {
 }
 
 func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
-	fmt.Printf("in parseGitDiffHunk\n")
+	log.Debugf(logCtx, "in parseGitDiffHunk")
 	var headerLine []byte
 
 	// if we encountered a hunk header the last time we were processing,
 	// use it, then empty it out
 	if hs.nextHunkHeader != nil {
-		fmt.Printf("hs.nextHunkHeader != nil. hs.nextHunkHeader=%s\n", string(hs.nextHunkHeader))
+		log.Debugf(logCtx, "hs.nextHunkHeader != nil. hs.nextHunkHeader=%s", string(hs.nextHunkHeader))
 		headerLine = hs.nextHunkHeader
 		hs.nextHunkHeader = nil
-		fmt.Printf("headerLineInner=%s\n", string(headerLine))
+		log.Debugf(logCtx, "headerLineInner=%s", string(headerLine))
 	} else {
-		fmt.Printf("scanning\n")
+		log.Debugf(logCtx, "scanning")
 		hs.input.Scan()
 		headerLine = hs.input.Bytes()
 	}
 
-	fmt.Printf("headerLine=%s\n", string(headerLine))
+	log.Debugf(logCtx, "headerLine=%s", string(headerLine))
 
 	// if nothing left to process, exit
 	if len(headerLine) == 0 {
@@ -2087,10 +2200,10 @@ func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
 
 	header, err := parseGitDiffHunkHeader(headerLine)
 
-	fmt.Printf("header=%s\n", header.toString())
+	log.Debugf(logCtx, "header=%s", header.toString())
 
 	if err != nil {
-		fmt.Printf("err=%v\n", err)
+		log.Errorf(logCtx, "err=%v", err)
 		return nil
 	}
 
@@ -2104,7 +2217,7 @@ func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
 		NoTrailingNewline:  false,
 	})
 
-	fmt.Printf("gitDiffHunkLine: %s\n", lines[0].Text)
+	log.Debugf(logCtx, "gitDiffHunkLine: %s", lines[0].Text)
 
 	hunk := &GitDiffHunk{
 		Lines:  lines,
@@ -2121,10 +2234,10 @@ func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
 		lineType := getDiffLineType(line)
 		if lineType == UnknownLine {
 			if diffHeaderRe.Match(line) {
-				fmt.Printf("found the next hunk header, storing it. header=%s\n", string(line))
+				log.Debugf(logCtx, "found the next hunk header, storing it. header=%s", string(line))
 				hs.nextHunkHeader = line
 			} else {
-				fmt.Printf("line=%s has invalid prefix:%s\n", string(line), string(line[0]))
+				log.Warnf(logCtx, "line=%s has invalid prefix:%s", string(line), string(line[0]))
 			}
 			break
 		}
@@ -2137,7 +2250,7 @@ func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
 		// noTrailingNewLine flag
 		if lineType == NoTrailingNewlineLine {
 			if len(line) < 12 {
-				fmt.Printf("Expected no-newline-marker to be 12bytes long")
+				log.Warnf(logCtx, "Expected no-newline-marker to be 12bytes long")
 				break
 			}
 			// tell the previous line that there is no trailing newline
@@ -2179,7 +2292,7 @@ func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
 	}
 
 	if len(hunk.Lines) == 1 {
-		fmt.Printf("error. malformed hunk\n")
+		log.Errorf(logCtx, "error. malformed hunk")
 	}
 
 	return hunk
@@ -2197,7 +2310,7 @@ func parseGitDiffHunk(hs *HunkScanner) *GitDiffHunk {
 // this function should work for 1..n diffs, that way we can use it for diffs of a single
 // file or for an entire commit
 func parseGitUnifiedDiff(input *bufio.Scanner) *GitDiff {
-	fmt.Printf("hello from parseGitUnifiedDiff\n")
+	log.Debugf(logCtx, "hello from parseGitUnifiedDiff")
 
 	diff := &GitDiff{}
 
@@ -2205,13 +2318,13 @@ func parseGitUnifiedDiff(input *bufio.Scanner) *GitDiff {
 	// TODO: return the text content of the header
 	header, err := parseGitDiffHeader(input)
 
-	fmt.Printf("header: %v err:%v\n", header, err)
+	log.Debugf(logCtx, "header: %v err:%v", header, err)
 	if err != nil || header == nil {
 		return nil
 	}
 
 	if header.IsBinary {
-		fmt.Printf("binary not handled rn\n")
+		log.Warnf(logCtx, "binary not handled rn")
 		return nil
 	}
 
@@ -2241,7 +2354,7 @@ func parseGitUnifiedDiff(input *bufio.Scanner) *GitDiff {
 
 	// for debugging, loop through every hunk and line and print line numbers
 	for i, hunk := range diff.Hunks {
-		fmt.Printf("hunk=%d has %d lines\n", i, len(hunk.Lines))
+		log.Debugf(logCtx, "hunk=%d has %d lines", i, len(hunk.Lines))
 		// 	for _, line := range hunk.Lines {
 		// fmt.Printf("newLineNumber=%d oldLineNumber=%d originalLineNumber=%d\n", line.NewLineNumber, line.OriginalLineNumber, line.OriginalLineNumber)
 		// }
@@ -2258,6 +2371,7 @@ func parseGitUnifiedDiff(input *bufio.Scanner) *GitDiff {
 // it PROBABLY WONT:
 //  1. Attempt to add context that can be collapsed
 func GetDiffBetweenTwoCommits(relativePath string, repo config.RepoConfig, oldRev string, newRev string, hideWhitespace bool) (*GitDiff, error) {
+	defer metrics.ObserveGitCommand("diff", time.Now())
 
 	// TODO: decide whether its worth it to bounce early if oldRev == newRev or to let diff check
 
@@ -2287,7 +2401,7 @@ func GetDiffBetweenTwoCommits(relativePath string, repo config.RepoConfig, oldRe
 		return nil, err
 	}
 
-	fmt.Printf("diff-command=%s\n", cmd.String())
+	log.Debugf(logCtx, "diff-command=%s", cmd.String())
 
 	err = cmd.Start()
 	if err != nil {
@@ -2570,7 +2684,7 @@ func getModifiedDiffRows(addedOrDeletedLines []GitDiffLine) []IDiffRow {
 		addedLine := addedLines[modifiedRowIdx]
 		deletedLine := deletedLines[modifiedRowIdx]
 
-		fmt.Printf("deletedLineNum=%d newLineNume=%d\n", deletedLine.OriginalLineNumber, addedLine.NewLineNumber)
+		log.Debugf(logCtx, "deletedLineNum=%d newLineNume=%d", deletedLine.OriginalLineNumber, addedLine.NewLineNumber)
 		rows = append(rows, IDiffRowModified{
 			Type: ModifiedLine,
 			BeforeData: IDiffRowData{
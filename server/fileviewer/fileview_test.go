@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -478,3 +479,63 @@ func TestParseGitListTagsOutput(t *testing.T) {
 	}
 
 }
+
+func TestLanguageForPath(t *testing.T) {
+	cases := map[string]string{
+		"server/api.go":      "go",
+		"src/BUILD":          "python",
+		"tools/defs.bzl":     "python",
+		"README":             "",
+		"web/src/index.jsx":  "jsx",
+		"docs/notes.unknown": "",
+	}
+	for path, want := range cases {
+		if got := LanguageForPath(path); got != want {
+			t.Errorf("LanguageForPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	exts, names := LanguageFiles("python")
+	if !reflect.DeepEqual(names, []string{"BUILD", "BUILD.bazel", "WORKSPACE"}) {
+		t.Errorf("python file names: got %q", names)
+	}
+	for _, ext := range exts {
+		if extToLangMap[ext] != "python" {
+			t.Errorf("python extensions: got %q, which isn't python", ext)
+		}
+	}
+}
+
+func TestLookupLanguage(t *testing.T) {
+	cases := map[string]string{
+		"go":       "go",
+		"Golang":   "go",
+		"asciidoc": "AsciiDoc",
+		"C++":      "cpp",
+		"PY":       "python",
+		"cobol":    "",
+	}
+	for name, want := range cases {
+		got, ok := LookupLanguage(name)
+		if got != want || ok != (want != "") {
+			t.Errorf("LookupLanguage(%q) = %q, %v, want %q", name, got, ok, want)
+		}
+	}
+
+	if got, want := LanguageFileRegex("yaml"), `\.(yaml|yml)$`; got != want {
+		t.Errorf("LanguageFileRegex(yaml) = %q, want %q", got, want)
+	}
+	re := regexp.MustCompile(LanguageFileRegex("python"))
+	for path, want := range map[string]bool{
+		"setup.py":      true,
+		"src/BUILD":     true,
+		"WORKSPACE":     true,
+		"src/BUILD.txt": false,
+		"MYBUILD":       false,
+		"main.go":       false,
+	} {
+		if re.MatchString(path) != want {
+			t.Errorf("LanguageFileRegex(python) matching %q: got %v, want %v", path, !want, want)
+		}
+	}
+}
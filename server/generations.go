@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// queryGeneration returns the generation of the index given to at: or
+// index: anywhere in query, or "" for the current one.
+func queryGeneration(query string, globalRegex bool) (string, error) {
+	values, err := queryOpValues(query, globalRegex, "at", "index")
+	if err != nil {
+		return "", err
+	}
+	var at string
+	for _, v := range values {
+		if at != "" && v != at {
+			return "", fmt.Errorf("Cannot search both at:%s and at:%s", at, v)
+		}
+		at = v
+	}
+	return at, nil
+}
+
+// requestGeneration returns the generation r's query asks for, which
+// extractQuery has already checked.
+func requestGeneration(r *http.Request) string {
+	params := r.URL.Query()
+	at, _ := queryGeneration(params.Get("q"), params.Get("regex") != "false")
+	return at
+}
+
+// generation returns the generation of bk's index that at names: either
+// a configured generation's name, or a date, YYYY-MM-DD, picking the
+// newest index, current or not, built by the end of that day in UTC. It
+// returns nil if there's no such generation.
+func (bk *Backend) generation(at string) *Backend {
+	for _, g := range bk.Generations {
+		if g.Generation == at {
+			return g
+		}
+	}
+	day, err := time.Parse("2006-01-02", at)
+	if err != nil {
+		return nil
+	}
+	end := day.AddDate(0, 0, 1)
+
+	var newest *Backend
+	var newestTime time.Time
+	for _, g := range append([]*Backend{bk}, bk.Generations...) {
+		g.I.Lock()
+		indexTime := g.I.IndexTime
+		g.I.Unlock()
+		if !indexTime.IsZero() && indexTime.Before(end) && indexTime.After(newestTime) {
+			newest, newestTime = g, indexTime
+		}
+	}
+	return newest
+}
+
+// searchGeneration describes the index of bk that reply came from.
+func searchGeneration(bk *Backend, reply *api.ReplySearch) *api.SearchGeneration {
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	return &api.SearchGeneration{
+		Name:       bk.Generation,
+		IndexTime:  bk.I.IndexTime,
+		ExitReason: reply.Info.ExitReason,
+	}
+}
+
+// searchDiff runs the search in r against the two generations of its
+// backend named by the from and to parameters, "" being the current
+// index, and compares their matches. Like ServerSideAPISearchV2, it
+// returns an error code and messages if it fails.
+func (s *server) searchDiff(ctx context.Context, r *http.Request) (reply *api.ReplySearchDiff, errCode int, errorMsg string, errorMsgLong string) {
+	q, expr, is_regex, err := extractQuery(ctx, r)
+
+	if err != nil {
+		return nil, 400, "bad_query", err.Error()
+	}
+	if requestGeneration(r) != "" {
+		return nil, 400, "bad_query", "Choose the indexes to compare with from and to, rather than at:"
+	}
+
+	backendName, backend := getBackendFromQuery(s, r, &q, expr)
+	if backend == nil {
+		return nil, 400, "bad_backend", fmt.Sprintf("Unknown backend: %s", backendName)
+	}
+	ctx = withSearchFields(ctx, r, backend.Id)
+
+	if expr == nil && q.Line == "" {
+		kind := "string"
+		if is_regex {
+			kind = "regex"
+		}
+		msg := fmt.Sprintf("You must specify a %s to match", kind)
+		return nil, 400, "bad_query", msg
+	}
+
+	var generations []*Backend
+	for _, param := range []string{"from", "to"} {
+		at := r.URL.Query().Get(param)
+		bk := backend
+		if at != "" {
+			bk = backend.generation(at)
+		}
+		if bk == nil {
+			return nil, 400, "bad_generation", fmt.Sprintf("Unknown generation of %s: %s", backend.Id, at)
+		}
+		generations = append(generations, bk)
+	}
+
+	if q.MaxMatches == 0 {
+		q.MaxMatches = s.config.DefaultMaxMatches
+		expr.setMaxMatches(q.MaxMatches)
+	}
+	s.limitQuery(&q, expr)
+
+	// exportSearch raises the query's max_matches as it pages, so each
+	// search starts over from the same one.
+	maxMatches := q.MaxMatches
+	var replies []*api.ReplySearch
+	for _, bk := range generations {
+		q.MaxMatches = maxMatches
+		expr.setMaxMatches(maxMatches)
+		reply, err := exportSearch(&q, expr, s.exportMaxMatches(), func(q *pb.Query, expr *QueryExpr) (*api.ReplySearch, error) {
+			return s.doSearch(ctx, bk, q, expr, searchOptions{regex: is_regex})
+		})
+		if err != nil {
+			code, errcode, msg := getQueryError(err)
+			return nil, code, errcode, fmt.Sprintf("Searching %s: %s", bk.Id, msg)
+		}
+		replies = append(replies, reply)
+	}
+
+	from, to := allResults(replies[0]), allResults(replies[1])
+	reply = &api.ReplySearchDiff{
+		From:    searchGeneration(generations[0], replies[0]),
+		To:      searchGeneration(generations[1], replies[1]),
+		Added:   newMatches(resultMatches(from), to),
+		Removed: newMatches(resultMatches(to), from),
+	}
+	if reply.Added == nil {
+		reply.Added = []*api.Result{}
+	}
+	if reply.Removed == nil {
+		reply.Removed = []*api.Result{}
+	}
+	return reply, 0, "", ""
+}
+
+// ServeAPISearchDiff compares the matches for a search in two
+// generations of a backend's index.
+func (s *server) ServeAPISearchDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	reply, errCode, errorMsg, errorMsgLong := s.searchDiff(ctx, r)
+	if reply == nil {
+		writeError(ctx, w, errCode, errorMsg, errorMsgLong)
+		return
+	}
+	replyJSON(ctx, w, 200, reply)
+}
+
+// generationOption is a generation as the search diff page offers it.
+type generationOption struct {
+	Name  string
+	Label string
+}
+
+// ServeSearchDiff renders a page comparing the matches for a search in
+// two generations of a backend's index.
+func (s *server) ServeSearchDiff(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	backendName := params.Get(":backend")
+	if backendName == "" && len(s.bkOrder) > 0 {
+		backendName = s.bkOrder[0]
+	}
+	var options []generationOption
+	if bk := s.bk[backendName]; bk != nil {
+		for _, g := range append([]*Backend{bk}, bk.Generations...) {
+			g.I.Lock()
+			indexTime := g.I.IndexTime
+			g.I.Unlock()
+			name := g.Generation
+			if name == "" {
+				name = "current"
+			}
+			options = append(options, generationOption{
+				Name:  g.Generation,
+				Label: fmt.Sprintf("%s (%s)", name, indexTime.UTC().Format("2006-01-02 15:04")),
+			})
+		}
+	}
+
+	var reply *api.ReplySearchDiff
+	var errorMsg string
+	if params.Get("q") != "" {
+		reply, _, _, errorMsg = s.searchDiff(ctx, r)
+	}
+
+	s.renderPage(ctx, w, r, "search_diff.html", &page{
+		Title:         "compare indexes",
+		IncludeHeader: true,
+		Data: struct {
+			Backend     string
+			Generations []generationOption
+			Query       string
+			From, To    string
+			Reply       *api.ReplySearchDiff
+			Error       string
+		}{backendName, options, params.Get("q"), params.Get("from"), params.Get("to"), reply, errorMsg},
+	})
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestQueryGeneration(t *testing.T) {
+	cases := []struct {
+		q    string
+		want string
+		err  bool
+	}{
+		{"hello", "", false},
+		{"hello at:last-week", "last-week", false},
+		{"index:2024-05-07 hello", "2024-05-07", false},
+		{"a at:x AND (b OR c at:x)", "x", false},
+		{"a at:x index:y", "", true},
+		{"a at:x AND b at:y", "", true},
+	}
+	for _, tc := range cases {
+		got, err := queryGeneration(tc.q, true)
+		if (err != nil) != tc.err {
+			t.Errorf("queryGeneration(%q): err=%v, want error: %t", tc.q, err, tc.err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("queryGeneration(%q) = %q, want %q", tc.q, got, tc.want)
+		}
+	}
+	if _, err := ParseQuery("hello at:last-week", true); err != nil {
+		t.Errorf("ParseQuery with at: failed: %s", err)
+	}
+}
+
+func TestBackendGeneration(t *testing.T) {
+	day := func(d int, hour int) time.Time {
+		return time.Date(2024, 5, d, hour, 0, 0, 0, time.UTC)
+	}
+	older := &Backend{Id: "main@older", Generation: "older", I: &I{IndexTime: day(1, 12)}}
+	old := &Backend{Id: "main@old", Generation: "old", I: &I{IndexTime: day(7, 23)}}
+	bk := &Backend{Id: "main", I: &I{IndexTime: day(14, 0)}, Generations: []*Backend{older, old}}
+
+	cases := []struct {
+		at   string
+		want *Backend
+	}{
+		{"old", old},
+		{"2024-05-01", older},
+		{"2024-05-06", older},
+		{"2024-05-07", old},
+		{"2024-05-14", bk},
+		{"2024-04-30", nil},
+		{"yesterday", nil},
+	}
+	for _, tc := range cases {
+		if got := bk.generation(tc.at); got != tc.want {
+			t.Errorf("generation(%q) = %v, want %v", tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestSearchDiff(t *testing.T) {
+	line := func(path, text string, lno int64) *pb.SearchResult {
+		return &pb.SearchResult{Tree: "repo", Version: "v", Path: path, Line: text, LineNumber: lno}
+	}
+	old := &Backend{Id: "main@old", Generation: "old", I: &I{}, Codesearch: &fakeCodesearch{
+		lines: []*pb.SearchResult{line("a.go", "oldFunc()", 1), line("b.go", "oldFunc()", 1)},
+	}}
+	bk := &Backend{Id: "main", I: &I{}, Generations: []*Backend{old}, Codesearch: &fakeCodesearch{
+		lines: []*pb.SearchResult{line("a.go", "oldFunc()", 3), line("c.go", "oldFunc()", 1)},
+	}}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": bk},
+		bkOrder: []string{"main"},
+	}
+
+	r := httptest.NewRequest("GET", "/api/v2/search/diff/main?q=oldFunc&from=old&:backend=main", nil)
+	reply, _, _, msg := s.searchDiff(context.Background(), r)
+	if reply == nil {
+		t.Fatal(msg)
+	}
+	if reply.From.Name != "old" || reply.To.Name != "" {
+		t.Errorf("compared %q with %q", reply.From.Name, reply.To.Name)
+	}
+	if len(reply.Added) != 1 || reply.Added[0].Path != "c.go" {
+		t.Errorf("added %+v", reply.Added)
+	}
+	if len(reply.Removed) != 1 || reply.Removed[0].Path != "b.go" {
+		t.Errorf("removed %+v", reply.Removed)
+	}
+
+	for _, bad := range []string{
+		"q=oldFunc&from=older&:backend=main",
+		"q=oldFunc+at:old&:backend=main",
+		"q=&from=old&:backend=main",
+		"q=oldFunc(&from=old&:backend=main",
+	} {
+		r := httptest.NewRequest("GET", "/api/v2/search/diff/main?"+bad, nil)
+		if reply, code, _, _ := s.searchDiff(context.Background(), r); reply != nil || code != 400 {
+			t.Errorf("searchDiff(%s) = %v, %d; want a 400", bad, reply, code)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/api/v2/search/main?q=oldFunc+at:old&:backend=main", nil)
+	if name, got := getBackendFromQuery(s, r, &pb.Query{}, nil); got != old {
+		t.Errorf("getBackendFromQuery with at:old = %s, %v", name, got)
+	}
+}
@@ -0,0 +1,64 @@
+package identity
+
+import (
+	"golang.org/x/net/context"
+)
+
+type key int
+
+const identityKey key = 0
+
+// Scopes grant access to parts of the server.
+const (
+	ScopeSearch     = "search"
+	ScopeFileviewer = "fileviewer"
+	// ScopeAdmin grants access to everything, including every repo.
+	ScopeAdmin = "admin"
+)
+
+// Identity is who sent a request, as established by the auth middleware.
+type Identity struct {
+	// The user or API token's name.
+	Name string
+	// How the identity was established, e.g. "token", "oidc", "proxy"
+	// or "iap".
+	Method string
+	// What the identity may access, when established by the auth
+	// middleware.
+	Scopes []string
+	// The groups the user belongs to, which repo ACLs refer to.
+	Groups []string
+}
+
+// HasScope reports whether id may access what scope guards.
+func (id *Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// InGroup reports whether id belongs to group. As a special case,
+// "user:<name>" names a group holding only the user of that name.
+func (id *Identity) InGroup(group string) bool {
+	if group == "user:"+id.Name {
+		return true
+	}
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey).(*Identity)
+	return id, ok
+}
@@ -2,20 +2,232 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/livegrep/livegrep/server/reqid"
 	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
 )
 
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Fields are structured key/value pairs attached to a log line. Common
+// keys are "handler", "backend", "query", "latency_ms", "exit_reason"
+// and "remote_addr".
+type Fields map[string]interface{}
+
+type fieldsKey struct{}
+
+// WithFields returns a context whose log lines carry fields, in addition
+// to any fields already attached to ctx.
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := make(Fields)
+	for k, v := range fieldsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+func fieldsFromContext(ctx context.Context) Fields {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+var (
+	mu       sync.Mutex
+	out      io.Writer = os.Stdout
+	asJSON   bool
+	minLevel = LevelInfo
+)
+
+// SetFormat switches between "text" (the default) and "json" output,
+// where every line is a single JSON object.
+func SetFormat(format string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	switch format {
+	case "", "text":
+		asJSON = false
+	case "json":
+		asJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// SetLevel drops lines logged below level.
+func SetLevel(level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	minLevel = level
+}
+
+// SetOutput redirects logging, which goes to stdout by default.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Printf logs at info level.
 func Printf(c context.Context, msg string, args ...interface{}) {
+	Logf(c, LevelInfo, nil, msg, args...)
+}
+
+func Debugf(c context.Context, msg string, args ...interface{}) {
+	Logf(c, LevelDebug, nil, msg, args...)
+}
+
+func Infof(c context.Context, msg string, args ...interface{}) {
+	Logf(c, LevelInfo, nil, msg, args...)
+}
+
+func Warnf(c context.Context, msg string, args ...interface{}) {
+	Logf(c, LevelWarn, nil, msg, args...)
+}
+
+func Errorf(c context.Context, msg string, args ...interface{}) {
+	Logf(c, LevelError, nil, msg, args...)
+}
+
+// Logf logs msg at level, with fields added to those attached to c.
+func Logf(c context.Context, level Level, fields Fields, msg string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if level < minLevel {
+		return
+	}
+
+	now := time.Now().UTC()
+	reqID, hasReqID := RequestID(c)
+	all := fieldsFromContext(c)
+	if len(fields) > 0 {
+		merged := make(Fields, len(all)+len(fields))
+		for k, v := range all {
+			merged[k] = v
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+		all = merged
+	}
+
 	var line bytes.Buffer
-	line.WriteString(time.Now().UTC().Format("[2006-01-02T15:04:05.999] "))
+	if asJSON {
+		writeJSON(&line, now, level, reqID, hasReqID, all, fmt.Sprintf(msg, args...))
+	} else {
+		line.WriteString(now.Format("[2006-01-02T15:04:05.999] "))
+		if level != LevelInfo {
+			fmt.Fprintf(&line, "%s: ", strings.ToUpper(level.String()))
+		}
+		if hasReqID {
+			fmt.Fprintf(&line, "[%s] ", reqID)
+		}
+		fmt.Fprintf(&line, msg, args...)
+		for _, k := range sortedKeys(all) {
+			fmt.Fprintf(&line, " %s=%s", k, textValue(all[k]))
+		}
+	}
+	line.WriteByte('\n')
+	out.Write(line.Bytes())
+}
+
+// RequestID returns the request id attached to c, if any.
+func RequestID(c context.Context) (reqid.RequestID, bool) {
+	if c == nil {
+		return "", false
+	}
+	return reqid.FromContext(c)
+}
+
+func writeJSON(line *bytes.Buffer, now time.Time, level Level, reqID reqid.RequestID, hasReqID bool, fields Fields, msg string) {
+	obj := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		obj[k] = v
+	}
+	obj["time"] = now.Format(time.RFC3339Nano)
+	obj["level"] = level.String()
+	obj["msg"] = msg
+	if hasReqID {
+		obj["reqid"] = string(reqID)
+	}
+	enc := json.NewEncoder(line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		fmt.Fprintf(line, `{"time":%q,"level":"error","msg":"log: encoding fields: %s"}`,
+			now.Format(time.RFC3339Nano), err)
+	}
+	// Encode terminates the line itself
+	if b := line.Bytes(); len(b) > 0 && b[len(b)-1] == '\n' {
+		line.Truncate(line.Len() - 1)
+	}
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-	if reqID, ok := reqid.FromContext(c); ok {
-		fmt.Fprintf(&line, "[%s] ", reqID)
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
 	}
-	fmt.Fprintf(&line, msg, args...)
-	fmt.Println(line.String())
+	return s
 }
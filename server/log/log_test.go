@@ -0,0 +1,88 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/reqid"
+)
+
+func capture(t *testing.T, format string, level Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := SetFormat(format); err != nil {
+		t.Fatalf("SetFormat: %v", err)
+	}
+	SetLevel(level)
+	SetOutput(&buf)
+	t.Cleanup(func() {
+		SetFormat("text")
+		SetLevel(LevelInfo)
+		SetOutput(os.Stdout)
+	})
+	return &buf
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := capture(t, "json", LevelInfo)
+
+	ctx := reqid.NewContext(context.Background(), "abc")
+	ctx = WithFields(ctx, Fields{"handler": "ServeAPISearch", "backend": "a"})
+	Logf(ctx, LevelWarn, Fields{"backend": "b", "latency_ms": 12}, "searched %d repos", 3)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("not a JSON line: %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":      "warn",
+		"reqid":      "abc",
+		"msg":        "searched 3 repos",
+		"handler":    "ServeAPISearch",
+		"backend":    "b",
+		"latency_ms": float64(12),
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %v", k, line[k], v)
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Error("missing time")
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	buf := capture(t, "text", LevelInfo)
+
+	ctx := WithFields(context.Background(), Fields{"query": "hello world", "backend": "a"})
+	Printf(ctx, "responding success")
+	got := buf.String()
+	if !strings.HasSuffix(got, `] responding success backend=a query="hello world"`+"\n") {
+		t.Errorf("unexpected line %q", got)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	buf := capture(t, "text", LevelWarn)
+
+	Printf(context.Background(), "dropped")
+	Debugf(context.Background(), "dropped")
+	Errorf(context.Background(), "kept")
+	if got := buf.String(); strings.Contains(got, "dropped") || !strings.Contains(got, "ERROR: kept") {
+		t.Errorf("unexpected output %q", got)
+	}
+}
+
+func TestSetFormatErrors(t *testing.T) {
+	if err := SetFormat("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backendUpDesc = prometheus.NewDesc("livegrep_backend_up",
+		"Whether the backend answered its last poll.",
+		[]string{"backend", "backup"}, nil)
+	backendIndexAgeDesc = prometheus.NewDesc("livegrep_backend_index_age_seconds",
+		"Time since the backend's index was built.",
+		[]string{"backend", "backup"}, nil)
+)
+
+// backendCollector reports the state of the server's backends, and their
+// backups, as of the last time each was polled.
+type backendCollector struct {
+	s *server
+}
+
+func (c *backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendUpDesc
+	ch <- backendIndexAgeDesc
+}
+
+func (c *backendCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, id := range c.s.bkOrder {
+		bk := c.s.bk[id]
+		collectBackend(ch, bk, bk.Id, "false")
+		if bk.BackupBackend != nil {
+			collectBackend(ch, bk.BackupBackend, bk.Id, "true")
+		}
+	}
+}
+
+func collectBackend(ch chan<- prometheus.Metric, bk *Backend, id, backup string) {
+	bk.Up.Lock()
+	up := 0.0
+	if bk.Up.IsUp {
+		up = 1
+	}
+	bk.Up.Unlock()
+	ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, up, id, backup)
+
+	bk.I.Lock()
+	indexTime := bk.I.IndexTime
+	bk.I.Unlock()
+	if !indexTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(backendIndexAgeDesc, prometheus.GaugeValue,
+			time.Since(indexTime).Seconds(), id, backup)
+	}
+}
@@ -0,0 +1,73 @@
+// Package metrics holds the Prometheus metrics exported by the web
+// server on /metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "livegrep"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent serving HTTP requests, by handler.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+
+	searchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "searches_total",
+		Help:      "Searches answered, by backend and the reason the search stopped.",
+	}, []string{"backend", "exit_reason"})
+
+	gitCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fileviewer_git_duration_seconds",
+		Help:      "Time spent running git subprocesses for the fileviewer, by git command.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, searchesTotal, gitCommandDuration)
+}
+
+// InstrumentHandler counts and times the requests served by h under the
+// given handler name.
+func InstrumentHandler(name string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerCounter(requestsTotal.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(requestDuration.MustCurryWith(labels), h))
+}
+
+// ObserveSearch records a search answered by backend.
+func ObserveSearch(backend, exitReason string) {
+	searchesTotal.WithLabelValues(backend, exitReason).Inc()
+}
+
+// ObserveGitCommand records how long a git command started at start
+// took. It's meant to be deferred:
+//
+//	defer metrics.ObserveGitCommand("blame", time.Now())
+func ObserveGitCommand(command string, start time.Time) {
+	gitCommandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics in the default registry, along with any
+// from extra.
+func Handler(extra ...prometheus.Gatherer) http.Handler {
+	gatherers := append(prometheus.Gatherers{prometheus.DefaultGatherer}, extra...)
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
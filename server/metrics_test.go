@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandlerName(t *testing.T) {
+	s := &server{}
+	if got := handlerName(s.ServeAPISearch); got != "ServeAPISearch" {
+		t.Errorf("handlerName = %q, want ServeAPISearch", got)
+	}
+}
+
+func TestBackendCollector(t *testing.T) {
+	up := &Backend{Id: "up", I: &I{IndexTime: time.Now().Add(-time.Hour)}, Up: &Availability{IsUp: true}}
+	down := &Backend{Id: "down", I: &I{}, Up: &Availability{}}
+	s := &server{
+		bk:      map[string]*Backend{"up": up, "down": down},
+		bkOrder: []string{"up", "down"},
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&backendCollector{s})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			values[family.GetName()+"/"+m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+
+	if values["livegrep_backend_up/up"] != 1 || values["livegrep_backend_up/down"] != 0 {
+		t.Errorf("backend_up = %v", values)
+	}
+	if age := values["livegrep_backend_index_age_seconds/up"]; age < 3600 || age > 3700 {
+		t.Errorf("index age = %v, want about an hour", age)
+	}
+	if _, ok := values["livegrep_backend_index_age_seconds/down"]; ok {
+		t.Error("a backend that was never polled has no index age")
+	}
+}
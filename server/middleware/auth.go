@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// scopePaths maps path prefixes to the scope needed to request them.
+// Paths not listed here, e.g. static assets and /healthz, need none.
+var scopePaths = []struct {
+	prefix string
+	scope  string
+}{
+	{"/debug/", identity.ScopeAdmin},
+	{"/metrics", identity.ScopeAdmin},
+
+	{"/api/v1/search/", identity.ScopeSearch},
+	{"/api/v1/bkstatus/", identity.ScopeSearch},
+	{"/api/v2/search/", identity.ScopeSearch},
+	{"/api/v2/getRenderedSearchResults/", identity.ScopeSearch},
+	{"/api/v2/getRenderedReferences/", identity.ScopeSearch},
+	{"/api/v2/saved-searches", identity.ScopeSearch},
+	{"/search", identity.ScopeSearch},
+	{"/saved-searches", identity.ScopeSearch},
+
+	{"/view/", identity.ScopeFileviewer},
+	{"/delve/", identity.ScopeFileviewer},
+	{"/diff/", identity.ScopeFileviewer},
+	{"/raw-blob/", identity.ScopeFileviewer},
+	{"/experimental/", identity.ScopeFileviewer},
+	{"/simple-git-log/", identity.ScopeFileviewer},
+	{"/git-show/", identity.ScopeFileviewer},
+	{"/api/v2/json/", identity.ScopeFileviewer},
+	{"/api/v2/getRenderedFileTree/", identity.ScopeFileviewer},
+	{"/api/v2/getSyntaxHighlightedFileForZoekt/", identity.ScopeFileviewer},
+	{"/api/v2/getDirectoryTreeForZoekt/", identity.ScopeFileviewer},
+	{"/api/v2/getGitLogForZoekt/", identity.ScopeFileviewer},
+	{"/api/v2/getAllBranchesForZoekt/", identity.ScopeFileviewer},
+	{"/api/v2/getAllTagsForZoekt/", identity.ScopeFileviewer},
+}
+
+// requiredScope returns the scope needed to request path, if any.
+func requiredScope(path string) (string, bool) {
+	for _, p := range scopePaths {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.scope, true
+		}
+	}
+	return "", false
+}
+
+// An Authenticator establishes who sent a request.
+type Authenticator interface {
+	// Authenticate returns a nil Identity if r carries no credentials
+	// the Authenticator recognizes, and an error if it carries
+	// credentials that aren't valid.
+	Authenticate(r *http.Request) (*identity.Identity, error)
+}
+
+type authHandler struct {
+	inner          http.Handler
+	authenticators []Authenticator
+	allowAnonymous bool
+	// The scopes of a user IAP authenticated
+	userScopes func(user string) []string
+}
+
+func ShouldEnableAuth(cfg config.Auth) bool {
+	return cfg.TokensFile != "" || cfg.OIDC.Issuer != "" || cfg.ProxyHeader != ""
+}
+
+// authenticate asks each authenticator in turn who sent r. If none can
+// tell, but one rejected r's credentials, it returns that error.
+func (h *authHandler) authenticate(r *http.Request) (*identity.Identity, error) {
+	var firstErr error
+	for _, a := range h.authenticators {
+		id, err := a.Authenticate(r)
+		if id != nil {
+			return id, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Load balancer health checks carry no credentials.
+	if r.URL.Path == "/healthz" {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := log.WithFields(context.Background(), log.Fields{"remote_addr": r.RemoteAddr})
+	// IAP, in front of us, may have established who sent r already.
+	// Credentials r carries then mustn't replace who it says.
+	id, ok := identity.FromContext(r.Context())
+	if ok {
+		if len(id.Scopes) == 0 {
+			scoped := *id
+			scoped.Scopes = h.userScopes(id.Name)
+			id = &scoped
+		}
+	} else {
+		var err error
+		if id, err = h.authenticate(r); err != nil {
+			log.Warnf(ctx, "Unauthorized: %v", err)
+			writeAuthError(w, http.StatusUnauthorized, "unauthorized", "Invalid credentials")
+			return
+		}
+	}
+
+	scope, guarded := requiredScope(r.URL.Path)
+	if id == nil {
+		if !h.allowAnonymous && guarded {
+			writeAuthError(w, http.StatusUnauthorized, "unauthorized", "Credentials required")
+			return
+		}
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	if guarded && !id.HasScope(scope) {
+		log.Warnf(ctx, "Forbidden: %s %q lacks scope %s for %s", id.Method, id.Name, scope, r.URL.Path)
+		writeAuthError(w, http.StatusForbidden, "forbidden",
+			fmt.Sprintf("Your credentials don't grant the %q scope", scope))
+		return
+	}
+	h.inner.ServeHTTP(w, r.WithContext(identity.NewContext(r.Context(), id)))
+}
+
+func writeAuthError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&api.ReplyError{Err: api.InnerError{Code: code, Message: message}})
+}
+
+// userScopes returns what a user authenticated with OIDC, a proxy
+// header or IAP may access.
+func userScopes(cfg config.Auth) func(user string) []string {
+	scopes := cfg.UserScopes
+	if len(scopes) == 0 {
+		scopes = []string{identity.ScopeSearch, identity.ScopeFileviewer}
+	}
+	admins := make(map[string]bool)
+	for _, admin := range cfg.Admins {
+		admins[admin] = true
+	}
+	return func(user string) []string {
+		if admins[user] {
+			return []string{identity.ScopeAdmin}
+		}
+		return scopes
+	}
+}
+
+// WrapWithAuth requires requests to h to carry credentials, as
+// configured by cfg, that grant access to the path they request. The
+// Identity they establish is added to the request's context. Requests
+// IAP has already authenticated keep its Identity, with the scopes cfg
+// gives users.
+func WrapWithAuth(h http.Handler, cfg config.Auth) (http.Handler, error) {
+	var authenticators []Authenticator
+	if cfg.TokensFile != "" {
+		tokens, err := LoadTokens(cfg.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+	if cfg.OIDC.Issuer != "" {
+		oidc, err := newOIDCAuthenticator(cfg.OIDC, userScopes(cfg))
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, oidc)
+	}
+	if cfg.ProxyHeader != "" {
+		proxy, err := newProxyAuthenticator(cfg.ProxyHeader, cfg.ProxyGroupsHeader, cfg.TrustedProxies, userScopes(cfg))
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, proxy)
+	}
+	return &authHandler{
+		inner:          h,
+		authenticators: authenticators,
+		allowAnonymous: cfg.AllowAnonymous,
+		userScopes:     userScopes(cfg),
+	}, nil
+}
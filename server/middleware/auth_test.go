@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+)
+
+func writeTokens(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "livegrep-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "tokens.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuth(t *testing.T) {
+	sum := sha256.Sum256([]byte("hashed-secret"))
+	path := writeTokens(t, `[
+		{"name": "ci", "token": "search-secret", "scopes": ["search"]},
+		{"name": "ops", "sha256": "`+hex.EncodeToString(sum[:])+`", "scopes": ["admin"]}
+	]`)
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := WrapWithAuth(inner, config.Auth{TokensFile: path})
+	if err != nil {
+		t.Fatalf("WrapWithAuth: %v", err)
+	}
+
+	cases := []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/api/v1/search/?q=a", "search-secret", 200},
+		{"/api/v1/search/?q=a", "hashed-secret", 200},
+		{"/api/v1/search/?q=a", "wrong", 401},
+		{"/api/v1/search/?q=a", "", 401},
+		{"/delve/org/repo/blob/HEAD/README", "search-secret", 403},
+		{"/delve/org/repo/blob/HEAD/README", "hashed-secret", 200},
+		{"/debug/stats", "search-secret", 403},
+		{"/healthz", "", 200},
+		{"/assets/css/codesearch.css", "", 200},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("GET %s with token %q: %d, want %d", tc.path, tc.token, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAuthAllowAnonymous(t *testing.T) {
+	path := writeTokens(t, `[{"name": "ci", "token": "secret", "scopes": ["search"]}]`)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := WrapWithAuth(inner, config.Auth{TokensFile: path, AllowAnonymous: true})
+	if err != nil {
+		t.Fatalf("WrapWithAuth: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/delve/org/repo/blob/HEAD/README", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Errorf("anonymous request: %d, want 200", w.Code)
+	}
+
+	r.Header.Set("Authorization", "Bearer bogus")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 401 {
+		t.Errorf("bad token: %d, want 401", w.Code)
+	}
+}
+
+func TestAuthKeepsIAPIdentity(t *testing.T) {
+	path := writeTokens(t, `[{"name": "ci", "token": "secret", "scopes": ["search"]}]`)
+	var got *identity.Identity
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = identity.FromContext(r.Context())
+	})
+	h, err := WrapWithAuth(inner, config.Auth{TokensFile: path})
+	if err != nil {
+		t.Fatalf("WrapWithAuth: %v", err)
+	}
+
+	iap := &identity.Identity{Name: "user@example.com", Method: "iap"}
+	for _, token := range []string{"", "secret", "bogus"} {
+		got = nil
+		r := httptest.NewRequest("GET", "/delve/org/repo/blob/HEAD/README", nil)
+		r = r.WithContext(identity.NewContext(r.Context(), iap))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("IAP user with token %q: %d, want 200", token, w.Code)
+		}
+		if got == nil || got.Name != iap.Name || got.Method != "iap" {
+			t.Errorf("IAP user with token %q: reached the handler as %+v", token, got)
+		}
+	}
+}
+
+func TestLoadTokensErrors(t *testing.T) {
+	for _, contents := range []string{
+		`{"name": "not a list"}`,
+		`[{"token": "no name"}]`,
+		`[{"name": "neither"}]`,
+		`[{"name": "both", "token": "a", "sha256": "b"}]`,
+		`[{"name": "short", "sha256": "abcd"}]`,
+		`[{"name": "scope", "token": "a", "scopes": ["everything"]}]`,
+	} {
+		if _, err := LoadTokens(writeTokens(t, contents)); err == nil {
+			t.Errorf("expected an error loading %s", contents)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"google.golang.org/api/idtoken"
 
 	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
 	"github.com/livegrep/livegrep/server/log"
 )
 
@@ -23,12 +24,12 @@ func ShouldEnableGoogleIAP(cfg config.GoogleIAPConfig) bool {
 	}
 
 	if cfg.BackendServiceID == "" && cfg.ProjectID == "" {
-		log.Printf(ctx, "GoogleIAPConfig: ProjectNumber provided but no BackendServiceID or ProjectID found. Not enabling.")
+		log.Warnf(ctx, "GoogleIAPConfig: ProjectNumber provided but no BackendServiceID or ProjectID found. Not enabling.")
 		return false
 	}
 
 	if cfg.BackendServiceID != "" && cfg.ProjectID != "" {
-		log.Printf(ctx, "GoogleIAPConfig: BackendServiceID and ProjectID are mutually exclusive. Not enabling.")
+		log.Warnf(ctx, "GoogleIAPConfig: BackendServiceID and ProjectID are mutually exclusive. Not enabling.")
 		return false
 	}
 
@@ -52,14 +53,18 @@ func (h *iapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		aud = fmt.Sprintf("/projects/%s/apps/%s", h.cfg.ProjectNumber, h.cfg.ProjectID)
 	}
 
-	_, err := idtoken.Validate(ctx, iapJWT, aud)
+	payload, err := idtoken.Validate(ctx, iapJWT, aud)
 
 	if err != nil {
-		log.Printf(ctx, "Unauthorized: idtoken.Validate: %v", err)
+		ctx = log.WithFields(ctx, log.Fields{"remote_addr": r.RemoteAddr})
+		log.Warnf(ctx, "Unauthorized: idtoken.Validate: %v", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	if email, _ := payload.Claims["email"].(string); email != "" {
+		r = r.WithContext(identity.NewContext(r.Context(), &identity.Identity{Name: email, Method: "iap"}))
+	}
 	h.inner.ServeHTTP(w, r)
 }
 
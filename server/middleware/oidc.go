@@ -0,0 +1,377 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+)
+
+// clockSkew is how far off we allow the issuer's clock to be when
+// checking a JWT's exp and nbf claims.
+const clockSkew = time.Minute
+
+// jwksRefreshInterval is how often we'll refetch the issuer's keys on
+// seeing a JWT signed with a key we don't know, e.g. after rotation.
+const jwksRefreshInterval = time.Minute
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys in a JWKS document, by key id.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns nil for key types we don't support.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// keySet holds an issuer's signing keys, refetching them from url when
+// asked for a key it doesn't have.
+type keySet struct {
+	url string
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastFetched time.Time
+}
+
+func (ks *keySet) fetch() error {
+	resp, err := jwksClient.Get(ks.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("fetching %s: status %d", ks.url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("reading %s: %s", ks.url, err)
+	}
+	ks.keys = keys
+	return nil
+}
+
+func (ks *keySet) get(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	if ks.url == "" || time.Since(ks.lastFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	ks.lastFetched = time.Now()
+	if err := ks.fetch(); err != nil {
+		return nil, err
+	}
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// discoverJWKSURL reads the jwks_uri from issuer's OpenID discovery
+// document.
+func discoverJWKSURL(issuer string) (string, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("fetching %s: status %d", url, resp.StatusCode)
+	}
+	var doc struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("reading %s: %s", url, err)
+	}
+	if doc.JWKSURI == "" {
+		return "", fmt.Errorf("%s has no jwks_uri", url)
+	}
+	return doc.JWKSURI, nil
+}
+
+type oidcAuthenticator struct {
+	cfg    config.OIDC
+	keys   *keySet
+	scopes func(user string) []string
+	now    func() time.Time
+}
+
+func newOIDCAuthenticator(cfg config.OIDC, scopes func(string) []string) (*oidcAuthenticator, error) {
+	if cfg.Audience == "" {
+		return nil, errors.New("oidc: audience is required")
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "email"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	keys := &keySet{url: cfg.JWKSURL}
+	switch {
+	case cfg.JWKSFile != "":
+		data, err := ioutil.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		if keys.keys, err = parseJWKS(data); err != nil {
+			return nil, fmt.Errorf("reading %s: %s", cfg.JWKSFile, err)
+		}
+		keys.url = ""
+	default:
+		if keys.url == "" {
+			var err error
+			if keys.url, err = discoverJWKSURL(cfg.Issuer); err != nil {
+				return nil, err
+			}
+		}
+		keys.lastFetched = time.Now()
+		if err := keys.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &oidcAuthenticator{cfg: cfg, keys: keys, scopes: scopes, now: time.Now}, nil
+}
+
+func (a *oidcAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	var token string
+	if a.cfg.Header != "" {
+		token = r.Header.Get(a.cfg.Header)
+	} else {
+		token = bearerToken(r)
+	}
+	// Leave bearer tokens that aren't JWTs to other authenticators.
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %s", err)
+	}
+	user, _ := claims[a.cfg.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("oidc: token has no %q claim", a.cfg.UserClaim)
+	}
+	var groups []string
+	if list, ok := claims[a.cfg.GroupsClaim].([]interface{}); ok {
+		for _, g := range list {
+			if g, ok := g.(string); ok {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return &identity.Identity{Name: user, Method: "oidc", Scopes: a.scopes(user), Groups: groups}, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// verify checks token's signature and standard claims, and returns its
+// claims.
+func (a *oidcAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("bad header: %s", err)
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	key, err := a.keys.get(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad signature: %s", err)
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(key, header.Alg, hash, h.Sum(nil), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("bad claims: %s", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != a.cfg.Issuer {
+		return nil, fmt.Errorf("issuer %q, want %q", iss, a.cfg.Issuer)
+	}
+	if !hasAudience(claims["aud"], a.cfg.Audience) {
+		return nil, fmt.Errorf("token is not for audience %q", a.cfg.Audience)
+	}
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest, sig []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key does not match alg %q", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether the "aud" claim, a string or a list of
+// them, includes audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
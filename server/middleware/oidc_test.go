@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+func jwksFor(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	return data
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var issuer string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer + "/keys"})
+		case "/keys":
+			w.Write(jwksFor(rsaKey, ecKey))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+	issuer = idp.URL
+
+	cfg := config.Auth{
+		OIDC:   config.OIDC{Issuer: issuer, Audience: "livegrep"},
+		Admins: []string{"root@example.com"},
+	}
+	a, err := newOIDCAuthenticator(cfg.OIDC, userScopes(cfg))
+	if err != nil {
+		t.Fatalf("newOIDCAuthenticator: %v", err)
+	}
+
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   issuer,
+			"aud":   []string{"other", "livegrep"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"email": "user@example.com",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+	authenticate := func(token string) (*identity.Identity, error) {
+		r := httptest.NewRequest("GET", "/api/v1/search/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(r)
+	}
+
+	for _, tc := range []struct {
+		key  crypto.Signer
+		alg  string
+		kid  string
+		user string
+	}{
+		{rsaKey, "RS256", "rsa", "user@example.com"},
+		{ecKey, "ES256", "ec", "user@example.com"},
+	} {
+		id, err := authenticate(signJWT(t, tc.key, tc.alg, tc.kid, claims(nil)))
+		if err != nil || id == nil || id.Name != tc.user || id.Method != "oidc" {
+			t.Errorf("%s: Authenticate = %+v, %v", tc.alg, id, err)
+		}
+	}
+
+	id, err := authenticate(signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"email": "root@example.com"})))
+	if err != nil || !id.HasScope(identity.ScopeAdmin) {
+		t.Errorf("admins should get the admin scope: %+v, %v", id, err)
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	bad := map[string]string{
+		"expired":        signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"not yet valid":  signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"wrong audience": signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"})),
+		"wrong issuer":   signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"no user":        signJWT(t, rsaKey, "RS256", "rsa", claims(map[string]interface{}{"email": ""})),
+		"wrong key":      signJWT(t, otherKey, "RS256", "rsa", claims(nil)),
+		"unknown key":    signJWT(t, rsaKey, "RS256", "nope", claims(nil)),
+		"alg mismatch":   signJWT(t, rsaKey, "ES256", "rsa", claims(nil)),
+		"alg none":       signJWT(t, rsaKey, "none", "rsa", claims(nil)),
+	}
+	for name, token := range bad {
+		if id, err := authenticate(token); err == nil {
+			t.Errorf("%s: expected an error, got %+v", name, id)
+		}
+	}
+
+	if id, err := authenticate("not-a-jwt"); id != nil || err != nil {
+		t.Errorf("other bearer tokens should be left alone: %+v, %v", id, err)
+	}
+}
+
+func TestProxyAuthenticator(t *testing.T) {
+	a, err := newProxyAuthenticator("X-Forwarded-Email", "", []string{"10.0.0.0/8"}, userScopes(config.Auth{}))
+	if err != nil {
+		t.Fatalf("newProxyAuthenticator: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:4567"
+	if id, err := a.Authenticate(r); id != nil || err != nil {
+		t.Errorf("no header: %+v, %v", id, err)
+	}
+
+	r.Header.Set("X-Forwarded-Email", "user@example.com")
+	id, err := a.Authenticate(r)
+	if err != nil || id.Name != "user@example.com" || !id.HasScope(identity.ScopeFileviewer) || id.HasScope(identity.ScopeAdmin) {
+		t.Errorf("trusted proxy: %+v, %v", id, err)
+	}
+
+	r.RemoteAddr = "192.168.1.1:4567"
+	if _, err := a.Authenticate(r); err == nil {
+		t.Error("the header should not be trusted from other addresses")
+	}
+
+	if _, err := newProxyAuthenticator("X-Forwarded-Email", "", []string{"bogus"}, nil); err == nil {
+		t.Error("expected an error for a bad CIDR")
+	}
+	if _, err := newProxyAuthenticator("X-Forwarded-Email", "", nil, nil); err == nil {
+		t.Error("expected an error without trusted proxies")
+	}
+	if _, err := WrapWithAuth(http.NotFoundHandler(), config.Auth{ProxyHeader: "X-Forwarded-Email"}); err == nil {
+		t.Error("auth should not be enabled with proxy_header and no trusted_proxies")
+	}
+}
+
+func TestAuthAddsIdentityToContext(t *testing.T) {
+	var got *identity.Identity
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = identity.FromContext(r.Context())
+	})
+	// httptest requests come from 192.0.2.1.
+	h, err := WrapWithAuth(inner, config.Auth{ProxyHeader: "X-Forwarded-User", TrustedProxies: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatalf("WrapWithAuth: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/search/?q=a", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || got == nil || got.Name != "alice" || got.Method != "proxy" {
+		t.Errorf("status %d, identity %+v", w.Code, got)
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/identity"
+)
+
+// proxyAuthenticator trusts an authenticating proxy to name the user
+// in a header.
+type proxyAuthenticator struct {
+	header       string
+	groupsHeader string
+	trusted      []*net.IPNet
+	scopes       func(user string) []string
+}
+
+// newProxyAuthenticator fails if trustedProxies is empty: the headers
+// would then be trusted from any client that sets them.
+func newProxyAuthenticator(header, groupsHeader string, trustedProxies []string, scopes func(string) []string) (*proxyAuthenticator, error) {
+	if len(trustedProxies) == 0 {
+		return nil, fmt.Errorf("proxy_header %s needs trusted_proxies, the addresses the proxy connects from", header)
+	}
+	a := &proxyAuthenticator{header: header, groupsHeader: groupsHeader, scopes: scopes}
+	for _, cidr := range trustedProxies {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %s", err)
+		}
+		a.trusted = append(a.trusted, ipnet)
+	}
+	return a, nil
+}
+
+func (a *proxyAuthenticator) trusts(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, ipnet := range a.trusted {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *proxyAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	user := r.Header.Get(a.header)
+	if user == "" {
+		return nil, nil
+	}
+	if !a.trusts(r.RemoteAddr) {
+		return nil, fmt.Errorf("%s set by untrusted address %s", a.header, r.RemoteAddr)
+	}
+	var groups []string
+	if a.groupsHeader != "" {
+		for _, g := range strings.Split(r.Header.Get(a.groupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return &identity.Identity{Name: user, Method: "proxy", Scopes: a.scopes(user), Groups: groups}, nil
+}
@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+// defaultRateLimitPaths are the routes that search the backends.
+var defaultRateLimitPaths = []string{
+	"/api/v1/search/",
+	"/api/v2/search/",
+	"/api/v2/getRenderedSearchResults/",
+	"/api/v2/getRenderedReferences/",
+	"/search-diff",
+	"/saved-searches",
+}
+
+// sweepInterval is how often we forget clients that have stopped
+// sending requests.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from key's bucket. If there is none, it returns
+// how long until there will be.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose buckets have refilled, since a new bucket
+// would be just the same.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+type rateLimitHandler struct {
+	inner   http.Handler
+	cfg     *config.RateLimit
+	paths   []string
+	limiter *rateLimiter
+}
+
+func ShouldEnableRateLimit(cfg config.RateLimit) bool {
+	return cfg.RequestsPerSecond > 0
+}
+
+// clientKey identifies who sent r, as configured by cfg.Key. Only the
+// identity the auth middleware or IAP verified will do: a client could
+// send different unverified headers with each request for a new bucket
+// every time.
+func (h *rateLimitHandler) clientKey(r *http.Request) string {
+	if id, ok := identity.FromContext(r.Context()); ok {
+		switch h.cfg.Key {
+		case "user":
+			return "user:" + id.Method + ":" + id.Name
+		case "iap", "token":
+			// The identity's method is named the same.
+			if id.Method == h.cfg.Key {
+				return h.cfg.Key + ":" + id.Name
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func (h *rateLimitHandler) limited(path string) bool {
+	for _, prefix := range h.paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.limited(r.URL.Path) {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	key := h.clientKey(r)
+	ok, wait := h.limiter.allow(key)
+	if ok {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := log.WithFields(context.Background(), log.Fields{"remote_addr": r.RemoteAddr})
+	log.Warnf(ctx, "rate limited client=%s path=%s", strings.SplitN(key, ":", 2)[0], r.URL.Path)
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(&api.ReplyError{Err: api.InnerError{
+		Code:    "rate_limited",
+		Message: fmt.Sprintf("Too many requests; try again in %ds", retryAfter),
+	}})
+}
+
+func WrapWithRateLimit(h http.Handler, cfg config.RateLimit) http.Handler {
+	paths := cfg.Paths
+	if len(paths) == 0 {
+		paths = defaultRateLimitPaths
+	}
+	return &rateLimitHandler{
+		inner:   h,
+		cfg:     &cfg,
+		paths:   paths,
+		limiter: newRateLimiter(cfg.RequestsPerSecond, cfg.Burst),
+	}
+}
@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(2, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d should be within the burst", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("a third request should be limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %s, want 500ms", wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("other clients should not be limited")
+	}
+
+	now = now.Add(wait)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("the bucket should have refilled")
+	}
+
+	now = now.Add(2 * sweepInterval)
+	l.allow("c")
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle clients should be forgotten")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := WrapWithRateLimit(inner, config.RateLimit{RequestsPerSecond: 1, Key: "token"})
+
+	// get sends a request from remote, as the API token named token if
+	// the auth middleware would have verified one, and with header as
+	// its Authorization header.
+	get := func(path, remote, token, header string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		if token != "" {
+			r = r.WithContext(identity.NewContext(r.Context(), &identity.Identity{Name: token, Method: "token"}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("/api/v1/search/?q=a", "10.0.0.1:1234", "t1", ""); w.Code != 200 {
+		t.Fatalf("first request: %d", w.Code)
+	}
+	w := get("/api/v1/search/?q=a", "10.0.0.2:1234", "t1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("same token from another IP: %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+	var reply api.ReplyError
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Err.Code != "rate_limited" {
+		t.Errorf("body = %q, %v", w.Body.String(), err)
+	}
+
+	if w := get("/api/v1/search/?q=a", "10.0.0.1:1234", "t2", ""); w.Code != 200 {
+		t.Errorf("another token: %d", w.Code)
+	}
+	// Without a verified token, clients are limited by IP, whatever
+	// they send.
+	if w := get("/api/v1/search/?q=a", "10.0.0.1:1234", "", "Bearer fake1"); w.Code != 200 {
+		t.Errorf("no token: %d", w.Code)
+	}
+	if w := get("/api/v1/search/?q=a", "10.0.0.1:5678", "", "Bearer fake2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same IP, another unverified token: %d, want 429", w.Code)
+	}
+	// Nor without one.
+	if w := get("/api/v1/search/?q=a", "10.0.0.1:1234", "", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same IP, no token: %d, want 429", w.Code)
+	}
+	if w := get("/view/a/b", "10.0.0.1:1234", "", ""); w.Code != 200 {
+		t.Errorf("paths other than the search APIs should not be limited: %d", w.Code)
+	}
+}
+
+func TestRateLimitHandlerKeys(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	iap := &identity.Identity{Name: "user@example.com", Method: "iap"}
+	token := &identity.Identity{Name: "ci", Method: "token"}
+	for _, tc := range []struct {
+		key string
+		id  *identity.Identity
+		// An unverified header sent with the request, which is ignored.
+		header, value string
+		want          string
+	}{
+		{"ip", iap, "", "", "ip:10.0.0.1"},
+		{"user", iap, "", "", "user:iap:user@example.com"},
+		{"user", token, "", "", "user:token:ci"},
+		{"user", nil, "", "", "ip:10.0.0.1"},
+		{"iap", iap, "", "", "iap:user@example.com"},
+		{"iap", token, "", "", "ip:10.0.0.1"},
+		{"iap", nil, "X-Goog-Authenticated-User-Email", "accounts.google.com:other@example.com", "ip:10.0.0.1"},
+		{"token", token, "", "", "token:ci"},
+		{"token", iap, "", "", "ip:10.0.0.1"},
+		{"token", nil, "Authorization", "Bearer made-up", "ip:10.0.0.1"},
+	} {
+		h := WrapWithRateLimit(inner, config.RateLimit{RequestsPerSecond: 1, Key: tc.key}).(*rateLimitHandler)
+		r := httptest.NewRequest("GET", "/api/v1/search/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		if tc.id != nil {
+			r = r.WithContext(identity.NewContext(r.Context(), tc.id))
+		}
+		if got := h.clientKey(r); got != tc.want {
+			t.Errorf("key %s, identity %+v: clientKey = %q, want %q", tc.key, tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitHandlerPaths(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := WrapWithRateLimit(inner, config.RateLimit{RequestsPerSecond: 1}).(*rateLimitHandler)
+	for _, path := range []string{
+		"/api/v1/search/main",
+		"/api/v2/search/",
+		"/api/v2/getRenderedSearchResults/",
+		"/api/v2/getRenderedReferences/",
+		"/search-diff",
+		"/saved-searches",
+	} {
+		if !h.limited(path) {
+			t.Errorf("%s should be limited", path)
+		}
+	}
+	for _, path := range []string{"/", "/view/a/b", "/about"} {
+		if h.limited(path) {
+			t.Errorf("%s should not be limited", path)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/identity"
+)
+
+// APIToken is an entry in the tokens file.
+type APIToken struct {
+	Name string `json:"name"`
+	// The token itself, or, so the file needn't hold secrets, its
+	// SHA-256 in hex.
+	Token  string   `json:"token"`
+	SHA256 string   `json:"sha256"`
+	Scopes []string `json:"scopes"`
+	Groups []string `json:"groups"`
+}
+
+type tokenAuthenticator struct {
+	// keyed by each token's SHA-256
+	tokens map[[sha256.Size]byte]*APIToken
+}
+
+// LoadTokens reads the API tokens listed in the JSON file at path.
+func LoadTokens(path string) (Authenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+	a, err := newTokenAuthenticator(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+	return a, nil
+}
+
+func newTokenAuthenticator(tokens []APIToken) (*tokenAuthenticator, error) {
+	a := &tokenAuthenticator{tokens: make(map[[sha256.Size]byte]*APIToken)}
+	for i := range tokens {
+		t := &tokens[i]
+		if t.Name == "" {
+			return nil, fmt.Errorf("token %d has no name", i)
+		}
+		for _, scope := range t.Scopes {
+			if scope != identity.ScopeSearch && scope != identity.ScopeFileviewer && scope != identity.ScopeAdmin {
+				return nil, fmt.Errorf("token %s: unknown scope %q", t.Name, scope)
+			}
+		}
+
+		var sum [sha256.Size]byte
+		switch {
+		case t.Token != "" && t.SHA256 != "":
+			return nil, fmt.Errorf("token %s: token and sha256 are mutually exclusive", t.Name)
+		case t.Token != "":
+			sum = sha256.Sum256([]byte(t.Token))
+		case t.SHA256 != "":
+			b, err := hex.DecodeString(t.SHA256)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("token %s: sha256 must be %d hex-encoded bytes", t.Name, sha256.Size)
+			}
+			copy(sum[:], b)
+		default:
+			return nil, fmt.Errorf("token %s: one of token or sha256 is required", t.Name)
+		}
+		a.tokens[sum] = t
+	}
+	return a, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*identity.Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+	// Looking tokens up by their hash means how long we take says
+	// nothing about how much of a token was right.
+	t, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errors.New("unknown API token")
+	}
+	return &identity.Identity{Name: t.Name, Method: "token", Scopes: t.Scopes, Groups: t.Groups}, nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("bearer ") && strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+		return strings.TrimSpace(auth[len("bearer "):])
+	}
+	return ""
+}
@@ -9,6 +9,8 @@ import (
 	"strings"
 	"unicode/utf8"
 
+	"github.com/livegrep/livegrep/server/fileviewer"
+
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 )
 
@@ -19,29 +21,87 @@ var knownTags = map[string]bool{
 	"-file":       true,
 	"path":        true,
 	"-path":       true,
+	"dir":         true,
+	"-dir":        true,
 	"repo":        true,
 	"-repo":       true,
 	"tags":        true,
 	"-tags":       true,
+	"lang":        true,
+	"-lang":       true,
 	"case":        true,
 	"lit":         true,
+	"sym":         true,
+	"def":         true,
 	"max_matches": true,
+	"sort":        true,
+	"at":          true,
+	"index":       true,
+}
+
+// repeatableTags are the operators that may be given more than once in
+// a query, each time narrowing it further.
+var repeatableTags = map[string]bool{
+	"file":  true,
+	"-file": true,
+	"path":  true,
+	"-path": true,
+	"dir":   true,
+	"-dir":  true,
+	"repo":  true,
+	"-repo": true,
+	"tags":  true,
+	"-tags": true,
+	"lang":  true,
+	"-lang": true,
 }
 
-func onlyOneSynonym(ops map[string]string, op1 string, op2 string) (string, error) {
-	if ops[op1] != "" && ops[op2] != "" {
-		return "", fmt.Errorf("Cannot provide both %s: and %s:, because they are synonyms", op1, op2)
+// queryOpValues returns the non-empty terms given to any of keys
+// anywhere in query, including in any term of a boolean query, for the
+// operators that apply to the whole search rather than to a term.
+func queryOpValues(query string, globalRegex bool, keys ...string) ([]string, error) {
+	var values []string
+	var walk func(q string) error
+	walk = func(q string) error {
+		for _, t := range scanQueryExpr(strings.TrimSpace(q), globalRegex) {
+			switch t.kind {
+			case tokGroup:
+				if err := walk(t.text); err != nil {
+					return err
+				}
+			case tokTerm:
+				ops, err := parseQueryOps(t.text, globalRegex)
+				if err != nil {
+					return err
+				}
+				for _, key := range keys {
+					for _, v := range ops[key] {
+						if v != "" {
+							values = append(values, v)
+						}
+					}
+				}
+			}
+		}
+		return nil
 	}
-	if ops[op1] != "" {
-		return ops[op1], nil
+	if err := walk(query); err != nil {
+		return nil, err
 	}
-	return ops[op2], nil
+	return values, nil
 }
 
-func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
-	var out pb.Query
-
-	ops := make(map[string]string)
+// parseQueryOps splits query into the terms given to each operator, in
+// the order they were given. The main search term is under "".
+func parseQueryOps(query string, globalRegex bool) (map[string][]string, error) {
+	ops := make(map[string][]string)
+	set := func(key, term string) error {
+		if _, alreadySet := ops[key]; alreadySet && !repeatableTags[key] {
+			return fmt.Errorf("got term twice: %s", key)
+		}
+		ops[key] = append(ops[key], term)
+		return nil
+	}
 	key := ""
 	term := ""
 	q := strings.TrimSpace(query)
@@ -52,10 +112,9 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		m := pieceRE.FindStringSubmatchIndex(q)
 		if m == nil {
 			term += q
-			if _, alreadySet := ops[key]; alreadySet {
-				return out, fmt.Errorf("got term twice: %s", key)
+			if err := set(key, term); err != nil {
+				return nil, err
 			}
-			ops[key] = term
 			break
 		}
 
@@ -71,10 +130,9 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 				term += " "
 
 			} else {
-				if _, alreadySet := ops[key]; alreadySet {
-					return out, fmt.Errorf("got term twice: %s", key)
+				if err := set(key, term); err != nil {
+					return nil, err
 				}
-				ops[key] = term
 				key = ""
 				term = ""
 				inRegex = globalRegex
@@ -123,16 +181,23 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 				q = q[i:]
 			}
 		} else if match[0] == '\\' {
-			term += match
+			if kw, ok := escapedKeyword(match+q, justGotSpace); ok {
+				// An escaped boolean operator, e.g. \AND, is the
+				// word itself.
+				term += kw
+				q = q[len(kw)-1:]
+			} else {
+				term += match
+			}
 		} else {
 			// An operator. The key is in match group 1
 			newKey := match[m[2]-m[0] : m[3]-m[0]]
 			if key == "" && knownTags[newKey] {
 				if strings.TrimSpace(term) != "" {
 					if _, alreadySet := ops[key]; alreadySet {
-						return out, fmt.Errorf("main search term must be contiguous")
+						return nil, fmt.Errorf("main search term must be contiguous")
 					}
-					ops[key] = term
+					ops[key] = []string{term}
 				}
 				term = ""
 				key = newKey
@@ -146,41 +211,265 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 		justGotSpace = (match == " ")
 	}
 
-	var err error
-	if out.File, err = onlyOneSynonym(ops, "file", "path"); err != nil {
-		return out, err
+	return ops, nil
+}
+
+// splitFilterList splits a term given to a filter operator into the
+// alternatives it lists, separated by commas or pipes. In a regex, those
+// only separate alternatives outside of groups, classes and repetition
+// counts; otherwise they can be escaped with a backslash.
+func splitFilterList(term string, regex bool) []string {
+	var alts []string
+	var cur strings.Builder
+	depth := 0
+	inClass := false
+	for i := 0; i < len(term); i++ {
+		c := term[i]
+		if c == '\\' && i+1 < len(term) {
+			if !regex && (term[i+1] == ',' || term[i+1] == '|') {
+				cur.WriteByte(term[i+1])
+			} else {
+				cur.WriteString(term[i : i+2])
+			}
+			i++
+			continue
+		}
+		if regex {
+			switch {
+			case inClass:
+				inClass = c != ']'
+			case c == '[':
+				inClass = true
+			case c == '(' || c == '{':
+				depth++
+			case c == ')' || c == '}':
+				depth--
+			}
+		}
+		if (c == ',' || c == '|') && depth == 0 && !inClass {
+			if cur.Len() > 0 {
+				alts = append(alts, cur.String())
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(c)
 	}
-	out.Repo = ops["repo"]
-	out.Tags = ops["tags"]
-	if out.NotFile, err = onlyOneSynonym(ops, "-file", "-path"); err != nil {
-		return out, err
+	if cur.Len() > 0 {
+		alts = append(alts, cur.String())
 	}
-	out.NotRepo = ops["-repo"]
-	out.NotTags = ops["-tags"]
+	return alts
+}
+
+// filterAlternatives returns a regex for each alternative listed in the
+// terms given to a filter operator.
+func filterAlternatives(terms []string, regex bool) [][]string {
+	var res [][]string
+	for _, term := range terms {
+		var alts []string
+		for _, alt := range splitFilterList(term, regex) {
+			if !regex {
+				alt = regexp.QuoteMeta(alt)
+			}
+			alts = append(alts, alt)
+		}
+		if len(alts) > 0 {
+			res = append(res, alts)
+		}
+	}
+	return res
+}
+
+// dirAlternatives returns a regex for the files under each directory
+// listed in the terms given to dir:. Directories are paths from the root
+// of a repo, and are never regexes, so that the filter means the same
+// thing whether the query is a regex or not.
+func dirAlternatives(terms []string) [][]string {
+	var res [][]string
+	for _, term := range terms {
+		var alts []string
+		for _, dir := range splitFilterList(term, false) {
+			if dir = strings.Trim(dir, "/"); dir != "" {
+				alts = append(alts, "^"+regexp.QuoteMeta(dir)+"/")
+			}
+		}
+		if len(alts) > 0 {
+			res = append(res, alts)
+		}
+	}
+	return res
+}
+
+// languageAlternatives returns a regex for the files in each language
+// listed in the terms given to lang:.
+func languageAlternatives(terms []string) ([][]string, error) {
+	var res [][]string
+	for _, term := range terms {
+		var alts []string
+		for _, name := range splitFilterList(term, false) {
+			lang, ok := fileviewer.LookupLanguage(name)
+			if !ok {
+				return nil, fmt.Errorf("Unknown language given to lang: %q", name)
+			}
+			alts = append(alts, fileviewer.LanguageFileRegex(lang))
+		}
+		if len(alts) > 0 {
+			res = append(res, alts)
+		}
+	}
+	return res, nil
+}
+
+// anyFilter returns a regex matching whatever any of res does.
+func anyFilter(res []string) string {
+	if len(res) == 1 {
+		return res[0]
+	}
+	grouped := make([]string, len(res))
+	for i, re := range res {
+		grouped[i] = "(?:" + re + ")"
+	}
+	return strings.Join(grouped, "|")
+}
+
+// QueryFilters are the file:, repo: and tags: filters a query gives on
+// top of the first of each. The backend matches a single pattern per
+// filter, and no one regex matches what several do wherever their
+// matches overlap, so it's given the first and the frontend checks the
+// rest on its results.
+type QueryFilters struct {
+	File []*regexp.Regexp
+	Repo []*regexp.Regexp
+	Tags []*regexp.Regexp
+}
+
+// compileFilter compiles a filter's regex for the frontend to match as
+// the backend does, ignoring case unless it has an upper-case letter.
+func compileFilter(op, re string) (*regexp.Regexp, error) {
+	if strings.IndexAny(re, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1 {
+		re = "(?i)" + re
+	}
+	compiled, err := regexp.Compile(re)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regex given to %s: %v", op, err)
+	}
+	return compiled, nil
+}
+
+// firstFilter returns a regex for the backend matching what one of the
+// first of terms' alternatives does, and the rest of terms compiled for
+// the frontend to check.
+func firstFilter(op string, terms [][]string) (string, []*regexp.Regexp, error) {
+	if len(terms) == 0 {
+		return "", nil, nil
+	}
+	var rest []*regexp.Regexp
+	for _, alts := range terms[1:] {
+		re, err := compileFilter(op, anyFilter(alts))
+		if err != nil {
+			return "", nil, err
+		}
+		rest = append(rest, re)
+	}
+	return anyFilter(terms[0]), rest, nil
+}
+
+// notFilters returns a regex matching whatever any of terms'
+// alternatives does.
+func notFilters(terms [][]string) string {
+	var res []string
+	for _, alts := range terms {
+		res = append(res, alts...)
+	}
+	return anyFilter(res)
+}
+
+// ParseQuery parses a query without boolean operators into the query
+// the backend runs. It fails on queries that repeat a file:, repo: or
+// tags: filter, which the backend can't run on its own; ParseQueryExpr
+// handles those.
+func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
+	out, filters, err := parseQuery(query, globalRegex)
+	if err == nil && filters != nil {
+		err = errors.New("Repeated file:, repo: and tags: filters need ParseQueryExpr")
+	}
+	return out, err
+}
+
+// parseQuery parses a query without boolean operators into the query
+// the backend runs, and the filters it repeats, if any, for the
+// frontend to check.
+func parseQuery(query string, globalRegex bool) (pb.Query, *QueryFilters, error) {
+	var out pb.Query
+	var filters QueryFilters
+
+	ops, err := parseQueryOps(query, globalRegex)
+	if err != nil {
+		return out, nil, err
+	}
+	// Only the filter operators can be given more than once.
+	op := func(key string) string {
+		if len(ops[key]) == 0 {
+			return ""
+		}
+		return ops[key][0]
+	}
+	if _, err := parseSortOrder(op("sort")); err != nil {
+		return out, nil, err
+	}
+
+	files := filterAlternatives(append(ops["file"], ops["path"]...), globalRegex)
+	files = append(files, dirAlternatives(ops["dir"])...)
+	langs, err := languageAlternatives(ops["lang"])
+	if err != nil {
+		return out, nil, err
+	}
+	if out.File, filters.File, err = firstFilter("file:", append(files, langs...)); err != nil {
+		return out, nil, err
+	}
+	if out.Repo, filters.Repo, err = firstFilter("repo:", filterAlternatives(ops["repo"], globalRegex)); err != nil {
+		return out, nil, err
+	}
+	// Tags are always matched as regexes.
+	if out.Tags, filters.Tags, err = firstFilter("tags:", filterAlternatives(ops["tags"], true)); err != nil {
+		return out, nil, err
+	}
+	notLangs, err := languageAlternatives(ops["-lang"])
+	if err != nil {
+		return out, nil, err
+	}
+	notFiles := append(filterAlternatives(append(ops["-file"], ops["-path"]...), globalRegex), dirAlternatives(ops["-dir"])...)
+	out.NotFile = notFilters(append(notFiles, notLangs...))
+	out.NotRepo = notFilters(filterAlternatives(ops["-repo"], globalRegex))
+	out.NotTags = notFilters(filterAlternatives(ops["-tags"], true))
+
 	var bits []string
-	for _, k := range []string{"", "case", "lit"} {
-		bit := strings.TrimSpace(ops[k])
+	symbol := false
+	for _, k := range []string{"", "case", "lit", "sym", "def"} {
+		bit := strings.TrimSpace(op(k))
 		if k == "lit" || !globalRegex {
 			bit = regexp.QuoteMeta(bit)
 		}
 		if len(bit) != 0 {
+			if k == "def" {
+				bit = symbolLine(bit)
+			}
+			symbol = symbol || k == "sym" || k == "def"
 			bits = append(bits, bit)
 		}
 	}
 
 	if len(bits) > 1 {
-		return out, errors.New("You cannot provide multiple of case:, lit:, and a bare regex")
+		return out, nil, errors.New("You cannot provide multiple of case:, lit:, sym:, def:, and a bare regex")
 	}
 
 	if len(bits) > 0 {
 		out.Line = bits[0]
 	}
-
-	if !globalRegex {
-		out.File = regexp.QuoteMeta(out.File)
-		out.NotFile = regexp.QuoteMeta(out.NotFile)
-		out.Repo = regexp.QuoteMeta(out.Repo)
-		out.NotRepo = regexp.QuoteMeta(out.NotRepo)
+	// Giving the backend a tags pattern makes it search only the tags
+	// file, so sym: and def: match nothing but definitions.
+	if symbol && out.Tags == "" {
+		out.Tags = ".*"
 	}
 
 	if out.Line == "" && out.File != "" {
@@ -200,16 +489,432 @@ func ParseQuery(query string, globalRegex bool) (pb.Query, error) {
 	} else {
 		out.FoldCase = strings.IndexAny(out.Line, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == -1
 	}
-	if v, ok := ops["max_matches"]; ok && v != "" {
+	if v := op("max_matches"); v != "" {
 		i, err := strconv.Atoi(v)
 		if err == nil {
 			out.MaxMatches = int32(i)
 		} else {
-			return out, errors.New("Value given to max_matches: must be a valid integer")
+			return out, nil, errors.New("Value given to max_matches: must be a valid integer")
 		}
 	} else {
 		out.MaxMatches = 0
 	}
 
-	return out, nil
+	if len(filters.File)+len(filters.Repo)+len(filters.Tags) == 0 {
+		return out, nil, nil
+	}
+	return out, &filters, nil
+}
+
+// ExprOp identifies the kind of node in a QueryExpr.
+type ExprOp int
+
+const (
+	ExprLeaf ExprOp = iota
+	ExprAnd
+	ExprOr
+	ExprNot
+)
+
+// QueryExpr is a boolean combination of queries, as produced by
+// ParseQueryExpr. Leaves hold an ordinary parsed query; inner nodes
+// combine the files matched by their children.
+type QueryExpr struct {
+	Op    ExprOp
+	Query pb.Query // only set when Op == ExprLeaf
+	// The filters Query repeats, if any, for the frontend to check on
+	// its results. Only set when Op == ExprLeaf.
+	Filters  *QueryFilters
+	Children []*QueryExpr
+}
+
+// Leaves returns every leaf query in the expression, in query order.
+func (e *QueryExpr) Leaves() []*QueryExpr {
+	if e.Op == ExprLeaf {
+		return []*QueryExpr{e}
+	}
+	var leaves []*QueryExpr
+	for _, c := range e.Children {
+		leaves = append(leaves, c.Leaves()...)
+	}
+	return leaves
+}
+
+// PositiveLeaves returns the leaves that are not negated by an odd
+// number of NOTs. Only their matches are returned to the user.
+func (e *QueryExpr) PositiveLeaves() []*QueryExpr {
+	var leaves []*QueryExpr
+	var walk func(e *QueryExpr, negated bool)
+	walk = func(e *QueryExpr, negated bool) {
+		switch e.Op {
+		case ExprLeaf:
+			if !negated {
+				leaves = append(leaves, e)
+			}
+		case ExprNot:
+			walk(e.Children[0], !negated)
+		default:
+			for _, c := range e.Children {
+				walk(c, negated)
+			}
+		}
+	}
+	walk(e, false)
+	return leaves
+}
+
+type exprTokenKind int
+
+const (
+	tokTerm exprTokenKind = iota
+	tokAnd
+	tokOr
+	tokNot
+	tokGroup
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+var exprKeywords = []exprToken{
+	{tokAnd, "AND"},
+	{tokOr, "OR"},
+	{tokNot, "NOT"},
+}
+
+// escapedKeyword reports whether q starts with a backslash escaping one
+// of exprKeywords, which it returns, as a whole word: atWordStart says
+// whether q starts one.
+func escapedKeyword(q string, atWordStart bool) (string, bool) {
+	if !atWordStart || !strings.HasPrefix(q, "\\") {
+		return "", false
+	}
+	for _, kw := range exprKeywords {
+		end := 1 + len(kw.text)
+		if strings.HasPrefix(q[1:], kw.text) && (end == len(q) || q[end] == ' ') {
+			return kw.text, true
+		}
+	}
+	return "", false
+}
+
+// matchingClose returns the index of the bracket closing the one at
+// q[start], or -1 if it is never closed.
+func matchingClose(q string, start int) int {
+	open := q[start]
+	close := byte(')')
+	if open == '[' {
+		close = ']'
+	}
+	depth := 0
+	for i := start; i < len(q); i++ {
+		switch q[i] {
+		case '\\':
+			i++
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// scanQueryExpr splits a query into boolean operators, parenthesized
+// groups and the plain query terms between them. Operators are only
+// recognized as whole, upper-case words outside of brackets, and a
+// parenthesized group is only treated as a boolean group if it contains
+// an operator itself, so regexes like `(foo|bar) baz` scan as a single
+// term. To search for the words themselves, escape them with a
+// backslash, as in `\AND`, which parseQueryOps turns back into the word,
+// or, in a regex, wrap them in parentheses.
+func scanQueryExpr(q string, globalRegex bool) []exprToken {
+	var toks []exprToken
+	var term strings.Builder
+	flush := func() {
+		if t := strings.TrimSpace(term.String()); t != "" {
+			toks = append(toks, exprToken{tokTerm, t})
+		}
+		term.Reset()
+	}
+
+	i := 0
+outer:
+	for i < len(q) {
+		if i == 0 || q[i-1] == ' ' {
+			for _, kw := range exprKeywords {
+				end := i + len(kw.text)
+				if strings.HasPrefix(q[i:], kw.text) && (end == len(q) || q[end] == ' ') {
+					flush()
+					toks = append(toks, kw)
+					i = end
+					continue outer
+				}
+			}
+			if q[i] == '(' {
+				end := matchingClose(q, i)
+				if end != -1 && (end+1 == len(q) || q[end+1] == ' ') &&
+					isExprGroup(scanQueryExpr(q[i+1:end], globalRegex)) {
+					flush()
+					toks = append(toks, exprToken{tokGroup, q[i+1 : end]})
+					i = end + 1
+					continue
+				}
+			}
+		}
+
+		switch {
+		case q[i] == '\\' && i+1 < len(q):
+			term.WriteString(q[i : i+2])
+			i += 2
+		case globalRegex && (q[i] == '(' || q[i] == '['):
+			if end := matchingClose(q, i); end != -1 {
+				term.WriteString(q[i : end+1])
+				i = end + 1
+			} else {
+				term.WriteByte(q[i])
+				i++
+			}
+		default:
+			term.WriteByte(q[i])
+			i++
+		}
+	}
+	flush()
+	return toks
+}
+
+// isExprGroup reports whether toks, scanned from inside parentheses, are
+// a boolean group: they need an operator and something for it to
+// operate on, so that `(AND)` is still the regex matching the word.
+func isExprGroup(toks []exprToken) bool {
+	for _, t := range toks {
+		if t.kind == tokTerm || t.kind == tokGroup {
+			return hasExprOperator(toks)
+		}
+	}
+	return false
+}
+
+func hasExprOperator(toks []exprToken) bool {
+	for _, t := range toks {
+		if t.kind != tokTerm {
+			return true
+		}
+	}
+	return false
+}
+
+type exprParser struct {
+	toks        []exprToken
+	pos         int
+	globalRegex bool
+}
+
+func (p *exprParser) peek() (exprToken, bool) {
+	if p.pos >= len(p.toks) {
+		return exprToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *exprParser) parseOr() (*QueryExpr, error) {
+	or := &QueryExpr{Op: ExprOr}
+	for {
+		and, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or.Children = append(or.Children, and)
+		if t, ok := p.peek(); !ok || t.kind != tokOr {
+			break
+		}
+		p.pos++
+	}
+	if len(or.Children) == 1 {
+		return or.Children[0], nil
+	}
+	return or, nil
+}
+
+// parseAnd parses terms joined by AND. Adjacent terms without an
+// operator between them, such as `foo NOT bar`, are also ANDed.
+func (p *exprParser) parseAnd() (*QueryExpr, error) {
+	and := &QueryExpr{Op: ExprAnd}
+	for {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and.Children = append(and.Children, operand)
+		t, ok := p.peek()
+		if !ok || t.kind == tokOr {
+			break
+		}
+		if t.kind == tokAnd {
+			p.pos++
+		}
+	}
+	if len(and.Children) == 1 {
+		return and.Children[0], nil
+	}
+	return and, nil
+}
+
+func (p *exprParser) parseUnary() (*QueryExpr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("Expected a search term at the end of the query")
+	}
+	p.pos++
+	switch t.kind {
+	case tokNot:
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryExpr{Op: ExprNot, Children: []*QueryExpr{child}}, nil
+	case tokGroup:
+		inner := &exprParser{
+			toks:        scanQueryExpr(strings.TrimSpace(t.text), p.globalRegex),
+			globalRegex: p.globalRegex,
+		}
+		return inner.parse()
+	case tokTerm:
+		q, filters, err := parseQuery(t.text, p.globalRegex)
+		if err != nil {
+			return nil, err
+		}
+		if q.TreenameOnly {
+			return nil, fmt.Errorf("repo: cannot be used on its own in a boolean query: %q", t.text)
+		}
+		if q.Line == "" {
+			return nil, fmt.Errorf("Every term in a boolean query must have something to match: %q", t.text)
+		}
+		return &QueryExpr{Op: ExprLeaf, Query: q, Filters: filters}, nil
+	default:
+		return nil, fmt.Errorf("Expected a search term before %s", t.text)
+	}
+}
+
+func (p *exprParser) parse() (*QueryExpr, error) {
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("Unexpected %s in boolean query", t.text)
+	}
+	return e, nil
+}
+
+// negated reports whether e matches the complement of a set of files,
+// and fails if e mixes negated and non-negated terms in a way that
+// can't be computed from the files each term matches.
+func (e *QueryExpr) negated() (bool, error) {
+	switch e.Op {
+	case ExprLeaf:
+		return false, nil
+	case ExprNot:
+		neg, err := e.Children[0].negated()
+		return !neg, err
+	case ExprAnd:
+		// a AND NOT b is fine; NOT a AND NOT b is NOT (a OR b).
+		allNegated := true
+		for _, c := range e.Children {
+			neg, err := c.negated()
+			if err != nil {
+				return false, err
+			}
+			allNegated = allNegated && neg
+		}
+		return allNegated, nil
+	default:
+		var sawNegated, sawPositive bool
+		for _, c := range e.Children {
+			neg, err := c.negated()
+			if err != nil {
+				return false, err
+			}
+			sawNegated = sawNegated || neg
+			sawPositive = sawPositive || !neg
+		}
+		if sawNegated && sawPositive {
+			return false, errors.New("NOT terms cannot be combined with other terms using OR")
+		}
+		return sawNegated, nil
+	}
+}
+
+// ParseQueryExpr parses a query that combines several queries with
+// AND, OR, NOT and parentheses, e.g. `foo file:\.go AND (bar OR baz)`.
+// Each term between the operators is parsed on its own by ParseQuery.
+//
+// A query without boolean operators that repeats a file:, repo: or
+// tags: filter becomes a single leaf, so that its results are checked
+// against the repeated filters as the leaves of boolean queries are.
+// Otherwise it returns a nil expression if the query contains no
+// boolean operators, in which case the caller should use ParseQuery
+// instead.
+func ParseQueryExpr(query string, globalRegex bool) (*QueryExpr, error) {
+	toks := scanQueryExpr(strings.TrimSpace(query), globalRegex)
+	if !hasExprOperator(toks) {
+		q, filters, err := parseQuery(query, globalRegex)
+		if err != nil || filters == nil {
+			// ParseQuery will report the error.
+			return nil, nil
+		}
+		return &QueryExpr{Op: ExprLeaf, Query: q, Filters: filters}, nil
+	}
+
+	p := &exprParser{toks: toks, globalRegex: globalRegex}
+	e, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if neg, err := e.negated(); err != nil {
+		return nil, err
+	} else if neg {
+		return nil, errors.New("A boolean query must match something; combine NOT with another term using AND")
+	}
+
+	// max_matches: is a property of the whole search, so it applies
+	// to every term no matter which one it was written next to.
+	var maxMatches int32
+	for _, l := range e.Leaves() {
+		if l.Query.MaxMatches > maxMatches {
+			maxMatches = l.Query.MaxMatches
+		}
+	}
+	e.setMaxMatches(maxMatches)
+
+	return e, nil
+}
+
+// setContextLines sets ContextLines on every leaf of e, and, like
+// setMaxMatches, is a no-op on a nil expression.
+func (e *QueryExpr) setContextLines(n int32) {
+	if e == nil {
+		return
+	}
+	for _, l := range e.Leaves() {
+		l.Query.ContextLines = n
+	}
+}
+
+// setMaxMatches sets MaxMatches on every leaf of e. It is a no-op on a
+// nil expression, so callers can use it whether or not the query had
+// boolean operators.
+func (e *QueryExpr) setMaxMatches(n int32) {
+	if e == nil {
+		return
+	}
+	for _, l := range e.Leaves() {
+		l.Query.MaxMatches = n
+	}
 }
@@ -1,14 +1,19 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"reflect"
 	"testing"
 
+	"github.com/livegrep/livegrep/server/fileviewer"
+
 	pb "github.com/livegrep/livegrep/src/proto/go_proto"
 )
 
 func TestParseQuery(t *testing.T) {
+	pythonFiles := fileviewer.LanguageFileRegex("python")
+
 	cases := []struct {
 		in    string
 		out   pb.Query
@@ -211,6 +216,82 @@ func TestParseQuery(t *testing.T) {
 			pb.Query{Line: `b`, File: `a\(`, FoldCase: true},
 			false,
 		},
+
+		// lang:
+		{
+			"hello lang:go",
+			pb.Query{Line: "hello", File: `\.(go|proto)$`, FoldCase: true},
+			true,
+		},
+		{
+			"hello lang:Golang",
+			pb.Query{Line: "hello", File: `\.(go|proto)$`, FoldCase: true},
+			false,
+		},
+		{
+			"hello -lang:yml -file:test",
+			pb.Query{Line: "hello", NotFile: `(?:test)|(?:\.(yaml|yml)$)`, FoldCase: true},
+			true,
+		},
+		{
+			"lang:go",
+			pb.Query{Line: `\.(go|proto)$`, FilenameOnly: true, FoldCase: true},
+			true,
+		},
+
+		// repeated filters and OR lists
+		{
+			"hello file:src/,lib/ -file:test -path:vendor|third_party",
+			pb.Query{Line: "hello", File: `(?:src/)|(?:lib/)`, NotFile: `(?:test)|(?:vendor)|(?:third_party)`, FoldCase: true},
+			true,
+		},
+		{
+			"hello lang:go,python",
+			pb.Query{Line: "hello", File: `(?:\.(go|proto)$)|(?:` + pythonFiles + `)`, FoldCase: true},
+			true,
+		},
+		{
+			"hello file:a{1,2}[,|] repo:foo|bar",
+			pb.Query{Line: "hello", File: `a{1,2}[,|]`, Repo: `(?:foo)|(?:bar)`, FoldCase: true},
+			true,
+		},
+		{
+			"hello file:a.b,c\\,d repo:x|y",
+			pb.Query{Line: "hello", File: `(?:a\.b)|(?:c,d)`, Repo: `(?:x)|(?:y)`, FoldCase: true},
+			false,
+		},
+
+		// dir: is literal and anchored at the root of the repo
+		{
+			"hello dir:server/",
+			pb.Query{Line: "hello", File: `^server/`, FoldCase: true},
+			true,
+		},
+		{
+			"hello dir:/src/c++/",
+			pb.Query{Line: "hello", File: `^src/c\+\+/`, FoldCase: true},
+			false,
+		},
+		{
+			"hello -dir:vendor,third_party -path:test",
+			pb.Query{Line: "hello", NotFile: `(?:test)|(?:^vendor/)|(?:^third_party/)`, FoldCase: true},
+			true,
+		},
+		{
+			"sym:handle",
+			pb.Query{Line: "handle", Tags: ".*", FoldCase: true},
+			true,
+		},
+		{
+			"def:Open file:os/",
+			pb.Query{Line: "^(?:Open)$", File: "os/", Tags: ".*"},
+			true,
+		},
+		{
+			"def:a.b tags:^function",
+			pb.Query{Line: `^(?:a\.b)$`, Tags: "^function", FoldCase: true},
+			false,
+		},
 	}
 
 	for _, tc := range cases {
@@ -234,9 +315,13 @@ func TestParseQueryError(t *testing.T) {
 		{"case:a b"},
 		{"lit:a b"},
 		{"case:a lit:b"},
+		{"a sym:b"},
+		{"sym:a def:b"},
 		{"a max_matches:a"},
 		{"a file:b c"},
 		{"a file:((abc()())()) c"},
+		{"a lang:cobol"},
+		{"a sort:path sort:repo"},
 	}
 
 	for _, tc := range cases {
@@ -246,3 +331,357 @@ func TestParseQueryError(t *testing.T) {
 		}
 	}
 }
+
+func leaf(q pb.Query) *QueryExpr {
+	return &QueryExpr{Op: ExprLeaf, Query: q}
+}
+
+func TestParseQueryExpr(t *testing.T) {
+	cases := []struct {
+		in    string
+		out   *QueryExpr
+		regex bool
+	}{
+		// no operators: callers fall back to ParseQuery
+		{"hello", nil, true},
+		{"( a  )", nil, true},
+		{"(foo|bar) file:AND", nil, true},
+		{"ANDROID", nil, true},
+		{"foo \\OR bar", nil, true},
+		{"(AND)", nil, true},
+		{
+			"\\NOT AND foo",
+			&QueryExpr{Op: ExprAnd, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "NOT", FoldCase: false}),
+				leaf(pb.Query{Line: "foo", FoldCase: true}),
+			}},
+			true,
+		},
+		{
+			"(OR) OR foo",
+			&QueryExpr{Op: ExprOr, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "(OR)", FoldCase: false}),
+				leaf(pb.Query{Line: "foo", FoldCase: true}),
+			}},
+			true,
+		},
+		{
+			"a \\AND b OR c",
+			&QueryExpr{Op: ExprOr, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "a AND b", FoldCase: false}),
+				leaf(pb.Query{Line: "c", FoldCase: true}),
+			}},
+			false,
+		},
+		{
+			"foo AND bar",
+			&QueryExpr{Op: ExprAnd, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "foo", FoldCase: true}),
+				leaf(pb.Query{Line: "bar", FoldCase: true}),
+			}},
+			true,
+		},
+		{
+			"foo file:\\.go OR Bar",
+			&QueryExpr{Op: ExprOr, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "foo", File: "\\.go", FoldCase: true}),
+				leaf(pb.Query{Line: "Bar", FoldCase: false}),
+			}},
+			true,
+		},
+		{
+			"foo NOT bar",
+			&QueryExpr{Op: ExprAnd, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "foo", FoldCase: true}),
+				{Op: ExprNot, Children: []*QueryExpr{
+					leaf(pb.Query{Line: "bar", FoldCase: true}),
+				}},
+			}},
+			true,
+		},
+		{
+			"a OR b AND c",
+			&QueryExpr{Op: ExprOr, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "a", FoldCase: true}),
+				{Op: ExprAnd, Children: []*QueryExpr{
+					leaf(pb.Query{Line: "b", FoldCase: true}),
+					leaf(pb.Query{Line: "c", FoldCase: true}),
+				}},
+			}},
+			true,
+		},
+		{
+			"(a OR b) AND (c|d)",
+			&QueryExpr{Op: ExprAnd, Children: []*QueryExpr{
+				{Op: ExprOr, Children: []*QueryExpr{
+					leaf(pb.Query{Line: "a", FoldCase: true}),
+					leaf(pb.Query{Line: "b", FoldCase: true}),
+				}},
+				leaf(pb.Query{Line: "(c|d)", FoldCase: true}),
+			}},
+			true,
+		},
+		{
+			"a max_matches:10 AND file:b",
+			&QueryExpr{Op: ExprAnd, Children: []*QueryExpr{
+				leaf(pb.Query{Line: "a", FoldCase: true, MaxMatches: 10}),
+				leaf(pb.Query{Line: "b", FoldCase: true, FilenameOnly: true, MaxMatches: 10}),
+			}},
+			true,
+		},
+		{
+			"a( AND b",
+			&QueryExpr{Op: ExprAnd, Children: []*QueryExpr{
+				leaf(pb.Query{Line: `a\(`, FoldCase: true}),
+				leaf(pb.Query{Line: "b", FoldCase: true}),
+			}},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		parsed, err := ParseQueryExpr(tc.in, tc.regex)
+		if err != nil {
+			t.Errorf("ParseQueryExpr(%q) error=%v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.out, parsed) {
+			got, _ := json.MarshalIndent(parsed, "", "  ")
+			want, _ := json.MarshalIndent(tc.out, "", "  ")
+			t.Errorf("error parsing %q: expected:\n%s\ngot:\n%s",
+				tc.in, want, got)
+		}
+	}
+}
+
+func TestEscapedKeywords(t *testing.T) {
+	cases := []struct {
+		in    string
+		regex bool
+		line  string
+	}{
+		{`foo \OR bar`, true, "foo OR bar"},
+		{`\AND`, true, "AND"},
+		{`\NOT`, false, "NOT"},
+		{`x \AND y`, false, "x AND y"},
+		// Only whole words are operators to escape.
+		{`\ANDROID`, true, `\ANDROID`},
+		{`a\AND`, true, `a\AND`},
+	}
+	for _, tc := range cases {
+		q, err := ParseQuery(tc.in, tc.regex)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) error=%v", tc.in, err)
+			continue
+		}
+		if q.Line != tc.line {
+			t.Errorf("ParseQuery(%q, regex=%v).Line = %q, want %q", tc.in, tc.regex, q.Line, tc.line)
+		}
+	}
+}
+
+func TestParseQueryExprError(t *testing.T) {
+	cases := []string{
+		"NOT a",
+		"a OR NOT b",
+		"a AND",
+		"OR a",
+		"a AND repo:b",
+		"a AND (b OR)",
+		"a AND case:b c",
+	}
+
+	for _, in := range cases {
+		parsed, err := ParseQueryExpr(in, true)
+		if err == nil {
+			t.Errorf("expected an error parsing (%v), got %#v", in, parsed)
+		}
+	}
+}
+
+func TestRepeatedFilters(t *testing.T) {
+	cases := []struct {
+		query string
+		// The backend filter that should be sent, and the filters
+		// checked in the frontend.
+		file, repo string
+		checked    int
+		// Whether a result in each tree/path passes.
+		match map[[2]string]bool
+	}{
+		{
+			// Overlapping: both filters match the same ".go".
+			query: `foo file:\.go lang:go`,
+			file:  `\.go`, checked: 1,
+			match: map[[2]string]bool{
+				{"r", "a.go"}:    true,
+				{"r", "a.go.py"}: false,
+				{"r", "a.py"}:    false,
+			},
+		},
+		{
+			// Nested: one filter's match contains the other's.
+			query: "foo file:src/ file:src/main",
+			file:  "src/", checked: 1,
+			match: map[[2]string]bool{
+				{"r", "src/main.go"}:     true,
+				{"r", "lib/src/main.go"}: true,
+				{"r", "src/util.go"}:     false,
+			},
+		},
+		{
+			query: `foo file:src/,lib/ file:\.go$ path:util`,
+			file:  "(?:src/)|(?:lib/)", checked: 2,
+			match: map[[2]string]bool{
+				{"r", "src/util/a.go"}:  true,
+				{"r", "lib/a_util.go"}:  true,
+				{"r", "src/util/a.c"}:   false,
+				{"r", "tools/util.go"}:  false,
+				{"r", "src/go/util.py"}: false,
+			},
+		},
+		{
+			query: `foo file:\.go$ dir:src`,
+			file:  `\.go$`, checked: 1,
+			match: map[[2]string]bool{
+				{"r", "src/a.go"}:     true,
+				{"r", "lib/src/a.go"}: false,
+				{"r", "src/a.c"}:      false,
+			},
+		},
+		{
+			query: "foo repo:org/ repo:org/lib",
+			repo:  "org/", checked: 1,
+			match: map[[2]string]bool{
+				{"org/lib", "a.go"}: true,
+				{"org/app", "a.go"}: false,
+			},
+		},
+		{
+			// Filters ignore case like the backend's unless they have
+			// an upper-case letter.
+			query: "foo file:x file:Readme",
+			file:  "x", checked: 1,
+			match: map[[2]string]bool{
+				{"r", "x/Readme.md"}: true,
+				{"r", "x/README.md"}: false,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		expr, err := ParseQueryExpr(tc.query, true)
+		if err != nil {
+			t.Fatalf("ParseQueryExpr(%q): %v", tc.query, err)
+		}
+		if expr == nil || expr.Op != ExprLeaf {
+			t.Fatalf("ParseQueryExpr(%q) = %+v, want a leaf", tc.query, expr)
+		}
+		if expr.Query.File != tc.file || expr.Query.Repo != tc.repo {
+			t.Errorf("%q: backend filters file=%q repo=%q, want file=%q repo=%q",
+				tc.query, expr.Query.File, expr.Query.Repo, tc.file, tc.repo)
+		}
+		f := expr.Filters
+		if checked := len(f.File) + len(f.Repo) + len(f.Tags); checked != tc.checked {
+			t.Errorf("%q: %d filters checked in the frontend, want %d", tc.query, checked, tc.checked)
+		}
+
+		// What the backend returns for the first filter of each.
+		search := &pb.CodeSearchResult{Stats: &pb.SearchStats{}}
+		fileRE, _ := compileFilter("file:", tc.file)
+		repoRE, _ := compileFilter("repo:", tc.repo)
+		for k := range tc.match {
+			if repoRE.MatchString(k[0]) && fileRE.MatchString(k[1]) {
+				search.Results = append(search.Results, &pb.SearchResult{Tree: k[0], Path: k[1], NumMatches: 1})
+				search.Stats.NumMatches++
+			}
+		}
+		filtered := f.filterSearch(search)
+		got := map[[2]string]bool{}
+		for _, r := range filtered.Results {
+			got[[2]string{r.Tree, r.Path}] = true
+		}
+		for k, want := range tc.match {
+			if got[k] != want {
+				t.Errorf("%q: %s/%s matched=%v, want %v", tc.query, k[0], k[1], got[k], want)
+			}
+		}
+		if filtered.Stats.NumMatches != int64(len(filtered.Results)) {
+			t.Errorf("%q: %d matches counted for %d results", tc.query, filtered.Stats.NumMatches, len(filtered.Results))
+		}
+	}
+
+	if _, err := ParseQuery("foo file:a file:b", true); err == nil {
+		t.Error("ParseQuery accepted repeated filters")
+	}
+}
+
+func TestRepeatedFiltersInBooleanQuery(t *testing.T) {
+	expr, err := ParseQueryExpr("foo file:src/ file:main AND bar", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := expr.Leaves()
+	if len(leaves) != 2 || leaves[0].Filters == nil || leaves[1].Filters != nil {
+		t.Fatalf("leaves %+v, want the first to repeat filters", leaves)
+	}
+
+	results := map[string][]*pb.SearchResult{
+		"foo": {
+			{Tree: "r", Path: "src/main.go", LineNumber: 1, NumMatches: 1},
+			{Tree: "r", Path: "src/util.go", LineNumber: 1, NumMatches: 1},
+		},
+		"bar": {
+			{Tree: "r", Path: "src/main.go", LineNumber: 2, NumMatches: 1},
+			{Tree: "r", Path: "src/util.go", LineNumber: 2, NumMatches: 1},
+		},
+	}
+	search := func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+		return &pb.CodeSearchResult{Stats: &pb.SearchStats{}, Results: results[q.Line]}, nil
+	}
+	combined, err := searchExpr(context.Background(), expr, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range combined.Results {
+		if r.Path != "src/main.go" {
+			t.Errorf("got a result in %s, which file:main excludes", r.Path)
+		}
+	}
+	if len(combined.Results) != 2 {
+		t.Errorf("got %d results, want both lines of src/main.go", len(combined.Results))
+	}
+}
+
+func TestRepeatedFiltersSearchAgain(t *testing.T) {
+	cs := &fakeCodesearch{}
+	for i := int64(1); i <= 50; i++ {
+		cs.lines = append(cs.lines, fakeLine("r", "src/README", i, "foo"))
+	}
+	for i := int64(1); i <= 10; i++ {
+		cs.lines = append(cs.lines, fakeLine("r", "src/main.go", i, "foo"))
+	}
+
+	expr, err := ParseQueryExpr(`file:src/ file:\.go$ foo max_matches:5`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(ctx context.Context, q *pb.Query) (*pb.CodeSearchResult, error) {
+		return cs.Search(ctx, q)
+	}
+	result, err := searchExpr(context.Background(), expr, search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) < 5 {
+		t.Errorf("got %d results, want at least the 5 asked for", len(result.Results))
+	}
+	for _, r := range result.Results {
+		if r.Path != "src/main.go" {
+			t.Errorf("got a result in %s, which file:\\.go$ excludes", r.Path)
+		}
+	}
+	if expr.Query.MaxMatches != 5 {
+		t.Errorf("searching again left the leaf asking for %d matches", expr.Query.MaxMatches)
+	}
+}
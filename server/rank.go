@@ -0,0 +1,294 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// The orders search results can be sorted in, chosen with sort:.
+const (
+	sortRelevance   = "relevance"
+	sortPath        = "path"
+	sortRepo        = "repo"
+	sortDefinitions = "definitions"
+)
+
+// parseSortOrder checks the term given to sort:. An empty order means
+// the server's default.
+func parseSortOrder(order string) (string, error) {
+	switch order {
+	case "", sortRelevance, sortPath, sortRepo, sortDefinitions:
+		return order, nil
+	}
+	return "", fmt.Errorf("Unknown sort: order %q; use relevance, path, repo or definitions", order)
+}
+
+// querySortOrder returns the order given to sort: anywhere in query,
+// including in any term of a boolean query.
+func querySortOrder(query string, globalRegex bool) (string, error) {
+	orders, err := queryOpValues(query, globalRegex, "sort")
+	if err != nil {
+		return "", err
+	}
+	var order string
+	for _, o := range orders {
+		if order != "" && o != order {
+			return "", fmt.Errorf("Cannot sort by both %s and %s", order, o)
+		}
+		order = o
+	}
+	return parseSortOrder(order)
+}
+
+// A rankedFile is what a ranker knows about the matches in one file.
+type rankedFile struct {
+	tree, path string
+	numMatches int
+	// How many of the matches are definitions found in the tags file.
+	definitions int
+	// Where the file's results are in the slice being ranked.
+	index int
+}
+
+// A ranker orders the files matched by a search, best first. pattern
+// is what the search matched lines against, if we could compile it.
+type ranker interface {
+	rank(files []rankedFile, pattern *regexp.Regexp)
+}
+
+// repoRanker orders files by repo, then path.
+type repoRanker struct{}
+
+func (repoRanker) rank(files []rankedFile, pattern *regexp.Regexp) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].tree != files[j].tree {
+			return files[i].tree < files[j].tree
+		}
+		return files[i].path < files[j].path
+	})
+}
+
+// pathRanker orders files by path, then repo.
+type pathRanker struct{}
+
+func (pathRanker) rank(files []rankedFile, pattern *regexp.Regexp) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].path != files[j].path {
+			return files[i].path < files[j].path
+		}
+		return files[i].tree < files[j].tree
+	})
+}
+
+// The signals relevanceRanker scores files with.
+const (
+	// Each match adds matchScore, up to maxScoredMatches of them, so a
+	// file that merely mentions the pattern a lot doesn't win outright.
+	matchScore       = 1.0
+	maxScoredMatches = 10
+	// Taken off for each directory a file is nested in.
+	depthPenalty = 0.5
+	// Added when the file's name matches the pattern, since that's
+	// often where the thing searched for is defined.
+	filenameBonus = 5.0
+
+	testPenalty      = 6.0
+	vendorPenalty    = 8.0
+	generatedPenalty = 6.0
+)
+
+var (
+	testPathRE      = regexp.MustCompile(`(^|/)(tests?|__tests__|spec|testdata)/|[._-](test|spec)\.[^/]*$|(^|/)test_[^/]*$`)
+	vendorPathRE    = regexp.MustCompile(`(^|/)(vendor|third_party|third-party|node_modules)/`)
+	generatedPathRE = regexp.MustCompile(`\.pb\.(go|h|cc)$|_pb2(_grpc)?\.py$|\.min\.(js|css)$|(^|/)(gen|generated)/|[._]generated\.[^/]*$`)
+)
+
+type repoBoost struct {
+	repo  *regexp.Regexp
+	boost float64
+}
+
+// relevanceRanker orders files by a score made from signals like how
+// many matches they have and whether they're tests or vendored code,
+// falling back to repo order for files that score the same.
+type relevanceRanker struct {
+	boosts []repoBoost
+}
+
+func (r *relevanceRanker) score(f rankedFile, pattern *regexp.Regexp) float64 {
+	score := matchScore * math.Min(float64(f.numMatches), maxScoredMatches)
+	score -= depthPenalty * float64(strings.Count(f.path, "/"))
+	if pattern != nil && pattern.MatchString(path.Base(f.path)) {
+		score += filenameBonus
+	}
+	if testPathRE.MatchString(f.path) {
+		score -= testPenalty
+	}
+	if vendorPathRE.MatchString(f.path) {
+		score -= vendorPenalty
+	}
+	if generatedPathRE.MatchString(f.path) {
+		score -= generatedPenalty
+	}
+	for _, b := range r.boosts {
+		if b.repo.MatchString(f.tree) {
+			score += b.boost
+		}
+	}
+	return score
+}
+
+func (r *relevanceRanker) rank(files []rankedFile, pattern *regexp.Regexp) {
+	repoRanker{}.rank(files, pattern)
+	scores := make(map[int]float64, len(files))
+	for _, f := range files {
+		scores[f.index] = r.score(f, pattern)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return scores[files[i].index] > scores[files[j].index]
+	})
+}
+
+// definitionsRanker orders files that define what was searched for
+// before those that only use it, and otherwise like relevance does.
+type definitionsRanker struct {
+	relevance ranker
+}
+
+func (r definitionsRanker) rank(files []rankedFile, pattern *regexp.Regexp) {
+	r.relevance.rank(files, pattern)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].definitions > 0 && files[j].definitions == 0
+	})
+}
+
+// newRankers returns the rankers for each order sort: can ask for.
+func newRankers(cfg config.Ranking) (map[string]ranker, error) {
+	if _, err := parseSortOrder(cfg.DefaultSort); err != nil {
+		return nil, fmt.Errorf("ranking: default_sort: %s", err)
+	}
+	relevance := &relevanceRanker{}
+	for repo, boost := range cfg.RepoBoosts {
+		re, err := regexp.Compile(repo)
+		if err != nil {
+			return nil, fmt.Errorf("ranking: repo_boosts: %s", err)
+		}
+		relevance.boosts = append(relevance.boosts, repoBoost{re, boost})
+	}
+	return map[string]ranker{
+		sortRelevance:   relevance,
+		sortPath:        pathRanker{},
+		sortRepo:        repoRanker{},
+		sortDefinitions: definitionsRanker{relevance},
+	}, nil
+}
+
+// ranker returns the ranker for order, or for the server's default if
+// order is empty.
+func (s *server) ranker(order string) ranker {
+	if order == "" && s.config != nil {
+		order = s.config.Ranking.DefaultSort
+	}
+	if order == "" {
+		order = sortRelevance
+	}
+	if r, ok := s.rankers[order]; ok {
+		return r
+	}
+	if order == sortRelevance {
+		return &relevanceRanker{}
+	}
+	if order == sortDefinitions {
+		return definitionsRanker{&relevanceRanker{}}
+	}
+	return repoRanker{}
+}
+
+// rankPattern compiles the pattern a search matches lines against, for
+// rankers to match file names with. For boolean queries, that's the
+// first term whose matches are returned.
+func rankPattern(q *pb.Query, expr *QueryExpr) *regexp.Regexp {
+	if expr != nil {
+		leaves := expr.PositiveLeaves()
+		if len(leaves) == 0 {
+			return nil
+		}
+		q = &leaves[0].Query
+	}
+	if q.Line == "" {
+		return nil
+	}
+	pattern := q.Line
+	if q.FoldCase {
+		pattern = "(?i)" + pattern
+	}
+	// The backend's RE2 accepts a few things Go's regexp doesn't; we
+	// just go without the filename signal for those.
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// rankResultsV2 puts results in the order r ranks their files in.
+func rankResultsV2(r ranker, results []*api.ResultV2, pattern *regexp.Regexp) {
+	files := make([]rankedFile, len(results))
+	for i, res := range results {
+		files[i] = rankedFile{
+			tree:        res.Tree,
+			path:        res.Path,
+			numMatches:  res.NumMatches,
+			definitions: res.NumDefinitions,
+			index:       i,
+		}
+	}
+	r.rank(files, pattern)
+	ranked := make([]*api.ResultV2, len(results))
+	for i, f := range files {
+		ranked[i] = results[f.index]
+	}
+	copy(results, ranked)
+}
+
+// rankResults puts results, one per matching line, in the order r ranks
+// their files in, and each file's lines in order.
+func rankResults(r ranker, results []*api.Result, pattern *regexp.Regexp) {
+	type fileKey struct{ tree, path string }
+	var files []rankedFile
+	lines := make(map[int][]*api.Result)
+	index := make(map[fileKey]int)
+	for _, res := range results {
+		k := fileKey{res.Tree, res.Path}
+		i, ok := index[k]
+		if !ok {
+			i = len(files)
+			index[k] = i
+			files = append(files, rankedFile{tree: res.Tree, path: res.Path, index: i})
+		}
+		files[i].numMatches++
+		if res.Symbol != nil {
+			files[i].definitions++
+		}
+		lines[i] = append(lines[i], res)
+	}
+	r.rank(files, pattern)
+
+	ranked := results[:0]
+	for _, f := range files {
+		fileLines := lines[f.index]
+		sort.SliceStable(fileLines, func(i, j int) bool {
+			return fileLines[i].LineNumber < fileLines[j].LineNumber
+		})
+		ranked = append(ranked, fileLines...)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func rankedPaths(results []*api.ResultV2) []string {
+	var paths []string
+	for _, r := range results {
+		paths = append(paths, r.Tree+":"+r.Path)
+	}
+	return paths
+}
+
+func TestQuerySortOrder(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+		err   bool
+	}{
+		{"foo", "", false},
+		{"foo sort:path", "path", false},
+		{"sort:repo foo", "repo", false},
+		{"foo AND (bar OR baz sort:relevance)", "relevance", false},
+		{"foo sort:path AND bar sort:path", "path", false},
+		{"foo sort:path AND bar sort:repo", "", true},
+		{"foo sort:definitions", "definitions", false},
+		{"foo sort:size", "", true},
+	}
+	for _, tc := range cases {
+		got, err := querySortOrder(tc.query, true)
+		if (err != nil) != tc.err {
+			t.Errorf("querySortOrder(%q): err=%v, want error: %v", tc.query, err, tc.err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("querySortOrder(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+
+	if _, err := ParseQuery("foo sort:size", true); err == nil {
+		t.Error("ParseQuery accepted an unknown sort: order")
+	}
+	q, err := ParseQuery("foo sort:path", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Line != "foo" {
+		t.Errorf("ParseQuery kept sort: in the line: %q", q.Line)
+	}
+}
+
+func TestRelevanceRanking(t *testing.T) {
+	results := []*api.ResultV2{
+		{Tree: "a", Path: "vendor/github.com/x/handler.go", NumMatches: 3},
+		{Tree: "a", Path: "server/handler_test.go", NumMatches: 3},
+		{Tree: "a", Path: "server/api.go", NumMatches: 3},
+		{Tree: "a", Path: "server/handler.go", NumMatches: 3},
+		{Tree: "a", Path: "proto/handler.pb.go", NumMatches: 3},
+		{Tree: "b", Path: "server/api.go", NumMatches: 3},
+	}
+	rankResultsV2(&relevanceRanker{}, results, regexp.MustCompile("(?i)handler"))
+	want := []string{
+		"a:server/handler.go",
+		"a:server/api.go",
+		"b:server/api.go",
+		"a:proto/handler.pb.go",
+		"a:server/handler_test.go",
+		"a:vendor/github.com/x/handler.go",
+	}
+	if got := rankedPaths(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestRepoBoosts(t *testing.T) {
+	rankers, err := newRankers(config.Ranking{RepoBoosts: map[string]float64{"^b$": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []*api.ResultV2{
+		{Tree: "a", Path: "main.go", NumMatches: 2},
+		{Tree: "b", Path: "main.go", NumMatches: 1},
+	}
+	rankResultsV2(rankers[sortRelevance], results, nil)
+	if got, want := rankedPaths(results), []string{"b:main.go", "a:main.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := newRankers(config.Ranking{RepoBoosts: map[string]float64{"(": 1}}); err == nil {
+		t.Error("newRankers accepted a bad repo regex")
+	}
+	if _, err := newRankers(config.Ranking{DefaultSort: "size"}); err == nil {
+		t.Error("newRankers accepted a bad default_sort")
+	}
+}
+
+func TestPathAndRepoRanking(t *testing.T) {
+	results := func() []*api.ResultV2 {
+		return []*api.ResultV2{
+			{Tree: "b", Path: "a.go"},
+			{Tree: "a", Path: "b.go"},
+			{Tree: "a", Path: "a.go"},
+		}
+	}
+	r := results()
+	rankResultsV2(pathRanker{}, r, nil)
+	if got, want := rankedPaths(r), []string{"a:a.go", "b:a.go", "a:b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("path: got %v, want %v", got, want)
+	}
+	r = results()
+	rankResultsV2(repoRanker{}, r, nil)
+	if got, want := rankedPaths(r), []string{"a:a.go", "a:b.go", "b:a.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("repo: got %v, want %v", got, want)
+	}
+}
+
+func TestDefinitionsRanking(t *testing.T) {
+	rankers, err := newRankers(config.Ranking{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []*api.ResultV2{
+		{Tree: "a", Path: "server/api.go", NumMatches: 5},
+		{Tree: "a", Path: "server/deep/nested/handler.go", NumMatches: 1, NumDefinitions: 1},
+		{Tree: "a", Path: "main.go", NumMatches: 3},
+	}
+	rankResultsV2(rankers[sortDefinitions], results, nil)
+	want := []string{"a:server/deep/nested/handler.go", "a:server/api.go", "a:main.go"}
+	if got := rankedPaths(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestRankResultsGroupsLines(t *testing.T) {
+	results := []*api.Result{
+		{Tree: "a", Path: "x_test.go", LineNumber: 1},
+		{Tree: "a", Path: "x.go", LineNumber: 9},
+		{Tree: "a", Path: "x_test.go", LineNumber: 2},
+		{Tree: "a", Path: "x.go", LineNumber: 3},
+	}
+	rankResults(&relevanceRanker{}, results, nil)
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Path+":"+string(rune('0'+r.LineNumber)))
+	}
+	want := []string{"x.go:3", "x.go:9", "x_test.go:1", "x_test.go:2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRankPattern(t *testing.T) {
+	if re := rankPattern(&pb.Query{Line: "Foo", FoldCase: true}, nil); re == nil || !re.MatchString("foo.go") {
+		t.Errorf("fold_case pattern %v doesn't match foo.go", re)
+	}
+	if re := rankPattern(&pb.Query{Line: `\Cx`}, nil); re != nil {
+		t.Errorf("got %v for a pattern Go can't compile", re)
+	}
+	expr, err := ParseQueryExpr("NOT bar AND foo", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re := rankPattern(&pb.Query{}, expr); re == nil || re.String() != "(?i)foo" {
+		t.Errorf("boolean query pattern: got %v, want (?i)foo", re)
+	}
+}
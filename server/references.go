@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// symbolRE matches the symbols the fileviewer can look up: the same
+// identifiers the syntax highlighter lets people click on.
+var symbolRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// referencesQuery searches repo for lines using symbol as a whole word.
+func referencesQuery(symbol, repo string) string {
+	return fmt.Sprintf(`case:\b%s\b repo:^%s$`, symbol, regexp.QuoteMeta(repo))
+}
+
+// definitionQuery searches the backend's tags for where symbol is
+// defined, in any repo.
+func definitionQuery(symbol string) string {
+	return "def:" + symbol
+}
+
+// symbolSearchRequest returns a request for query against backend, as
+// ServerSideAPISearchV2 takes it. Symbols are matched case-sensitively.
+func symbolSearchRequest(backend, query string) *http.Request {
+	params := url.Values{
+		"q":         {query},
+		"regex":     {"true"},
+		"fold_case": {"false"},
+		":backend":  {backend},
+	}
+	return &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/api/v2/search/", RawQuery: params.Encode()},
+		Header: make(http.Header),
+	}
+}
+
+// A symbolSearch is one of the searches the references panel shows.
+type symbolSearch struct {
+	// Links to the search page showing all of the results.
+	URL   string
+	Reply *api.ReplySearchV2
+	Error string
+}
+
+// symbolReferences is what the fileviewer's references panel shows for
+// a symbol clicked on in a file in Repo.
+type symbolReferences struct {
+	Symbol string
+	Repo   string
+	// Nil when the backend has no tags. The references are then all we
+	// can offer, definitions included.
+	Definitions *symbolSearch
+	References  *symbolSearch
+}
+
+func (s *server) symbolSearch(ctx context.Context, backend, query string) *symbolSearch {
+	r := symbolSearchRequest(backend, query)
+	params := r.URL.Query()
+	params.Del(":backend")
+	search := &symbolSearch{URL: "/search/" + url.PathEscape(backend) + "?" + params.Encode()}
+
+	reply, _, _, errorMsgLong := s.ServerSideAPISearchV2(ctx, nil, r)
+	if reply == nil {
+		search.Error = errorMsgLong
+	}
+	search.Reply = reply
+	return search
+}
+
+// findReferences searches for where symbol is defined and used, from a
+// file in repo. If backendName is empty, we use the backend that
+// indexes repo.
+func (s *server) findReferences(ctx context.Context, backendName, symbol, repo string) (*symbolReferences, error) {
+	if !symbolRE.MatchString(symbol) {
+		return nil, fmt.Errorf("Not a symbol: %q", symbol)
+	}
+	if repo == "" {
+		return nil, fmt.Errorf("No repo to find references to %s in", symbol)
+	}
+	var bk *Backend
+	if backendName != "" {
+		bk = s.bk[backendName]
+	} else {
+		bk = s.routeQuery(&pb.Query{Repo: "^" + regexp.QuoteMeta(repo) + "$"}, nil)
+	}
+	if bk == nil {
+		return nil, fmt.Errorf("Unknown backend: %s", backendName)
+	}
+	bk.I.Lock()
+	hasTags := bk.I.HasTags
+	bk.I.Unlock()
+
+	refs := &symbolReferences{
+		Symbol:     symbol,
+		Repo:       repo,
+		References: s.symbolSearch(ctx, bk.Id, referencesQuery(symbol, repo)),
+	}
+	if hasTags {
+		refs.Definitions = s.symbolSearch(ctx, bk.Id, definitionQuery(symbol))
+	}
+	return refs, nil
+}
+
+// ServeRenderedReferences renders the fileviewer's references panel for
+// the symbol and repo parameters.
+func (s *server) ServeRenderedReferences(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	refs, err := s.findReferences(ctx, params.Get(":backend"), params.Get("symbol"), params.Get("repo"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	s.renderPage(ctx, w, r, "references_partial.html", &page{
+		IncludeHeader: false,
+		Data:          refs,
+	})
+}
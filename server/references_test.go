@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestSymbolQueries(t *testing.T) {
+	q, err := ParseQuery(referencesQuery("Open", "org/my.lib"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Line != `\bOpen\b` || q.Repo != `^org/my\.lib$` || q.FoldCase {
+		t.Errorf("references query parsed to %+v", q)
+	}
+	q, err = ParseQuery(definitionQuery("open"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Line != "^(?:open)$" || q.Tags == "" {
+		t.Errorf("definition query parsed to %+v", q)
+	}
+}
+
+func TestFindReferences(t *testing.T) {
+	// Set by New, which the test doesn't call.
+	newYorkTime = time.UTC
+
+	cs := &fakeCodesearch{
+		lines: []*pb.SearchResult{{
+			Tree: "org/lib", Version: "v", Path: "use.go", LineNumber: 7,
+			Line: "\tOpen()", Bounds: []*pb.Bounds{{Left: 1, Right: 5}}, NumMatches: 1,
+		}},
+		tags: []*pb.SearchResult{{
+			Tree: "org/lib", Version: "v", Path: "open.go", LineNumber: 3,
+			Line: "func Open() {", Bounds: []*pb.Bounds{{Left: 5, Right: 9}}, NumMatches: 1,
+			Tag: "Open\topen.go\t3;\"\tfunction",
+		}},
+	}
+	bk := &Backend{Id: "main", I: &I{Trees: []Tree{{Name: "org/lib"}}}, Codesearch: cs}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": bk},
+		bkOrder: []string{"main"},
+	}
+	ctx := context.Background()
+
+	refs, err := s.findReferences(ctx, "", "Open", "org/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs.Definitions != nil {
+		t.Errorf("searched for definitions without tags: %+v", refs.Definitions)
+	}
+	if refs.References.Error != "" || len(refs.References.Reply.Results) != 1 {
+		t.Fatalf("references: %+v", refs.References)
+	}
+	if !strings.HasPrefix(refs.References.URL, "/search/main?") {
+		t.Errorf("references URL = %s", refs.References.URL)
+	}
+
+	bk.I.HasTags = true
+	cs.queries = nil
+	refs, err = s.findReferences(ctx, "main", "Open", "org/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs.Definitions == nil || len(refs.Definitions.Reply.Results) != 1 {
+		t.Fatalf("definitions: %+v", refs.Definitions)
+	}
+	if def := refs.Definitions.Reply.Results[0]; def.Path != "open.go" || def.NumDefinitions != 1 {
+		t.Errorf("definition: %+v", def)
+	}
+	for _, q := range cs.queries {
+		if q.FoldCase {
+			t.Errorf("symbol search %+v ignores case", q)
+		}
+	}
+
+	for _, bad := range []struct{ backend, symbol, repo string }{
+		{"", "a b", "org/lib"},
+		{"", "", "org/lib"},
+		{"", "Open", ""},
+		{"other", "Open", "org/lib"},
+	} {
+		if _, err := s.findReferences(ctx, bad.backend, bad.symbol, bad.repo); err == nil {
+			t.Errorf("findReferences(%q, %q, %q) succeeded", bad.backend, bad.symbol, bad.repo)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/fileviewer"
+	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/metrics"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// replaceContextLines is how many unchanged lines surround the changes in
+// a patch, as in git diff's.
+const replaceContextLines = 3
+
+// A fileReplacement is what a replacement does to one file.
+type fileReplacement struct {
+	path     string
+	old, new []string
+	// Whether the file's last line has no newline.
+	noEOL bool
+	// The indexes of the lines the replacement changes, in order.
+	changed []int
+}
+
+func splitLines(content string) (lines []string, noEOL bool) {
+	if content == "" {
+		return nil, false
+	}
+	noEOL = !strings.HasSuffix(content, "\n")
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n"), noEOL
+}
+
+// replaceLines replaces what re matches with template, in the lines of
+// content numbered lnos, counting from 1.
+func replaceLines(path, content string, lnos []int, re *regexp.Regexp, template string) *fileReplacement {
+	f := &fileReplacement{path: path}
+	f.old, f.noEOL = splitLines(content)
+	f.new = append([]string(nil), f.old...)
+
+	sort.Ints(lnos)
+	for i, lno := range lnos {
+		if lno < 1 || lno > len(f.old) || (i > 0 && lno == lnos[i-1]) {
+			continue
+		}
+		line := f.old[lno-1]
+		if replaced := re.ReplaceAllString(line, template); replaced != line {
+			f.new[lno-1] = replaced
+			f.changed = append(f.changed, lno-1)
+		}
+	}
+	return f
+}
+
+// writeDiff writes the changes to f as a unified diff, as git diff
+// would, merging changes whose context overlaps into one hunk.
+func (f *fileReplacement) writeDiff(b *strings.Builder) {
+	fmt.Fprintf(b, "diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n", f.path, f.path, f.path, f.path)
+	writeLine := func(prefix string, i int, line string) {
+		b.WriteString(prefix + line + "\n")
+		if f.noEOL && i == len(f.old)-1 {
+			b.WriteString("\\ No newline at end of file\n")
+		}
+	}
+
+	for i := 0; i < len(f.changed); {
+		start := f.changed[i] - replaceContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := f.changed[i] + replaceContextLines + 1
+		j := i + 1
+		for j < len(f.changed) && f.changed[j]-replaceContextLines <= end {
+			end = f.changed[j] + replaceContextLines + 1
+			j++
+		}
+		if end > len(f.old) {
+			end = len(f.old)
+		}
+
+		// Replacing within lines never adds or removes any, so both
+		// sides of a hunk cover the same lines.
+		fmt.Fprintf(b, "@@ -%d,%d +%d,%d @@\n", start+1, end-start, start+1, end-start)
+		next := i
+		for k := start; k < end; k++ {
+			if next < j && f.changed[next] == k {
+				writeLine("-", k, f.old[k])
+				writeLine("+", k, f.new[k])
+				next++
+			} else {
+				writeLine(" ", k, f.old[k])
+			}
+		}
+		i = j
+	}
+}
+
+// replaceRegexp compiles the regex q matches lines with, for Go to
+// replace matches of.
+func replaceRegexp(q *pb.Query) (*regexp.Regexp, error) {
+	pattern := q.Line
+	if q.FoldCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Can't replace matches of %q: %s", q.Line, err)
+	}
+	return re, nil
+}
+
+type replaceFile struct {
+	tree, version, path string
+}
+
+// buildPatches applies the replacement to every file with results,
+// reading each at the version it was indexed at, and returns a patch for
+// each repo it changes.
+func (s *server) buildPatches(ctx context.Context, results []*api.Result, re *regexp.Regexp, template string) ([]*api.RepoPatch, []string) {
+	lines := make(map[replaceFile][]int)
+	var files []replaceFile
+	for _, r := range results {
+		f := replaceFile{r.Tree, r.Version, r.Path}
+		if _, ok := lines[f]; !ok {
+			files = append(files, f)
+		}
+		lines[f] = append(lines[f], r.LineNumber)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].tree != files[j].tree {
+			return files[i].tree < files[j].tree
+		}
+		return files[i].path < files[j].path
+	})
+
+	var patches []*api.RepoPatch
+	var skipped []string
+	var diff strings.Builder
+	var patch *api.RepoPatch
+	flush := func() {
+		if patch != nil && patch.NumFiles > 0 {
+			patch.Diff = diff.String()
+			patches = append(patches, patch)
+		}
+		diff.Reset()
+	}
+	for _, f := range files {
+		if patch == nil || patch.Tree != f.tree {
+			flush()
+			patch = &api.RepoPatch{Tree: f.tree, Version: f.version}
+		}
+		repo, ok := s.repos[f.tree]
+		if !ok {
+			skipped = append(skipped, fmt.Sprintf("%s:%s: the repo isn't configured for the file viewer", f.tree, f.path))
+			continue
+		}
+		content, err := fileviewer.ReadBlob(f.path, repo, f.version)
+		if err != nil {
+			log.Warnf(ctx, "reading blob for replacement tree=%q path=%q err=%s", f.tree, f.path, err)
+			skipped = append(skipped, fmt.Sprintf("%s:%s: %s", f.tree, f.path, err))
+			continue
+		}
+		replaced := replaceLines(f.path, content, lines[f], re, template)
+		if len(replaced.changed) == 0 {
+			continue
+		}
+		replaced.writeDiff(&diff)
+		patch.NumFiles++
+		patch.NumLines += len(replaced.changed)
+	}
+	flush()
+	return patches, skipped
+}
+
+// ServeAPISearchReplace previews replacing every match of a search with
+// the replace parameter, in which $1 or ${name} expand to the match's
+// capture groups. It searches for every match up to the configured
+// export_max_matches, and replies with a unified diff per repo, or, with
+// format=patch, just the diff for the repo named by tree, to download.
+func (s *server) ServeAPISearchReplace(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	template, ok := params["replace"]
+	if !ok {
+		writeError(ctx, w, 400, "bad_replace", "You must give the text to replace matches with as replace")
+		return
+	}
+	format := params.Get("format")
+	switch format {
+	case "", "json":
+	case "patch":
+		if params.Get("tree") == "" {
+			writeError(ctx, w, 400, "bad_format", "format=patch needs the tree to download the patch for")
+			return
+		}
+	default:
+		writeError(ctx, w, 400, "bad_format", fmt.Sprintf("Unknown format: %s. Use json or patch", format))
+		return
+	}
+
+	q, expr, is_regex, err := extractQuery(ctx, r)
+
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	backendName, backend := getBackendFromQuery(s, r, &q, expr)
+	if backend == nil {
+		writeError(ctx, w, 400, "bad_backend",
+			fmt.Sprintf("Unknown backend: %s", backendName))
+		return
+	}
+	ctx = withSearchFields(ctx, r, backend.Id)
+
+	if expr != nil && expr.Op != ExprLeaf {
+		writeError(ctx, w, 400, "bad_query", "Search-and-replace needs a single search term, not a boolean query")
+		return
+	}
+	if expr != nil {
+		// A single term that repeats filters. It's still searched as
+		// a leaf, so that they're checked.
+		q = expr.Query
+	}
+	if q.Line == "" || q.FilenameOnly || q.TreenameOnly {
+		kind := "string"
+		if is_regex {
+			kind = "regex"
+		}
+		msg := fmt.Sprintf("You must specify a %s to replace", kind)
+		writeError(ctx, w, 400, "bad_query", msg)
+		return
+	}
+	re, err := replaceRegexp(&q)
+	if err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+
+	if q.MaxMatches == 0 {
+		q.MaxMatches = s.config.DefaultMaxMatches
+	}
+	s.limitQuery(&q, expr)
+
+	reply, err := exportSearch(&q, expr, s.exportMaxMatches(), func(q *pb.Query, expr *QueryExpr) (*api.ReplySearch, error) {
+		return s.doSearch(ctx, backend, q, expr, searchOptions{regex: is_regex})
+	})
+
+	if err != nil {
+		log.Errorf(ctx, "error in search-and-replace err=%s", err)
+		writeQueryError(ctx, w, err)
+		return
+	}
+
+	metrics.ObserveSearch(backend.Id, reply.Info.ExitReason)
+
+	if s.statsd != nil {
+		s.statsd.Increment("api.search.replace.invocations")
+		s.statsd.Increment("api.search.replace.exit_reason." + reply.Info.ExitReason)
+		s.statsd.Timing("api.search.replace.total_time", reply.Info.TotalTime)
+	}
+
+	logSearch(ctx, len(reply.Results), reply.Info)
+
+	patches, skipped := s.buildPatches(ctx, reply.Results, re, template[0])
+
+	if format == "patch" {
+		tree := params.Get("tree")
+		for _, p := range patches {
+			if p.Tree != tree {
+				continue
+			}
+			w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+			w.Header().Set("Content-Disposition",
+				fmt.Sprintf("attachment; filename=\"%s.patch\"", strings.Replace(tree, "/", "-", -1)))
+			w.Header().Set("X-Livegrep-Exit-Reason", reply.Info.ExitReason)
+			w.WriteHeader(200)
+			w.Write([]byte(p.Diff))
+			return
+		}
+		writeError(ctx, w, 404, "no_changes", fmt.Sprintf("The replacement changes nothing in %s", tree))
+		return
+	}
+
+	if patches == nil {
+		patches = []*api.RepoPatch{}
+	}
+	replyJSON(ctx, w, 200, &api.ReplyReplace{
+		Info:    reply.Info,
+		Patches: patches,
+		Skipped: skipped,
+	})
+}
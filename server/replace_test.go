@@ -0,0 +1,142 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestReplaceDiff(t *testing.T) {
+	lines := func(n int) string {
+		var b strings.Builder
+		for i := 1; i <= n; i++ {
+			b.WriteString("line " + strings.Repeat("x", i%3) + "\n")
+		}
+		return b.String()
+	}
+	cases := []struct {
+		name    string
+		content string
+		lnos    []int
+		re      string
+		replace string
+		want    string
+	}{
+		{
+			"capture groups",
+			"a\nfoo(1, 2)\nb\n",
+			[]int{2},
+			`foo\((\w+), (\w+)\)`, "bar($2, $1)",
+			`diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,3 +1,3 @@
+ a
+-foo(1, 2)
++bar(2, 1)
+ b
+`,
+		},
+		{
+			"only matched lines change",
+			"foo\nfoo\n",
+			[]int{2, 2},
+			"foo", "bar",
+			`diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,2 +1,2 @@
+ foo
+-foo
++bar
+`,
+		},
+		{
+			"no newline at end of file",
+			"a\nfoo",
+			[]int{2},
+			"foo", "bar",
+			`diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,2 +1,2 @@
+ a
+-foo
+\ No newline at end of file
++bar
+\ No newline at end of file
+`,
+		},
+		{
+			"nearby changes share a hunk",
+			strings.Replace(lines(12), "line \n", "line o\n", -1),
+			[]int{3, 9},
+			"o$", "0",
+			`diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,12 +1,12 @@
+ line x
+ line xx
+-line o
++line 0
+ line x
+ line xx
+ line o
+ line x
+ line xx
+-line o
++line 0
+ line x
+ line xx
+ line o
+`,
+		},
+		{
+			"distant changes get their own hunks",
+			strings.Replace(lines(12), "line \n", "line o\n", -1),
+			[]int{1, 11},
+			"x+$", "y",
+			`diff --git a/f.go b/f.go
+--- a/f.go
++++ b/f.go
+@@ -1,4 +1,4 @@
+-line x
++line y
+ line xx
+ line o
+ line x
+@@ -8,5 +8,5 @@
+ line xx
+ line o
+ line x
+-line xx
++line y
+ line o
+`,
+		},
+	}
+	for _, tc := range cases {
+		f := replaceLines("f.go", tc.content, tc.lnos, regexp.MustCompile(tc.re), tc.replace)
+		var b strings.Builder
+		f.writeDiff(&b)
+		if b.String() != tc.want {
+			t.Errorf("%s: got diff\n%s\nwant\n%s", tc.name, b.String(), tc.want)
+		}
+	}
+}
+
+func TestReplaceRegexp(t *testing.T) {
+	re, err := replaceRegexp(&pb.Query{Line: "foo", FoldCase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := re.ReplaceAllString("Foo FOO", "bar"); got != "bar bar" {
+		t.Errorf("case-folded replacement gave %q", got)
+	}
+	if _, err := replaceRegexp(&pb.Query{Line: "(a"}); err == nil {
+		t.Error("expected an error replacing matches of an invalid regex")
+	}
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+// latencyWindowSize is how many recent search latencies we keep to
+// decide when to hedge.
+const latencyWindowSize = 200
+
+// minHedgeSamples is how many latencies we want before trusting their
+// percentile enough to hedge on it.
+const minHedgeSamples = 20
+
+type replica struct {
+	addr   string
+	client pb.CodeSearchClient
+	conn   *grpc.ClientConn
+	// its share of searches relative to the other replicas
+	weight int
+	// set when the replica didn't answer the last poll, or a search
+	// since then found it unavailable
+	down     int32
+	inflight int64
+}
+
+// replicaSet is a pb.CodeSearchClient that spreads calls across identical
+// copies of an index. Replica health comes from QuickInfo, which the
+// Backend's poll loop calls every second.
+type replicaSet struct {
+	replicas        []*replica
+	next            uint32
+	leastLoaded     bool
+	hedgePercentile float64
+	latencies       *latencyWindow
+
+	mu sync.Mutex
+	// the replica with the oldest index when QuickInfo last asked
+	oldest *replica
+}
+
+func newReplicaSet(replicas []*replica, be config.Backend) (*replicaSet, error) {
+	rs := &replicaSet{
+		replicas:        replicas,
+		hedgePercentile: be.HedgePercentile,
+		latencies:       newLatencyWindow(latencyWindowSize),
+	}
+	switch be.Balancing {
+	case "", "round_robin":
+	case "least_loaded":
+		rs.leastLoaded = true
+	default:
+		return nil, fmt.Errorf("backend %s: unknown balancing %q", be.Id, be.Balancing)
+	}
+	for _, r := range replicas {
+		r.weight = 1
+	}
+	for addr, weight := range be.Weights {
+		found := false
+		for _, r := range replicas {
+			if r.addr == addr {
+				r.weight = weight
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("backend %s: weight for %s, which is neither addr nor a replica", be.Id, addr)
+		}
+		if weight <= 0 {
+			return nil, fmt.Errorf("backend %s: weight for %s must be positive", be.Id, addr)
+		}
+	}
+	if be.HedgePercentile < 0 || be.HedgePercentile >= 100 {
+		return nil, fmt.Errorf("backend %s: hedge_percentile must be between 0 and 100", be.Id)
+	}
+	return rs, nil
+}
+
+// healthy returns the replicas that answered the last poll, or all of
+// them if none did, since they may yet recover.
+func (rs *replicaSet) healthy() []*replica {
+	up := make([]*replica, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		if atomic.LoadInt32(&r.down) == 0 {
+			up = append(up, r)
+		}
+	}
+	if len(up) == 0 {
+		return rs.replicas
+	}
+	return up
+}
+
+// pick returns the replica to send the next call to, other than those
+// in exclude, or nil if there is no such replica. Each replica is picked
+// in proportion to its weight.
+func (rs *replicaSet) pick(exclude ...*replica) *replica {
+	var candidates []*replica
+	total := 0
+	for _, r := range rs.healthy() {
+		if !containsReplica(exclude, r) {
+			candidates = append(candidates, r)
+			total += r.weight
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	n := int(atomic.AddUint32(&rs.next, 1) % uint32(total))
+	start := 0
+	for n >= candidates[start].weight {
+		n -= candidates[start].weight
+		start++
+	}
+	best := candidates[start]
+	if !rs.leastLoaded {
+		return best
+	}
+	// Start from the round robin pick, so ties are spread out too.
+	for i := 1; i < len(candidates); i++ {
+		r := candidates[(start+i)%len(candidates)]
+		// Compares inflight/weight without dividing.
+		if atomic.LoadInt64(&r.inflight)*int64(best.weight) < atomic.LoadInt64(&best.inflight)*int64(r.weight) {
+			best = r
+		}
+	}
+	return best
+}
+
+func containsReplica(replicas []*replica, r *replica) bool {
+	for _, other := range replicas {
+		if other == r {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether a search that failed with err might succeed
+// on another replica.
+func retryable(err error) bool {
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// hedgeDelay returns how long to wait for a search before also sending
+// it to a second replica, if we should at all.
+func (rs *replicaSet) hedgeDelay() (time.Duration, bool) {
+	if rs.hedgePercentile <= 0 || len(rs.healthy()) < 2 {
+		return 0, false
+	}
+	return rs.latencies.Percentile(rs.hedgePercentile)
+}
+
+func (rs *replicaSet) search(ctx context.Context, r *replica, in *pb.Query, opts []grpc.CallOption) (*pb.CodeSearchResult, error) {
+	atomic.AddInt64(&r.inflight, 1)
+	defer atomic.AddInt64(&r.inflight, -1)
+
+	start := time.Now()
+	result, err := r.client.Search(ctx, in, opts...)
+	if err == nil {
+		rs.latencies.Add(time.Since(start))
+	}
+	if grpc.Code(err) == codes.Unavailable {
+		// Until the next poll finds it back up.
+		atomic.StoreInt32(&r.down, 1)
+	}
+	return result, err
+}
+
+// Search sends the search to a replica, and, if it fails with a
+// retryable error, once more to another one.
+func (rs *replicaSet) Search(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (*pb.CodeSearchResult, error) {
+	first := rs.pick()
+	delay, hedge := rs.hedgeDelay()
+	if !hedge {
+		result, err := rs.search(ctx, first, in, opts)
+		if err != nil && retryable(err) {
+			if second := rs.pick(first); second != nil {
+				return rs.search(ctx, second, in, opts)
+			}
+		}
+		return result, err
+	}
+
+	// Whichever search loses is cancelled when we return.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type answer struct {
+		result *pb.CodeSearchResult
+		err    error
+	}
+	answers := make(chan answer, 2)
+	send := func(r *replica) {
+		go func() {
+			result, err := rs.search(ctx, r, in, opts)
+			answers <- answer{result, err}
+		}()
+	}
+
+	sent := []*replica{first}
+	send(first)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	retried := false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if second := rs.pick(sent...); second != nil {
+				sent = append(sent, second)
+				send(second)
+				pending++
+			}
+		case a := <-answers:
+			pending--
+			if a.err == nil {
+				return a.result, nil
+			}
+			err = a.err
+			if retryable(err) && !retried {
+				retried = true
+				if next := rs.pick(sent...); next != nil {
+					sent = append(sent, next)
+					send(next)
+					pending++
+				}
+			}
+		}
+	}
+	return nil, err
+}
+
+// StreamSearch streams the search from a replica. If it fails with a
+// retryable error before any results arrive, it's sent once more to
+// another one, as Search does.
+func (rs *replicaSet) StreamSearch(ctx context.Context, in *pb.Query, opts ...grpc.CallOption) (pb.CodeSearch_StreamSearchClient, error) {
+	s := &replicaStream{rs: rs, ctx: ctx, in: in, opts: opts}
+	if err := s.open(rs.pick()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replicaStream is a search streaming from one of a replicaSet's
+// replicas, which starts over on another if the first fails before
+// sending anything.
+type replicaStream struct {
+	pb.CodeSearch_StreamSearchClient
+	rs       *replicaSet
+	ctx      context.Context
+	in       *pb.Query
+	opts     []grpc.CallOption
+	sent     []*replica
+	received bool
+}
+
+// open streams the search from r.
+func (s *replicaStream) open(r *replica) error {
+	s.sent = append(s.sent, r)
+	stream, err := r.client.StreamSearch(s.ctx, s.in, s.opts...)
+	if err != nil {
+		return s.retry(err)
+	}
+	s.CodeSearch_StreamSearchClient = stream
+	return nil
+}
+
+// retry opens the stream on another replica if err, which the last one
+// failed with, is retryable and it hasn't been retried already.
+// Otherwise it returns err.
+func (s *replicaStream) retry(err error) error {
+	if grpc.Code(err) == codes.Unavailable {
+		// Until the next poll finds it back up.
+		atomic.StoreInt32(&s.sent[len(s.sent)-1].down, 1)
+	}
+	if !retryable(err) || len(s.sent) > 1 {
+		return err
+	}
+	next := s.rs.pick(s.sent...)
+	if next == nil {
+		return err
+	}
+	return s.open(next)
+}
+
+func (s *replicaStream) Recv() (*pb.CodeSearchResult, error) {
+	result, err := s.CodeSearch_StreamSearchClient.Recv()
+	if err == nil {
+		s.received = true
+		return result, nil
+	}
+	if err == io.EOF || s.received || len(s.sent) > 1 {
+		return nil, err
+	}
+	if err := s.retry(err); err != nil {
+		return nil, err
+	}
+	return s.Recv()
+}
+
+// Info describes the replica with the oldest index, whose index time
+// QuickInfo reports, or, before QuickInfo has answered, any replica.
+func (rs *replicaSet) Info(ctx context.Context, in *pb.InfoRequest, opts ...grpc.CallOption) (*pb.ServerInfo, error) {
+	rs.mu.Lock()
+	r := rs.oldest
+	rs.mu.Unlock()
+	if r == nil {
+		r = rs.pick()
+	}
+	return r.client.Info(ctx, in, opts...)
+}
+
+// QuickInfo asks every replica, marking the ones that don't answer as
+// down. It returns the oldest index among those that do, so the Backend
+// only sees a new index once every replica has it.
+func (rs *replicaSet) QuickInfo(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.QuickServerInfo, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var oldest *pb.QuickServerInfo
+	var oldestReplica *replica
+	var firstErr error
+	for _, r := range rs.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			info, err := r.client.QuickInfo(ctx, in, opts...)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				atomic.StoreInt32(&r.down, 1)
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			atomic.StoreInt32(&r.down, 0)
+			if oldest == nil || info.IndexTime < oldest.IndexTime {
+				oldest, oldestReplica = info, r
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if oldest == nil {
+		return nil, firstErr
+	}
+	rs.mu.Lock()
+	rs.oldest = oldestReplica
+	rs.mu.Unlock()
+	return oldest, nil
+}
+
+// Reload asks every replica to reload its index.
+func (rs *replicaSet) Reload(ctx context.Context, in *pb.Empty, opts ...grpc.CallOption) (*pb.Empty, error) {
+	var firstErr error
+	for _, r := range rs.replicas {
+		if _, err := r.client.Reload(ctx, in, opts...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return &pb.Empty{}, nil
+}
+
+type ReplicaStatus struct {
+	Addr       string             `json:"addr"`
+	GrpcStatus connectivity.State `json:"grpc_status"`
+	Up         bool               `json:"up"`
+	Weight     int                `json:"weight"`
+	InFlight   int64              `json:"in_flight"`
+}
+
+func (rs *replicaSet) status() []*ReplicaStatus {
+	statuses := make([]*ReplicaStatus, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		statuses = append(statuses, &ReplicaStatus{
+			Addr:       r.addr,
+			GrpcStatus: r.conn.GetState(),
+			Up:         atomic.LoadInt32(&r.down) == 0,
+			Weight:     r.weight,
+			InFlight:   atomic.LoadInt64(&r.inflight),
+		})
+	}
+	return statuses
+}
+
+// latencyWindow keeps the most recent search latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, size)}
+}
+
+func (w *latencyWindow) Add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+}
+
+// Percentile returns the p'th percentile latency, or false if we haven't
+// seen enough searches yet.
+func (w *latencyWindow) Percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+
+	if len(sorted) < minHedgeSamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(p / 100 * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx], true
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func testReplicaSet(t *testing.T, be config.Backend, fakes ...*fakeCodesearch) *replicaSet {
+	var replicas []*replica
+	for _, f := range fakes {
+		replicas = append(replicas, &replica{addr: f.name, client: f})
+	}
+	rs, err := newReplicaSet(replicas, be)
+	if err != nil {
+		t.Fatalf("newReplicaSet: %v", err)
+	}
+	return rs
+}
+
+func TestReplicaSetRoundRobin(t *testing.T) {
+	a, b, c := &fakeCodesearch{name: "a"}, &fakeCodesearch{name: "b"}, &fakeCodesearch{name: "c"}
+	rs := testReplicaSet(t, config.Backend{}, a, b, c)
+
+	for i := 0; i < 6; i++ {
+		rs.Search(context.Background(), &pb.Query{})
+	}
+	for _, f := range []*fakeCodesearch{a, b, c} {
+		if f.searches != 2 {
+			t.Errorf("replica %s got %d searches, want 2", f.name, f.searches)
+		}
+	}
+}
+
+func TestReplicaSetSkipsDownReplicas(t *testing.T) {
+	a, b := &fakeCodesearch{name: "a", indexTime: 20}, &fakeCodesearch{name: "b", down: true}
+	rs := testReplicaSet(t, config.Backend{}, a, b)
+
+	info, err := rs.QuickInfo(context.Background(), &pb.Empty{})
+	if err != nil || info.IndexTime != 20 {
+		t.Fatalf("QuickInfo = %v, %v", info, err)
+	}
+	for i := 0; i < 4; i++ {
+		rs.Search(context.Background(), &pb.Query{})
+	}
+	if b.searches != 0 {
+		t.Errorf("down replica got %d searches", b.searches)
+	}
+
+	b.down = false
+	b.indexTime = 10
+	info, _ = rs.QuickInfo(context.Background(), &pb.Empty{})
+	if info.IndexTime != 10 {
+		t.Errorf("QuickInfo should report the oldest index, got %d", info.IndexTime)
+	}
+	if len(rs.healthy()) != 2 {
+		t.Error("replica should be healthy again")
+	}
+}
+
+func TestReplicaSetLeastLoaded(t *testing.T) {
+	a, b := &fakeCodesearch{name: "a"}, &fakeCodesearch{name: "b"}
+	rs := testReplicaSet(t, config.Backend{Balancing: "least_loaded"}, a, b)
+	rs.replicas[0].inflight = 5
+
+	for i := 0; i < 4; i++ {
+		if r := rs.pick(); r.addr != "b" {
+			t.Errorf("picked %s, want the least loaded replica", r.addr)
+		}
+	}
+
+	// a has more in flight, but fewer for its weight.
+	rs = testReplicaSet(t, config.Backend{Balancing: "least_loaded", Weights: map[string]int{"a": 4}}, a, b)
+	rs.replicas[0].inflight = 3
+	rs.replicas[1].inflight = 1
+	for i := 0; i < 4; i++ {
+		if r := rs.pick(); r.addr != "a" {
+			t.Errorf("picked %s, want the least loaded replica for its weight", r.addr)
+		}
+	}
+}
+
+func TestReplicaSetWeights(t *testing.T) {
+	a, b, c := &fakeCodesearch{name: "a"}, &fakeCodesearch{name: "b"}, &fakeCodesearch{name: "c"}
+	rs := testReplicaSet(t, config.Backend{Weights: map[string]int{"a": 3, "c": 2}}, a, b, c)
+
+	for i := 0; i < 12; i++ {
+		rs.Search(context.Background(), &pb.Query{})
+	}
+	for _, want := range []struct {
+		f        *fakeCodesearch
+		searches int32
+	}{{a, 6}, {b, 2}, {c, 4}} {
+		if want.f.searches != want.searches {
+			t.Errorf("replica %s got %d searches, want %d", want.f.name, want.f.searches, want.searches)
+		}
+	}
+}
+
+func TestReplicaSetRetries(t *testing.T) {
+	unavailable := grpc.Errorf(codes.Unavailable, "connection refused")
+	for _, hedge := range []float64{0, 90} {
+		a, b := &fakeCodesearch{name: "a", err: unavailable}, &fakeCodesearch{name: "b"}
+		rs := testReplicaSet(t, config.Backend{HedgePercentile: hedge}, a, b)
+		for i := 0; i < minHedgeSamples; i++ {
+			// Too slow to hedge before a fails.
+			rs.latencies.Add(time.Hour)
+		}
+		// make sure a is picked first
+		rs.next = 1
+
+		result, err := rs.Search(context.Background(), &pb.Query{})
+		if err != nil || result.IndexName != "b" {
+			t.Errorf("hedge %v: Search = %v, %v, want b's answer", hedge, result, err)
+		}
+		if a.searches != 1 || b.searches != 1 {
+			t.Errorf("hedge %v: a got %d searches and b %d, want one each", hedge, a.searches, b.searches)
+		}
+		if up := rs.healthy(); len(up) != 1 || up[0].addr != "b" {
+			t.Errorf("hedge %v: a should be down until the next poll", hedge)
+		}
+	}
+
+	// Other errors would fail on any replica.
+	a, b := &fakeCodesearch{name: "a", err: grpc.Errorf(codes.InvalidArgument, "bad regex")}, &fakeCodesearch{name: "b"}
+	rs := testReplicaSet(t, config.Backend{}, a, b)
+	rs.next = 1
+	if _, err := rs.Search(context.Background(), &pb.Query{}); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Search = %v, want a's error", err)
+	}
+	if b.searches != 0 {
+		t.Errorf("b got %d searches; only retryable errors should be retried", b.searches)
+	}
+
+	// With nowhere else to go, the error is returned.
+	a = &fakeCodesearch{name: "a", err: unavailable}
+	rs = testReplicaSet(t, config.Backend{}, a)
+	if _, err := rs.Search(context.Background(), &pb.Query{}); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Search = %v, want a's error", err)
+	}
+}
+
+func TestReplicaSetRetriesStreams(t *testing.T) {
+	unavailable := grpc.Errorf(codes.Unavailable, "connection refused")
+	aborted := grpc.Errorf(codes.Aborted, "reloading")
+	for _, a := range []*fakeCodesearch{
+		{name: "a", err: unavailable},
+		{name: "a", streamErr: aborted},
+	} {
+		b := &fakeCodesearch{name: "b", lines: []*pb.SearchResult{fakeLine("r", "a.go", 1, "foo")}}
+		rs := testReplicaSet(t, config.Backend{}, a, b)
+		// make sure a is picked first
+		rs.next = 1
+
+		stream, err := rs.StreamSearch(context.Background(), &pb.Query{Line: "foo"})
+		if err != nil {
+			t.Fatalf("StreamSearch: %v", err)
+		}
+		if result, err := stream.Recv(); err != nil || len(result.Results) != 1 {
+			t.Errorf("Recv = %v, %v, want b's result", result, err)
+		}
+		if a.searches != 1 || b.searches != 1 {
+			t.Errorf("a got %d streams and b %d, want one each", a.searches, b.searches)
+		}
+	}
+
+	// Once results have arrived, a stream can't start over.
+	a := &fakeCodesearch{name: "a", lines: []*pb.SearchResult{fakeLine("r", "a.go", 1, "foo")}}
+	b := &fakeCodesearch{name: "b"}
+	rs := testReplicaSet(t, config.Backend{}, a, b)
+	rs.next = 1
+	stream, err := rs.StreamSearch(context.Background(), &pb.Query{Line: "foo"})
+	if err != nil {
+		t.Fatalf("StreamSearch: %v", err)
+	}
+	stream.Recv()
+	a.streamErr = aborted
+	if _, err := stream.Recv(); grpc.Code(err) != codes.Aborted {
+		t.Errorf("Recv = %v, want a's error", err)
+	}
+	if b.searches != 0 {
+		t.Errorf("b got %d streams after a sent results", b.searches)
+	}
+}
+
+func TestReplicaSetInfoFromOldest(t *testing.T) {
+	a, b := &fakeCodesearch{name: "a", indexTime: 20}, &fakeCodesearch{name: "b", indexTime: 10}
+	rs := testReplicaSet(t, config.Backend{}, a, b)
+	if _, err := rs.QuickInfo(context.Background(), &pb.Empty{}); err != nil {
+		t.Fatalf("QuickInfo: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		info, err := rs.Info(context.Background(), &pb.InfoRequest{})
+		if err != nil || info.Name != "b" {
+			t.Errorf("Info = %v, %v, want the oldest replica's", info, err)
+		}
+	}
+}
+
+func TestReplicaSetHedges(t *testing.T) {
+	slow, fast := &fakeCodesearch{name: "slow", delay: time.Second}, &fakeCodesearch{name: "fast"}
+	rs := testReplicaSet(t, config.Backend{HedgePercentile: 90}, slow, fast)
+	for i := 0; i < minHedgeSamples; i++ {
+		rs.latencies.Add(time.Millisecond)
+	}
+	// make sure the slow replica is picked first
+	rs.next = 1
+
+	start := time.Now()
+	result, err := rs.Search(context.Background(), &pb.Query{})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if result.IndexName != "fast" {
+		t.Errorf("answered by %s, want the hedged replica", result.IndexName)
+	}
+	if elapsed := time.Since(start); elapsed >= slow.delay {
+		t.Errorf("hedged search took %s", elapsed)
+	}
+}
+
+func TestNewReplicaSetErrors(t *testing.T) {
+	for _, be := range []config.Backend{
+		{Balancing: "random"},
+		{HedgePercentile: 100},
+		{Weights: map[string]int{"a": 0}},
+		{Weights: map[string]int{"elsewhere": 2}},
+	} {
+		if _, err := newReplicaSet([]*replica{{addr: "a"}}, be); err == nil {
+			t.Errorf("expected an error for %+v", be)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// checkBackendConfig makes sure the default backend and every backend
+// route name a configured backend.
+func (s *server) checkBackendConfig() error {
+	if id := s.config.DefaultBackend; id != "" && s.bk[id] == nil {
+		return fmt.Errorf("default_backend: unknown backend %q", id)
+	}
+	for _, route := range s.config.BackendRoutes {
+		if route.RepoPrefix == "" {
+			return fmt.Errorf("backend_routes: route to %q has no repo_prefix", route.Backend)
+		}
+		if s.bk[route.Backend] == nil {
+			return fmt.Errorf("backend_routes: unknown backend %q", route.Backend)
+		}
+	}
+	return nil
+}
+
+// defaultBackend returns the backend searched when a request doesn't
+// name one and can't be routed by its repo: filter.
+func (s *server) defaultBackend() *Backend {
+	if s.config.DefaultBackend != "" {
+		return s.bk[s.config.DefaultBackend]
+	}
+	if len(s.bkOrder) == 0 {
+		return nil
+	}
+	return s.bk[s.bkOrder[0]]
+}
+
+// queryRepo returns the repo: filter a query is routed by. For boolean
+// queries that's the first positive term that has one.
+func queryRepo(q *pb.Query, expr *QueryExpr) string {
+	if expr == nil {
+		return q.Repo
+	}
+	for _, leaf := range expr.PositiveLeaves() {
+		if leaf.Query.Repo != "" {
+			return leaf.Query.Repo
+		}
+	}
+	return ""
+}
+
+// routeQuery picks the backend for a query that doesn't name one. The
+// configured routes are tried first; failing those, we pick a backend that
+// indexes a tree matching the repo: filter, preferring the default one.
+func (s *server) routeQuery(q *pb.Query, expr *QueryExpr) *Backend {
+	repo := queryRepo(q, expr)
+	if repo == "" {
+		return s.defaultBackend()
+	}
+
+	prefix := strings.TrimPrefix(repo, "^")
+	for _, route := range s.config.BackendRoutes {
+		if strings.HasPrefix(prefix, route.RepoPrefix) {
+			return s.bk[route.Backend]
+		}
+	}
+
+	re, err := regexp.Compile(repo)
+	if err != nil {
+		// let the backend report the bad regex
+		return s.defaultBackend()
+	}
+
+	if bk := s.defaultBackend(); bk != nil && bk.hasTreeMatching(re) {
+		return bk
+	}
+	for _, id := range s.bkOrder {
+		if bk := s.bk[id]; bk.hasTreeMatching(re) {
+			return bk
+		}
+	}
+	return s.defaultBackend()
+}
+
+// hasTreeMatching reports whether the backend last told us it indexes a
+// tree whose name matches re.
+func (bk *Backend) hasTreeMatching(re *regexp.Regexp) bool {
+	bk.I.Lock()
+	defer bk.I.Unlock()
+	for _, tree := range bk.I.Trees {
+		if re.MatchString(tree.Name) {
+			return true
+		}
+	}
+	return false
+}
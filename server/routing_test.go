@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/livegrep/livegrep/server/config"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func routingServer(cfg *config.Config) *server {
+	s := &server{config: cfg, bk: make(map[string]*Backend)}
+	trees := map[string][]string{
+		"mono":  {"org/mono"},
+		"deps":  {"vendor/grpc", "vendor/re2"},
+		"infra": {"infra/terraform"},
+	}
+	for _, id := range []string{"mono", "deps", "infra"} {
+		bk := &Backend{Id: id, I: &I{Name: id}}
+		for _, name := range trees[id] {
+			bk.I.Trees = append(bk.I.Trees, Tree{Name: name})
+		}
+		s.bk[id] = bk
+		s.bkOrder = append(s.bkOrder, id)
+	}
+	return s
+}
+
+func TestRouteQuery(t *testing.T) {
+	s := routingServer(&config.Config{
+		DefaultBackend: "deps",
+		BackendRoutes: []config.BackendRoute{
+			{RepoPrefix: "infra/", Backend: "infra"},
+		},
+	})
+
+	cases := []struct {
+		repo string
+		want string
+	}{
+		{"", "deps"},
+		{"infra/.*", "infra"},
+		{"^infra/terraform$", "infra"},
+		{"org/", "mono"},
+		{"vendor/grpc", "deps"},
+		{"nothing/indexes/this", "deps"},
+		{"(unbalanced", "deps"},
+	}
+	for _, tc := range cases {
+		bk := s.routeQuery(&pb.Query{Line: "hello", Repo: tc.repo}, nil)
+		if bk == nil || bk.Id != tc.want {
+			t.Errorf("routeQuery(repo=%q) = %v, want %q", tc.repo, bk, tc.want)
+		}
+	}
+
+	expr, err := ParseQueryExpr("hello repo:org/mono AND world", true)
+	if err != nil {
+		t.Fatalf("ParseQueryExpr: %v", err)
+	}
+	if bk := s.routeQuery(&pb.Query{}, expr); bk.Id != "mono" {
+		t.Errorf("routeQuery(expr) = %q, want mono", bk.Id)
+	}
+}
+
+func TestDefaultBackend(t *testing.T) {
+	s := routingServer(&config.Config{})
+	if bk := s.defaultBackend(); bk.Id != "mono" {
+		t.Errorf("defaultBackend() = %q, want the first configured backend", bk.Id)
+	}
+
+	s.config.DefaultBackend = "infra"
+	if bk := s.defaultBackend(); bk.Id != "infra" {
+		t.Errorf("defaultBackend() = %q, want infra", bk.Id)
+	}
+}
+
+func TestCheckBackendConfig(t *testing.T) {
+	bad := []*config.Config{
+		{DefaultBackend: "missing"},
+		{BackendRoutes: []config.BackendRoute{{RepoPrefix: "x/", Backend: "missing"}}},
+		{BackendRoutes: []config.BackendRoute{{Backend: "mono"}}},
+	}
+	for _, cfg := range bad {
+		if err := routingServer(cfg).checkBackendConfig(); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+
+	good := &config.Config{
+		DefaultBackend: "deps",
+		BackendRoutes:  []config.BackendRoute{{RepoPrefix: "infra/", Backend: "infra"}},
+	}
+	if err := routingServer(good).checkBackendConfig(); err != nil {
+		t.Errorf("checkBackendConfig: %v", err)
+	}
+}
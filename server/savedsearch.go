@@ -0,0 +1,473 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/identity"
+	"github.com/livegrep/livegrep/server/log"
+)
+
+var errNoSavedSearch = errors.New("no such saved search")
+
+// A savedSearchStore keeps the searches users save. Implementations must
+// be safe to use from several goroutines.
+type savedSearchStore interface {
+	// List returns owner's saved searches, oldest first.
+	List(owner string) ([]*api.SavedSearch, error)
+	// Get returns the saved search with id, or errNoSavedSearch.
+	Get(id string) (*api.SavedSearch, error)
+	// Create stores search, giving it a new Id.
+	Create(search *api.SavedSearch) error
+	// Delete removes the saved search with id, or returns
+	// errNoSavedSearch.
+	Delete(id string) error
+}
+
+// jsonSavedSearchStore keeps saved searches in memory, writing them all
+// out to a JSON file whenever they change.
+type jsonSavedSearchStore struct {
+	path string
+
+	mu       sync.Mutex
+	searches []*api.SavedSearch
+}
+
+// openJSONSavedSearchStore loads the saved searches in the JSON file at
+// path, which needn't exist yet.
+func openJSONSavedSearchStore(path string) (*jsonSavedSearchStore, error) {
+	st := &jsonSavedSearchStore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st.searches); err != nil {
+		return nil, fmt.Errorf("reading saved searches from %s: %s", path, err)
+	}
+	return st, nil
+}
+
+func (st *jsonSavedSearchStore) List(owner string) ([]*api.SavedSearch, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var searches []*api.SavedSearch
+	for _, s := range st.searches {
+		if s.Owner == owner {
+			copied := *s
+			searches = append(searches, &copied)
+		}
+	}
+	return searches, nil
+}
+
+func (st *jsonSavedSearchStore) Get(id string) (*api.SavedSearch, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, s := range st.searches {
+		if s.Id == id {
+			copied := *s
+			return &copied, nil
+		}
+	}
+	return nil, errNoSavedSearch
+}
+
+func (st *jsonSavedSearchStore) Create(search *api.SavedSearch) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	search.Id = hex.EncodeToString(id)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	copied := *search
+	searches := append(st.searches[:len(st.searches):len(st.searches)], &copied)
+	if err := st.write(searches); err != nil {
+		return err
+	}
+	st.searches = searches
+	return nil
+}
+
+func (st *jsonSavedSearchStore) Delete(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, s := range st.searches {
+		if s.Id != id {
+			continue
+		}
+		searches := append(append([]*api.SavedSearch{}, st.searches[:i]...), st.searches[i+1:]...)
+		if err := st.write(searches); err != nil {
+			return err
+		}
+		st.searches = searches
+		return nil
+	}
+	return errNoSavedSearch
+}
+
+// write replaces the store's file with searches.
+func (st *jsonSavedSearchStore) write(searches []*api.SavedSearch) error {
+	data, err := json.MarshalIndent(searches, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(st.path, data)
+}
+
+// writeFileAtomically replaces the file at path with data. It writes a
+// new file and renames it into place, so that a crash can't leave the
+// file half written.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// requesterName returns the name of whoever sent the request ctx belongs
+// to, or "" if the request isn't authenticated.
+func requesterName(ctx context.Context) string {
+	if id, ok := identity.FromContext(ctx); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// requireRequester returns requesterName(ctx), or writes an error and
+// returns "" if the request isn't authenticated: without auth, everyone
+// would share one owner's saved searches.
+func requireRequester(ctx context.Context, w http.ResponseWriter, what string) string {
+	name := requesterName(ctx)
+	if name == "" {
+		writeError(ctx, w, 401, "unauthorized", fmt.Sprintf("Sign in to use %s", what))
+	}
+	return name
+}
+
+// savedSearchRequest returns a request for the search search saved, as
+// ServerSideAPISearchV2 takes it.
+func savedSearchRequest(search *api.SavedSearch) *http.Request {
+	params := url.Values{
+		"q":     {search.Query},
+		"regex": {strconv.FormatBool(search.Regex)},
+	}
+	if search.FoldCase != "" {
+		params.Set("fold_case", search.FoldCase)
+	}
+	if search.Backend != "" {
+		params.Set(":backend", search.Backend)
+	}
+	return &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/api/v2/search/", RawQuery: params.Encode()},
+		Header: make(http.Header),
+	}
+}
+
+// savedSearchURL links to the search page showing search's results.
+func savedSearchURL(search *api.SavedSearch) string {
+	r := savedSearchRequest(search)
+	params := r.URL.Query()
+	params.Del(":backend")
+	return "/search/" + url.PathEscape(search.Backend) + "?" + params.Encode()
+}
+
+// checkSavedSearch checks that search names a backend we have and a
+// query we can parse, so that it doesn't fail every time it's rerun.
+func (s *server) checkSavedSearch(ctx context.Context, search *api.SavedSearch) error {
+	if strings.TrimSpace(search.Name) == "" {
+		return errors.New("A saved search needs a name")
+	}
+	if search.Backend != "" && search.Backend != AllBackends && s.bk[search.Backend] == nil {
+		return fmt.Errorf("Unknown backend: %s", search.Backend)
+	}
+	switch search.FoldCase {
+	case "", "auto", "true", "false":
+	default:
+		return fmt.Errorf("Invalid fold_case: %q; use auto, true or false", search.FoldCase)
+	}
+	q, expr, _, err := extractQuery(ctx, savedSearchRequest(search))
+	if err != nil {
+		return err
+	}
+	if expr == nil && q.Line == "" {
+		return errors.New("You must specify a string or regex to match")
+	}
+	return nil
+}
+
+func (s *server) checkSavedSearchesEnabled(ctx context.Context, w http.ResponseWriter) bool {
+	if s.savedSearches == nil {
+		writeError(ctx, w, 404, "not_found", "Saved searches are not enabled")
+		return false
+	}
+	return true
+}
+
+// ServeAPISavedSearches lists the searches the requester saved.
+func (s *server) ServeAPISavedSearches(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkSavedSearchesEnabled(ctx, w) {
+		return
+	}
+	owner := requireRequester(ctx, w, "saved searches")
+	if owner == "" {
+		return
+	}
+	searches, err := s.savedSearches.List(owner)
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	if searches == nil {
+		searches = []*api.SavedSearch{}
+	}
+	replyJSON(ctx, w, 200, &api.ReplySavedSearches{SavedSearches: searches})
+}
+
+// ServeAPICreateSavedSearch saves the search in the request's body for
+// the requester. Only JSON bodies are accepted, so that other sites
+// can't have browsers save searches with a form.
+func (s *server) ServeAPICreateSavedSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkSavedSearchesEnabled(ctx, w) {
+		return
+	}
+	owner := requireRequester(ctx, w, "saved searches")
+	if owner == "" {
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		writeError(ctx, w, 415, "bad_content_type", "Saved searches must be sent as application/json")
+		return
+	}
+	var search api.SavedSearch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&search); err != nil {
+		writeError(ctx, w, 400, "bad_request", fmt.Sprintf("Invalid saved search: %s", err))
+		return
+	}
+	search.Owner = owner
+	search.Created = time.Now().UTC()
+	if err := s.checkSavedSearch(ctx, &search); err != nil {
+		writeError(ctx, w, 400, "bad_query", err.Error())
+		return
+	}
+	if err := s.savedSearches.Create(&search); err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	log.Infof(ctx, "saved search id=%s name=%q owner=%q", search.Id, search.Name, search.Owner)
+	replyJSON(ctx, w, 201, &search)
+}
+
+// ServeAPIDeleteSavedSearch deletes a saved search, if the requester
+// saved it or is an admin.
+func (s *server) ServeAPIDeleteSavedSearch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkSavedSearchesEnabled(ctx, w) {
+		return
+	}
+	owner := requireRequester(ctx, w, "saved searches")
+	if owner == "" {
+		return
+	}
+	id := r.URL.Query().Get(":id")
+	search, err := s.savedSearches.Get(id)
+	if err == nil && search.Owner != owner {
+		if reqId, ok := identity.FromContext(ctx); !ok || !reqId.HasScope(identity.ScopeAdmin) {
+			// Don't tell others which ids exist.
+			err = errNoSavedSearch
+		}
+	}
+	if err == nil {
+		err = s.savedSearches.Delete(id)
+	}
+	if err == nil {
+		s.savedSearchCounts.forget(id)
+	}
+	if err == errNoSavedSearch {
+		writeError(ctx, w, 404, "not_found", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(ctx, w, 500, "internal_error", err.Error())
+		return
+	}
+	log.Infof(ctx, "deleted saved search id=%s", id)
+	w.WriteHeader(204)
+}
+
+// At most this many saved searches are counted at once for the saved
+// searches page, so that someone with many doesn't tie up the backends.
+const savedSearchCountConcurrency = 4
+
+// How long a saved search's count is shown before it's counted again.
+const savedSearchCountTTL = 5 * time.Minute
+
+// savedSearchCount is how many matches a saved search had when it was
+// last counted.
+type savedSearchCount struct {
+	at         time.Time
+	numMatches int
+	more       bool
+}
+
+// savedSearchCounts remembers how many matches saved searches had, so
+// that reloading the saved searches page doesn't rerun every one of
+// them. A nil *savedSearchCounts is valid, and remembers nothing.
+type savedSearchCounts struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	counts map[string]*savedSearchCount
+}
+
+func newSavedSearchCounts() *savedSearchCounts {
+	return &savedSearchCounts{now: time.Now, counts: make(map[string]*savedSearchCount)}
+}
+
+// get returns the count of the saved search with id, if it was counted
+// less than savedSearchCountTTL ago.
+func (c *savedSearchCounts) get(id string) (*savedSearchCount, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count, ok := c.counts[id]
+	if !ok || c.now().Sub(count.at) >= savedSearchCountTTL {
+		return nil, false
+	}
+	return count, true
+}
+
+// put remembers the count of the saved search with id, forgetting any
+// that have expired.
+func (c *savedSearchCounts) put(id string, numMatches int, more bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for other, count := range c.counts {
+		if now.Sub(count.at) >= savedSearchCountTTL {
+			delete(c.counts, other)
+		}
+	}
+	c.counts[id] = &savedSearchCount{at: now, numMatches: numMatches, more: more}
+}
+
+// forget drops the count of the saved search with id.
+func (c *savedSearchCounts) forget(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counts, id)
+}
+
+// savedSearchRow is a saved search as the saved searches page shows it.
+type savedSearchRow struct {
+	Search     *api.SavedSearch
+	URL        string
+	NumMatches int
+	// Whether the search stopped before finding every match.
+	More  bool
+	Error string
+}
+
+// countSavedSearch fills in row's count, rerunning its search unless it
+// was counted recently.
+func (s *server) countSavedSearch(ctx context.Context, row *savedSearchRow) {
+	if count, ok := s.savedSearchCounts.get(row.Search.Id); ok {
+		row.NumMatches, row.More = count.numMatches, count.more
+		return
+	}
+	reply, _, _, errorMsgLong := s.ServerSideAPISearchV2(ctx, nil, savedSearchRequest(row.Search))
+	if reply == nil {
+		row.Error = errorMsgLong
+		return
+	}
+	row.NumMatches = reply.Info.NumMatches
+	row.More = reply.Info.ExitReason != "NONE"
+	s.savedSearchCounts.put(row.Search.Id, row.NumMatches, row.More)
+}
+
+// countSavedSearches returns rows for searches, sorted by name, with
+// their counts, running at most savedSearchCountConcurrency of them at
+// once.
+func (s *server) countSavedSearches(ctx context.Context, searches []*api.SavedSearch) []*savedSearchRow {
+	rows := make([]*savedSearchRow, len(searches))
+	sem := make(chan struct{}, savedSearchCountConcurrency)
+	var wg sync.WaitGroup
+	for i, search := range searches {
+		rows[i] = &savedSearchRow{Search: search, URL: savedSearchURL(search)}
+		wg.Add(1)
+		go func(row *savedSearchRow) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			s.countSavedSearch(ctx, row)
+		}(rows[i])
+	}
+	wg.Wait()
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i].Search.Name < rows[j].Search.Name
+	})
+	return rows
+}
+
+// ServeSavedSearches renders a page listing the requester's saved
+// searches, each with how many matches it has now.
+func (s *server) ServeSavedSearches(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	owner := requesterName(ctx)
+	var searches []*api.SavedSearch
+	if s.savedSearches != nil && owner != "" {
+		var err error
+		if searches, err = s.savedSearches.List(owner); err != nil {
+			log.Errorf(ctx, "listing saved searches err=%s", err)
+		}
+	}
+
+	rows := s.countSavedSearches(ctx, searches)
+
+	s.renderPage(ctx, w, r, "saved_searches.html", &page{
+		Title:         "saved searches",
+		IncludeHeader: true,
+		Data: struct {
+			Enabled  bool
+			SignedIn bool
+			Rows     []*savedSearchRow
+		}{s.savedSearches != nil, owner != "", rows},
+	})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestJSONSavedSearchStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "saved.json")
+	st, err := openJSONSavedSearchStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	todo := &api.SavedSearch{Name: "todos", Owner: "alice", Query: "TODO"}
+	if err := st.Create(todo); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Create(&api.SavedSearch{Name: "fixmes", Owner: "bob", Query: "FIXME"}); err != nil {
+		t.Fatal(err)
+	}
+	if todo.Id == "" {
+		t.Fatal("Create didn't give the search an id")
+	}
+
+	reopened, err := openJSONSavedSearchStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searches, err := reopened.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(searches) != 1 || searches[0].Id != todo.Id || searches[0].Query != "TODO" {
+		t.Fatalf("List(alice) after reopening = %+v, want just %+v", searches, todo)
+	}
+
+	if err := reopened.Delete(todo.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Delete(todo.Id); err != errNoSavedSearch {
+		t.Errorf("deleting twice: got err=%v, want %v", err, errNoSavedSearch)
+	}
+	if _, err := reopened.Get(todo.Id); err != errNoSavedSearch {
+		t.Errorf("Get after Delete: got err=%v, want %v", err, errNoSavedSearch)
+	}
+	if searches, _ := reopened.List("bob"); len(searches) != 1 {
+		t.Errorf("List(bob) = %+v, want one search", searches)
+	}
+}
+
+func TestSavedSearchAPI(t *testing.T) {
+	st, err := openJSONSavedSearchStore(filepath.Join(t.TempDir(), "saved.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		bk:            map[string]*Backend{"main": {Id: "main"}},
+		bkOrder:       []string{"main"},
+		savedSearches: st,
+	}
+	ctxFor := func(name string) context.Context {
+		if name == "" {
+			return context.Background()
+		}
+		return identity.NewContext(context.Background(), &identity.Identity{Name: name})
+	}
+
+	create := func(who, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v2/saved-searches", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		s.ServeAPICreateSavedSearch(ctxFor(who), w, r)
+		return w
+	}
+	badCases := []struct {
+		contentType, body string
+		status            int
+	}{
+		{"application/x-www-form-urlencoded", "name=a&q=b", 415},
+		{"application/json", `{"name": "a", "q": "b", "backend": "other"}`, 400},
+		{"application/json", `{"name": "a", "q": " "}`, 400},
+		{"application/json", `{"name": "", "q": "b"}`, 400},
+		{"application/json", `{"name": "a", "q": "b", "fold_case": "maybe"}`, 400},
+	}
+	for _, tc := range badCases {
+		if w := create("alice", tc.contentType, tc.body); w.Code != tc.status {
+			t.Errorf("creating %s: got status %d, want %d: %s", tc.body, w.Code, tc.status, w.Body)
+		}
+	}
+
+	w := create("alice", "application/json; charset=utf-8",
+		`{"id": "mine", "name": "deprecated", "q": "oldFunc\\(", "backend": "main", "regex": true, "owner": "bob"}`)
+	if w.Code != 201 {
+		t.Fatalf("creating: got status %d: %s", w.Code, w.Body)
+	}
+	var created api.SavedSearch
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "mine" || created.Owner != "alice" || created.Created.IsZero() {
+		t.Errorf("created %+v, want a new id, alice as owner and a creation time", created)
+	}
+
+	list := func(who string) []*api.SavedSearch {
+		w := httptest.NewRecorder()
+		s.ServeAPISavedSearches(ctxFor(who), w, httptest.NewRequest("GET", "/api/v2/saved-searches", nil))
+		var reply api.ReplySavedSearches
+		if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.SavedSearches
+	}
+	if got := list("alice"); len(got) != 1 || got[0].Id != created.Id {
+		t.Errorf("alice's saved searches = %+v, want just %s", got, created.Id)
+	}
+	if got := list("bob"); len(got) != 0 {
+		t.Errorf("bob's saved searches = %+v, want none", got)
+	}
+
+	if w := create("", "application/json", `{"name": "a", "q": "b"}`); w.Code != 401 {
+		t.Errorf("creating without signing in: got status %d, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeAPISavedSearches(ctxFor(""), w, httptest.NewRequest("GET", "/api/v2/saved-searches", nil))
+	if w.Code != 401 {
+		t.Errorf("listing without signing in: got status %d, want 401", w.Code)
+	}
+
+	del := func(who, id string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", "/api/v2/saved-searches/"+id+"?:id="+id, nil)
+		s.ServeAPIDeleteSavedSearch(ctxFor(who), w, r)
+		return w.Code
+	}
+	if code := del("bob", created.Id); code != 404 {
+		t.Errorf("bob deleting alice's search: got status %d, want 404", code)
+	}
+	if code := del("", created.Id); code != 401 {
+		t.Errorf("deleting without signing in: got status %d, want 401", code)
+	}
+	if code := del("alice", created.Id); code != 204 {
+		t.Errorf("alice deleting her search: got status %d, want 204", code)
+	}
+	if code := del("alice", created.Id); code != 404 {
+		t.Errorf("deleting twice: got status %d, want 404", code)
+	}
+}
+
+func TestSavedSearchURL(t *testing.T) {
+	search := &api.SavedSearch{Backend: "main", Query: "foo bar", Regex: true, FoldCase: "false"}
+	if got, want := savedSearchURL(search), "/search/main?fold_case=false&q=foo+bar&regex=true"; got != want {
+		t.Errorf("savedSearchURL = %q, want %q", got, want)
+	}
+}
+
+func TestCountSavedSearches(t *testing.T) {
+	// Set by New, which the test doesn't call.
+	newYorkTime = time.UTC
+
+	cs := &fakeCodesearch{
+		lines: []*pb.SearchResult{fakeLine("repo", "a.go", 1, "TODO")},
+		// Long enough for the searches to overlap.
+		delay: 5 * time.Millisecond,
+	}
+	counts := newSavedSearchCounts()
+	now := time.Unix(1000, 0)
+	counts.now = func() time.Time { return now }
+	s := &server{
+		config:            &config.Config{},
+		bk:                map[string]*Backend{"main": {Id: "main", I: &I{}, Codesearch: cs}},
+		bkOrder:           []string{"main"},
+		savedSearchCounts: counts,
+	}
+
+	var searches []*api.SavedSearch
+	for i := 0; i < 3*savedSearchCountConcurrency; i++ {
+		searches = append(searches, &api.SavedSearch{Id: fmt.Sprint(i), Name: fmt.Sprintf("%02d", i), Query: "TODO"})
+	}
+	count := func() []*savedSearchRow {
+		rows := s.countSavedSearches(context.Background(), searches)
+		for i, row := range rows {
+			if row.Error != "" || row.NumMatches != 1 || row.More || row.Search != searches[i] {
+				t.Fatalf("row %d = %+v", i, row)
+			}
+		}
+		return rows
+	}
+
+	count()
+	if int(cs.searches) != len(searches) {
+		t.Errorf("ran %d searches, want %d", cs.searches, len(searches))
+	}
+	if cs.mostAtOnce > savedSearchCountConcurrency {
+		t.Errorf("ran %d searches at once, want at most %d", cs.mostAtOnce, savedSearchCountConcurrency)
+	}
+
+	count()
+	if int(cs.searches) != len(searches) {
+		t.Errorf("counting again reran %d searches", int(cs.searches)-len(searches))
+	}
+
+	counts.forget("0")
+	now = now.Add(savedSearchCountTTL / 2)
+	count()
+	if int(cs.searches) != len(searches)+1 {
+		t.Errorf("ran %d searches, want only the forgotten one again", int(cs.searches)-len(searches))
+	}
+
+	now = now.Add(savedSearchCountTTL)
+	count()
+	if int(cs.searches) != 2*len(searches)+1 {
+		t.Errorf("ran %d searches, want every expired one again", int(cs.searches)-len(searches)-1)
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,11 +22,14 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/bmizerany/pat"
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/alexcesaro/statsd.v2"
 
 	"github.com/livegrep/livegrep/server/config"
 	"github.com/livegrep/livegrep/server/fileviewer"
+	"github.com/livegrep/livegrep/server/identity"
 	"github.com/livegrep/livegrep/server/log"
+	"github.com/livegrep/livegrep/server/metrics"
 	"github.com/livegrep/livegrep/server/reqid"
 	"github.com/livegrep/livegrep/server/templates"
 )
@@ -56,8 +61,20 @@ type server struct {
 
 	statsd *statsd.Client
 
+	// Metrics describing this server's backends; see backendCollector
+	registry *prometheus.Registry
+
 	serveFilePathRegex *regexp.Regexp
 
+	// How search results may be ordered, by sort: order
+	rankers map[string]ranker
+
+	// Where users' saved searches are kept; nil if they can't save any
+	savedSearches savedSearchStore
+	// The saved searches' counts the saved searches page last showed
+	savedSearchCounts *savedSearchCounts
+	watcher           *watcher
+
 	mu          sync.Mutex
 	Templates   map[string]*template.Template
 	AssetHashes map[string]string
@@ -247,13 +264,13 @@ func (s *server) ServeListAllBranchesForZoekt(ctx context.Context, w http.Respon
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/api/v2/getAllBranchesForZoekt/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 
 	repoPath := fmt.Sprintf("%s/%s/%s.git", s.config.ZoektRepoCache, parent, repo)
 
 	branches, err := fileviewer.ListAllBranches(repoPath)
 	if err != nil {
-		fmt.Printf("err=%v\n", err)
+		log.Errorf(ctx, "err=%v", err)
 		http.Error(w, "could not list branches for repo provided", 500)
 		return
 	}
@@ -265,13 +282,13 @@ func (s *server) ServeListAllTagsForZoekt(ctx context.Context, w http.ResponseWr
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/api/v2/getAllTagsForZoekt/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 
 	repoPath := fmt.Sprintf("%s/%s/%s.git", s.config.ZoektRepoCache, parent, repo)
 
 	tags, err := fileviewer.ListAllTags(repoPath)
 	if err != nil {
-		fmt.Printf("err=%v\n", err)
+		log.Errorf(ctx, "err=%v", err)
 		http.Error(w, "could not list branches for repo provided", 500)
 		return
 	}
@@ -284,19 +301,19 @@ func (s *server) ServeGitLogForZoekt(ctx context.Context, w http.ResponseWriter,
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/api/v2/getGitLogForZoekt/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 	sp := strings.Split(repoRevAndPath, ":")
 
-	log.Printf(ctx, "sp=%v\n", sp)
+	log.Debugf(ctx, "sp=%v", sp)
 	var rev, path string
 	if len(sp) == 2 {
 		rev = sp[0]
 		path = sp[1]
 	} else {
 		// we're in a broken case.
-		log.Printf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2\n", repoRevAndPath)
+		log.Errorf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2", repoRevAndPath)
 		if len(sp) == 1 && sp[0] != "" {
-			log.Printf(ctx, "sp[1\n")
+			log.Debugf(ctx, "sp[1")
 			rev = sp[0]
 		} else {
 			rev = "HEAD"
@@ -341,7 +358,7 @@ func (s *server) ServeGitLogForZoekt(ctx context.Context, w http.ResponseWriter,
 	commitLog, err := fileviewer.BuildGitLog(opts, repoPath)
 
 	if err != nil {
-		fmt.Printf("err=%v\n", err)
+		log.Errorf(ctx, "err=%v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -360,7 +377,7 @@ func (s *server) ServeGitLogJson(ctx context.Context, w http.ResponseWriter, r *
 	repoConfig, err := s.filebrowseEnabled(parent + "/" + repo)
 
 	if err != nil {
-		fmt.Printf("err=%v\n", err)
+		log.Errorf(ctx, "err=%v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -402,7 +419,7 @@ func (s *server) ServeGitLogJson(ctx context.Context, w http.ResponseWriter, r *
 	commitLog, err := fileviewer.BuildGitLog(opts, repoConfig.Path)
 
 	if err != nil {
-		fmt.Printf("err=%v\n", err)
+		log.Errorf(ctx, "err=%v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -419,19 +436,19 @@ func (s *server) ServeGitLsTreeForZoekt(ctx context.Context, w http.ResponseWrit
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/api/v2/getDirectoryTreeForZoekt/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 	sp := strings.Split(repoRevAndPath, ":")
 
-	log.Printf(ctx, "sp=%v\n", sp)
+	log.Debugf(ctx, "sp=%v", sp)
 	var rev, path string
 	if len(sp) == 2 {
 		rev = sp[0]
 		path = sp[1]
 	} else {
 		// we're in a broken case.
-		log.Printf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2\n", repoRevAndPath)
+		log.Errorf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2", repoRevAndPath)
 		if len(sp) == 1 && sp[0] != "" {
-			log.Printf(ctx, "sp[1\n")
+			log.Debugf(ctx, "sp[1")
 			rev = sp[0]
 		} else {
 			rev = "HEAD"
@@ -481,7 +498,7 @@ func (s *server) ServeGitLsTreeRendered(ctx context.Context, w http.ResponseWrit
 	rev := r.URL.Query().Get(":rev")
 	path := pat.Tail("/api/v2/getRenderedFileTree/:parent/:repo/:rev/", r.URL.Path)
 
-	fmt.Printf("parent:%s repoName:%s rev:%s path:%s\n", parent, repoName, rev, path)
+	log.Debugf(ctx, "parent:%s repoName:%s rev:%s path:%s", parent, repoName, rev, path)
 	if len(s.repos) == 0 {
 		http.Error(w, "File browsing and git commands not enabled", 404)
 		return
@@ -493,7 +510,7 @@ func (s *server) ServeGitLsTreeRendered(ctx context.Context, w http.ResponseWrit
 		return
 	}
 
-	fmt.Printf("repo.Path=%s repo.Name=%s\n", repo.Path, repo.Name)
+	log.Debugf(ctx, "repo.Path=%s repo.Name=%s", repo.Path, repo.Name)
 	data, err := fileviewer.BuildDirectoryTree(path, repo.Path, rev)
 
 	if err != nil {
@@ -545,7 +562,7 @@ func (s *server) ServeSimpleGitLog(ctx context.Context, w http.ResponseWriter, r
 		templateName := "simplegitlogpaginated.html"
 		t, ok := s.Templates[templateName]
 		if !ok {
-			log.Printf(ctx, "Error: no template named %v", templateName)
+			log.Errorf(ctx, "Error: no template named %v", templateName)
 			return
 		}
 
@@ -556,7 +573,7 @@ func (s *server) ServeSimpleGitLog(ctx context.Context, w http.ResponseWriter, r
 		})
 
 		if err != nil {
-			log.Printf(ctx, "Error rendering %v: %s", templateName, err)
+			log.Errorf(ctx, "Error rendering %v: %s", templateName, err)
 			return
 		}
 		return
@@ -576,19 +593,19 @@ func (s *server) ServeSyntaxHighlightedFileForZoekt(ctx context.Context, w http.
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/api/v2/getSyntaxHighlightedFileForZoekt/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 	sp := strings.Split(repoRevAndPath, ":")
 
-	log.Printf(ctx, "sp=%v\n", sp)
+	log.Debugf(ctx, "sp=%v", sp)
 	var rev, path string
 	if len(sp) == 2 {
 		rev = sp[0]
 		path = sp[1]
 	} else {
 		// we're in a broken case.
-		log.Printf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2\n", repoRevAndPath)
+		log.Errorf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2", repoRevAndPath)
 		if len(sp) == 1 && sp[0] != "" {
-			log.Printf(ctx, "sp[1\n")
+			log.Debugf(ctx, "sp[1")
 			rev = sp[0]
 		} else {
 			rev = "HEAD"
@@ -597,7 +614,7 @@ func (s *server) ServeSyntaxHighlightedFileForZoekt(ctx context.Context, w http.
 	}
 
 	repoPath := fmt.Sprintf("%s/%s/%s.git", s.config.ZoektRepoCache, parent, repo)
-	fmt.Printf("repoPath=%s\n", repoPath)
+	log.Debugf(ctx, "repoPath=%s", repoPath)
 	data, err := fileviewer.BuildFileDataForZoektFilePreview(path, repoPath, parent+"/"+repo, rev)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error reading file or tree - %s", err), 500)
@@ -615,19 +632,19 @@ func (s *server) ServeGitBlobRaw(ctx context.Context, w http.ResponseWriter, r *
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/raw-blob/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 	sp := strings.Split(repoRevAndPath, ":")
 
-	log.Printf(ctx, "sp=%v\n", sp)
+	log.Debugf(ctx, "sp=%v", sp)
 	var rev, path string
 	if len(sp) == 2 {
 		rev = sp[0]
 		path = sp[1]
 	} else {
 		// we're in a broken case.
-		log.Printf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2\n", repoRevAndPath)
+		log.Errorf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2", repoRevAndPath)
 		if len(sp) == 1 && sp[0] != "" {
-			log.Printf(ctx, "sp[1\n")
+			log.Debugf(ctx, "sp[1")
 			rev = sp[0]
 		} else {
 			rev = "HEAD"
@@ -675,7 +692,7 @@ func (s *server) ServeGitBlobRaw(ctx context.Context, w http.ResponseWriter, r *
 }
 
 func logAndServeError(ctx context.Context, w http.ResponseWriter, errMsg string, errCode int) {
-	log.Printf(ctx, errMsg)
+	log.Errorf(ctx, "%s", errMsg)
 	http.Error(w, errMsg, errCode)
 }
 
@@ -685,7 +702,7 @@ func (s *server) ServeGitBlob(ctx context.Context, w http.ResponseWriter, r *htt
 	repo := r.URL.Query().Get(":repo")
 	rev := r.URL.Query().Get(":rev")
 	// m.Add("GET", "/:parent/:repo/blob/:rev/", srv.Handler(srv.ServeGitBlob))
-	fmt.Printf("r.URL.Path=%s\n", r.URL.Path)
+	log.Debugf(ctx, "r.URL.Path=%s", r.URL.Path)
 
 	// TODO(xvandish): this is temporary. Soon we can split out blob and directory code all the way
 	// down, which will lend more utility then right now. Right now the differentiation between blob/tree
@@ -766,7 +783,7 @@ func (s *server) ServeFile(ctx context.Context, w http.ResponseWriter, r *http.R
 	}
 
 	repo, ok := s.repos[repoName]
-	if !ok {
+	if !ok || !s.canSeeRepo(ctx, nil, repoName) {
 		errMsg := fmt.Sprintf("Error: No such repo: %s", repoName)
 		logAndServeError(ctx, w, errMsg, 500)
 		return
@@ -844,7 +861,7 @@ func (s *server) ServeDiff(ctx context.Context, w http.ResponseWriter, r *http.R
 
 	rows := diff.GetDiffRowsSplit()
 	if err != nil {
-		log.Printf(ctx, "splitdiff err=%v\n", err)
+		log.Errorf(ctx, "splitdiff err=%v", err)
 		io.WriteString(w, err.Error())
 		return
 	}
@@ -882,19 +899,19 @@ func (s *server) ServeExperimental(ctx context.Context, w http.ResponseWriter, r
 	repo := r.URL.Query().Get(":repo")
 
 	repoRevAndPath := pat.Tail("/experimental/:parent/:repo/+/", r.URL.Path)
-	log.Printf(ctx, "repoRevAndPath: %s\n", repoRevAndPath)
+	log.Debugf(ctx, "repoRevAndPath: %s", repoRevAndPath)
 	sp := strings.Split(repoRevAndPath, ":")
 
-	log.Printf(ctx, "sp=%v\n", sp)
+	log.Debugf(ctx, "sp=%v", sp)
 	var repoRev, path string
 	if len(sp) == 2 {
 		repoRev = sp[0]
 		path = sp[1]
 	} else {
 		// we're in a broken case.
-		log.Printf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2\n", repoRevAndPath)
+		log.Errorf(ctx, "ERROR: repoRevAndPath: %s -- split len != 2", repoRevAndPath)
 		if len(sp) == 1 && sp[0] != "" {
-			log.Printf(ctx, "sp[1\n")
+			log.Debugf(ctx, "sp[1")
 			repoRev = sp[0]
 		} else {
 			repoRev = "HEAD"
@@ -905,7 +922,7 @@ func (s *server) ServeExperimental(ctx context.Context, w http.ResponseWriter, r
 	q := r.URL.Query()
 	dataFileCommit := q.Get("dfc")
 
-	log.Printf(ctx, "repoRev=%s path=%s\n", repoRev, path)
+	log.Debugf(ctx, "repoRev=%s path=%s", repoRev, path)
 
 	parentMap, ok := s.newRepos[parent]
 
@@ -981,15 +998,15 @@ func (s *server) ServeExperimental(ctx context.Context, w http.ResponseWriter, r
 	// TODO: use goroutines to do these in parallel
 	tree, err := fileviewer.BuildDirectoryTree(path, repoConfig.Path, repoRev)
 	if err != nil {
-		log.Printf(ctx, "Error building directory tree: %s\n", err.Error())
+		log.Errorf(ctx, "Error building directory tree: %s", err.Error())
 	}
 	branches, err := fileviewer.ListAllBranches(repoConfig.Path)
 	if err != nil {
-		log.Printf(ctx, "Error getting branches: %s\n", err.Error())
+		log.Errorf(ctx, "Error getting branches: %s", err.Error())
 	}
 	tags, err := fileviewer.ListAllTags(repoConfig.Path)
 	if err != nil {
-		log.Printf(ctx, "Error getting tags: %s\n", err.Error())
+		log.Errorf(ctx, "Error getting tags: %s", err.Error())
 	}
 
 	data.DirectoryTree = tree
@@ -1082,9 +1099,7 @@ func (s *server) ServeBackendStatus(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		for _, bk = range s.bk {
-			break
-		}
+		bk = s.defaultBackend()
 	}
 
 	status := bk.getStatus()
@@ -1110,18 +1125,17 @@ func (s *server) ServeOpensearch(ctx context.Context, w http.ResponseWriter, r *
 		BaseURL: s.requestProtocol(r) + "://" + r.Host + "/",
 	}
 
-	for _, bk := range s.bk {
-		if bk.I.Name != "" {
-			data.BackendName = bk.I.Name
-			break
-		}
+	if bk := s.defaultBackend(); bk != nil {
+		bk.I.Lock()
+		data.BackendName = bk.I.Name
+		bk.I.Unlock()
 	}
 
 	templateName := "opensearch.xml"
 	w.Header().Set("Content-Type", "application/xml")
 	err := s.OpenSearch.ExecuteTemplate(w, templateName, data)
 	if err != nil {
-		log.Printf(ctx, "Error rendering %s: %s", templateName, err)
+		log.Errorf(ctx, "Error rendering %s: %s", templateName, err)
 		return
 	}
 }
@@ -1135,10 +1149,10 @@ func (s *server) renderPage(ctx context.Context, w io.Writer, r *http.Request, t
 
 	t, ok := s.Templates[templateName]
 	if !ok {
-		log.Printf(ctx, "Error: no template named %v", templateName)
+		log.Errorf(ctx, "Error: no template named %v", templateName)
 		return
 	}
-	log.Printf(ctx, "found template %s", templateName)
+	log.Debugf(ctx, "found template %s", templateName)
 
 	pageData.Config = s.config
 	pageData.AssetHashes = s.AssetHashes
@@ -1151,11 +1165,11 @@ func (s *server) renderPage(ctx context.Context, w io.Writer, r *http.Request, t
 
 	err := t.ExecuteTemplate(w, templateName, pageData)
 	if err != nil {
-		log.Printf(ctx, "Error rendering %v: %s", templateName, err)
+		log.Errorf(ctx, "Error rendering %v: %s", templateName, err)
 		return
 	}
 
-	log.Printf(ctx, "success %s", templateName)
+	log.Debugf(ctx, "success %s", templateName)
 }
 
 type reloadHandler struct {
@@ -1174,7 +1188,11 @@ func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.inner.ServeHTTP(w, r)
 }
 
-type handler func(c context.Context, w http.ResponseWriter, r *http.Request)
+type handler struct {
+	srv   *server
+	name  string
+	serve func(c context.Context, w http.ResponseWriter, r *http.Request)
+}
 
 const RequestTimeout = 30 * time.Second
 
@@ -1183,13 +1201,39 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
 	defer cancel()
 	ctx = reqid.NewContext(ctx, reqid.New())
-	log.Printf(ctx, "http request: remote=%q method=%q url=%q",
-		r.RemoteAddr, r.Method, r.URL)
-	h(ctx, w, r)
+	fields := log.Fields{
+		"handler":     h.name,
+		"remote_addr": r.RemoteAddr,
+	}
+	if id, ok := identity.FromContext(r.Context()); ok {
+		ctx = identity.NewContext(ctx, id)
+		fields["user"] = id.Name
+	}
+	ctx = log.WithFields(ctx, fields)
+	log.Printf(ctx, "http request: method=%q url=%q", r.Method, r.URL)
+	start := time.Now()
+	// Answer as if repos the requester may not see don't exist.
+	if !h.srv.canSeeRequestedRepo(ctx, r) {
+		http.Error(w, "No such repo", 404)
+		return
+	}
+	h.serve(ctx, w, r)
+	log.Logf(ctx, log.LevelInfo, log.Fields{
+		"latency_ms": time.Since(start).Milliseconds(),
+	}, "http request done")
 }
 
 func (s *server) Handler(f func(c context.Context, w http.ResponseWriter, r *http.Request)) http.Handler {
-	return handler(f)
+	name := handlerName(f)
+	return metrics.InstrumentHandler(name, handler{srv: s, name: name, serve: f})
+}
+
+// handlerName turns e.g. (*server).ServeAPISearch-fm into ServeAPISearch,
+// to label the handler's metrics with.
+func handlerName(f interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.TrimSuffix(name, "-fm")
 }
 
 // Takes a search query, performs the search, then renders the results into HTML and serves it
@@ -1210,6 +1254,15 @@ func (s *server) ServeRenderedSearchResults(ctx context.Context, w http.Response
 }
 
 func New(cfg *config.Config) (http.Handler, error) {
+	if err := log.SetFormat(cfg.Log.Format); err != nil {
+		return nil, err
+	}
+	level, err := log.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return nil, err
+	}
+	log.SetLevel(level)
+
 	srv := &server{
 		config:   cfg,
 		bk:       make(map[string]*Backend),
@@ -1222,7 +1275,7 @@ func New(cfg *config.Config) (http.Handler, error) {
 	log.Printf(ctx, "loading New_York/America time")
 	newYork, err := time.LoadLocation("America/New_York")
 	if err != nil {
-		log.Printf(ctx, "error loading America/New_York time: %v\n. Falling back to local/system", err)
+		log.Warnf(ctx, "error loading America/New_York time: %v\n. Falling back to local/system", err)
 		newYork = time.Local
 	}
 	newYorkTime = newYork
@@ -1247,8 +1300,8 @@ func New(cfg *config.Config) (http.Handler, error) {
 				panic(fmt.Sprint("Invalid TagsFormat: %s. Only 'datadog' and 'influxdb' allowed", givenFmt))
 			}
 
-			log.Printf(ctx, "appending tags: %v\n", cfg.StatsD.Tags)
-			log.Printf(ctx, "appending tagsFormat: %v\n", tagsFormat)
+			log.Printf(ctx, "appending tags: %v", cfg.StatsD.Tags)
+			log.Printf(ctx, "appending tagsFormat: %v", tagsFormat)
 			args = append(args, statsd.Tags(cfg.StatsD.Tags...), statsd.TagsFormat(tagsFormat))
 		}
 
@@ -1261,20 +1314,57 @@ func New(cfg *config.Config) (http.Handler, error) {
 		log.Printf(ctx, "Finished initializing StatsD client")
 	}
 
+	if len(cfg.Watches.Queries) > 0 && !cfg.FileviewerOnly {
+		if srv.watcher, err = newWatcher(srv, cfg.Watches); err != nil {
+			return nil, err
+		}
+	}
+
 	if !srv.config.FileviewerOnly {
 		for _, bk := range srv.config.Backends {
 			be, e := NewBackend(bk)
 			if e != nil {
 				return nil, e
 			}
+			be.cache = newSearchCache(cfg.SearchCache)
+			if srv.watcher != nil {
+				be.onNewIndex = srv.watcher.indexChanged
+			}
 			be.Start()
 			srv.bk[be.Id] = be
 			srv.bkOrder = append(srv.bkOrder, be.Id)
 		}
+
+		if err := srv.checkBackendConfig(); err != nil {
+			return nil, err
+		}
 	} else {
-		fmt.Printf("starting in fileviewer only mode\n")
+		log.Printf(ctx, "starting in fileviewer only mode")
 	}
 
+	if srv.rankers, err = newRankers(cfg.Ranking); err != nil {
+		return nil, err
+	}
+
+	if cfg.SavedSearches.Path != "" {
+		store, err := openJSONSavedSearchStore(cfg.SavedSearches.Path)
+		if err != nil {
+			return nil, err
+		}
+		srv.savedSearches = store
+		srv.savedSearchCounts = newSavedSearchCounts()
+	}
+
+	if srv.watcher != nil {
+		if err := srv.checkWatches(ctx, cfg.Watches.Queries); err != nil {
+			return nil, err
+		}
+		go srv.watcher.run()
+	}
+
+	srv.registry = prometheus.NewRegistry()
+	srv.registry.MustRegister(&backendCollector{srv})
+
 	var repoNames []string
 	for _, r := range srv.config.IndexConfig.Repositories {
 		srv.repos[r.Name] = r
@@ -1295,6 +1385,7 @@ func New(cfg *config.Config) (http.Handler, error) {
 	m.Add("GET", "/healthz", http.HandlerFunc(srv.ServeHealthZ))
 	m.Add("GET", "/debug/healthcheck", http.HandlerFunc(srv.ServeHealthcheck))
 	m.Add("GET", "/debug/stats", srv.Handler(srv.ServeStats))
+	m.Add("GET", "/metrics", metrics.Handler(srv.registry))
 	m.Add("GET", "/search/:backend", srv.Handler(srv.ServeSearch))
 	m.Add("GET", "/search/", srv.Handler(srv.ServeSearch))
 	m.Add("GET", "/view/", srv.Handler(srv.ServeFile))
@@ -1316,6 +1407,9 @@ func New(cfg *config.Config) (http.Handler, error) {
 	m.Add("GET", "/about", srv.Handler(srv.ServeAbout))
 	m.Add("GET", "/about-fileviewer", srv.Handler(srv.ServeAboutFileviewer))
 	m.Add("GET", "/help", srv.Handler(srv.ServeHelp))
+	m.Add("GET", "/saved-searches", srv.Handler(srv.ServeSavedSearches))
+	m.Add("GET", "/search-diff/:backend", srv.Handler(srv.ServeSearchDiff))
+	m.Add("GET", "/search-diff/", srv.Handler(srv.ServeSearchDiff))
 	m.Add("GET", "/opensearch.xml", srv.Handler(srv.ServeOpensearch))
 	m.Add("GET", "/", srv.Handler(srv.ServeRoot))
 
@@ -1343,6 +1437,21 @@ func New(cfg *config.Config) (http.Handler, error) {
 
 	m.Add("GET", "/api/v2/getRenderedSearchResults/:backend", srv.Handler(srv.ServeRenderedSearchResults))
 	m.Add("GET", "/api/v2/getRenderedSearchResults/", srv.Handler(srv.ServeRenderedSearchResults))
+	m.Add("GET", "/api/v2/getRenderedReferences/:backend", srv.Handler(srv.ServeRenderedReferences))
+	m.Add("GET", "/api/v2/getRenderedReferences/", srv.Handler(srv.ServeRenderedReferences))
+	m.Add("GET", "/api/v2/search/stream/:backend", srv.Handler(srv.ServeAPISearchStream))
+	m.Add("GET", "/api/v2/search/stream/", srv.Handler(srv.ServeAPISearchStream))
+	m.Add("GET", "/api/v2/search/export/:backend", srv.Handler(srv.ServeAPISearchExport))
+	m.Add("GET", "/api/v2/search/export/", srv.Handler(srv.ServeAPISearchExport))
+	m.Add("GET", "/api/v2/search/diff/:backend", srv.Handler(srv.ServeAPISearchDiff))
+	m.Add("GET", "/api/v2/search/diff/", srv.Handler(srv.ServeAPISearchDiff))
+	m.Add("GET", "/api/v2/search/replace/:backend", srv.Handler(srv.ServeAPISearchReplace))
+	m.Add("GET", "/api/v2/search/replace/", srv.Handler(srv.ServeAPISearchReplace))
+	m.Add("GET", "/api/v2/search/:backend", srv.Handler(srv.ServeAPISearchV2))
+	m.Add("GET", "/api/v2/search/", srv.Handler(srv.ServeAPISearchV2))
+	m.Add("GET", "/api/v2/saved-searches", srv.Handler(srv.ServeAPISavedSearches))
+	m.Add("POST", "/api/v2/saved-searches", srv.Handler(srv.ServeAPICreateSavedSearch))
+	m.Add("DELETE", "/api/v2/saved-searches/:id", srv.Handler(srv.ServeAPIDeleteSavedSearch))
 	m.Add("GET", "/api/v2/getRenderedFileTree/:parent/:repo/:rev/", srv.Handler(srv.ServeGitLsTreeRendered))
 	// m.Add("GET", "/delve/:parent/:repo/commits/:rev/", srv.Handler(srv.ServeSimpleGitLog))
 	// m.Add("GET", "/api/v2/json/git-log/:parent/:repo/:rev/", srv.Handler(srv.ServeSimpleGitLogJson))
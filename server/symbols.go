@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/livegrep/livegrep/server/api"
+)
+
+// tagFields are the ctags extension fields that describe a symbol
+// rather than name its scope. Any other "key:value" field is a scope,
+// like "class:Server", whose key depends on the language.
+var tagFields = map[string]bool{
+	"access":         true,
+	"end":            true,
+	"file":           true,
+	"implementation": true,
+	"inherits":       true,
+	"language":       true,
+	"line":           true,
+	"roles":          true,
+	"signature":      true,
+	"typeref":        true,
+}
+
+// parseTag describes the symbol defined by a line of a ctags file,
+// "name\tpath\tlno;\"\tkind\tkey:value...", as written by
+// `ctags --format=2 -n --fields=+K`. It returns nil for an empty or
+// malformed line.
+func parseTag(tag string) *api.Symbol {
+	fields := strings.Split(tag, "\t")
+	if len(fields) < 3 || fields[0] == "" {
+		return nil
+	}
+	sym := &api.Symbol{Name: fields[0]}
+	for _, f := range fields[3:] {
+		key, value, ok := strings.Cut(f, ":")
+		switch {
+		case !ok:
+			sym.Kind = f
+		case key == "kind":
+			sym.Kind = value
+		case sym.Scope == "" && !tagFields[key]:
+			sym.ScopeKind, sym.Scope = key, value
+		}
+	}
+	return sym
+}
+
+// symbolLine is the regex a def: search matches symbol names with: the
+// whole name, rather than any part of it.
+func symbolLine(name string) string {
+	return "^(?:" + name + ")$"
+}
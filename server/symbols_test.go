@@ -0,0 +1,57 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/livegrep/livegrep/server/api"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+func TestParseTag(t *testing.T) {
+	cases := []struct {
+		tag  string
+		want *api.Symbol
+	}{
+		{"", nil},
+		{"main\tmain.go", nil},
+		{
+			"main\tcmd/main.go\t12;\"\tfunction",
+			&api.Symbol{Name: "main", Kind: "function"},
+		},
+		{
+			"ServeHTTP\tserver/server.go\t40;\"\tmethod\tfile:\tstruct:server\tsignature:(w, r)",
+			&api.Symbol{Name: "ServeHTTP", Kind: "method", Scope: "server", ScopeKind: "struct"},
+		},
+		{
+			"Open\tos.cc\t3;\"\tkind:function\tlanguage:C++\tnamespace:os",
+			&api.Symbol{Name: "Open", Kind: "function", Scope: "os", ScopeKind: "namespace"},
+		},
+	}
+	for _, tc := range cases {
+		if got := parseTag(tc.tag); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseTag(%q) = %+v, want %+v", tc.tag, got, tc.want)
+		}
+	}
+}
+
+func TestAddContextLinesSymbol(t *testing.T) {
+	result := &api.ResultV2{ContextLines: make(map[int]*api.ResultLine)}
+	addContextLines(result, &pb.SearchResult{
+		LineNumber:   2,
+		Line:         "func Open() {",
+		ContextAfter: []string{"}"},
+		NumMatches:   1,
+		Tag:          "Open\tos.go\t2;\"\tfunction",
+	})
+	addContextLines(result, &pb.SearchResult{LineNumber: 3, Line: "}", NumMatches: 1})
+	if result.NumDefinitions != 1 {
+		t.Errorf("NumDefinitions = %d, want 1", result.NumDefinitions)
+	}
+	if sym := result.ContextLines[2].Symbol; sym == nil || sym.Name != "Open" {
+		t.Errorf("definition line has symbol %+v", sym)
+	}
+	if sym := result.ContextLines[3].Symbol; sym != nil {
+		t.Errorf("other line has symbol %+v", sym)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -19,10 +20,17 @@ import (
 	"github.com/alecthomas/chroma/lexers"
 	"github.com/alecthomas/chroma/styles"
 
+	"golang.org/x/net/context"
+
 	"github.com/livegrep/livegrep/server/api"
 	"github.com/livegrep/livegrep/server/fileviewer"
+	"github.com/livegrep/livegrep/server/log"
 )
 
+// logCtx is what template helpers log with, as they aren't passed the
+// request's context.
+var logCtx = context.Background()
+
 func linkTag(nonce template.HTMLAttr, rel string, s string, m map[string]string) template.HTML {
 	hash := m[strings.TrimPrefix(s, "/")]
 	href := s + "?v=" + hash
@@ -239,6 +247,17 @@ func getFirstNFiles(s []*api.FileResult, n int) []*api.FileResult {
 	return s[:c]
 }
 
+// hasDefinitions reports whether any of results are definitions found
+// in the backend's tags.
+func hasDefinitions(results []*api.ResultV2) bool {
+	for _, r := range results {
+		if r.NumDefinitions > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func shouldInsertBlankLine(currIdx int, lines []*api.ResultLine) bool {
 	prevIdx := currIdx - 1
 	if prevIdx < 0 {
@@ -318,6 +337,22 @@ func styleAttr(styles map[chroma.TokenType]string, tt chroma.TokenType) string {
 	}
 	return fmt.Sprintf(` class="%s"`, cls)
 }
+
+// identifierRE matches the tokens the fileviewer lets people click on
+// to find where they're defined and used.
+var identifierRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// tokenAttrs returns the attributes of the span holding token. Names get
+// the class symbol-ref and their name in data-symbol, for the fileviewer
+// to search for when they're clicked.
+func tokenAttrs(css map[chroma.TokenType]string, token chroma.Token) string {
+	if !token.Type.InCategory(chroma.Name) || !identifierRE.MatchString(token.Value) {
+		return styleAttr(css, token.Type)
+	}
+	cls := strings.TrimSpace(getChromaClass(token.Type) + " symbol-ref")
+	return fmt.Sprintf(` class="%s" data-symbol="%s"`, cls, token.Value)
+}
+
 func writeCSS(w io.Writer, style *chroma.Style) error {
 	css := styleToCSS(style)
 
@@ -344,7 +379,7 @@ func writeCSS(w io.Writer, style *chroma.Style) error {
 }
 
 func timeTrack(start time.Time, name string) {
-	fmt.Printf("%s took %s\n", name, time.Since(start))
+	log.Debugf(logCtx, "%s took %s", name, time.Since(start))
 }
 
 func getLexerForFilename(filename string) chroma.Lexer {
@@ -352,7 +387,7 @@ func getLexerForFilename(filename string) chroma.Lexer {
 	if l == nil {
 		l = lexers.Fallback
 	}
-	fmt.Printf("using lexer: %s\n", l.Config().Name)
+	log.Debugf(logCtx, "using lexer: %s", l.Config().Name)
 	return l
 }
 
@@ -392,15 +427,15 @@ func getSyntaxHighlightedContent(content, language, filename string) SyntaxHighl
 	css := styleToCSS(styles.Xcode)
 
 	if l == nil {
-		fmt.Printf("unable to get lexer with language=%s. Trying via filename=%s\n", language, filename)
+		log.Debugf(logCtx, "unable to get lexer with language=%s. Trying via filename=%s", language, filename)
 		l = lexers.Match(filename)
 		if l == nil {
-			fmt.Printf("failed to get lexer with filename. Not using a lexer and just splitting content.\n")
+			log.Debugf(logCtx, "failed to get lexer with filename. Not using a lexer and just splitting content.")
 			return SyntaxHighlightedContent{
 				Content: convertContentBlobToArrayOfLines(content),
 			}
 		} else {
-			fmt.Printf("Found lexer=%s for filename=%s\n", l.Config().Name, filename)
+			log.Debugf(logCtx, "Found lexer=%s for filename=%s", l.Config().Name, filename)
 		}
 	}
 
@@ -410,7 +445,7 @@ func getSyntaxHighlightedContent(content, language, filename string) SyntaxHighl
 	it, err := l.Tokenise(nil, content)
 
 	if err != nil {
-		fmt.Printf("error tokenizing=%+v\n", err)
+		log.Errorf(logCtx, "error tokenizing=%+v", err)
 		return SyntaxHighlightedContent{
 			Content: convertContentBlobToArrayOfLines(content),
 		}
@@ -429,7 +464,7 @@ func getSyntaxHighlightedContent(content, language, filename string) SyntaxHighl
 		var b strings.Builder
 		for _, token := range tokens {
 			html := html.EscapeString(token.String())
-			attr := styleAttr(css, token.Type)
+			attr := tokenAttrs(css, token)
 			b.WriteString(fmt.Sprintf("<span%s>%s</span>", attr, html))
 		}
 
@@ -450,6 +485,7 @@ func getFuncs() map[string]interface{} {
 		"splitCodeLineIntoParts":           splitCodeLineIntoParts,
 		"min":                              min,
 		"getFirstNFiles":                   getFirstNFiles,
+		"hasDefinitions":                   hasDefinitions,
 		"shouldInsertBlankLine":            shouldInsertBlankLine,
 		"getLineNumberLinkClass":           getLineNumberLinkClass,
 		"renderCodeLine":                   renderCodeLine,
@@ -517,7 +553,7 @@ func getDiffRowType(row fileviewer.IDiffRow) string {
 	case fileviewer.IDiffRowHunk:
 		return "hunk"
 	default:
-		fmt.Printf("encountered weird row. row T=%T val=%v\n type=%v", row)
+		log.Warnf(logCtx, "encountered weird row. row T=%T val=%v", row, row)
 		return "blah"
 	}
 
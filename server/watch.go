@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+	"github.com/livegrep/livegrep/server/identity"
+	"github.com/livegrep/livegrep/server/log"
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+)
+
+// watchWebhookTimeout bounds how long a webhook may take to accept a
+// notification.
+const watchWebhookTimeout = 30 * time.Second
+
+// watchMatch identifies a match a watch found. Matches are told apart by
+// their line's text rather than its number, so that edits elsewhere in a
+// file don't make the matches in it look new.
+type watchMatch struct {
+	Tree string `json:"tree"`
+	Path string `json:"path"`
+	Line string `json:"line"`
+}
+
+// watchRun is what a watch found the last time it ran against a backend.
+type watchRun struct {
+	IndexTime  time.Time    `json:"index_time"`
+	Incomplete bool         `json:"incomplete,omitempty"`
+	Matches    []watchMatch `json:"matches"`
+	// Matches found since, in runs whose webhook failed, that were
+	// already appended to the watch's file.
+	Written []watchMatch `json:"written,omitempty"`
+}
+
+// A watcher reruns the configured watches against each backend whose
+// index changes, and notifies whoever each names of the matches that
+// weren't in the backend's previous index.
+type watcher struct {
+	srv       *server
+	watches   []config.Watch
+	statePath string
+	client    *http.Client
+
+	mu sync.Mutex
+	// The backends whose index changed since the watches last ran.
+	pending map[string]*Backend
+	wake    chan struct{}
+
+	// The last run of each watch against each backend, by backend id and
+	// then watch name. Only run touches it once it's started.
+	runs map[string]map[string]*watchRun
+}
+
+// newWatcher returns a watcher for cfg's watches, loading their last
+// runs from cfg's state file, if it exists.
+func newWatcher(srv *server, cfg config.Watches) (*watcher, error) {
+	w := &watcher{
+		srv:       srv,
+		watches:   cfg.Queries,
+		statePath: cfg.StatePath,
+		client:    &http.Client{Timeout: watchWebhookTimeout},
+		pending:   make(map[string]*Backend),
+		wake:      make(chan struct{}, 1),
+		runs:      make(map[string]map[string]*watchRun),
+	}
+	if w.statePath == "" {
+		return w, nil
+	}
+	data, err := ioutil.ReadFile(w.statePath)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &w.runs); err != nil {
+		return nil, fmt.Errorf("reading watch state from %s: %s", w.statePath, err)
+	}
+	return w, nil
+}
+
+// checkWatches checks that each watch has a unique name, somewhere to
+// send notifications, and a search that would work.
+func (s *server) checkWatches(ctx context.Context, watches []config.Watch) error {
+	names := make(map[string]bool)
+	for _, watch := range watches {
+		if names[watch.Name] {
+			return fmt.Errorf("Two watches are named %q", watch.Name)
+		}
+		names[watch.Name] = true
+		if watch.WebhookURL == "" && watch.File == "" {
+			return fmt.Errorf("Watch %q needs a webhook_url or file to send new matches to", watch.Name)
+		}
+		if at, _ := queryGeneration(watch.Query, watch.Regex); at != "" {
+			return fmt.Errorf("Watch %q searches each new index, so it can't use at:", watch.Name)
+		}
+		err := s.checkSavedSearch(ctx, &api.SavedSearch{
+			Name:     watch.Name,
+			Backend:  watch.Backend,
+			Query:    watch.Query,
+			Regex:    watch.Regex,
+			FoldCase: watch.FoldCase,
+		})
+		if err != nil {
+			return fmt.Errorf("Watch %q: %s", watch.Name, err)
+		}
+	}
+	return nil
+}
+
+// indexChanged queues the watches to run against bk. It's each backend's
+// onNewIndex.
+func (w *watcher) indexChanged(bk *Backend) {
+	w.mu.Lock()
+	w.pending[bk.Id] = bk
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run runs the watches against each backend whose index changes, one
+// backend at a time. It never returns.
+func (w *watcher) run() {
+	ctx := context.Background()
+	for range w.wake {
+		w.mu.Lock()
+		pending := w.pending
+		w.pending = make(map[string]*Backend)
+		w.mu.Unlock()
+
+		ids := make([]string, 0, len(pending))
+		for id := range pending {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			w.runBackend(ctx, pending[id])
+		}
+		if err := w.save(); err != nil {
+			log.Errorf(ctx, "saving watch state err=%s", err)
+		}
+	}
+}
+
+// runBackend runs the watches for bk against its current index, unless
+// they've already run against it, and notifies of any new matches.
+func (w *watcher) runBackend(ctx context.Context, bk *Backend) {
+	bk.I.Lock()
+	indexTime := bk.I.IndexTime
+	bk.I.Unlock()
+
+	for i := range w.watches {
+		watch := &w.watches[i]
+		if watch.Backend != "" && watch.Backend != bk.Id {
+			continue
+		}
+		last := w.runs[bk.Id][watch.Name]
+		if last != nil && !last.IndexTime.Before(indexTime) {
+			continue
+		}
+
+		ctx := log.WithFields(ctx, log.Fields{"watch": watch.Name, "backend": bk.Id})
+		run, results, err := w.search(ctx, bk, watch, indexTime)
+		if err != nil {
+			log.Warnf(ctx, "running watch err=%s", err)
+			continue
+		}
+
+		// A watch's first run has nothing to compare with, so it only
+		// records what it found.
+		if last != nil {
+			notification := func(fresh []*api.Result) *api.WatchNotification {
+				return &api.WatchNotification{
+					Watch:      watch.Name,
+					Backend:    bk.Id,
+					IndexTime:  indexTime,
+					Query:      watch.Query,
+					Incomplete: last.Incomplete || run.Incomplete,
+					NewMatches: fresh,
+				}
+			}
+			if err := w.notify(ctx, watch, last, results, notification); err != nil {
+				// Keep the last run, so that these matches are
+				// reported again once the index next changes.
+				log.Errorf(ctx, "notifying of new matches err=%s", err)
+				continue
+			}
+		}
+
+		if w.runs[bk.Id] == nil {
+			w.runs[bk.Id] = make(map[string]*watchRun)
+		}
+		w.runs[bk.Id][watch.Name] = run
+	}
+}
+
+// search runs watch's search against bk, as the groups the watch names,
+// up to the configured export_max_matches.
+func (w *watcher) search(ctx context.Context, bk *Backend, watch *config.Watch, indexTime time.Time) (*watchRun, []*api.Result, error) {
+	r := savedSearchRequest(&api.SavedSearch{
+		Backend:  bk.Id,
+		Query:    watch.Query,
+		Regex:    watch.Regex,
+		FoldCase: watch.FoldCase,
+	})
+	q, expr, is_regex, err := extractQuery(ctx, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q.MaxMatches == 0 {
+		q.MaxMatches = w.srv.config.DefaultMaxMatches
+		expr.setMaxMatches(q.MaxMatches)
+	}
+	w.srv.limitQuery(&q, expr)
+
+	ctx = identity.NewContext(ctx, &identity.Identity{
+		Name:   "watch:" + watch.Name,
+		Method: "watch",
+		Groups: watch.Groups,
+	})
+	reply, err := exportSearch(&q, expr, w.srv.exportMaxMatches(), func(q *pb.Query, expr *QueryExpr) (*api.ReplySearch, error) {
+		return w.srv.doSearch(ctx, bk, q, expr, searchOptions{regex: is_regex})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := allResults(reply)
+	run := &watchRun{
+		IndexTime:  indexTime,
+		Incomplete: reply.Info.ExitReason != "NONE",
+		Matches:    resultMatches(results),
+	}
+	return run, results, nil
+}
+
+// allResults returns reply's line results followed by its file results,
+// which have no line.
+func allResults(reply *api.ReplySearch) []*api.Result {
+	results := reply.Results
+	for _, r := range reply.FileResults {
+		results = append(results, &api.Result{Tree: r.Tree, Version: r.Version, Path: r.Path})
+	}
+	return results
+}
+
+func resultMatches(results []*api.Result) []watchMatch {
+	var matches []watchMatch
+	for _, r := range results {
+		matches = append(matches, watchMatch{r.Tree, r.Path, r.Line})
+	}
+	return matches
+}
+
+// newMatches returns the results whose matches aren't in last.
+func newMatches(last []watchMatch, results []*api.Result) []*api.Result {
+	seen := make(map[watchMatch]bool, len(last))
+	for _, m := range last {
+		seen[m] = true
+	}
+	var fresh []*api.Result
+	for _, r := range results {
+		m := watchMatch{r.Tree, r.Path, r.Line}
+		if !seen[m] {
+			seen[m] = true
+			fresh = append(fresh, r)
+		}
+	}
+	return fresh
+}
+
+// notify tells where watch says of the results whose matches aren't in
+// its last run. The file is only told of those it wasn't already: if
+// the webhook fails after the file is written, last keeps what was
+// written, so that only the webhook is told of it again.
+func (w *watcher) notify(ctx context.Context, watch *config.Watch, last *watchRun, results []*api.Result,
+	notification func(fresh []*api.Result) *api.WatchNotification) error {
+	if watch.File != "" {
+		written := append(last.Matches[:len(last.Matches):len(last.Matches)], last.Written...)
+		if fresh := newMatches(written, results); len(fresh) > 0 {
+			if err := appendNotification(watch.File, notification(fresh)); err != nil {
+				return err
+			}
+			last.Written = append(last.Written, resultMatches(fresh)...)
+			log.Infof(ctx, "wrote new matches count=%d", len(fresh))
+		}
+	}
+	if watch.WebhookURL != "" {
+		if fresh := newMatches(last.Matches, results); len(fresh) > 0 {
+			if err := w.post(watch.WebhookURL, notification(fresh)); err != nil {
+				return err
+			}
+			log.Infof(ctx, "notified of new matches count=%d", len(fresh))
+		}
+	}
+	return nil
+}
+
+// appendNotification appends n to the file at path, as a line of JSON.
+func appendNotification(path string, n *api.WatchNotification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// post sends n to the webhook at url.
+func (w *watcher) post(url string, n *api.WatchNotification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("webhook replied " + resp.Status)
+	}
+	return nil
+}
+
+// save writes the watches' last runs to the state file, if there is
+// one, dropping those of watches that are no longer configured.
+func (w *watcher) save() error {
+	if w.statePath == "" {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, watch := range w.watches {
+		names[watch.Name] = true
+	}
+	for _, runs := range w.runs {
+		for name := range runs {
+			if !names[name] {
+				delete(runs, name)
+			}
+		}
+	}
+	data, err := json.MarshalIndent(w.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(w.statePath, data)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/livegrep/livegrep/src/proto/go_proto"
+
+	"github.com/livegrep/livegrep/server/api"
+	"github.com/livegrep/livegrep/server/config"
+)
+
+func TestWatcher(t *testing.T) {
+	var posted []*api.WatchNotification
+	webhookStatus := 200
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n api.WatchNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decoding notification: %s", err)
+		}
+		posted = append(posted, &n)
+		w.WriteHeader(webhookStatus)
+	}))
+	defer webhook.Close()
+
+	dir := t.TempDir()
+	cfg := config.Watches{
+		Queries: []config.Watch{{
+			Name:       "banned",
+			Query:      "oldFunc",
+			WebhookURL: webhook.URL,
+			File:       filepath.Join(dir, "new.jsonl"),
+		}},
+		StatePath: filepath.Join(dir, "state.json"),
+	}
+	cs := &fakeCodesearch{}
+	bk := &Backend{Id: "main", I: &I{}, Codesearch: cs}
+	s := &server{
+		config:  &config.Config{},
+		bk:      map[string]*Backend{"main": bk},
+		bkOrder: []string{"main"},
+	}
+	w, err := newWatcher(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkWatches(context.Background(), cfg.Queries); err != nil {
+		t.Fatal(err)
+	}
+
+	line := func(path, text string, lno int64) *pb.SearchResult {
+		return &pb.SearchResult{Tree: "repo", Version: "v", Path: path, Line: text, LineNumber: lno}
+	}
+	index := func(lines ...*pb.SearchResult) {
+		cs.lines = lines
+		bk.I.IndexTime = bk.I.IndexTime.Add(time.Hour)
+		w.runBackend(context.Background(), bk)
+	}
+
+	index(line("a.go", "oldFunc()", 1))
+	if len(posted) != 0 {
+		t.Fatalf("the first run notified of %+v", posted[0])
+	}
+
+	// Moving a match doesn't make it new.
+	index(line("a.go", "oldFunc()", 5), line("b.go", "x := oldFunc()", 2))
+	if len(posted) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(posted))
+	}
+	if n := posted[0]; n.Watch != "banned" || n.Backend != "main" ||
+		len(n.NewMatches) != 1 || n.NewMatches[0].Path != "b.go" || n.NewMatches[0].LineNumber != 2 {
+		t.Errorf("got notification %+v", n)
+	}
+	data, err := ioutil.ReadFile(cfg.Queries[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"b.go"`) {
+		t.Errorf("got file %q", data)
+	}
+
+	// Matches that failed to be delivered are sent again.
+	webhookStatus = 500
+	index(line("a.go", "oldFunc()", 5), line("b.go", "x := oldFunc()", 2), line("c.go", "oldFunc()", 1))
+	webhookStatus = 200
+	index(line("a.go", "oldFunc()", 5), line("b.go", "x := oldFunc()", 2), line("c.go", "oldFunc()", 1))
+	if len(posted) != 3 || len(posted[2].NewMatches) != 1 || posted[2].NewMatches[0].Path != "c.go" {
+		t.Errorf("got notifications %+v", posted)
+	}
+	// but only to the webhook that failed: the file had them already.
+	data, err = ioutil.ReadFile(cfg.Queries[0].File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"c.go"`) {
+		t.Errorf("got file %q", data)
+	}
+
+	// A restart doesn't rerun the watches against the same index.
+	if err := w.save(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = newWatcher(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.lines = append(cs.lines, line("d.go", "oldFunc()", 1))
+	w.runBackend(context.Background(), bk)
+	if len(posted) != 3 {
+		t.Errorf("rerunning against the same index notified of %+v", posted[3])
+	}
+}
+
+func TestCheckWatches(t *testing.T) {
+	s := &server{bk: map[string]*Backend{"main": {Id: "main"}}, bkOrder: []string{"main"}}
+	bad := [][]config.Watch{
+		{{Name: "a", Query: "x"}},
+		{{Name: "a", Query: "x", File: "f"}, {Name: "a", Query: "y", File: "f"}},
+		{{Name: "a", Query: "x", File: "f", Backend: "other"}},
+		{{Name: "a", Query: "x lang:cobol", File: "f"}},
+	}
+	for _, watches := range bad {
+		if err := s.checkWatches(context.Background(), watches); err == nil {
+			t.Errorf("checkWatches(%+v) succeeded", watches)
+		}
+	}
+}
@@ -106,6 +106,9 @@ struct match_result {
     StringPiece line;
     vector<match_bound> match_bounds;
     int num_matches;
+    // For a match found by searching the tags file, the tags line
+    // that pointed at it; empty otherwise.
+    StringPiece tag;
 };
 
 struct file_result {
@@ -116,6 +116,7 @@ bool tag_searcher::transform(query *q, match_result *m) const {
 
 
     // line (match the first occurrence for simplicity)
+    m->tag = m->line;
     m->line = *line_it;
 
     StringPiece match;
@@ -23,6 +23,7 @@
 #include <boost/bind.hpp>
 
 using grpc::ServerContext;
+using grpc::ServerWriter;
 using grpc::Status;
 using grpc::StatusCode;
 
@@ -31,6 +32,8 @@ using std::string;
 DEFINE_int32(context_lines, 3, "The default number of result context lines to provide for a single query.");
 DEFINE_int32(max_matches, 50, "The default maximum number of matches to return for a single query.");
 
+class add_match;
+
 class CodeSearchImpl final : public CodeSearch::Service {
  public:
     explicit CodeSearchImpl(code_searcher *cs, code_searcher *tagdata, std::promise<void> *reload_request);
@@ -38,8 +41,10 @@ class CodeSearchImpl final : public CodeSearch::Service {
 
     virtual grpc::Status Info(grpc::ServerContext* context, const ::InfoRequest* request, ::ServerInfo* response);
     virtual grpc::Status QuickInfo(grpc::ServerContext* context, const ::Empty* request, ::QuickServerInfo* response);
-    void TagsFirstSearch_(::CodeSearchResult* response, query& q, match_stats& stats);
+    void TagsFirstSearch_(add_match& cb, query& q, match_stats& stats);
+    grpc::Status Search_(grpc::ServerContext* context, const ::Query* request, ::CodeSearchResult* response, ServerWriter< ::CodeSearchResult>* writer);
     virtual grpc::Status Search(grpc::ServerContext* context, const ::Query* request, ::CodeSearchResult* response);
+    virtual grpc::Status StreamSearch(grpc::ServerContext* context, const ::Query* request, ServerWriter< ::CodeSearchResult>* writer);
     virtual grpc::Status Reload(grpc::ServerContext* context, const ::Empty* request, ::Empty* response);
 
  private:
@@ -173,13 +178,30 @@ class add_match {
 public:
     typedef std::set<std::pair<indexed_file*, int>> line_set;
 
-    add_match(line_set* ls, CodeSearchResult* response)
-        : unique_lines_(ls), response_(response) {}
+    // If writer is set, each result is also sent to the client as
+    // soon as it is added to the response.
+    //
+    // If cursor is set, the results are ordered: only results after
+    // the cursor are added, and of those only the first limit of each
+    // kind, in (tree, path, line) order, are kept. The search must then
+    // run over the whole index, and finish() be called once it's done;
+    // results are only sent to the writer then.
+    add_match(line_set* ls, CodeSearchResult* response,
+              ServerWriter<CodeSearchResult>* writer = nullptr,
+              const Cursor* cursor = nullptr, int limit = 0)
+        : unique_lines_(ls), response_(response), writer_(writer),
+          cursor_(cursor), limit_(limit), truncated_(false),
+          has_bound_(false), bound_lno_(0) {}
 
     int match_count() {
         return response_->results_size();
     }
 
+    // Whether an ordered search found more results than it kept.
+    bool truncated() const {
+        return truncated_;
+    }
+
     void operator()(const match_result *m) const {
         // Avoid a duplicate if a line is returned once from the
         // tags search then again during the main corpus search.
@@ -187,6 +209,15 @@ public:
         if (already_inserted) {
             return;
         }
+        if (!after_cursor(m->file->tree->name, m->file->path, m->lno)) {
+            return;
+        }
+        if (has_bound_ && !key_less(m->file->tree->name, m->file->path, m->lno,
+                                    bound_tree_, bound_path_, bound_lno_)) {
+            // We already have limit results before this one.
+            truncated_ = true;
+            return;
+        }
 
         auto result = response_->add_results();
         result->set_tree(m->file->tree->name);
@@ -208,29 +239,155 @@ public:
         }
 
         result->set_line(m->line.ToString());
+        if (!m->tag.empty()) {
+            result->set_tag(m->tag.ToString());
+        }
+
+        if (ordered()) {
+            if (response_->results_size() >= 2 * limit_ && limit_ > 0) {
+                keep_first(response_->mutable_results(), result_less);
+                const auto &last = response_->results(limit_ - 1);
+                has_bound_ = true;
+                bound_tree_ = last.tree();
+                bound_path_ = last.path();
+                bound_lno_ = last.line_number();
+            }
+        } else if (writer_ != nullptr) {
+            CodeSearchResult chunk;
+            chunk.add_results()->CopyFrom(*result);
+            writer_->Write(chunk);
+        }
     }
 
     void operator()(const file_result *f) const {
+        if (!after_cursor(f->file->tree->name, f->file->path, 0))
+            return;
         auto result = response_->add_file_results();
         result->set_tree(f->file->tree->name);
         result->set_version(f->file->tree->version);
         result->set_path(f->file->path);
         result->mutable_bounds()->set_left(f->matchleft);
         result->mutable_bounds()->set_right(f->matchright);
+
+        if (ordered()) {
+            if (response_->file_results_size() >= 2 * limit_ && limit_ > 0)
+                keep_first(response_->mutable_file_results(), file_less);
+        } else if (writer_ != nullptr) {
+            CodeSearchResult chunk;
+            chunk.add_file_results()->CopyFrom(*result);
+            writer_->Write(chunk);
+        }
     }
 
     void operator()(const tree_result *t) const {
+        if (!after_cursor(t->tree->name, StringPiece(), 0))
+            return;
         auto result = response_->add_tree_results();
         result->set_name(t->tree->name);
         result->set_version(t->tree->version);
         result->mutable_metadata()->CopyFrom(t->tree->metadata);
         result->mutable_bounds()->set_left(t->matchleft);
         result->mutable_bounds()->set_right(t->matchright);
+
+        if (ordered()) {
+            if (response_->tree_results_size() >= 2 * limit_ && limit_ > 0)
+                keep_first(response_->mutable_tree_results(), tree_less);
+        } else if (writer_ != nullptr) {
+            CodeSearchResult chunk;
+            chunk.add_tree_results()->CopyFrom(*result);
+            writer_->Write(chunk);
+        }
+    }
+
+    // Sorts an ordered search's results, drops all but the first limit
+    // of each kind, and sends them to the writer.
+    void finish() const {
+        if (!ordered())
+            return;
+        keep_first(response_->mutable_results(), result_less);
+        keep_first(response_->mutable_file_results(), file_less);
+        keep_first(response_->mutable_tree_results(), tree_less);
+        if (writer_ == nullptr)
+            return;
+        for (auto &r : response_->results()) {
+            CodeSearchResult chunk;
+            chunk.add_results()->CopyFrom(r);
+            writer_->Write(chunk);
+        }
+        for (auto &r : response_->file_results()) {
+            CodeSearchResult chunk;
+            chunk.add_file_results()->CopyFrom(r);
+            writer_->Write(chunk);
+        }
+        for (auto &r : response_->tree_results()) {
+            CodeSearchResult chunk;
+            chunk.add_tree_results()->CopyFrom(r);
+            writer_->Write(chunk);
+        }
     }
 
 private:
+    bool ordered() const {
+        return cursor_ != nullptr;
+    }
+
+    static bool key_less(StringPiece tree, StringPiece path, int64_t lno,
+                         StringPiece otree, StringPiece opath, int64_t olno) {
+        int cmp = tree.compare(otree);
+        if (cmp != 0)
+            return cmp < 0;
+        cmp = path.compare(opath);
+        if (cmp != 0)
+            return cmp < 0;
+        return lno < olno;
+    }
+
+    static bool result_less(const SearchResult *a, const SearchResult *b) {
+        return key_less(a->tree(), a->path(), a->line_number(),
+                        b->tree(), b->path(), b->line_number());
+    }
+
+    static bool file_less(const FileResult *a, const FileResult *b) {
+        return key_less(a->tree(), a->path(), 0, b->tree(), b->path(), 0);
+    }
+
+    static bool tree_less(const TreeResult *a, const TreeResult *b) {
+        return a->name() < b->name();
+    }
+
+    // keep_first sorts results and drops all but the first limit_.
+    template <class T, class Less>
+    void keep_first(google::protobuf::RepeatedPtrField<T> *results, Less less) const {
+        if (limit_ <= 0 || results->size() <= limit_) {
+            std::sort(results->pointer_begin(), results->pointer_end(), less);
+            return;
+        }
+        std::partial_sort(results->pointer_begin(),
+                          results->pointer_begin() + limit_,
+                          results->pointer_end(), less);
+        results->DeleteSubrange(limit_, results->size() - limit_);
+        truncated_ = true;
+    }
+
+    bool after_cursor(StringPiece tree, StringPiece path, int64_t lno) const {
+        if (cursor_ == nullptr)
+            return true;
+        return key_less(cursor_->tree(), cursor_->path(), cursor_->line_number(),
+                        tree, path, lno);
+    }
+
     line_set* unique_lines_;
     CodeSearchResult* response_;
+    ServerWriter<CodeSearchResult>* writer_;
+    const Cursor* cursor_;
+    int limit_;
+    mutable bool truncated_;
+    // Once an ordered search has limit results, the last of them: any
+    // result after it would be dropped.
+    mutable bool has_bound_;
+    mutable string bound_tree_;
+    mutable string bound_path_;
+    mutable int64_t bound_lno_;
 };
 
 static void run_tags_search(const query& main_query, std::string regex,
@@ -269,30 +426,32 @@ static std::string pat(const std::shared_ptr<RE2> &p) {
     return p->pattern();
 }
 
-void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, match_stats& stats) {
+void CodeSearchImpl::TagsFirstSearch_(add_match& cb, query& q, match_stats& stats) {
     string line_pat = q.line_pat->pattern();
     string regex;
     int32_t original_max_matches = q.max_matches;  // remember original value
 
-    add_match::line_set ls;
-    add_match cb(&ls, response);
-
     /* To surface the most important matches first, start with tags.
        First pass: is the pattern an exact match for any tags? */
     regex = "^" + line_pat + "$";
     run_tags_search(q, regex, tagdata_, cb, tagmatch_, stats);
 
-    q.max_matches = original_max_matches - cb.match_count();
-    if (q.max_matches <= 0)
-        return;
+    // A max_matches of 0 means no limit, which the passes share.
+    if (original_max_matches > 0) {
+        q.max_matches = original_max_matches - cb.match_count();
+        if (q.max_matches <= 0)
+            return;
+    }
 
     /* Second pass: is the pattern a prefix match for any tags? */
     regex = "^" + line_pat + "[^\t]";
     run_tags_search(q, regex, tagdata_, cb, tagmatch_, stats);
 
-    q.max_matches = original_max_matches - cb.match_count();
-    if (q.max_matches <= 0)
-        return;
+    if (original_max_matches > 0) {
+        q.max_matches = original_max_matches - cb.match_count();
+        if (q.max_matches <= 0)
+            return;
+    }
 
     /* Third and final pass: full corpus search. */
     code_searcher::search_thread *search;
@@ -303,6 +462,25 @@ void CodeSearchImpl::TagsFirstSearch_(::CodeSearchResult* response, query& q, ma
 }
 
 Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::CodeSearchResult* response) {
+    return Search_(context, request, response, nullptr);
+}
+
+Status CodeSearchImpl::StreamSearch(ServerContext* context, const ::Query* request, ServerWriter< ::CodeSearchResult>* writer) {
+    ::CodeSearchResult response;
+    Status st = Search_(context, request, &response, writer);
+    if (!st.ok())
+        return st;
+
+    // The results have already been sent; finish with the stats.
+    ::CodeSearchResult last;
+    last.set_index_name(response.index_name());
+    last.set_index_time(response.index_time());
+    last.mutable_stats()->CopyFrom(response.stats());
+    writer->Write(last);
+    return Status::OK;
+}
+
+Status CodeSearchImpl::Search_(ServerContext* context, const ::Query* request, ::CodeSearchResult* response, ServerWriter< ::CodeSearchResult>* writer) {
     WidthWalker width;
 
     scoped_trace_id trace(trace_id_from_request(context));
@@ -367,26 +545,40 @@ Status CodeSearchImpl::Search(ServerContext* context, const ::Query* request, ::
         && line_pat.back() != '$'
         ;
 
+    // A search resuming after a cursor returns the first max_matches
+    // results after it, which means searching the whole index for them
+    // rather than stopping at the first max_matches found.
+    const ::Cursor* cursor = nullptr;
+    int limit = 0;
+    if (request->has_resume_after()) {
+        cursor = &request->resume_after();
+        limit = q.max_matches;
+        q.max_matches = 0;
+    }
+
+    if (q.tags_pat != NULL && tagdata_ == NULL)
+        return Status(StatusCode::FAILED_PRECONDITION, "No tags file available.");
+
     match_stats stats;
     timer search_tm(true);
+    add_match::line_set ls;
+    add_match cb(&ls, response, writer, cursor, limit);
     if (q.tags_pat == NULL && tagdata_ && might_match_tags) {
-        CodeSearchImpl::TagsFirstSearch_(response, q, stats);
+        CodeSearchImpl::TagsFirstSearch_(cb, q, stats);
     } else if (q.tags_pat == NULL) {
         code_searcher::search_thread *search;
         if (!pool_.try_pop(&search))
             search = new code_searcher::search_thread(cs_);
-        add_match::line_set ls;
-        add_match cb(&ls, response);
         search->match(q, cb, cb, cb, &stats);
         pool_.push(search);
     } else {
-        if (tagdata_ == NULL)
-            return Status(StatusCode::FAILED_PRECONDITION, "No tags file available.");
-
-        add_match::line_set ls;
-        add_match cb(&ls, response);
         run_tags_search(q, line_pat, tagdata_, cb, tagmatch_, stats);
     }
+    cb.finish();
+    // An ordered search that ran to completion but found more than it
+    // kept stopped at the match limit, as far as its caller can tell.
+    if (stats.why == kExitNone && cb.truncated())
+        stats.why = kExitMatchLimit;
     search_tm.pause();
 
     auto out_stats = response->mutable_stats();
@@ -22,13 +22,21 @@ var lastUrlUpdate;
 var two_seconds = 2000;
 // We could maybe rethink this to be a function that only updates
 // the searchapram for the changed option. Ok for now tho
-function updateSearchParamState() {
+//
+// If paged is set, the search is run so that the results after its
+// first page can be fetched a page at a time.
+function updateSearchParamState(paged) {
   var sp = new URLSearchParams(window.location.search);
   // we don't encode the query ourseleves, as that's already being performed by
   // something here, and it resulted in a double encoding.
   sp.set("q", searchOptions.q);
   sp.set("regex", searchOptions.regex);
   sp.set("fold_case", searchOptions.case);
+  if (paged) {
+    sp.set("cursor", "");
+  } else {
+    sp.delete("cursor");
+  }
 
   // IMPORTANT: If not running in the codesearch context, we don't track the
   // search state in the url. This is to avoid polluting the url with context
@@ -108,6 +116,48 @@ function doSearch(searchParams) {
     });
 }
 
+// Fetch the page of results after the one the button ends, and add
+// them to those already shown.
+function loadNextPage(btn) {
+  var sp = new URLSearchParams(window.location.search);
+  sp.set("cursor", btn.getAttribute("data-cursor"));
+  var urlToFetch = "/api/v2/getRenderedSearchResults/?" + sp.toString();
+  btn.disabled = true;
+  fetch(urlToFetch)
+    .then(function (r) {
+      if (!r.ok) {
+        return Promise.reject(r.text());
+      }
+      return r.text();
+    })
+    .then(function (text) {
+      var page = document.createElement("div");
+      page.innerHTML = text;
+      ["path-results", "tree-results", "code-results"].forEach(function (cls) {
+        var from = page.querySelector("." + cls);
+        var to = resultsContainer.querySelector("." + cls);
+        if (!from || !to) return;
+        while (from.firstChild) {
+          to.appendChild(from.firstChild);
+        }
+      });
+      var next = page.querySelector(".next-page-results");
+      var current = btn.closest(".next-page-results");
+      if (next) {
+        current.replaceWith(next);
+      } else {
+        current.remove();
+      }
+    })
+    .catch(function (err) {
+      btn.disabled = false;
+      err.then(function (errText) {
+        errorsBox.querySelector("#errortext").innerText = errText;
+        errorsBox.style.display = "initial";
+      });
+    });
+}
+
 function updateQuery(inputEvnt) {
   searchOptions.q = inputEvnt.target.value;
   updateSearchParamState();
@@ -292,6 +342,20 @@ function handleFileExtBtnClick(e) {
   searchBox.dispatchEvent(new Event("input"));
 }
 
+// Narrows the search to a facet by adding its filter to the query.
+function handleFacetBtnClick(btn) {
+  searchBox.value = btn.dataset.filter + " " + searchBox.value;
+  searchBox.dispatchEvent(new Event("input"));
+}
+
+// Sorts the search by the button's order, replacing any sort: already
+// in the query.
+function handleSortBtnClick(btn) {
+  var q = searchBox.value.replace(/(^|\s)sort:\S*/g, "").trim();
+  searchBox.value = "sort:" + btn.dataset.sort + " " + q;
+  searchBox.dispatchEvent(new Event("input"));
+}
+
 function init() {
   "use strict";
 
@@ -323,16 +387,18 @@ function init() {
     var btn = e.target.closest("button");
     if (btn && btn.id == "showMoreFilematchesBtn") {
       toggleMoreFileMatches(e);
+    } else if (btn && btn.id == "nextPageBtn") {
+      loadNextPage(btn);
     } else if (btn && btn.classList.contains("file-extension")) {
       handleFileExtBtnClick(e);
+    } else if (btn && btn.classList.contains("facet")) {
+      handleFacetBtnClick(btn);
+    } else if (btn && btn.classList.contains("sort-toggle")) {
+      handleSortBtnClick(btn);
     } else if (e.target.tagName == "A" && e.target.href != "" && e.target.id == "next-page") {
       e.preventDefault();
-      // just update the search input with the value of "q"
-      var sp = new URLSearchParams(e.target.href);
-      var newQ = sp.get("q");
-      searchOptions.q = newQ;
-      searchBox.value = newQ;
-      updateSearchParamState();
+      // run the same search again, paged
+      updateSearchParamState(true);
     }
   });
 
@@ -1160,6 +1160,7 @@ var verticalNavigationSplitter;
 var horizontalLowerPaneSplitter;
 var navigationPane;
 var openGitMetaTab;
+var referencesPanel;
 
 var searchOptions = {
   q: "",
@@ -1207,6 +1208,43 @@ function toggleFileLinksMenu() {
   }
 }
 
+// Shows where symbol is defined and used in the references panel beside
+// the file.
+async function showReferences(symbol) {
+  var content = referencesPanel.querySelector(".references-content");
+  referencesPanel.classList.remove("hidden");
+  referencesPanel.dataset.symbol = symbol;
+  content.innerText = `Searching for ${symbol}...`;
+
+  var sp = new URLSearchParams({ symbol: symbol, repo: window.scriptData.repo });
+  var r = await fetch(`/api/v2/getRenderedReferences/?${sp.toString()}`);
+  var text = await r.text();
+
+  // a later click has already replaced this search
+  if (referencesPanel.dataset.symbol !== symbol) {
+    return;
+  }
+  if (!r.ok) {
+    content.innerText = text;
+    return;
+  }
+  content.innerHTML = text;
+}
+
+function closeReferences() {
+  referencesPanel.classList.add("hidden");
+  delete referencesPanel.dataset.symbol;
+}
+
+// Looks up the symbol clicked on, unless the click was to select text.
+function handleSymbolClick(event) {
+  var symbolEl = event.target.closest(".symbol-ref");
+  if (!symbolEl || window.getSelection().toString() !== "") {
+    return;
+  }
+  showReferences(symbolEl.dataset.symbol);
+}
+
 // we do a simple search
 function searchRepos(inputEvnt) {
   var searchQuery = ""; // initialize to empty search so we can manually call
@@ -1703,6 +1741,20 @@ function initScriptData(initData) {
 
 
 
+// Narrows the search to a facet by adding its filter to the query.
+function handleFacetBtnClick(btn) {
+  searchBox.value = btn.dataset.filter + " " + searchBox.value;
+  searchBox.dispatchEvent(new Event("input"));
+}
+
+// Sorts the search by the button's order, replacing any sort: already
+// in the query.
+function handleSortBtnClick(btn) {
+  var q = searchBox.value.replace(/(^|\s)sort:\S*/g, "").trim();
+  searchBox.value = "sort:" + btn.dataset.sort + " " + q;
+  searchBox.dispatchEvent(new Event("input"));
+}
+
 // initData is passed to us via the go template setting script_data,
 // then entry.js calling `init(window.script_data);`
 function init(initData) {
@@ -1734,6 +1786,7 @@ function init(initData) {
   root = document.querySelector(".file-content"); // TODO: this is identical to lineNumberContainer
   sideNav = document.getElementById("side-nav");
   historyPanel = document.getElementsByClassName("lower-detail-wrapper")[0];
+  referencesPanel = document.getElementById("references-panel");
   gitHistoryTable = document.getElementById("git-history-table");
   // get the open git search tab
   openGitMetaTab = document.querySelector("#git-tabs > li[data-selected='true']");
@@ -1770,6 +1823,8 @@ function init(initData) {
   document.getElementById("toggle-blame").addEventListener("click", toggleBlame);
   document.getElementById("toggle-history").addEventListener("click", toggleHistoryPanel);
   document.getElementById("toggle-file-links").addEventListener("click", toggleFileLinksMenu);
+  document.getElementById("close-references").addEventListener("click", closeReferences);
+  root.addEventListener("click", handleSymbolClick);
   updateFileLinksButtons();
 
   document.addEventListener("click", function (e) {
@@ -1778,6 +1833,10 @@ function init(initData) {
       toggleMoreFileMatches(e);
     } else if (btn && btn.classList.contains("file-extension")) {
       handleFileExtBtnClick(e);
+    } else if (btn && btn.classList.contains("facet")) {
+      handleFacetBtnClick(btn);
+    } else if (btn && btn.classList.contains("sort-toggle")) {
+      handleSortBtnClick(btn);
     } else if (btn && btn.id == "repo-search-toggle") {
       toggleRepoSeachAutocompleteMenu();
     } else if (btn && btn.id == "git-search-toggle") {
@@ -1788,12 +1847,8 @@ function init(initData) {
       e.target.id == "next-page"
     ) {
       e.preventDefault();
-      // just update the search input with the value of "q"
-      var sp = new URLSearchParams(e.target.href);
-      var newQ = sp.get("q");
-      searchOptions.q = newQ;
-      searchBox.value = newQ;
-      updateSearchParamState();
+      // run the same search again, paged
+      updateSearchParamState(true);
     }
   });
 }